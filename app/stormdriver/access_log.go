@@ -0,0 +1,170 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The fields an access log line may include.
+const (
+	accessFieldMethod       = "method"
+	accessFieldPath         = "path"
+	accessFieldRoute        = "route"
+	accessFieldCaller       = "caller"
+	accessFieldRemoteAddr   = "remoteAddr"
+	accessFieldClouddrivers = "clouddrivers"
+	accessFieldStatus       = "status"
+	accessFieldBytes        = "bytes"
+	accessFieldLatency      = "latency"
+	accessFieldRequestID    = "requestID"
+)
+
+var allAccessFields = []string{
+	accessFieldMethod,
+	accessFieldPath,
+	accessFieldRoute,
+	accessFieldCaller,
+	accessFieldRemoteAddr,
+	accessFieldClouddrivers,
+	accessFieldStatus,
+	accessFieldBytes,
+	accessFieldLatency,
+	accessFieldRequestID,
+}
+
+// accessLogConfig chooses the fields of the access log line written for
+// each request.  If Fields is empty, all of them are logged.
+type accessLogConfig struct {
+	Fields []string `yaml:"fields,omitempty" json:"fields,omitempty"`
+}
+
+func (c accessLogConfig) validate() error {
+	known := map[string]bool{}
+	for _, f := range allAccessFields {
+		known[f] = true
+	}
+	for _, f := range c.Fields {
+		if !known[f] {
+			return fmt.Errorf("unknown field %q", f)
+		}
+	}
+	return nil
+}
+
+type accessLogger struct {
+	fields map[string]bool
+}
+
+func makeAccessLogger(c accessLogConfig) *accessLogger {
+	fields := c.Fields
+	if len(fields) == 0 {
+		fields = allAccessFields
+	}
+	ret := &accessLogger{fields: map[string]bool{}}
+	for _, f := range fields {
+		ret.fields[f] = true
+	}
+	return ret
+}
+
+// contactedClouddrivers collects the requests sent to clouddrivers
+// while handling one incoming request.
+type contactedClouddrivers struct {
+	sync.Mutex
+	targets []string
+}
+
+type contactedClouddriversKey struct{}
+
+// noteClouddriver records that a request is being sent to target while
+// handling the request ctx belongs to.  The target's scheme, host, path,
+// and query are kept, so clouddrivers sharing a host are told apart;
+// any user information is not.
+func noteClouddriver(ctx context.Context, target string) {
+	contacted, ok := ctx.Value(contactedClouddriversKey{}).(*contactedClouddrivers)
+	if !ok {
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return
+	}
+	u.User = nil
+	u.Fragment = ""
+	logged := u.String()
+	contacted.Lock()
+	defer contacted.Unlock()
+	for _, t := range contacted.targets {
+		if t == logged {
+			return
+		}
+	}
+	contacted.targets = append(contacted.targets, logged)
+}
+
+func (c *contactedClouddrivers) list() []string {
+	c.Lock()
+	defer c.Unlock()
+	ret := make([]string, len(c.targets))
+	copy(ret, c.targets)
+	return ret
+}
+
+// middleware writes one structured log line for each request once it
+// has been answered.
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		contacted := &contactedClouddrivers{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), contactedClouddriversKey{}, contacted)))
+		if rec.statusCode == 0 {
+			rec.statusCode = http.StatusOK
+		}
+		zap.S().Infow("access", l.keysAndValues(req, rec, contacted.list(), time.Since(start))...)
+	})
+}
+
+func (l *accessLogger) keysAndValues(req *http.Request, rec *statusRecorder, clouddrivers []string, latency time.Duration) []interface{} {
+	values := map[string]interface{}{
+		accessFieldMethod:       req.Method,
+		accessFieldPath:         req.URL.Path,
+		accessFieldRoute:        routeTemplate(req),
+		accessFieldCaller:       req.Header.Get("x-spinnaker-user"),
+		accessFieldRemoteAddr:   req.RemoteAddr,
+		accessFieldClouddrivers: clouddrivers,
+		accessFieldStatus:       rec.statusCode,
+		accessFieldBytes:        rec.bytes,
+		accessFieldLatency:      latency,
+		accessFieldRequestID:    req.Header.Get(requestIDHeader),
+	}
+	ret := []interface{}{}
+	for _, f := range allAccessFields {
+		if l.fields[f] {
+			ret = append(ret, f, values[f])
+		}
+	}
+	return ret
+}
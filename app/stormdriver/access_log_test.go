@@ -0,0 +1,105 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_accessLogConfig_validate(t *testing.T) {
+	assert.NoError(t, accessLogConfig{}.validate())
+	assert.NoError(t, accessLogConfig{Fields: []string{"method", "status"}}.validate())
+	assert.Error(t, accessLogConfig{Fields: []string{"method", "referer"}}.validate())
+}
+
+func Test_accessLogger_middleware(t *testing.T) {
+	backend := hedgeTestServer(t, 0, http.StatusOK, `[{"name":"app"}]`)
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{"prod": {URL: backend.URL}},
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	tests := []struct {
+		name     string
+		fields   []string
+		wantKeys []string
+	}{
+		{"all fields by default", nil, allAccessFields},
+		{"chosen fields", []string{"status", "method"}, []string{"method", "status"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = logs.TakeAll()
+			s := &srv{}
+			r := mux.NewRouter()
+			r.HandleFunc("/applications", s.fetchList(""))
+			r.Use(makeAccessLogger(accessLogConfig{Fields: tt.fields}).middleware)
+
+			req := httptest.NewRequest(http.MethodGet, "/applications", nil)
+			req.Header.Set("x-spinnaker-user", "alice")
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			entries := logs.FilterMessage("access").All()
+			require.Len(t, entries, 1)
+			fields := entries[0].ContextMap()
+			keys := []string{}
+			for _, f := range allAccessFields {
+				if _, found := fields[f]; found {
+					keys = append(keys, f)
+				}
+			}
+			assert.Equal(t, tt.wantKeys, keys)
+			assert.Equal(t, int64(http.StatusOK), fields["status"])
+			assert.Equal(t, http.MethodGet, fields["method"])
+			if tt.fields == nil {
+				assert.Equal(t, "alice", fields["caller"])
+				assert.Equal(t, "/applications", fields["route"])
+				assert.Equal(t, []interface{}{backend.URL + "/applications"}, fields["clouddrivers"])
+				assert.Equal(t, int64(len(`[{"name":"app"}]`)), fields["bytes"])
+			}
+		})
+	}
+}
+
+func Test_noteClouddriver(t *testing.T) {
+	contacted := &contactedClouddrivers{}
+	ctx := context.WithValue(context.Background(), contactedClouddriversKey{}, contacted)
+	noteClouddriver(ctx, "https://user:pass@cd:7002/applications?expand=true")
+	noteClouddriver(ctx, "https://cd:7002/applications?expand=true")
+	noteClouddriver(ctx, "https://cd:7002/east/credentials")
+	noteClouddriver(ctx, "https://cd:7002/west/credentials")
+	assert.Equal(t, []string{
+		"https://cd:7002/applications?expand=true",
+		"https://cd:7002/east/credentials",
+		"https://cd:7002/west/credentials",
+	}, contacted.list())
+
+	noteClouddriver(context.Background(), "https://cd:7002/ignored")
+}
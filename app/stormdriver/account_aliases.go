@@ -0,0 +1,308 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// aliasedQueryParameters are the query parameters which hold account names.
+var aliasedQueryParameters = []string{"account", "credentials"}
+
+// aliasedBodyFields are the request body fields which hold account names.
+var aliasedBodyFields = []string{"account", "credentials", "artifactAccount"}
+
+// accountAliases maps the account names clients use to the names the
+// clouddrivers use, so accounts can be renamed without changing every
+// clouddriver.  Routing and permissions use the clouddrivers' names.
+type accountAliases struct {
+	toReal  map[string]string
+	toAlias map[string]string
+}
+
+// aliases is nil unless accountAliases are configured.
+var aliases *accountAliases
+
+// validateAccountAliases checks that each alias maps to one account, no
+// account has two aliases, and an alias is not itself aliased.
+func validateAccountAliases(m map[string]string) error {
+	seen := map[string]string{}
+	for alias, real := range m {
+		if alias == "" || real == "" {
+			return fmt.Errorf("alias and account names cannot be empty")
+		}
+		if other, found := seen[real]; found {
+			return fmt.Errorf("%s has two aliases, %s and %s", real, other, alias)
+		}
+		seen[real] = alias
+		if _, found := m[real]; found {
+			return fmt.Errorf("%s is both an alias and an aliased account", real)
+		}
+	}
+	return nil
+}
+
+func makeAccountAliases(m map[string]string) *accountAliases {
+	if len(m) == 0 {
+		return nil
+	}
+	a := &accountAliases{toReal: map[string]string{}, toAlias: map[string]string{}}
+	for alias, real := range m {
+		a.toReal[alias] = real
+		a.toAlias[real] = alias
+	}
+	return a
+}
+
+// resolve returns the clouddriver's name for an account.
+func (a *accountAliases) resolve(name string) string {
+	if a == nil {
+		return name
+	}
+	if real, found := a.toReal[name]; found {
+		return real
+	}
+	return name
+}
+
+// alias returns the name clients use for an account.
+func (a *accountAliases) alias(name string) string {
+	if a == nil {
+		return name
+	}
+	if alias, found := a.toAlias[name]; found {
+		return alias
+	}
+	return name
+}
+
+// middleware rewrites an aliased account in the {account} path variable
+// or the account query parameters, so handlers see and forward the
+// clouddriver's name.
+func (a *accountAliases) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		path := req.URL.EscapedPath()
+		changed := false
+
+		vars := mux.Vars(req)
+		if account, found := vars["account"]; found {
+			if real := a.resolve(account); real != account {
+				if rewritten, ok := replacePathVariable(req, path, "{account}", url.PathEscape(real)); ok {
+					path = rewritten
+					vars["account"] = real
+					req = mux.SetURLVars(req, vars)
+					changed = true
+				}
+			}
+		}
+
+		query := req.URL.Query()
+		for _, key := range aliasedQueryParameters {
+			values := query[key]
+			for idx, v := range values {
+				if real := a.resolve(v); real != v {
+					values[idx] = real
+					changed = true
+				}
+			}
+		}
+
+		if changed {
+			u := *req.URL
+			if unescaped, err := url.PathUnescape(path); err == nil {
+				u.Path = unescaped
+				u.RawPath = path
+			}
+			if req.URL.RawQuery != "" {
+				u.RawQuery = query.Encode()
+			}
+			req.URL = &u
+			req.RequestURI = u.RequestURI()
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// replacePathVariable replaces the path segment matching variable in the
+// route's template with value.
+func replacePathVariable(req *http.Request, path string, variable string, value string) (string, bool) {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return "", false
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "", false
+	}
+	segments := strings.Split(path, "/")
+	for idx, t := range strings.Split(template, "/") {
+		if t == variable && idx < len(segments) {
+			segments[idx] = value
+			return strings.Join(segments, "/"), true
+		}
+	}
+	return "", false
+}
+
+// resolveOperations rewrites aliased account and credentials fields in
+// a list of operations.  The body is returned unchanged if nothing is
+// aliased or it cannot be parsed.
+func (a *accountAliases) resolveOperations(data []byte) []byte {
+	if a == nil {
+		return data
+	}
+	var list []map[string]map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&list); err != nil {
+		return data
+	}
+	changed := false
+	for _, item := range list {
+		for _, op := range item {
+			for _, key := range aliasedQueryParameters {
+				if v, ok := op[key].(string); ok {
+					if real := a.resolve(v); real != v {
+						op[key] = real
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	if !changed {
+		return data
+	}
+	ret, err := json.Marshal(list)
+	if err != nil {
+		return data
+	}
+	return ret
+}
+
+// resolveBody rewrites aliased account names in the given fields of a
+// JSON request body, in objects nested up to depth deep, so requests
+// routed by their body are routed, checked, and forwarded with the
+// clouddriver's names.  The body is returned unchanged if nothing is
+// aliased or it cannot be parsed.
+func (a *accountAliases) resolveBody(data []byte, fields []string, depth int) []byte {
+	if a == nil {
+		return data
+	}
+	var body interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return data
+	}
+	if !a.resolveFields(body, fields, depth) {
+		return data
+	}
+	ret, err := json.Marshal(body)
+	if err != nil {
+		return data
+	}
+	return ret
+}
+
+func (a *accountAliases) resolveFields(v interface{}, fields []string, depth int) bool {
+	if depth == 0 {
+		return false
+	}
+	changed := false
+	switch item := v.(type) {
+	case []interface{}:
+		for _, element := range item {
+			changed = a.resolveFields(element, fields, depth-1) || changed
+		}
+	case map[string]interface{}:
+		for _, key := range fields {
+			if name, ok := item[key].(string); ok {
+				if real := a.resolve(name); real != name {
+					item[key] = real
+					changed = true
+				}
+			}
+		}
+		for _, element := range item {
+			changed = a.resolveFields(element, fields, depth-1) || changed
+		}
+	}
+	return changed
+}
+
+// renameAccounts replaces the name of each account document with its
+// alias.
+func (a *accountAliases) renameAccounts(items []interface{}) []interface{} {
+	if a == nil {
+		return items
+	}
+	for _, item := range items {
+		if doc, ok := item.(map[string]interface{}); ok {
+			if name, ok := doc["name"].(string); ok {
+				doc["name"] = a.alias(name)
+			}
+		}
+	}
+	return items
+}
+
+// renameAccountDocument is renameAccounts for a single JSON document.
+func (a *accountAliases) renameAccountDocument(data []byte) []byte {
+	if a == nil {
+		return data
+	}
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return data
+	}
+	name, ok := doc["name"].(string)
+	if !ok || a.alias(name) == name {
+		return data
+	}
+	doc["name"] = a.alias(name)
+	ret, err := json.Marshal(doc)
+	if err != nil {
+		return data
+	}
+	return ret
+}
+
+// filterCredentials applies permissions, then aliases, to the merged
+// /credentials list.
+func (s *srv) filterCredentials(req *http.Request, items []interface{}) []interface{} {
+	return aliases.renameAccounts(s.permissions.filterAccounts(req, items))
+}
+
+// filterArtifactCredentials applies aliases to the merged
+// /artifacts/credentials list.
+func (*srv) filterArtifactCredentials(req *http.Request, items []interface{}) []interface{} {
+	return aliases.renameAccounts(items)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateAccountAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases map[string]string
+		wantErr bool
+	}{
+		{"empty", nil, false},
+		{"simple", map[string]string{"prod": "prod-k8s", "dev": "dev-k8s"}, false},
+		{"empty alias", map[string]string{"": "prod-k8s"}, true},
+		{"empty account", map[string]string{"prod": ""}, true},
+		{"two aliases", map[string]string{"prod": "prod-k8s", "production": "prod-k8s"}, true},
+		{"chain", map[string]string{"prod": "production", "production": "prod-k8s"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAccountAliases(tt.aliases)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_accountAliases_nil(t *testing.T) {
+	var a *accountAliases
+	assert.Nil(t, makeAccountAliases(nil))
+	assert.Equal(t, "prod", a.resolve("prod"))
+	assert.Equal(t, "prod", a.alias("prod"))
+	assert.Equal(t, []byte(`[{"x":{"account":"prod"}}]`), a.resolveOperations([]byte(`[{"x":{"account":"prod"}}]`)))
+}
+
+func Test_accountAliases_middleware(t *testing.T) {
+	a := makeAccountAliases(map[string]string{"prod": "prod k8s"})
+	tests := []struct {
+		name        string
+		path        string
+		wantAccount string
+		wantURI     string
+	}{
+		{"path variable", "/instances/prod/i-1", "prod k8s", "/instances/prod%20k8s/i-1"},
+		{"unaliased path variable", "/instances/dev/i-1", "dev", "/instances/dev/i-1"},
+		{"query parameter", "/search?account=prod&q=x", "", "/search?account=prod+k8s&q=x"},
+		{"unaliased query parameter", "/search?credentials=dev", "", "/search?credentials=dev"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAccount, gotURI string
+			handler := func(w http.ResponseWriter, req *http.Request) {
+				gotAccount = mux.Vars(req)["account"]
+				gotURI = req.URL.RequestURI()
+			}
+			r := mux.NewRouter()
+			r.HandleFunc("/instances/{account}/{id}", handler)
+			r.HandleFunc("/search", handler)
+			r.Use(a.middleware)
+
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.wantAccount, gotAccount)
+			assert.Equal(t, tt.wantURI, gotURI)
+		})
+	}
+}
+
+func Test_accountAliases_resolveOperations(t *testing.T) {
+	a := makeAccountAliases(map[string]string{"prod": "prod-k8s"})
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			"aliased",
+			`[{"deployManifest":{"account":"prod","credentials":"prod","replicas":12345678901234567}}]`,
+			`[{"deployManifest":{"account":"prod-k8s","credentials":"prod-k8s","replicas":12345678901234567}}]`,
+		},
+		{
+			"not aliased",
+			`[{"deployManifest":{"account":"dev"}}]`,
+			`[{"deployManifest":{"account":"dev"}}]`,
+		},
+		{
+			"not a list of operations",
+			`{"account":"prod"}`,
+			`{"account":"prod"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.JSONEq(t, tt.want, string(a.resolveOperations([]byte(tt.body))))
+		})
+	}
+}
+
+func Test_accountAliases_resolveBody(t *testing.T) {
+	a := makeAccountAliases(map[string]string{"prod": "prod-k8s"})
+	tests := []struct {
+		name   string
+		body   string
+		fields []string
+		depth  int
+		want   string
+	}{
+		{
+			"artifact account",
+			`{"artifactAccount":"prod","reference":"r","size":12345678901234567}`,
+			aliasedBodyFields, 1,
+			`{"artifactAccount":"prod-k8s","reference":"r","size":12345678901234567}`,
+		},
+		{
+			"nested",
+			`{"job":[{"account":"prod"},{"credentials":"dev"}]}`,
+			aliasedBodyFields, maxAccountSearchDepth,
+			`{"job":[{"account":"prod-k8s"},{"credentials":"dev"}]}`,
+		},
+		{
+			"too deep",
+			`{"job":[{"account":"prod"}]}`,
+			aliasedBodyFields, 1,
+			`{"job":[{"account":"prod"}]}`,
+		},
+		{
+			"account definition",
+			`{"name":"prod","spec":{"name":"prod"}}`,
+			[]string{"name"}, 1,
+			`{"name":"prod-k8s","spec":{"name":"prod"}}`,
+		},
+		{
+			"not json",
+			`account=prod`,
+			aliasedBodyFields, 1,
+			`account=prod`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(a.resolveBody([]byte(tt.body), tt.fields, tt.depth))
+			if tt.name == "not json" {
+				assert.Equal(t, tt.want, got)
+				return
+			}
+			assert.JSONEq(t, tt.want, got)
+		})
+	}
+}
+
+func Test_accountAliases_renameAccounts(t *testing.T) {
+	a := makeAccountAliases(map[string]string{"prod": "prod-k8s"})
+	items := []interface{}{
+		map[string]interface{}{"name": "prod-k8s", "type": "kubernetes"},
+		map[string]interface{}{"name": "dev-k8s", "type": "kubernetes"},
+	}
+	want := []interface{}{
+		map[string]interface{}{"name": "prod", "type": "kubernetes"},
+		map[string]interface{}{"name": "dev-k8s", "type": "kubernetes"},
+	}
+	assert.Equal(t, want, a.renameAccounts(items))
+
+	assert.JSONEq(t, `{"name":"prod","type":"kubernetes"}`,
+		string(a.renameAccountDocument([]byte(`{"name":"prod-k8s","type":"kubernetes"}`))))
+	assert.Equal(t, `{"name":"dev-k8s"}`, string(a.renameAccountDocument([]byte(`{"name":"dev-k8s"}`))))
+}
+
+func Test_accountAliases_forwarded(t *testing.T) {
+	var gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotPath = req.URL.EscapedPath()
+		_, _ = io.WriteString(w, `{}`)
+	}))
+	defer backend.Close()
+
+	a := makeAccountAliases(map[string]string{"prod": "prod-k8s"})
+	r := mux.NewRouter()
+	r.HandleFunc("/manifests/{account}/{location}/{name}", func(w http.ResponseWriter, req *http.Request) {
+		resp, err := http.Get(backend.URL + req.URL.EscapedPath())
+		require.NoError(t, err)
+		resp.Body.Close()
+	})
+	r.Use(a.middleware)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/manifests/prod/default/pod%20x", nil))
+	assert.Equal(t, "/manifests/prod-k8s/default/pod%20x", gotPath)
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var accountConflicts = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "stormdriver",
+	Name:      "account_conflicts",
+	Help:      "Account names returned by more than one clouddriver on the last credential sync, by kind.",
+}, []string{"kind"})
+
+// accountConflict is an account name returned by more than one
+// clouddriver.  DifferingFields lists the top-level fields of the
+// account documents which are not the same on all of them; if it is
+// empty, the clouddrivers are serving the same account.
+type accountConflict struct {
+	Kind            string   `json:"kind" yaml:"kind"`
+	Account         string   `json:"account" yaml:"account"`
+	Clouddrivers    []string `json:"clouddrivers" yaml:"clouddrivers"`
+	RoutedTo        string   `json:"routedTo,omitempty" yaml:"routedTo,omitempty"`
+	DifferingFields []string `json:"differingFields,omitempty" yaml:"differingFields,omitempty"`
+}
+
+// same returns true if the conflict involves the same clouddrivers and
+// differences as other, so it need not be logged again.
+func (c accountConflict) same(other accountConflict) bool {
+	return reflect.DeepEqual(c.Clouddrivers, other.Clouddrivers) &&
+		reflect.DeepEqual(c.DifferingFields, other.DifferingFields)
+}
+
+// findConflicts returns the accounts which more than one clouddriver
+// returned, sorted by name.  Must be called with the lock held.
+func (m *ClouddriverManager) findConflicts(kind string, synced map[string][]trackedSpinnakerAccount, routes map[string]URLAndPriority) []accountConflict {
+	byName := map[string][]trackedSpinnakerAccount{}
+	owners := map[string][]string{}
+	for key, accounts := range synced {
+		name := m.nameForRouteKey(key)
+		if name == "" {
+			continue
+		}
+		for _, account := range accounts {
+			byName[account.Name] = append(byName[account.Name], account)
+			owners[account.Name] = append(owners[account.Name], name)
+		}
+	}
+
+	ret := []accountConflict{}
+	for account, clouddrivers := range owners {
+		if len(clouddrivers) < 2 {
+			continue
+		}
+		sort.Strings(clouddrivers)
+		conflict := accountConflict{
+			Kind:            kind,
+			Account:         account,
+			Clouddrivers:    clouddrivers,
+			DifferingFields: differingFields(byName[account]),
+		}
+		if route, found := routes[account]; found {
+			conflict.RoutedTo = m.routeTarget(route)
+		}
+		ret = append(ret, conflict)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Account < ret[j].Account })
+	return ret
+}
+
+// differingFields returns the sorted top-level fields which are not the
+// same in every account document.
+func differingFields(accounts []trackedSpinnakerAccount) []string {
+	docs := []map[string]interface{}{}
+	for _, account := range accounts {
+		doc := map[string]interface{}{}
+		data, err := json.Marshal(account)
+		if err == nil {
+			_ = json.Unmarshal(data, &doc)
+		}
+		docs = append(docs, doc)
+	}
+	fields := map[string]bool{}
+	for _, doc := range docs {
+		for field := range doc {
+			fields[field] = true
+		}
+	}
+	ret := []string{}
+	for field := range fields {
+		for _, doc := range docs[1:] {
+			if !reflect.DeepEqual(docs[0][field], doc[field]) {
+				ret = append(ret, field)
+				break
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// noteConflicts records the conflicts found by a sync, logging those
+// which are new or changed, and those resolved.  Must be called with
+// the lock held.
+func (m *ClouddriverManager) noteConflicts(kind string, synced map[string][]trackedSpinnakerAccount, routes map[string]URLAndPriority) {
+	if m.conflicts == nil {
+		m.conflicts = map[string][]accountConflict{}
+	}
+	previous := map[string]accountConflict{}
+	for _, c := range m.conflicts[kind] {
+		previous[c.Account] = c
+	}
+	current := m.findConflicts(kind, synced, routes)
+	for _, c := range current {
+		if old, found := previous[c.Account]; found && old.same(c) {
+			delete(previous, c.Account)
+			continue
+		}
+		delete(previous, c.Account)
+		zap.S().Warnw("account returned by more than one clouddriver",
+			"kind", kind,
+			"account", c.Account,
+			"clouddrivers", strings.Join(c.Clouddrivers, ","),
+			"routedTo", c.RoutedTo,
+			"differingFields", c.DifferingFields)
+	}
+	for account := range previous {
+		zap.S().Infow("account conflict resolved", "kind", kind, "account", account)
+	}
+	m.conflicts[kind] = current
+	accountConflicts.WithLabelValues(kind).Set(float64(len(current)))
+}
+
+// getConflicts returns the conflicts found by the last syncs.
+func (m *ClouddriverManager) getConflicts() []accountConflict {
+	m.Lock()
+	defer m.Unlock()
+	ret := []accountConflict{}
+	for _, kind := range []string{routeKindAccount, routeKindArtifactAccount} {
+		ret = append(ret, m.conflicts[kind]...)
+	}
+	return ret
+}
+
+func conflictRows(conflicts []accountConflict) [][]string {
+	ret := [][]string{{"kind", "account", "clouddrivers", "routedTo", "differingFields"}}
+	for _, c := range conflicts {
+		ret = append(ret, []string{c.Kind, c.Account, strings.Join(c.Clouddrivers, " "), c.RoutedTo, strings.Join(c.DifferingFields, " ")})
+	}
+	return ret
+}
+
+func (*srv) conflictsRequest(w http.ResponseWriter, req *http.Request) {
+	conflicts := clouddriverManager.getConflicts()
+	writeFormatted(w, req, conflicts, func() [][]string { return conflictRows(conflicts) })
+}
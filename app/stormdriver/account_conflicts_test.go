@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func conflictTestAccount(t *testing.T, doc string) trackedSpinnakerAccount {
+	var a trackedSpinnakerAccount
+	require.NoError(t, json.Unmarshal([]byte(doc), &a))
+	return a
+}
+
+func Test_ClouddriverManager_noteConflicts(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:a": {Name: "a", URL: "http://a"},
+			"config:b": {Name: "b", URL: "http://b"},
+		},
+	}
+	a := m.state["config:a"].routeKey()
+	b := m.state["config:b"].routeKey()
+	synced := map[string][]trackedSpinnakerAccount{
+		a: {
+			conflictTestAccount(t, `{"name":"shared","type":"kubernetes","namespaces":["x"]}`),
+			conflictTestAccount(t, `{"name":"same","type":"aws"}`),
+			conflictTestAccount(t, `{"name":"only-a","type":"aws"}`),
+		},
+		b: {
+			conflictTestAccount(t, `{"name":"shared","type":"kubernetes","namespaces":["y"]}`),
+			conflictTestAccount(t, `{"name":"same","type":"aws"}`),
+		},
+	}
+	routes := map[string]URLAndPriority{
+		"shared": {URL: "http://b"},
+		"same":   {URL: "http://a"},
+		"only-a": {URL: "http://a"},
+	}
+
+	m.noteConflicts(routeKindAccount, synced, routes)
+	assert.Equal(t, []accountConflict{
+		{Kind: routeKindAccount, Account: "same", Clouddrivers: []string{"a", "b"}, RoutedTo: "a", DifferingFields: []string{}},
+		{Kind: routeKindAccount, Account: "shared", Clouddrivers: []string{"a", "b"}, RoutedTo: "b", DifferingFields: []string{"namespaces"}},
+	}, m.getConflicts())
+
+	delete(synced, b)
+	m.noteConflicts(routeKindAccount, synced, routes)
+	assert.Empty(t, m.getConflicts(), "conflicts are resolved when only one clouddriver has the account")
+}
+
+func Test_srv_conflictsRequest(t *testing.T) {
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		conflicts: map[string][]accountConflict{
+			routeKindArtifactAccount: {{Kind: routeKindArtifactAccount, Account: "github", Clouddrivers: []string{"a", "b"}, RoutedTo: "a"}},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	(&srv{}).conflictsRequest(w, httptest.NewRequest(http.MethodGet, "/_internal/conflicts?format=csv", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "kind,account,clouddrivers,routedTo,differingFields\nartifactAccount,github,a b,a,\n", w.Body.String())
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"go.uber.org/zap"
+)
+
+// accountFilter limits the accounts a clouddriver may own to those
+// matching one of includes, if any are set, and none of excludes.
+// The patterns are shell globs.
+type accountFilter struct {
+	includes []string
+	excludes []string
+}
+
+func validateAccountPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return fmt.Errorf("patterns cannot be empty")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// makeAccountFilter returns nil if there are no patterns.
+func makeAccountFilter(includes []string, excludes []string) *accountFilter {
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil
+	}
+	return &accountFilter{includes: includes, excludes: excludes}
+}
+
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *accountFilter) allows(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.includes) > 0 && !matchesAnyPattern(f.includes, name) {
+		return false
+	}
+	return !matchesAnyPattern(f.excludes, name)
+}
+
+// filter returns the accounts the clouddriver at url may own.  A nil
+// list, from a failed fetch, stays nil.
+func (f *accountFilter) filter(url string, accounts []trackedSpinnakerAccount) []trackedSpinnakerAccount {
+	if f == nil || accounts == nil {
+		return accounts
+	}
+	ret := []trackedSpinnakerAccount{}
+	for _, account := range accounts {
+		if f.allows(account.Name) {
+			ret = append(ret, account)
+		} else {
+			zap.S().Debugw("ignoring account outside the clouddriver's account filter", "url", url, "account", account.Name)
+		}
+	}
+	return ret
+}
+
+// getAccountFilters returns the account filters of the clouddrivers
+// which have one, keyed by URLAndPriority.key().
+// Must be called with the lock held.
+func (m *ClouddriverManager) getAccountFilters() map[string]*accountFilter {
+	ret := map[string]*accountFilter{}
+	for _, cd := range m.state {
+		if cd.accountFilter != nil {
+			ret[cd.URL+":"+cd.token] = cd.accountFilter
+		}
+	}
+	return ret
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_accountFilter_allows(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		account  string
+		want     bool
+	}{
+		{"no filter", nil, nil, "anything", true},
+		{"included", []string{"aws-*"}, nil, "aws-prod", true},
+		{"not included", []string{"aws-*"}, nil, "gcp-prod", false},
+		{"one of several includes", []string{"aws-*", "gcp-*"}, nil, "gcp-prod", true},
+		{"excluded", nil, []string{"*-prod"}, "aws-prod", false},
+		{"not excluded", nil, []string{"*-prod"}, "aws-dev", true},
+		{"exclude wins over include", []string{"aws-*"}, []string{"aws-prod"}, "aws-prod", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := makeAccountFilter(tt.includes, tt.excludes)
+			assert.Equal(t, tt.want, f.allows(tt.account))
+		})
+	}
+}
+
+func Test_validateAccountPatterns(t *testing.T) {
+	assert.NoError(t, validateAccountPatterns(nil))
+	assert.NoError(t, validateAccountPatterns([]string{"aws-*", "gcp-?-prod"}))
+	assert.Error(t, validateAccountPatterns([]string{""}))
+	assert.Error(t, validateAccountPatterns([]string{"aws-[prod"}))
+}
+
+func Test_fetchCreds_accountFilter(t *testing.T) {
+	owner := hedgeTestServer(t, 0, 200, `[{"name":"aws-prod"},{"name":"aws-dev"}]`)
+	hijacker := hedgeTestServer(t, 0, 200, `[{"name":"aws-prod"},{"name":"gcp-prod"}]`)
+	cds := []URLAndPriority{{URL: owner.URL}, {URL: hijacker.URL, Priority: 100}}
+	filters := map[string]*accountFilter{
+		cds[1].key(): makeAccountFilter([]string{"gcp-*"}, nil),
+	}
+
+	routes, accounts, synced := fetchCreds(context.Background(), cds, "/credentials", "user", filters)
+	assert.Equal(t, map[string]URLAndPriority{
+		"aws-prod": cds[0],
+		"aws-dev":  cds[0],
+		"gcp-prod": cds[1],
+	}, routes)
+	assert.Len(t, accounts, 3)
+	if assert.Len(t, synced[cds[1].key()], 1) {
+		assert.Equal(t, "gcp-prod", synced[cds[1].key()][0].Name)
+	}
+}
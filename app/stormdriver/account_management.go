@@ -0,0 +1,195 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// accountManagementConfig configures the passthrough of Clouddriver's
+// account management API, where accounts are created with a POST and
+// updated with a PUT to /credentials, and deleted with a DELETE to
+// /credentials/{account}.  A new account is created on the clouddriver
+// its routing rule names, or else on DefaultClouddriver.
+type accountManagementConfig struct {
+	DefaultClouddriver string `yaml:"defaultClouddriver,omitempty" json:"defaultClouddriver,omitempty"`
+}
+
+// validate checks that DefaultClouddriver names a configured
+// clouddriver.  When clouddrivers can also come from the controller,
+// discovery, or the admin API, which names exist is only known later.
+func (c accountManagementConfig) validate(clouddrivers []clouddriverConfig, dynamic bool) error {
+	if c.DefaultClouddriver == "" || dynamic {
+		return nil
+	}
+	for _, cd := range clouddrivers {
+		if cd.Name == c.DefaultClouddriver {
+			return nil
+		}
+	}
+	return fmt.Errorf("defaultClouddriver %q is not a configured clouddriver", c.DefaultClouddriver)
+}
+
+var accountManagement accountManagementConfig
+
+// accountDefinitionName returns the name of the account an account
+// management request defines, or "" if it names none.
+func accountDefinitionName(data []byte) string {
+	var definition struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &definition); err != nil {
+		return ""
+	}
+	return definition.Name
+}
+
+// routeForClouddriverName returns the route to the clouddriver named name.
+func (m *ClouddriverManager) routeForClouddriverName(name string) (URLAndPriority, error) {
+	m.Lock()
+	defer m.Unlock()
+	cd, err := m.findClouddriverByName(name)
+	if err != nil {
+		return URLAndPriority{}, err
+	}
+	return URLAndPriority{URL: cd.URL, Priority: cd.Priority, token: cd.token}, nil
+}
+
+// newAccountRoute returns where to create an account no clouddriver has
+// yet: the route for the name if a routing rule matches it, else the
+// default clouddriver, else the only healthy clouddriver if there is
+// just one.
+func newAccountRoute(name string) (URLAndPriority, bool) {
+	if route, found := clouddriverManager.findCloudRoute(name); found {
+		return route, true
+	}
+	if accountManagement.DefaultClouddriver != "" {
+		route, err := clouddriverManager.routeForClouddriverName(accountManagement.DefaultClouddriver)
+		if err == nil {
+			return route, true
+		}
+	}
+	if healthy := clouddriverManager.getHealthyClouddriverURLs(); len(healthy) == 1 {
+		return healthy[0], true
+	}
+	return URLAndPriority{}, false
+}
+
+// accountDefinitionWrite sends an account management request, which
+// names the account in its body, to the clouddriver owning the account.
+// When create is true, the account may not exist yet, and is sent to
+// newAccountRoute.  While enforcing permissions, only admins may create
+// accounts.
+func (s *srv) accountDefinitionWrite(create bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			requestLogger(req.Context()).Errorw("io.ReadAll", "error", err)
+			return
+		}
+		req.Body.Close()
+
+		data = aliases.resolveBody(data, []string{"name"}, 1)
+		accountName := accountDefinitionName(data)
+		if accountName == "" {
+			httputil.SetError(w, http.StatusBadRequest, "account name is required")
+			return
+		}
+		auditRecordFrom(req.Context()).setAccounts([]string{accountName})
+		// a new account has no permissions yet, so only admins may
+		// create one.
+		if denied := s.permissions.checkWrite(req, []string{accountName}); denied != "" {
+			httputil.SetError(w, http.StatusForbidden, "access denied to account "+denied)
+			return
+		}
+		findRoute := clouddriverManager.findCloudRoute
+		if create {
+			findRoute = newAccountRoute
+		}
+		url, found := findRoute(accountName)
+		if !found {
+			requestLogger(req.Context()).Warnw("no route", "accountName", accountName)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		auditRecordFrom(req.Context()).setClouddriver(url)
+		forwardWithBody(w, req, url, data)
+	}
+}
+
+// pendingSync runs sync in the background when asked to, coalescing
+// requests: while a sync runs, any number of further requests cause
+// one more sync once it finishes, rather than one each.
+type pendingSync struct {
+	sync.Mutex
+	running bool
+	pending context.Context // the latest request made while running
+	sync    func(context.Context)
+}
+
+func (p *pendingSync) request(ctx context.Context) {
+	p.Lock()
+	defer p.Unlock()
+	if p.running {
+		p.pending = ctx
+		return
+	}
+	p.running = true
+	go p.run(ctx)
+}
+
+func (p *pendingSync) run(ctx context.Context) {
+	for {
+		p.sync(ctx)
+		p.Lock()
+		ctx = p.pending
+		p.pending = nil
+		if ctx == nil {
+			p.running = false
+			p.Unlock()
+			return
+		}
+		p.Unlock()
+	}
+}
+
+var accountChangeSyncs = &pendingSync{sync: func(ctx context.Context) {
+	clouddriverManager.syncAccounts(ctx)
+}}
+
+// syncAccountsAfter syncs the credentials from every clouddriver once
+// next succeeds, so a changed account is routed without waiting for the
+// next scheduled sync.
+func syncAccountsAfter(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, req)
+		if !httputil.StatusCodeOK(rec.statusCode) {
+			return
+		}
+		accountChangeSyncs.request(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(req.Context())))
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_accountDefinitionName(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"named", `{"name":"prod","type":"kubernetes"}`, "prod"},
+		{"unnamed", `{"type":"kubernetes"}`, ""},
+		{"not an object", `["prod"]`, ""},
+		{"junk", `{`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, accountDefinitionName([]byte(tt.body)))
+		})
+	}
+}
+
+func Test_accountDefinitionWrite(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write([]byte(name + " " + r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a := backend("a")
+	b := backend("b")
+
+	oldManager := clouddriverManager
+	oldManagement := accountManagement
+	defer func() {
+		clouddriverManager = oldManager
+		accountManagement = oldManagement
+	}()
+
+	tests := []struct {
+		name     string
+		config   accountManagementConfig
+		method   string
+		body     string
+		wantCode int
+		want     string
+	}{
+		{
+			"update goes to the owner",
+			accountManagementConfig{},
+			http.MethodPut, `{"name":"b1","type":"kubernetes"}`,
+			http.StatusOK, `b PUT /credentials {"name":"b1","type":"kubernetes"}`,
+		},
+		{
+			"update of an unknown account",
+			accountManagementConfig{},
+			http.MethodPut, `{"name":"c1"}`,
+			http.StatusServiceUnavailable, ``,
+		},
+		{
+			"create goes to the default clouddriver",
+			accountManagementConfig{DefaultClouddriver: "b"},
+			http.MethodPost, `{"name":"c1"}`,
+			http.StatusOK, `b POST /credentials {"name":"c1"}`,
+		},
+		{
+			"create of an existing account goes to its owner",
+			accountManagementConfig{DefaultClouddriver: "b"},
+			http.MethodPost, `{"name":"a1"}`,
+			http.StatusOK, `a POST /credentials {"name":"a1"}`,
+		},
+		{
+			"create with nowhere to go",
+			accountManagementConfig{},
+			http.MethodPost, `{"name":"c1"}`,
+			http.StatusServiceUnavailable, ``,
+		},
+		{
+			"create with an unknown default clouddriver",
+			accountManagementConfig{DefaultClouddriver: "z"},
+			http.MethodPost, `{"name":"c1"}`,
+			http.StatusServiceUnavailable, ``,
+		},
+		{
+			"no account name",
+			accountManagementConfig{DefaultClouddriver: "b"},
+			http.MethodPost, `{"type":"kubernetes"}`,
+			http.StatusBadRequest, `{"status":"error","code":400,"error":"account name is required"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clouddriverManager = &ClouddriverManager{
+				state: map[string]*trackedClouddriver{
+					"config:a": {Name: "a", URL: a.URL},
+					"config:b": {Name: "b", URL: b.URL},
+				},
+				cloudAccountRoutes: map[string]URLAndPriority{"a1": {URL: a.URL}, "b1": {URL: b.URL}},
+			}
+			accountManagement = tt.config
+			s := &srv{}
+			r := mux.NewRouter()
+			r.HandleFunc("/credentials", s.accountDefinitionWrite(true)).Methods(http.MethodPost)
+			r.HandleFunc("/credentials", s.accountDefinitionWrite(false)).Methods(http.MethodPut)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, "/credentials", strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, strings.TrimSpace(w.Body.String()))
+			}
+		})
+	}
+}
+
+func Test_accountManagementConfig_validate(t *testing.T) {
+	clouddrivers := []clouddriverConfig{{Name: "east"}}
+	assert.NoError(t, accountManagementConfig{}.validate(clouddrivers, false))
+	assert.NoError(t, accountManagementConfig{DefaultClouddriver: "east"}.validate(clouddrivers, false))
+	assert.ErrorContains(t, accountManagementConfig{DefaultClouddriver: "west"}.validate(clouddrivers, false), `"west" is not a configured clouddriver`)
+	assert.NoError(t, accountManagementConfig{DefaultClouddriver: "west"}.validate(clouddrivers, true), "may come from the controller later")
+}
+
+func Test_pendingSync(t *testing.T) {
+	var syncs int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	p := &pendingSync{sync: func(ctx context.Context) {
+		atomic.AddInt32(&syncs, 1)
+		started <- struct{}{}
+		<-release
+	}}
+
+	p.request(context.Background())
+	<-started
+	for i := 0; i < 5; i++ {
+		p.request(context.Background())
+	}
+	close(release)
+	<-started
+	assert.Eventually(t, func() bool {
+		p.Lock()
+		defer p.Unlock()
+		return !p.running
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&syncs), "requests made during a sync are coalesced into one more")
+}
+
+func Test_accountDefinitionWrite_permissions(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("b " + r.Method))
+	}))
+	defer b.Close()
+
+	oldManager := clouddriverManager
+	oldManagement := accountManagement
+	defer func() {
+		clouddriverManager = oldManager
+		accountManagement = oldManagement
+	}()
+	clouddriverManager = &ClouddriverManager{
+		state:              map[string]*trackedClouddriver{"config:b": {Name: "b", URL: b.URL}},
+		cloudAccountRoutes: map[string]URLAndPriority{"b1": {URL: b.URL}},
+		cloudAccounts: []trackedSpinnakerAccount{
+			{Name: "b1", permissions: accountPermissions{"WRITE": {"ops"}}},
+		},
+	}
+	accountManagement = accountManagementConfig{DefaultClouddriver: "b"}
+	s := &srv{permissions: makePermissionChecker(permissionsConfig{Enforce: true, AdminRoles: []string{"admin"}})}
+	r := mux.NewRouter()
+	r.HandleFunc("/credentials", s.accountDefinitionWrite(true)).Methods(http.MethodPost)
+	r.HandleFunc("/credentials", s.accountDefinitionWrite(false)).Methods(http.MethodPut)
+
+	tests := []struct {
+		name     string
+		method   string
+		roles    string
+		body     string
+		wantCode int
+	}{
+		{"create as admin", http.MethodPost, "admin", `{"name":"c1"}`, http.StatusOK},
+		{"create as non-admin", http.MethodPost, "ops", `{"name":"c1"}`, http.StatusForbidden},
+		{"create of an existing account as a writer", http.MethodPost, "ops", `{"name":"b1"}`, http.StatusOK},
+		{"update as a writer", http.MethodPut, "ops", `{"name":"b1"}`, http.StatusOK},
+		{"update as a non-writer", http.MethodPut, "dev", `{"name":"b1"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/credentials", strings.NewReader(tt.body))
+			req.Header.Set("x-spinnaker-roles", tt.roles)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// validateAccountOverrides checks that each account is pinned to a
+// named clouddriver.  Whether the clouddriver exists is only known once
+// the controller and discovery have reported, so it is checked on sync.
+func validateAccountOverrides(overrides map[string]string) error {
+	for account, clouddriver := range overrides {
+		if account == "" {
+			return fmt.Errorf("account name cannot be empty")
+		}
+		if clouddriver == "" {
+			return fmt.Errorf("%s: clouddriver name cannot be empty", account)
+		}
+	}
+	return nil
+}
+
+// setAccountOverrides replaces the account pins.  They take effect on
+// the next sync.
+func (m *ClouddriverManager) setAccountOverrides(overrides map[string]string) {
+	m.Lock()
+	defer m.Unlock()
+	m.accountOverrides = overrides
+	m.warnedOverrides = map[string]bool{}
+}
+
+// applyAccountOverrides routes each pinned account to its clouddriver,
+// whatever the clouddrivers returned.  Pinned accounts missing from the
+// routes are added only if addMissing is set, so that an account which
+// no clouddriver returned becomes a cloud account, not an artifact
+// account.  Must be called with the lock held.
+func (m *ClouddriverManager) applyAccountOverrides(routes map[string]URLAndPriority, addMissing bool) {
+	for account, name := range m.accountOverrides {
+		if _, found := routes[account]; !found && !addMissing {
+			continue
+		}
+		cd, err := m.findClouddriverByName(name)
+		if err != nil {
+			if !m.warnedOverrides[account] {
+				m.warnedOverrides[account] = true
+				zap.S().Warnw("account override not applied", "account", account, "clouddriver", name, "error", err)
+			}
+			continue
+		}
+		delete(m.warnedOverrides, account)
+		routes[account] = URLAndPriority{URL: cd.URL, Priority: cd.Priority, token: cd.token}
+	}
+}
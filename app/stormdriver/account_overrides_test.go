@@ -0,0 +1,58 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClouddriverManager_applyAccountOverrides(t *testing.T) {
+	m := &ClouddriverManager{state: map[string]*trackedClouddriver{
+		"config:west": {Name: "west", URL: "http://west", Priority: 1},
+		"config:east": {Name: "east", URL: "http://east", Priority: 2},
+	}}
+	m.setAccountOverrides(map[string]string{
+		"prod-k8s":    "east",
+		"new-account": "east",
+		"orphan":      "missing",
+	})
+	west := URLAndPriority{URL: "http://west", Priority: 1}
+	east := URLAndPriority{URL: "http://east", Priority: 2}
+
+	routes := map[string]URLAndPriority{"prod-k8s": west, "orphan": west, "other": west}
+	m.applyAccountOverrides(routes, true)
+	assert.Equal(t, map[string]URLAndPriority{
+		"prod-k8s":    east,
+		"new-account": east,
+		"orphan":      west,
+		"other":       west,
+	}, routes)
+	assert.True(t, m.warnedOverrides["orphan"], "an unknown clouddriver is logged once")
+
+	artifacts := map[string]URLAndPriority{"prod-k8s": west}
+	m.applyAccountOverrides(artifacts, false)
+	assert.Equal(t, map[string]URLAndPriority{"prod-k8s": east}, artifacts, "missing accounts are not added")
+}
+
+func Test_validateAccountOverrides(t *testing.T) {
+	assert.NoError(t, validateAccountOverrides(nil))
+	assert.NoError(t, validateAccountOverrides(map[string]string{"a": "cd"}))
+	assert.EqualError(t, validateAccountOverrides(map[string]string{"a": ""}), "a: clouddriver name cannot be empty")
+	assert.EqualError(t, validateAccountOverrides(map[string]string{"": "cd"}), "account name cannot be empty")
+}
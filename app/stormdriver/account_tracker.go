@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -36,6 +37,54 @@ import (
 type trackedSpinnakerAccount struct {
 	Name string `json:"name,omitempty" yaml:"name,omitempty"`
 	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// raw holds the complete account document as returned by clouddriver,
+	// including permissions and provider-specific fields.  It is empty
+	// for accounts not read from JSON.
+	raw json.RawMessage
+
+	permissions accountPermissions
+}
+
+// UnmarshalJSON keeps a copy of the complete account document.
+func (a *trackedSpinnakerAccount) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	a.Name = fields.Name
+	a.Type = fields.Type
+	a.raw = append(json.RawMessage(nil), data...)
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err == nil {
+		a.permissions = permissionsFromDocument(doc)
+	}
+	return nil
+}
+
+// MarshalJSON returns the complete account document, if known.
+func (a trackedSpinnakerAccount) MarshalJSON() ([]byte, error) {
+	if len(a.raw) > 0 {
+		return a.raw, nil
+	}
+	type plain trackedSpinnakerAccount
+	return json.Marshal(plain(a))
+}
+
+// MarshalYAML returns the complete account document, if known.
+func (a trackedSpinnakerAccount) MarshalYAML() (interface{}, error) {
+	type plain trackedSpinnakerAccount
+	if len(a.raw) == 0 {
+		return plain(a), nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(a.raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
 }
 
 type trackedClouddriver struct {
@@ -47,10 +96,30 @@ type trackedClouddriver struct {
 	LastSuccessfulContact   time.Time `json:"lastSuccessfulContact,omitempty" yaml:"lastSuccessfulContact,omitempty"`
 	Priority                int       `json:"priority,omitempty" yaml:"priority,omitempty"`
 	DisableArtifactAccounts bool      `json:"disableArtifactAccounts,omitempty" yaml:"disableArtifactAccounts,omitempty"`
+	Weight                  int       `json:"weight,omitempty" yaml:"weight,omitempty"`
 	healthcheckURL          string
+	healthcheckTimeout      time.Duration
+	healthcheck             *periodicCheck
 	token                   string
 	artifactHealth          error
 	accountHealth           error
+	maintenance             []maintenanceSchedule
+	inMaintenance           bool
+	quarantined             bool
+	syncFailures            int
+	healthFailures          int32
+	optional                bool
+	accountFilter           *accountFilter
+
+	// withdrawn is set once the controller stops announcing the
+	// clouddriver.  Until graceUntil, it keeps its routes even if its
+	// credential syncs fail.
+	withdrawn  bool
+	graceUntil time.Time
+
+	// config is what the clouddriver was built from, if it was not
+	// discovered through the controller.
+	config clouddriverConfig
 }
 
 const credentialsUpdateFrequency = 10
@@ -73,6 +142,58 @@ type ClouddriverManager struct {
 	artifactAccountRoutes map[string]URLAndPriority
 	artifactAccounts      []trackedSpinnakerAccount
 
+	// importedRoutes holds an advisory snapshot of routes, used only
+	// when no live route exists for an account.
+	importedRoutes *routeSnapshot
+
+	// syncedCloudAccounts and syncedArtifactAccounts hold the accounts
+	// each clouddriver returned on the last sync, keyed by route key,
+	// whether or not they were routed to it.
+	syncedCloudAccounts    map[string][]trackedSpinnakerAccount
+	syncedArtifactAccounts map[string][]trackedSpinnakerAccount
+
+	// swaps maps a clouddriver name to the name of the clouddriver
+	// which replaces it in all routes.
+	swaps map[string]string
+
+	// accountOverrides pins account names to clouddriver names, and
+	// warnedOverrides holds those already logged as not applicable.
+	accountOverrides map[string]string
+	warnedOverrides  map[string]bool
+
+	// routingRules route accounts by name pattern, and warnedRules holds
+	// the rules already logged as not applicable.
+	routingRules []routingRule
+	warnedRules  map[string]bool
+
+	// when the routes were last replaced by a sync
+	lastCloudSync    time.Time
+	lastArtifactSync time.Time
+
+	// routeDiffs holds the most recent changes made by syncs.
+	routeDiffs []routeDiff
+
+	// conflicts holds, by route kind, the accounts more than one
+	// clouddriver returned on the last sync.
+	conflicts map[string][]accountConflict
+
+	// quarantineThreshold is how many consecutive failures quarantine
+	// a clouddriver, or 0 to never quarantine.
+	quarantineThreshold int
+
+	// controllerGrace is how long clouddrivers from the controller keep
+	// their routes while withdrawn or reconnecting.
+	controllerGrace time.Duration
+
+	// syncLock serializes credential syncs, so a forced sync can report
+	// exactly what it changed.
+	syncLock sync.Mutex
+
+	// contacts holds, by route key, when each clouddriver last answered
+	// as a *contactTime, so proxied requests can note contact without
+	// taking the lock.  Use contactOf() to read it.
+	contacts sync.Map
+
 	state map[string]*trackedClouddriver
 
 	spinnakerUser string
@@ -87,6 +208,7 @@ func MakeClouddriverManager(clouddrivers []clouddriverConfig, spinnakerUser stri
 		artifactAccountRoutes: map[string]URLAndPriority{},
 		artifactAccounts:      []trackedSpinnakerAccount{},
 		state:                 map[string]*trackedClouddriver{},
+		swaps:                 map[string]string{},
 		health:                errors.New("initial sync not yet performed"),
 	}
 
@@ -101,14 +223,24 @@ func MakeClouddriverManager(clouddrivers []clouddriverConfig, spinnakerUser stri
 }
 
 func (a *trackedClouddriver) Check() error {
-	code, _, err := fetchHealthcheck(context.Background(), a.token, a.healthcheckURL)
-	if err != nil {
-		return err
+	if inMaintenance(a.maintenance, time.Now()) {
+		return nil
 	}
-	if code != http.StatusOK {
-		return fmt.Errorf("healthcheck returned status %d", code)
+	err := a.healthcheck.run(time.Now(), func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), a.healthcheckTimeout)
+		defer cancel()
+		code, _, err := fetchHealthcheck(withClouddriver(ctx, a.Name, a.routeKey()), a.token, a.healthcheckURL)
+		if err == nil && code != http.StatusOK {
+			err = fmt.Errorf("healthcheck returned status %d", code)
+		}
+		a.noteHealthcheck(err)
+		return err
+	})
+	if err != nil && clouddriverManager != nil {
+		err = fmt.Errorf("%v; last successful contact %s", err,
+			describeContact(clouddriverManager.lastSuccessfulContact(a), time.Now()))
 	}
-	return nil
+	return err
 	//	if a.artifactHealth != nil {
 	//		return a.artifactHealth
 	//	}
@@ -116,6 +248,13 @@ func (a *trackedClouddriver) Check() error {
 	// return a.accountHealth
 }
 
+// routeKey returns the same key as URLAndPriority.key() would for
+// routes pointing to this clouddriver.
+func (a *trackedClouddriver) routeKey() string {
+	u := URLAndPriority{URL: a.URL, token: a.token}
+	return u.key()
+}
+
 func fetchHealthcheck(ctx context.Context, token string, url string) (int, []byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
@@ -124,8 +263,9 @@ func fetchHealthcheck(ctx context.Context, token string, url string) (int, []byt
 	if token != "" {
 		req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := downstreamClients.clientFor(url).Do(req)
 	if err != nil {
+		noteDownstreamError(err)
 		return http.StatusUnprocessableEntity, []byte{}, err
 	}
 	defer resp.Body.Close()
@@ -157,12 +297,30 @@ func (m *ClouddriverManager) updateAllAccounts(t *time.Timer) {
 	ctx, span := tracerProvider.Provider.Tracer("updateAllAccounts").Start(context.Background(), "updateAllAccounts")
 	defer span.End()
 
+	m.syncAccounts(ctx)
+	t.Reset(credentialsUpdateFrequency * time.Second)
+}
+
+// syncAccounts fetches the cloud and artifact credentials from every
+// clouddriver, and returns the changes made to each routing table.
+// The manager's lock is not held while the credentials are fetched, as
+// downstream requests look up clouddriver names for their spans.
+func (m *ClouddriverManager) syncAccounts(ctx context.Context) (routeDiff, routeDiff) {
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+	previous := m.getCloudAccountRoutes()
+	previousArtifacts := m.getArtifactAccountRoutes()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go m.updateAccounts(ctx, &wg)
 	go m.updateArtifactAccounts(ctx, &wg)
 	wg.Wait()
-	t.Reset(credentialsUpdateFrequency * time.Second)
+
+	m.Lock()
+	defer m.Unlock()
+	return m.diffRoutes(routeKindAccount, previous, m.cloudAccountRoutes),
+		m.diffRoutes(routeKindArtifactAccount, previousArtifacts, m.artifactAccountRoutes)
 }
 
 func yesno(s string) bool {
@@ -171,28 +329,43 @@ func yesno(s string) bool {
 }
 
 func makeTrackedClouddriverFromConfig(clouddriver clouddriverConfig) (string, *trackedClouddriver) {
-	key := "config:" + clouddriver.Name
-	healthcheck := clouddriver.HealthcheckURL
-	if healthcheck == "" {
-		healthcheck = clouddriver.URL + "/health"
-	}
+	return makeTrackedClouddriverFromSource(configSource, clouddriver)
+}
+
+// makeTrackedClouddriverFromSource tracks a clouddriver described by a
+// clouddriverConfig, which came from the named source.
+func makeTrackedClouddriverFromSource(source string, clouddriver clouddriverConfig) (string, *trackedClouddriver) {
+	key := source + ":" + clouddriver.Name
+	healthcheck, healthcheckTimeout := healthcheckSettings(clouddriver)
 	var artifactHealth error = nil
 	if !clouddriver.DisableArtifactAccounts {
 		artifactHealth = errors.New("initial sync not yet performed")
 	}
+	// already checked by configuration.validate()
+	maintenance, _ := parseMaintenanceWindows(clouddriver.MaintenanceWindows)
 	ret := &trackedClouddriver{
-		Source:                  "config",
+		Source:                  source,
 		Name:                    clouddriver.Name,
 		URL:                     clouddriver.URL,
 		UIUrl:                   clouddriver.UIUrl,
 		LastSuccessfulContact:   time.Unix(0, 0).UTC(),
 		DisableArtifactAccounts: clouddriver.DisableArtifactAccounts,
 		Priority:                clouddriver.Priority,
+		Weight:                  clouddriver.Weight,
 		healthcheckURL:          healthcheck,
+		healthcheckTimeout:      healthcheckTimeout,
+		healthcheck:             makePeriodicCheck(clouddriver.Healthcheck),
 		artifactHealth:          artifactHealth,
 		accountHealth:           errors.New("initial sync not yet performed"),
+		maintenance:             maintenance,
+		optional:                clouddriver.Optional,
+		accountFilter:           makeAccountFilter(clouddriver.AccountIncludes, clouddriver.AccountExcludes),
+		config:                  clouddriver,
 	}
 	healthchecker.AddCheck("clouddriver "+key, true, ret)
+	if err := downstreamClients.register(clouddriver.URL, clouddriver.clientOptions()); err != nil {
+		zap.S().Errorw("cannot configure clouddriver client", "clouddriver", clouddriver.Name, "url", clouddriver.URL, "error", err)
+	}
 
 	return key, ret
 }
@@ -207,6 +380,13 @@ func makeTrackedClouddriverFromUpdate(update birger.ServiceUpdate) *trackedCloud
 			zap.S().Warnw("priority is not parsable", "clouddriver", update.Name, "agent", update.AgentName, "source", "controller", "badPriority", strpri, "error", err)
 		}
 	}
+	weight := 0
+	if strweight := update.Annotations["weight"]; strweight != "" {
+		if weight, err = strconv.Atoi(strweight); err != nil || weight < 0 {
+			zap.S().Warnw("weight is not parsable", "clouddriver", update.Name, "agent", update.AgentName, "source", "controller", "badWeight", strweight, "error", err)
+			weight = 0
+		}
+	}
 	var artifactHealth error = nil
 	if !disableArtifactAccounts {
 		artifactHealth = errors.New("initial sync not yet performed")
@@ -221,7 +401,10 @@ func makeTrackedClouddriverFromUpdate(update birger.ServiceUpdate) *trackedCloud
 		token:                   update.Token,
 		DisableArtifactAccounts: disableArtifactAccounts,
 		Priority:                priority,
-		healthcheckURL:          update.URL + "/health",
+		Weight:                  weight,
+		healthcheckURL:          update.URL + getHealthchecks().path(),
+		healthcheckTimeout:      getHealthchecks().timeout(),
+		healthcheck:             makePeriodicCheck(nil),
 		artifactHealth:          artifactHealth,
 		accountHealth:           errors.New("initial sync not yet performed"),
 	}
@@ -234,8 +417,7 @@ func (m *ClouddriverManager) handleUpdate(update birger.ServiceUpdate) {
 	key := "controller:" + update.AgentName + ":" + update.Name
 
 	if update.Operation == "delete" {
-		delete(m.state, key)
-		healthchecker.RemoveCheck("clouddriver " + key)
+		m.withdraw(key, time.Now())
 		return
 	}
 
@@ -247,7 +429,7 @@ func (m *ClouddriverManager) handleUpdate(update birger.ServiceUpdate) {
 			healthchecker.AddCheck("clouddriver "+key, true, tracked)
 			return
 		}
-		tracked.LastSuccessfulContact = old.LastSuccessfulContact
+		m.reannounce(old, tracked, time.Now())
 		healthchecker.RemoveCheck("clouddriver " + key)
 		healthchecker.AddCheck("clouddriver "+key, true, tracked)
 		m.state[key] = tracked
@@ -292,10 +474,52 @@ func (m *ClouddriverManager) getArtifactAccounts() []trackedSpinnakerAccount {
 	return copyTrackedAccounts(m.artifactAccounts)
 }
 
+// findCloudAccountPermissions returns the permissions from the named
+// account's document.
+func (m *ClouddriverManager) findCloudAccountPermissions(name string) (accountPermissions, bool) {
+	m.Lock()
+	defer m.Unlock()
+	for _, account := range m.cloudAccounts {
+		if account.Name == name {
+			return account.permissions, true
+		}
+	}
+	return nil, false
+}
+
+// clouddriverNameForRoute returns the name of the clouddriver a route
+// points to, or "" if it is not known.
+func (m *ClouddriverManager) clouddriverNameForRoute(route URLAndPriority) string {
+	m.Lock()
+	defer m.Unlock()
+	return m.nameForRouteKey(route.key())
+}
+
+// filterCloudAccountNames returns the sorted names of the cloud accounts
+// whose permissions pass the filter.
+func (m *ClouddriverManager) filterCloudAccountNames(filter func(accountPermissions) bool) []string {
+	m.Lock()
+	defer m.Unlock()
+	ret := []string{}
+	for _, account := range m.cloudAccounts {
+		if filter(account.permissions) {
+			ret = append(ret, account.Name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func (m *ClouddriverManager) findCloudRoute(name string) (URLAndPriority, bool) {
 	m.Lock()
 	defer m.Unlock()
 	val, found := m.cloudAccountRoutes[name]
+	if !found {
+		if route, found := m.ruleRoute(name); found {
+			return route, true
+		}
+		return m.findImportedRoute(name, false)
+	}
 	return val, found
 }
 
@@ -303,9 +527,52 @@ func (m *ClouddriverManager) findArtifactRoute(name string) (URLAndPriority, boo
 	m.Lock()
 	defer m.Unlock()
 	val, found := m.artifactAccountRoutes[name]
+	if !found {
+		if route, found := m.ruleRoute(name); found {
+			return route, true
+		}
+		return m.findImportedRoute(name, true)
+	}
 	return val, found
 }
 
+// getAccountsForClouddriver returns the cloud and artifact accounts currently
+// routed to any clouddriver with the given name.  found will be false if no
+// clouddriver by that name is known.
+func (m *ClouddriverManager) getAccountsForClouddriver(name string) (cloud []trackedSpinnakerAccount, artifact []trackedSpinnakerAccount, found bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	keys := map[string]bool{}
+	for _, cd := range m.state {
+		if cd.Name == name {
+			keys[cd.routeKey()] = true
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, false
+	}
+
+	cloud = accountsRoutedTo(keys, m.cloudAccounts, m.cloudAccountRoutes)
+	artifact = accountsRoutedTo(keys, m.artifactAccounts, m.artifactAccountRoutes)
+	return cloud, artifact, true
+}
+
+func accountsRoutedTo(keys map[string]bool, accounts []trackedSpinnakerAccount, routes map[string]URLAndPriority) []trackedSpinnakerAccount {
+	ret := []trackedSpinnakerAccount{}
+	for _, account := range accounts {
+		route, found := routes[account.Name]
+		if found && keys[route.key()] {
+			ret = append(ret, account)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// getHealthyClouddriverURLs returns the clouddrivers requests not routed
+// by account may go to.  Quarantined and withdrawn clouddrivers, and
+// optional ones while shedding load, are left out.
 func (m *ClouddriverManager) getHealthyClouddriverURLs() []URLAndPriority {
 	m.Lock()
 	defer m.Unlock()
@@ -316,6 +583,16 @@ func (m *ClouddriverManager) getHealthyClouddriverURLs() []URLAndPriority {
 	for _, v := range m.artifactAccountRoutes {
 		healthy[v.key()] = v
 	}
+	for _, v := range m.importedRouteTargets() {
+		if _, found := healthy[v.key()]; !found {
+			healthy[v.key()] = v
+		}
+	}
+	for _, cd := range m.state {
+		if cd.quarantined || cd.withdrawn || (cd.optional && shedder.active()) {
+			delete(healthy, cd.routeKey())
+		}
+	}
 	ret := []URLAndPriority{}
 	for _, v := range healthy {
 		ret = append(ret, v)
@@ -323,9 +600,23 @@ func (m *ClouddriverManager) getHealthyClouddriverURLs() []URLAndPriority {
 	return ret
 }
 
+// getClouddriverURLs returns the clouddrivers to sync, skipping any in a
+// maintenance window so their accounts fail over to others, and removes
+// withdrawn clouddrivers whose grace period has ended.
+// Must be called with the lock held.
 func (m *ClouddriverManager) getClouddriverURLs(artifactAccount bool) []URLAndPriority {
 	ret := []URLAndPriority{}
+	now := time.Now()
+	m.expireWithdrawn(now)
 	for _, cd := range m.state {
+		maintenance := inMaintenance(cd.maintenance, now)
+		if maintenance != cd.inMaintenance {
+			zap.S().Infow("clouddriver maintenance window", "clouddriver", cd.Name, "active", maintenance)
+			cd.inMaintenance = maintenance
+		}
+		if maintenance {
+			continue
+		}
 		if !artifactAccount || (artifactAccount && !cd.DisableArtifactAccounts) {
 			ret = append(ret, URLAndPriority{cd.URL, cd.Priority, cd.token})
 		}
@@ -334,29 +625,91 @@ func (m *ClouddriverManager) getClouddriverURLs(artifactAccount bool) []URLAndPr
 }
 
 func (m *ClouddriverManager) updateAccounts(ctx context.Context, wg *sync.WaitGroup) {
-	m.Lock()
-	defer m.Unlock()
 	defer wg.Done()
 	ctx, span := tracerProvider.Provider.Tracer("updateAccounts").Start(ctx, "updateAccounts")
 	defer span.End()
+	m.Lock()
 	cds := m.getClouddriverURLs(false)
-	newAccountRoutes, newAccounts := fetchCreds(ctx, cds, "/credentials", m.spinnakerUser)
+	filters := m.getAccountFilters()
+	m.Unlock()
+	newAccountRoutes, newAccounts, synced := fetchCreds(ctx, cds, "/credentials", m.spinnakerUser, filters)
+
+	m.Lock()
+	defer m.Unlock()
 
+	if tracked := m.stillTracked(cds, synced); len(tracked) != len(cds) {
+		cds = tracked
+		newAccountRoutes, newAccounts = mergeWithoutQuarantined(cds, synced, nil)
+	}
+
+	m.noteSyncHealth(cds, synced, false)
+	newAccounts = m.retainDuringGrace(cds, synced, m.syncedCloudAccounts, newAccountRoutes, newAccounts, time.Now())
+	quarantined := m.updateQuarantine()
+	if len(quarantined) > 0 {
+		newAccountRoutes, newAccounts = mergeWithoutQuarantined(cds, synced, quarantined)
+	}
+
+	previous := m.cloudAccountRoutes
+	firstSync := m.lastCloudSync.IsZero()
 	m.cloudAccountRoutes = newAccountRoutes
 	m.cloudAccounts = newAccounts
+	m.syncedCloudAccounts = synced
+	m.lastCloudSync = time.Now().UTC()
+	m.applySwaps(m.cloudAccountRoutes)
+	m.applyRoutingRules(m.cloudAccountRoutes)
+	m.applyAccountOverrides(m.cloudAccountRoutes, true)
+	dropQuarantinedRoutes(m.cloudAccountRoutes, quarantined)
+	m.pruneImportedRoutes()
+	m.noteConflicts(routeKindAccount, m.syncedCloudAccounts, m.cloudAccountRoutes)
+	if firstSync {
+		routeCount.WithLabelValues(routeKindAccount).Set(float64(len(m.cloudAccountRoutes)))
+	} else {
+		m.recordRouteDiff(m.diffRoutes(routeKindAccount, previous, m.cloudAccountRoutes))
+	}
 }
 
 func (m *ClouddriverManager) updateArtifactAccounts(ctx context.Context, wg *sync.WaitGroup) {
-	m.Lock()
-	defer m.Unlock()
 	defer wg.Done()
 	ctx, span := tracerProvider.Provider.Tracer("updateArtifactAccounts").Start(ctx, "updateArtifactAccounts")
 	defer span.End()
+	m.Lock()
 	cds := m.getClouddriverURLs(true)
-	newAccountRoutes, newAccounts := fetchCreds(ctx, cds, "/artifacts/credentials", m.spinnakerUser)
+	filters := m.getAccountFilters()
+	m.Unlock()
+	newAccountRoutes, newAccounts, synced := fetchCreds(ctx, cds, "/artifacts/credentials", m.spinnakerUser, filters)
+
+	m.Lock()
+	defer m.Unlock()
+
+	if tracked := m.stillTracked(cds, synced); len(tracked) != len(cds) {
+		cds = tracked
+		newAccountRoutes, newAccounts = mergeWithoutQuarantined(cds, synced, nil)
+	}
 
+	m.noteSyncHealth(cds, synced, true)
+	newAccounts = m.retainDuringGrace(cds, synced, m.syncedArtifactAccounts, newAccountRoutes, newAccounts, time.Now())
+	quarantined := m.updateQuarantine()
+	if len(quarantined) > 0 {
+		newAccountRoutes, newAccounts = mergeWithoutQuarantined(cds, synced, quarantined)
+	}
+
+	previous := m.artifactAccountRoutes
+	firstSync := m.lastArtifactSync.IsZero()
 	m.artifactAccountRoutes = newAccountRoutes
 	m.artifactAccounts = newAccounts
+	m.syncedArtifactAccounts = synced
+	m.lastArtifactSync = time.Now().UTC()
+	m.applySwaps(m.artifactAccountRoutes)
+	m.applyRoutingRules(m.artifactAccountRoutes)
+	m.applyAccountOverrides(m.artifactAccountRoutes, false)
+	dropQuarantinedRoutes(m.artifactAccountRoutes, quarantined)
+	m.pruneImportedRoutes()
+	m.noteConflicts(routeKindArtifactAccount, m.syncedArtifactAccounts, m.artifactAccountRoutes)
+	if firstSync {
+		routeCount.WithLabelValues(routeKindArtifactAccount).Set(float64(len(m.artifactAccountRoutes)))
+	} else {
+		m.recordRouteDiff(m.diffRoutes(routeKindArtifactAccount, previous, m.artifactAccountRoutes))
+	}
 }
 
 type credentialsResponse struct {
@@ -367,7 +720,7 @@ type credentialsResponse struct {
 func fetchCredsFromOne(ctx context.Context, c chan credentialsResponse, cd URLAndPriority, path string, headers http.Header) {
 	resp := credentialsResponse{cd: cd}
 	fullURL := combineURL(cd.URL, path)
-	data, code, _, err := fetchGet(ctx, fullURL, cd.token, headers)
+	data, code, _, err := fetchGet(withRoute(ctx, cd), fullURL, cd.token, headers)
 	if err != nil {
 		zap.S().Warnw("fetchGet", "error", err, "url", fullURL, "hasToken", cd.token != "")
 		c <- resp
@@ -391,9 +744,13 @@ func fetchCredsFromOne(ctx context.Context, c chan credentialsResponse, cd URLAn
 	c <- resp
 }
 
-func fetchCreds(ctx context.Context, cds []URLAndPriority, path string, spinnakerUser string) (map[string]URLAndPriority, []trackedSpinnakerAccount) {
+// fetchCreds returns the merged routes and accounts from all the clouddrivers,
+// as well as the accounts returned by each, keyed by URLAndPriority.key().
+// Accounts a clouddriver's filter does not allow are ignored.
+func fetchCreds(ctx context.Context, cds []URLAndPriority, path string, spinnakerUser string, filters map[string]*accountFilter) (map[string]URLAndPriority, []trackedSpinnakerAccount, map[string][]trackedSpinnakerAccount) {
 	newAccountRoutes := map[string]URLAndPriority{}
 	newAccounts := []trackedSpinnakerAccount{}
+	synced := map[string][]trackedSpinnakerAccount{}
 
 	headers := http.Header{}
 	headers.Set("x-spinnaker-user", spinnakerUser)
@@ -405,10 +762,14 @@ func fetchCreds(ctx context.Context, cds []URLAndPriority, path string, spinnake
 	}
 	for i := 0; i < len(cds); i++ {
 		creds := <-c
+		creds.accounts = filters[creds.cd.key()].filter(creds.cd.URL, creds.accounts)
+		if creds.accounts != nil {
+			synced[creds.cd.key()] = creds.accounts
+		}
 		newAccounts = mergeIfUnique(creds.cd, creds.accounts, newAccountRoutes, newAccounts)
 	}
 
-	return newAccountRoutes, newAccounts
+	return newAccountRoutes, newAccounts, synced
 }
 
 func mergeIfUnique(cd URLAndPriority, instanceAccounts []trackedSpinnakerAccount, routes map[string]URLAndPriority, newAccounts []trackedSpinnakerAccount) []trackedSpinnakerAccount {
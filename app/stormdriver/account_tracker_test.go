@@ -17,10 +17,13 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func Test_mergeIfUnique(t *testing.T) {
@@ -40,13 +43,13 @@ func Test_mergeIfUnique(t *testing.T) {
 			"no duplicate",
 			args{
 				URLAndPriority{"url2", 0, ""},
-				[]trackedSpinnakerAccount{{"a2", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a2", Type: "aws"}},
 				map[string]URLAndPriority{"a1": {"url1", 0, ""}},
-				[]trackedSpinnakerAccount{{"a1", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a1", Type: "aws"}},
 			},
 			[]trackedSpinnakerAccount{
-				{"a1", "aws"},
-				{"a2", "aws"},
+				{Name: "a1", Type: "aws"},
+				{Name: "a2", Type: "aws"},
 			},
 			map[string]URLAndPriority{
 				"a1": {"url1", 0, ""},
@@ -58,12 +61,12 @@ func Test_mergeIfUnique(t *testing.T) {
 			"duplicate item",
 			args{
 				URLAndPriority{"url2", 0, ""},
-				[]trackedSpinnakerAccount{{"a2", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a2", Type: "aws"}},
 				map[string]URLAndPriority{"a2": {"url1", 0, ""}},
-				[]trackedSpinnakerAccount{{"a2", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a2", Type: "aws"}},
 			},
 			[]trackedSpinnakerAccount{
-				{"a2", "aws"},
+				{Name: "a2", Type: "aws"},
 			},
 			map[string]URLAndPriority{
 				"a2": {"url1", 0, ""},
@@ -74,12 +77,12 @@ func Test_mergeIfUnique(t *testing.T) {
 			"Higher priority already exists",
 			args{
 				URLAndPriority{"url2", 1, ""},
-				[]trackedSpinnakerAccount{{"a2", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a2", Type: "aws"}},
 				map[string]URLAndPriority{"a2": {"url1", 0, ""}},
-				[]trackedSpinnakerAccount{{"a2", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a2", Type: "aws"}},
 			},
 			[]trackedSpinnakerAccount{
-				{"a2", "aws"},
+				{Name: "a2", Type: "aws"},
 			},
 			map[string]URLAndPriority{
 				"a2": {"url2", 1, ""},
@@ -90,12 +93,12 @@ func Test_mergeIfUnique(t *testing.T) {
 			"Higher priority found",
 			args{
 				URLAndPriority{"url2", 0, ""},
-				[]trackedSpinnakerAccount{{"a2", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a2", Type: "aws"}},
 				map[string]URLAndPriority{"a2": {"url1", 1, ""}},
-				[]trackedSpinnakerAccount{{"a2", "aws"}},
+				[]trackedSpinnakerAccount{{Name: "a2", Type: "aws"}},
 			},
 			[]trackedSpinnakerAccount{
-				{"a2", "aws"},
+				{Name: "a2", Type: "aws"},
 			},
 			map[string]URLAndPriority{
 				"a2": {"url1", 1, ""},
@@ -179,3 +182,55 @@ func Test_ClouddriverManager_getClouddriverURLs(t *testing.T) {
 		})
 	}
 }
+
+func Test_ClouddriverManager_getAccountsForClouddriver(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:alice": {Name: "alice", URL: "url1"},
+			"config:bob":   {Name: "bob", URL: "url2", token: "bobtoken"},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a1": {URL: "url1"},
+			"a2": {URL: "url2", token: "bobtoken"},
+			"a3": {URL: "url1"},
+		},
+		cloudAccounts: []trackedSpinnakerAccount{{Name: "a3", Type: "aws"}, {Name: "a2", Type: "aws"}, {Name: "a1", Type: "kubernetes"}},
+		artifactAccountRoutes: map[string]URLAndPriority{
+			"gh": {URL: "url2", token: "bobtoken"},
+		},
+		artifactAccounts: []trackedSpinnakerAccount{{Name: "gh", Type: "github"}},
+	}
+
+	cloud, artifact, found := m.getAccountsForClouddriver("alice")
+	assert.True(t, found)
+	assert.Equal(t, []trackedSpinnakerAccount{{Name: "a1", Type: "kubernetes"}, {Name: "a3", Type: "aws"}}, cloud)
+	assert.Equal(t, []trackedSpinnakerAccount{}, artifact)
+
+	cloud, artifact, found = m.getAccountsForClouddriver("bob")
+	assert.True(t, found)
+	assert.Equal(t, []trackedSpinnakerAccount{{Name: "a2", Type: "aws"}}, cloud)
+	assert.Equal(t, []trackedSpinnakerAccount{{Name: "gh", Type: "github"}}, artifact)
+
+	_, _, found = m.getAccountsForClouddriver("carol")
+	assert.False(t, found)
+}
+
+func Test_trackedSpinnakerAccount_rawDocument(t *testing.T) {
+	doc := `{"name":"a1","type":"kubernetes","providerVersion":"v2","permissions":{"READ":["dev"],"WRITE":["ops"]}}`
+	var account trackedSpinnakerAccount
+	require.NoError(t, json.Unmarshal([]byte(doc), &account))
+	assert.Equal(t, "a1", account.Name)
+	assert.Equal(t, "kubernetes", account.Type)
+
+	got, err := json.Marshal(account)
+	require.NoError(t, err)
+	assert.JSONEq(t, doc, string(got), "full document is preserved")
+
+	y, err := yaml.Marshal(account)
+	require.NoError(t, err)
+	assert.Contains(t, string(y), "providerVersion: v2")
+
+	got, err = json.Marshal(trackedSpinnakerAccount{Name: "a2", Type: "aws"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name":"a2","type":"aws"}`, string(got))
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.uber.org/zap"
+)
+
+const defaultAdminListenAddress = "127.0.0.1:6060"
+
+// adminConfig holds the settings for the administrative API, which
+// can change Stormdriver's routing state.  If Token is empty, the
+// administrative API is disabled.
+//
+// If Pprof is set, the Go profiler is served on a separate listener at
+// ListenAddress, which defaults to the loopback interface so it is
+// reached only by port forwarding.
+type adminConfig struct {
+	Token         string `yaml:"token,omitempty" json:"token,omitempty"`
+	ListenAddress string `yaml:"listenAddress,omitempty" json:"listenAddress,omitempty"`
+	Pprof         bool   `yaml:"pprof,omitempty" json:"pprof,omitempty"`
+}
+
+func (c adminConfig) listenAddress() string {
+	if c.ListenAddress == "" {
+		return defaultAdminListenAddress
+	}
+	return c.ListenAddress
+}
+
+func (c adminConfig) validate() error {
+	if c.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+			return fmt.Errorf("listenAddress: %v", err)
+		}
+	}
+	return nil
+}
+
+// requireAdmin ensures the request carries the configured admin token
+// as a bearer token before calling next.
+func (s *srv) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.adminToken == "" {
+			httputil.SetError(w, http.StatusForbidden, "admin API is disabled")
+			return
+		}
+		want := []byte("Bearer " + s.adminToken)
+		got := []byte(req.Header.Get("authorization"))
+		if subtle.ConstantTimeCompare(want, got) != 1 {
+			zap.S().Warnw("admin request rejected", "method", req.Method, "uri", req.RequestURI, "remoteAddr", req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httputil.SetError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next(w, req)
+	}
+}
+
+// adminHandler serves the Go profiler under /debug/pprof/.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// runAdminServer serves the admin listener until ctx is cancelled.
+func runAdminServer(ctx context.Context, c adminConfig) {
+	srv := &http.Server{
+		Addr:    c.listenAddress(),
+		Handler: adminHandler(),
+	}
+	zap.S().Infow("serving pprof", "address", srv.Addr)
+	// profiles may take as long as asked, so do not wait for them.
+	serveUntilDone(ctx, srv, time.Second, srv.ListenAndServe)
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_adminConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  adminConfig
+		wantErr bool
+	}{
+		{"default", adminConfig{}, false},
+		{"pprof on the default address", adminConfig{Pprof: true}, false},
+		{"address", adminConfig{ListenAddress: ":6060", Pprof: true}, false},
+		{"missing port", adminConfig{ListenAddress: "localhost", Pprof: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+	assert.Equal(t, defaultAdminListenAddress, adminConfig{}.listenAddress())
+}
+
+func Test_adminHandler(t *testing.T) {
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/debug/pprof/", http.StatusOK},
+		{"/debug/pprof/goroutine?debug=1", http.StatusOK},
+		{"/debug/pprof/cmdline", http.StatusOK},
+		{"/metrics", http.StatusNotFound},
+	}
+	h := adminHandler()
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
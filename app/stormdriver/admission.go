@@ -0,0 +1,208 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAdmissionMaxQueueWaitSeconds = 10
+
+// admissionConfig controls how many proxied requests may be in flight
+// at once.  If MaxConcurrent is 0, admission control is disabled.
+type admissionConfig struct {
+	MaxConcurrent       int `yaml:"maxConcurrent,omitempty" json:"maxConcurrent,omitempty"`
+	ReservedForOps      int `yaml:"reservedForOps,omitempty" json:"reservedForOps,omitempty"`
+	MaxQueueWaitSeconds int `yaml:"maxQueueWaitSeconds,omitempty" json:"maxQueueWaitSeconds,omitempty"`
+}
+
+func (c *admissionConfig) applyDefaults() {
+	if c.MaxConcurrent == 0 {
+		return
+	}
+	if c.MaxQueueWaitSeconds == 0 {
+		c.MaxQueueWaitSeconds = defaultAdmissionMaxQueueWaitSeconds
+	}
+	if c.ReservedForOps >= c.MaxConcurrent {
+		c.ReservedForOps = c.MaxConcurrent - 1
+	}
+}
+
+func (c *admissionConfig) validate() error {
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("maxConcurrent cannot be negative")
+	}
+	if c.ReservedForOps < 0 {
+		return fmt.Errorf("reservedForOps cannot be negative")
+	}
+	if c.MaxQueueWaitSeconds < 0 {
+		return fmt.Errorf("maxQueueWaitSeconds cannot be negative")
+	}
+	return nil
+}
+
+type admissionPriority int
+
+const (
+	admissionLow admissionPriority = iota
+	admissionHigh
+)
+
+// admissionController is a two-tier semaphore.  High priority requests
+// (operations which mutate infrastructure) are always handed a free slot
+// before any waiting low priority request, and low priority requests
+// may never use the slots reserved for high priority ones.
+type admissionController struct {
+	sync.Mutex
+	maxConcurrent int
+	lowLimit      int
+	maxQueueWait  time.Duration
+	inUse         int
+	highWaiters   []*admissionWaiter
+	lowWaiters    []*admissionWaiter
+}
+
+type admissionWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func makeAdmissionController(conf admissionConfig) *admissionController {
+	return &admissionController{
+		maxConcurrent: conf.MaxConcurrent,
+		lowLimit:      conf.MaxConcurrent - conf.ReservedForOps,
+		maxQueueWait:  time.Duration(conf.MaxQueueWaitSeconds) * time.Second,
+	}
+}
+
+func (a *admissionController) canAdmit(priority admissionPriority) bool {
+	if priority == admissionHigh {
+		return a.inUse < a.maxConcurrent
+	}
+	return a.inUse < a.lowLimit && len(a.highWaiters) == 0
+}
+
+// acquire blocks until a slot is available, or the context is done.
+// It returns true if a slot was obtained, in which case release()
+// must be called.
+func (a *admissionController) acquire(ctx context.Context, priority admissionPriority) bool {
+	a.Lock()
+	if a.canAdmit(priority) {
+		a.inUse++
+		a.Unlock()
+		return true
+	}
+	waiter := &admissionWaiter{ready: make(chan struct{})}
+	if priority == admissionHigh {
+		a.highWaiters = append(a.highWaiters, waiter)
+	} else {
+		a.lowWaiters = append(a.lowWaiters, waiter)
+	}
+	a.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true
+	case <-ctx.Done():
+		a.Lock()
+		defer a.Unlock()
+		if waiter.granted {
+			// lost the race; give the slot back to someone else.
+			a.inUse--
+			a.dispatch()
+			return false
+		}
+		a.highWaiters = removeWaiter(a.highWaiters, waiter)
+		a.lowWaiters = removeWaiter(a.lowWaiters, waiter)
+		return false
+	}
+}
+
+func (a *admissionController) release() {
+	a.Lock()
+	defer a.Unlock()
+	a.inUse--
+	a.dispatch()
+}
+
+// dispatch hands out free slots, high priority first.  Must be called with the lock held.
+func (a *admissionController) dispatch() {
+	for len(a.highWaiters) > 0 && a.inUse < a.maxConcurrent {
+		a.grant(a.highWaiters[0])
+		a.highWaiters = a.highWaiters[1:]
+	}
+	for len(a.highWaiters) == 0 && len(a.lowWaiters) > 0 && a.inUse < a.lowLimit {
+		a.grant(a.lowWaiters[0])
+		a.lowWaiters = a.lowWaiters[1:]
+	}
+}
+
+func (a *admissionController) grant(waiter *admissionWaiter) {
+	a.inUse++
+	waiter.granted = true
+	close(waiter.ready)
+}
+
+func removeWaiter(list []*admissionWaiter, target *admissionWaiter) []*admissionWaiter {
+	for idx, w := range list {
+		if w == target {
+			return append(list[:idx], list[idx+1:]...)
+		}
+	}
+	return list
+}
+
+func requestAdmissionPriority(req *http.Request) admissionPriority {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return admissionLow
+	}
+	return admissionHigh
+}
+
+func admissionExempt(req *http.Request) bool {
+	return req.URL.Path == "/health" || req.URL.Path == "/metrics" || strings.HasPrefix(req.URL.Path, "/_internal/")
+}
+
+func (a *admissionController) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.maxConcurrent == 0 || admissionExempt(req) || isStreamRoute(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		priority := requestAdmissionPriority(req)
+		ctx := req.Context()
+		if priority == admissionLow {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, a.maxQueueWait)
+			defer cancel()
+		}
+		if !a.acquire(ctx, priority) {
+			requestLogger(req.Context()).Warnw("request not admitted", "method", req.Method, "uri", req.RequestURI)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer a.release()
+		next.ServeHTTP(w, req)
+	})
+}
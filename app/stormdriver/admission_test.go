@@ -0,0 +1,83 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_admissionConfig_validate(t *testing.T) {
+	assert.NoError(t, (&admissionConfig{}).validate())
+	assert.NoError(t, (&admissionConfig{MaxConcurrent: 10, ReservedForOps: 2, MaxQueueWaitSeconds: 5}).validate())
+	assert.ErrorContains(t, (&admissionConfig{MaxConcurrent: -1}).validate(), "maxConcurrent")
+	assert.ErrorContains(t, (&admissionConfig{MaxConcurrent: 10, ReservedForOps: -1}).validate(), "reservedForOps")
+	assert.ErrorContains(t, (&admissionConfig{MaxConcurrent: 10, MaxQueueWaitSeconds: -1}).validate(), "maxQueueWaitSeconds")
+}
+
+func Test_admissionController_highPriorityFirst(t *testing.T) {
+	a := makeAdmissionController(admissionConfig{MaxConcurrent: 1})
+	ctx := context.Background()
+	require.True(t, a.acquire(ctx, admissionLow))
+
+	order := make(chan admissionPriority, 2)
+	go func() {
+		if a.acquire(ctx, admissionLow) {
+			order <- admissionLow
+			a.release()
+		}
+	}()
+	waitForWaiters(t, a, 0, 1)
+	go func() {
+		if a.acquire(ctx, admissionHigh) {
+			order <- admissionHigh
+			a.release()
+		}
+	}()
+	waitForWaiters(t, a, 1, 1)
+
+	a.release()
+	assert.Equal(t, admissionHigh, <-order)
+	assert.Equal(t, admissionLow, <-order)
+}
+
+// waitForWaiters blocks until the controller has the given number of
+// queued high and low priority waiters.
+func waitForWaiters(t *testing.T, a *admissionController, high int, low int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		a.Lock()
+		defer a.Unlock()
+		return len(a.highWaiters) == high && len(a.lowWaiters) == low
+	}, time.Second, time.Millisecond)
+}
+
+func Test_admissionController_reservedSlots(t *testing.T) {
+	a := makeAdmissionController(admissionConfig{MaxConcurrent: 2, ReservedForOps: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	require.True(t, a.acquire(ctx, admissionLow))
+	assert.False(t, a.acquire(ctx, admissionLow), "low priority must not use the reserved slot")
+	assert.True(t, a.acquire(context.Background(), admissionHigh))
+	assert.Equal(t, 2, a.inUse)
+	assert.Empty(t, a.lowWaiters)
+}
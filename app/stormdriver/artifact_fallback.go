@@ -0,0 +1,107 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// artifactFallbackConfig lets artifact fetches for an account no
+// clouddriver lists, such as the embedded or default accounts which
+// some clouddrivers leave out of /artifacts/credentials, go to a
+// clouddriver with an account for the same artifact type.  Types are
+// shell globs matched against the artifact's type, such as "github/*"
+// or "http/file".
+type artifactFallbackConfig struct {
+	Types []string `yaml:"types,omitempty" json:"types,omitempty"`
+}
+
+func (c artifactFallbackConfig) validate() error {
+	return validateAccountPatterns(c.Types)
+}
+
+var artifactFallback artifactFallbackConfig
+
+// getArtifactType returns the type of the artifact in an artifact fetch
+// request, or "" if it has none.
+func getArtifactType(data []byte) string {
+	var artifact struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &artifact); err != nil {
+		return ""
+	}
+	return artifact.Type
+}
+
+// artifactAccountTypes returns the artifact types an artifact account
+// supports, from the "types" in its document.
+func artifactAccountTypes(account trackedSpinnakerAccount) []string {
+	var doc struct {
+		Types []string `json:"types"`
+	}
+	if len(account.raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(account.raw, &doc); err != nil {
+		return nil
+	}
+	return doc.Types
+}
+
+// route returns where to send a fetch of an artifact of artifactType,
+// if its type may fall back: the clouddriver with the highest priority
+// owning an artifact account for the type.
+func (c artifactFallbackConfig) route(artifactType string) (URLAndPriority, bool) {
+	if artifactType == "" || !matchesAnyPattern(c.Types, artifactType) {
+		return URLAndPriority{}, false
+	}
+	return clouddriverManager.findArtifactRouteByType(artifactType)
+}
+
+// findArtifactRouteByType returns the route for an artifact account
+// supporting artifactType.  Where more than one clouddriver has such an
+// account, the one with the highest priority, then the lowest URL, is
+// chosen, so the same one is used every time.
+func (m *ClouddriverManager) findArtifactRouteByType(artifactType string) (URLAndPriority, bool) {
+	m.Lock()
+	defer m.Unlock()
+	candidates := []URLAndPriority{}
+	for _, account := range m.artifactAccounts {
+		route, found := m.artifactAccountRoutes[account.Name]
+		if !found {
+			continue
+		}
+		for _, t := range artifactAccountTypes(account) {
+			if t == artifactType {
+				candidates = append(candidates, route)
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return URLAndPriority{}, false
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority > candidates[j].Priority
+		}
+		return candidates[i].URL < candidates[j].URL
+	})
+	return candidates[0], true
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func artifactAccountForTest(name string, doc string) trackedSpinnakerAccount {
+	return trackedSpinnakerAccount{Name: name, raw: []byte(doc)}
+}
+
+func Test_artifactFallbackConfig_validate(t *testing.T) {
+	assert.NoError(t, artifactFallbackConfig{}.validate())
+	assert.NoError(t, artifactFallbackConfig{Types: []string{"github/*", "http/file"}}.validate())
+	assert.Error(t, artifactFallbackConfig{Types: []string{""}}.validate())
+	assert.Error(t, artifactFallbackConfig{Types: []string{"github/["}}.validate())
+}
+
+func Test_findArtifactRouteByType(t *testing.T) {
+	m := &ClouddriverManager{
+		artifactAccounts: []trackedSpinnakerAccount{
+			artifactAccountForTest("github-low", `{"name":"github-low","types":["github/file"]}`),
+			artifactAccountForTest("github-high", `{"name":"github-high","types":["github/file"]}`),
+			artifactAccountForTest("http", `{"name":"http","types":["http/file"]}`),
+			artifactAccountForTest("unrouted", `{"name":"unrouted","types":["s3/object"]}`),
+			{Name: "no-document"},
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{
+			"github-low":  {URL: "http://low", Priority: 1},
+			"github-high": {URL: "http://high", Priority: 10},
+			"http":        {URL: "http://low", Priority: 1},
+		},
+	}
+	tests := []struct {
+		name         string
+		artifactType string
+		want         URLAndPriority
+		wantFound    bool
+	}{
+		{"highest priority wins", "github/file", URLAndPriority{URL: "http://high", Priority: 10}, true},
+		{"one account", "http/file", URLAndPriority{URL: "http://low", Priority: 1}, true},
+		{"account without a route", "s3/object", URLAndPriority{}, false},
+		{"no account", "gcs/object", URLAndPriority{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := m.findArtifactRouteByType(tt.artifactType)
+			assert.Equal(t, tt.wantFound, found)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_artifactsPut_fallback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	oldManager := clouddriverManager
+	oldFallback := artifactFallback
+	defer func() {
+		clouddriverManager = oldManager
+		artifactFallback = oldFallback
+	}()
+	clouddriverManager = &ClouddriverManager{
+		artifactAccounts: []trackedSpinnakerAccount{
+			artifactAccountForTest("github", `{"name":"github","types":["github/file"]}`),
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{"github": {URL: backend.URL}},
+	}
+
+	tests := []struct {
+		name     string
+		types    []string
+		body     string
+		wantCode int
+	}{
+		{"fallback disabled", nil, `{"artifactAccount":"embedded-github","type":"github/file"}`, http.StatusServiceUnavailable},
+		{"type matches", []string{"github/*"}, `{"artifactAccount":"embedded-github","type":"github/file"}`, http.StatusOK},
+		{"type not configured", []string{"http/*"}, `{"artifactAccount":"embedded-github","type":"github/file"}`, http.StatusServiceUnavailable},
+		{"no account has the type", []string{"*/*"}, `{"artifactAccount":"embedded-s3","type":"s3/object"}`, http.StatusServiceUnavailable},
+		{"no type", []string{"*/*"}, `{"artifactAccount":"embedded-github"}`, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			artifactFallback = artifactFallbackConfig{Types: tt.types}
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "/artifacts/fetch", strings.NewReader(tt.body))
+			(&srv{}).artifactsPut(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+}
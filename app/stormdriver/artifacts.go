@@ -20,9 +20,8 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
-
-	"github.com/OpsMx/go-app-base/httputil"
-	"go.uber.org/zap"
+	"strconv"
+	"strings"
 )
 
 type artifactAccountFetchRequest struct {
@@ -42,41 +41,67 @@ func (*srv) artifactsPut(w http.ResponseWriter, req *http.Request) {
 	data, err := io.ReadAll(req.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		zap.S().Errorw("io.ReadAll", "error", err)
+		requestLogger(req.Context()).Errorw("io.ReadAll", "error", err)
 		return
 	}
 
+	data = aliases.resolveBody(data, aliasedBodyFields, 1)
 	accountName, err := getArtifactAccountName(data)
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		zap.S().Errorw("getArtifactAccountName", "error", err)
+		requestLogger(req.Context()).Errorw("getArtifactAccountName", "error", err)
 		return
 	}
 
 	if accountName == "" {
-		zap.S().Warnw("no account name in request")
+		requestLogger(req.Context()).Warnw("no account name in request")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
+	auditRecordFrom(req.Context()).setAccounts([]string{accountName})
 	url, found := clouddriverManager.findArtifactRoute(accountName)
 	if !found {
-		zap.S().Warnw("no route for artifact account", "accountName", accountName)
+		artifactType := getArtifactType(data)
+		if url, found = artifactFallback.route(artifactType); found {
+			requestLogger(req.Context()).Infow("artifact account routed by type", "accountName", accountName, "artifactType", artifactType)
+		}
+	}
+	if !found {
+		requestLogger(req.Context()).Warnw("no route for artifact account", "accountName", accountName)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
 	target := combineURL(url.URL, req.RequestURI)
-	responseBody, code, responseHeaders, err := fetchWithBody(req.Context(), req.Method, target, url.token, req.Header, data)
+	auditRecordFrom(req.Context()).setClouddriver(url)
+	resp, err := fetchWithBodyStream(withRoute(req.Context(), url), req.Method, target, url.token, req.Header, data)
 	if err != nil {
-		zap.S().Errorw("fetchWithBody", "error", err, "target", target, "method", req.Method, "hasToken", url.token != "")
-		w.WriteHeader(http.StatusServiceUnavailable)
+		requestLogger(req.Context()).Errorw("fetchWithBody", "error", err, "target", target, "method", req.Method, "hasToken", url.token != "")
+		w.WriteHeader(downstreamErrorStatus(err))
 		return
 	}
-	if !httputil.StatusCodeOK(code) {
-		w.Header().Set("content-type", responseHeaders.Get("content-type"))
-		w.WriteHeader(code)
+	defer resp.Body.Close()
+	copyResponseHeaders(routeClassAccount, w.Header(), resp.Header)
+	copyContentEncoding(w.Header(), resp.Header)
+	setArtifactContentType(w, resp.Header.Get("content-type"))
+	// Keep the upstream length, if known, so large artifacts are not
+	// needlessly chunked; otherwise the body is sent chunked as it arrives.
+	if resp.ContentLength >= 0 {
+		w.Header().Set("content-length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := streamBody(w, resp.Body); err != nil {
+		requestLogger(req.Context()).Warnw("streaming artifact", "target", target, "status", resp.StatusCode, "error", err)
+	}
+}
+
+// setArtifactContentType sets the content-type of a fetched artifact.
+// Artifacts are often not JSON, so one without a content-type is sent
+// as opaque bytes rather than with the usual default.
+func setArtifactContentType(w http.ResponseWriter, upstream string) {
+	if strings.TrimSpace(upstream) == "" {
+		w.Header().Set("content-type", "application/octet-stream")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	httputil.CheckedWrite(w, responseBody)
+	setContentType(w, upstream)
 }
@@ -16,7 +16,16 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func Test_getArtifactAccountName(t *testing.T) {
 	type args struct {
@@ -45,3 +54,58 @@ func Test_getArtifactAccountName(t *testing.T) {
 		})
 	}
 }
+
+func Test_artifactsPut(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	tests := []struct {
+		name            string
+		status          int
+		contentType     string
+		body            []byte
+		sized           bool
+		wantContentType string
+	}{
+		{"large chart with length", http.StatusOK, "application/x-gzip", large, true, "application/x-gzip"},
+		{"chunked manifest", http.StatusOK, "application/json", large, false, "application/json"},
+		{"no content type", http.StatusOK, "", []byte("raw"), true, "application/octet-stream"},
+		{"error body passed through", http.StatusNotFound, "application/json", []byte(`{"error":"not found"}`), true, "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				if tt.sized {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				w.WriteHeader(tt.status)
+				if tt.sized {
+					_, _ = w.Write(tt.body)
+					return
+				}
+				for b := tt.body; len(b) > 0; b = b[4096:] {
+					_, _ = w.Write(b[:4096])
+					w.(http.Flusher).Flush()
+				}
+			}))
+			defer backend.Close()
+
+			oldManager := clouddriverManager
+			defer func() { clouddriverManager = oldManager }()
+			clouddriverManager = &ClouddriverManager{
+				artifactAccountRoutes: map[string]URLAndPriority{"charts": {URL: backend.URL}},
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "/artifacts/fetch", strings.NewReader(`{"artifactAccount":"charts"}`))
+			(&srv{}).artifactsPut(w, req)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.wantContentType, w.Header().Get("content-type"))
+			assert.Equal(t, tt.body, w.Body.Bytes())
+			if tt.sized {
+				assert.Equal(t, strconv.Itoa(len(tt.body)), w.Header().Get("content-length"))
+			} else {
+				assert.Empty(t, w.Header().Get("content-length"))
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	auditTypeFile    = "file"
+	auditTypeWebhook = "webhook"
+
+	defaultAuditQueueSize = 1000
+)
+
+// The kinds of audited request.
+const (
+	auditKindOperation     = "operation"
+	auditKindArtifactFetch = "artifactFetch"
+	auditKindCacheRefresh  = "cacheRefresh"
+	auditKindAccountChange = "accountChange"
+	auditKindManifest      = "manifest"
+	auditKindWrite         = "write"
+	auditKindAdmin         = "admin"
+
+	// auditDrainTimeout bounds how long queued records are written for
+	// on shutdown.
+	auditDrainTimeout = 10 * time.Second
+)
+
+// auditConfig enables an audit record for every request which changes
+// something: operations, artifact fetches, cache refreshes, account
+// changes, manifest and other writes, and admin requests.  Type is
+// "file" (JSON lines appended to Path) or "webhook" (a JSON POST of
+// each record to URL).  If Type is empty, nothing is audited.
+type auditConfig struct {
+	Type      string `yaml:"type,omitempty" json:"type,omitempty"`
+	Path      string `yaml:"path,omitempty" json:"path,omitempty"`
+	URL       string `yaml:"url,omitempty" json:"url,omitempty"`
+	QueueSize int    `yaml:"queueSize,omitempty" json:"queueSize,omitempty"`
+}
+
+func (c *auditConfig) applyDefaults() {
+	if c.Type != "" && c.QueueSize == 0 {
+		c.QueueSize = defaultAuditQueueSize
+	}
+}
+
+func (c auditConfig) validate() error {
+	switch c.Type {
+	case "":
+		return nil
+	case auditTypeFile:
+		if c.Path == "" {
+			return fmt.Errorf("path is required for file")
+		}
+	case auditTypeWebhook:
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("url must use http or https")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+	return nil
+}
+
+// auditRecord says who asked for a change, and which clouddriver made
+// it.  Caller is the client's address, and ClientCertificate the
+// subject of its certificate, if it sent one.
+type auditRecord struct {
+	Time              time.Time `json:"time"`
+	Kind              string    `json:"kind"`
+	Method            string    `json:"method"`
+	Path              string    `json:"path"`
+	Caller            string    `json:"caller"`
+	ClientCertificate string    `json:"clientCertificate,omitempty"`
+	User              string    `json:"user,omitempty"`
+	RequestID         string    `json:"requestId,omitempty"`
+	Accounts          []string  `json:"accounts,omitempty"`
+	Clouddriver       string    `json:"clouddriver,omitempty"`
+	StatusCode        int       `json:"statusCode"`
+	TaskID            string    `json:"taskId,omitempty"`
+}
+
+// setAccounts records the accounts a request named.  It may be called
+// on a nil record.
+func (r *auditRecord) setAccounts(accounts []string) {
+	if r != nil {
+		r.Accounts = accounts
+	}
+}
+
+// setClouddriver records the clouddriver a request was sent to.  It may
+// be called on a nil record.
+func (r *auditRecord) setClouddriver(route URLAndPriority) {
+	if r == nil {
+		return
+	}
+	r.Clouddriver = clouddriverManager.clouddriverNameForRoute(route)
+	if r.Clouddriver == "" {
+		r.Clouddriver = route.URL
+	}
+}
+
+// setTaskID records the task a clouddriver started.  It may be called
+// on a nil record.
+func (r *auditRecord) setTaskID(id string) {
+	if r != nil {
+		r.TaskID = id
+	}
+}
+
+type auditRecordKey struct{}
+
+// auditRecordFrom returns the audit record for the request ctx belongs
+// to, or nil if it is not audited.
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	r, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return r
+}
+
+var auditRecordsDropped = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "audit_records_dropped_total",
+	Help:      "Audit records dropped because the queue was full or writing failed.",
+})
+
+// auditLog queues records and writes them in the background, so a slow
+// sink never delays an operation.  A nil auditLog records nothing.
+type auditLog struct {
+	sync.Mutex
+	sink   eventSink
+	queue  chan auditRecord
+	closed bool
+	done   chan struct{}
+}
+
+var audit *auditLog
+
+func makeAuditLog(conf auditConfig) (*auditLog, error) {
+	var sink eventSink
+	switch conf.Type {
+	case auditTypeFile:
+		f, err := os.OpenFile(conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		sink = &fileSink{f: f}
+	case auditTypeWebhook:
+		sink = &webhookSink{url: conf.URL}
+	default:
+		return nil, nil
+	}
+	return &auditLog{
+		sink:  sink,
+		queue: make(chan auditRecord, conf.QueueSize),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// audited wraps a handler so each request it handles is recorded once
+// it has been answered.  The handler adds what it learns, such as the
+// clouddriver used, to the record from auditRecordFrom().
+func (a *auditLog) audited(kind string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if a == nil {
+			next(w, req)
+			return
+		}
+		record := &auditRecord{
+			Time:      time.Now().UTC(),
+			Kind:      kind,
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Caller:    req.RemoteAddr,
+			User:      req.Header.Get("x-spinnaker-user"),
+			RequestID: req.Header.Get(requestIDHeader),
+		}
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			record.ClientCertificate = req.TLS.PeerCertificates[0].Subject.String()
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, req.WithContext(context.WithValue(req.Context(), auditRecordKey{}, record)))
+		record.StatusCode = rec.statusCode
+		if record.StatusCode == 0 {
+			record.StatusCode = http.StatusOK
+		}
+		a.emit(*record)
+	}
+}
+
+func (a *auditLog) emit(r auditRecord) {
+	a.Lock()
+	defer a.Unlock()
+	if a.closed {
+		auditRecordsDropped.Inc()
+		zap.S().Warnw("audit log closed, record dropped", "kind", r.Kind, "path", r.Path, "user", r.User)
+		return
+	}
+	select {
+	case a.queue <- r:
+	default:
+		auditRecordsDropped.Inc()
+		zap.S().Warnw("audit queue full, record dropped", "kind", r.Kind, "path", r.Path, "user", r.User)
+	}
+}
+
+// run writes queued records until the log is closed and every record
+// queued before then has been written.
+func (a *auditLog) run() {
+	defer close(a.done)
+	for r := range a.queue {
+		a.write(r)
+	}
+}
+
+func (a *auditLog) write(r auditRecord) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		auditRecordsDropped.Inc()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.sink.publish(ctx, payload); err != nil {
+		auditRecordsDropped.Inc()
+		zap.S().Warnw("unable to write audit record", "error", err)
+	}
+}
+
+// close stops queueing records, and waits up to timeout for those
+// already queued to be written.  It is called once the server has
+// stopped answering requests, so none of their records are lost.
+func (a *auditLog) close(timeout time.Duration) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.Unlock()
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		zap.S().Warnw("audit records still unwritten at exit", "queued", len(a.queue))
+	}
+}
+
+// fileSink appends each payload to a file as one line.
+type fileSink struct {
+	sync.Mutex
+	f *os.File
+}
+
+func (s *fileSink) publish(_ context.Context, payload []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.f.Write(append(payload, '\n'))
+	return err
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_auditConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  auditConfig
+		wantErr bool
+	}{
+		{"disabled", auditConfig{}, false},
+		{"file", auditConfig{Type: auditTypeFile, Path: "/var/log/audit"}, false},
+		{"file without path", auditConfig{Type: auditTypeFile}, true},
+		{"webhook", auditConfig{Type: auditTypeWebhook, URL: "https://audit.example.com/records"}, false},
+		{"webhook without scheme", auditConfig{Type: auditTypeWebhook, URL: "audit.example.com"}, true},
+		{"unknown type", auditConfig{Type: "syslog"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func readAuditRecords(t *testing.T, path string, count int) []auditRecord {
+	var lines []string
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false
+		}
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+		return len(lines) == count && lines[0] != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	ret := []auditRecord{}
+	for _, line := range lines {
+		var r auditRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &r))
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func Test_auditLog_operations(t *testing.T) {
+	backend := hedgeTestServer(t, 0, http.StatusOK, `{"id":"task-1","resourceUri":"/task/task-1"}`)
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		state:              map[string]*trackedClouddriver{"config:east": {Name: "east", URL: backend.URL}},
+		cloudAccountRoutes: map[string]URLAndPriority{"prod": {URL: backend.URL}},
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := makeAuditLog(auditConfig{Type: auditTypeFile, Path: path, QueueSize: 10})
+	require.NoError(t, err)
+	go log.run()
+	defer log.close(time.Second)
+
+	s := &srv{}
+	r := mux.NewRouter()
+	r.HandleFunc("/kubernetes/ops", log.audited(auditKindOperation, s.cloudOpsPost()))
+	r.PathPrefix("/cache").HandlerFunc(log.audited(auditKindCacheRefresh, handleCachePost))
+
+	req := httptest.NewRequest(http.MethodPost, "/kubernetes/ops", strings.NewReader(`[{"deployManifest":{"account":"prod"}}]`))
+	req.Header.Set("x-spinnaker-user", "alice")
+	req.Header.Set(requestIDHeader, "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodPost, "/cache/kubernetes/manifest", strings.NewReader(`{"account":"staging"}`))
+	req.Header.Set("x-spinnaker-user", "bob")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	records := readAuditRecords(t, path, 2)
+	assert.Equal(t, auditKindOperation, records[0].Kind)
+	assert.Equal(t, "alice", records[0].User)
+	assert.Equal(t, "req-1", records[0].RequestID)
+	assert.Equal(t, []string{"prod"}, records[0].Accounts)
+	assert.Equal(t, "east", records[0].Clouddriver)
+	assert.Equal(t, http.StatusOK, records[0].StatusCode)
+	assert.Equal(t, "task-1", records[0].TaskID)
+	assert.NotEmpty(t, records[0].Caller)
+
+	assert.Equal(t, auditKindCacheRefresh, records[1].Kind)
+	assert.Equal(t, "bob", records[1].User)
+	assert.Equal(t, []string{"staging"}, records[1].Accounts)
+	assert.Empty(t, records[1].Clouddriver)
+	assert.Equal(t, http.StatusServiceUnavailable, records[1].StatusCode)
+}
+
+func Test_auditLog_nil(t *testing.T) {
+	var log *auditLog
+	called := false
+	h := log.audited(auditKindOperation, func(w http.ResponseWriter, req *http.Request) {
+		called = true
+		assert.Nil(t, auditRecordFrom(req.Context()))
+		auditRecordFrom(req.Context()).setAccounts([]string{"prod"})
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/kubernetes/ops", nil))
+	assert.True(t, called)
+}
+
+func Test_auditLog_close(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := makeAuditLog(auditConfig{Type: auditTypeFile, Path: path, QueueSize: 10})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		log.emit(auditRecord{Kind: auditKindOperation})
+	}
+	go log.run()
+	log.close(5 * time.Second)
+	log.emit(auditRecord{Kind: auditKindWrite})
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"), "queued records are written before close returns")
+}
+
+func Test_auditLog_writeRoutes(t *testing.T) {
+	backend := hedgeTestServer(t, 0, http.StatusOK, `{}`)
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		state:              map[string]*trackedClouddriver{"config:east": {Name: "east", URL: backend.URL}},
+		cloudAccountRoutes: map[string]URLAndPriority{"prod": {URL: backend.URL}},
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := makeAuditLog(auditConfig{Type: auditTypeFile, Path: path, QueueSize: 10})
+	require.NoError(t, err)
+	oldAudit := audit
+	defer func() { audit = oldAudit }()
+	audit = log
+	go log.run()
+	defer log.close(time.Second)
+
+	s := &srv{}
+	r := mux.NewRouter()
+	s.routes(r)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/manifests/prod/default/deployment%20web", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/unknown/path", strings.NewReader(`{"account":"prod"}`)))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/serverGroups/prod/web-v001", nil))
+
+	records := readAuditRecords(t, path, 3)
+	assert.Equal(t, auditKindManifest, records[0].Kind)
+	assert.Equal(t, []string{"prod"}, records[0].Accounts)
+	assert.Equal(t, "east", records[0].Clouddriver)
+	assert.Equal(t, auditKindWrite, records[1].Kind)
+	assert.Equal(t, []string{"prod"}, records[1].Accounts)
+	assert.Equal(t, "east", records[1].Clouddriver)
+	assert.Equal(t, auditKindWrite, records[2].Kind, "account-routed deletes are audited")
+	assert.Equal(t, []string{"prod"}, records[2].Accounts)
+	assert.Equal(t, "east", records[2].Clouddriver)
+}
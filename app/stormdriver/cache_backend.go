@@ -0,0 +1,317 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	cacheTypeMemory = "memory"
+	cacheTypeRedis  = "redis"
+
+	defaultRedisKeyPrefix = "stormdriver:"
+	redisTimeout          = 2 * time.Second
+	redisMaxIdle          = 8
+)
+
+// cacheConfig selects where the response and search caches keep their
+// entries.  With "memory" (the default), each replica has its own; with
+// "redis", replicas behind a load balancer share them.
+type cacheConfig struct {
+	Type      string `yaml:"type,omitempty" json:"type,omitempty"`
+	Address   string `yaml:"address,omitempty" json:"address,omitempty"`
+	Password  string `yaml:"password,omitempty" json:"password,omitempty"`
+	DB        int    `yaml:"db,omitempty" json:"db,omitempty"`
+	KeyPrefix string `yaml:"keyPrefix,omitempty" json:"keyPrefix,omitempty"`
+}
+
+func (c *cacheConfig) applyDefaults() {
+	if c.Type == "" {
+		c.Type = cacheTypeMemory
+	}
+	if c.Type == cacheTypeRedis && c.KeyPrefix == "" {
+		c.KeyPrefix = defaultRedisKeyPrefix
+	}
+}
+
+func (c cacheConfig) validate() error {
+	switch c.Type {
+	case cacheTypeMemory:
+		return nil
+	case cacheTypeRedis:
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("address: %v", err)
+		}
+		if c.DB < 0 {
+			return fmt.Errorf("db cannot be negative")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+}
+
+// Cache stores values which expire.  Errors mean the cache could not
+// be used, and callers should carry on as if the value was not found.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// makeCache returns the backend to use for one cache.  Memory caches
+// hold at most maxEntries.  namespace keeps the keys of different
+// caches apart when they share a Redis server.
+func makeCache(conf cacheConfig, namespace string, maxEntries int) Cache {
+	if conf.Type == cacheTypeRedis {
+		return &redisCache{
+			address:  conf.Address,
+			password: conf.Password,
+			db:       conf.DB,
+			prefix:   conf.KeyPrefix + namespace + ":",
+		}
+	}
+	return makeMemoryCache(maxEntries)
+}
+
+// makeSharedCache returns the backend for a cache which keeps its own
+// entries in memory, and needs a backend only to share them between
+// replicas.  It returns nil unless a shared backend is configured.
+func makeSharedCache(conf cacheConfig, namespace string) Cache {
+	if conf.Type != cacheTypeRedis {
+		return nil
+	}
+	return makeCache(conf, namespace, 0)
+}
+
+type memoryCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryCache is a Cache held in this process.  When full, expired
+// entries are dropped, and if it is still full, new entries are not
+// stored.
+type memoryCache struct {
+	sync.Mutex
+	maxEntries int
+	entries    map[string]memoryCacheEntry
+	now        func() time.Time
+}
+
+func makeMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		entries:    map[string]memoryCacheEntry{},
+		now:        time.Now,
+	}
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	e, found := c.entries[key]
+	if !found || !c.now().Before(e.expires) {
+		return nil, false, nil
+	}
+	return e.value, true, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if _, found := c.entries[key]; !found && len(c.entries) >= c.maxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			return nil
+		}
+	}
+	c.entries[key] = memoryCacheEntry{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+var errRedisNil = errors.New("redis: nil")
+
+// redisCache is a Cache kept in Redis.  Like the NATS event sink, it
+// speaks the protocol directly, as only GET and SET are needed.
+// Connections are made when none is idle, without holding the lock,
+// and up to redisMaxIdle are kept for reuse.  A connection which fails
+// is closed rather than reused.
+type redisCache struct {
+	sync.Mutex
+	address  string
+	password string
+	db       int
+	prefix   string
+	idle     []*redisConn
+}
+
+// redisConn is one connection to Redis, used by one request at a time.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.do(ctx, "GET", c.prefix+key)
+	if err == errRedisNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	millis := ttl.Milliseconds()
+	if millis < 1 {
+		millis = 1
+	}
+	_, err := c.do(ctx, "SET", c.prefix+key, string(value), "PX", strconv.FormatInt(millis, 10))
+	return err
+}
+
+func (c *redisCache) connect(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if c.password != "" {
+		if _, err := rc.command("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth: %v", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("select: %v", err)
+		}
+	}
+	return rc, nil
+}
+
+// get returns an idle connection, or makes a new one.
+func (c *redisCache) get(ctx context.Context) (*redisConn, error) {
+	c.Lock()
+	if n := len(c.idle); n > 0 {
+		rc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.Unlock()
+		return rc, nil
+	}
+	c.Unlock()
+	return c.connect(ctx)
+}
+
+// put keeps rc for reuse, unless enough connections are idle already.
+func (c *redisCache) put(rc *redisConn) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.idle) >= redisMaxIdle {
+		rc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, rc)
+}
+
+func (c *redisCache) do(ctx context.Context, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	rc, err := c.get(ctx)
+	if err != nil {
+		zap.S().Warnw("unable to connect to redis", "address", c.address, "error", err)
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	_ = rc.conn.SetDeadline(deadline)
+	value, err := rc.command(args...)
+	if err != nil && err != errRedisNil {
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return value, err
+}
+
+// command sends one command and reads its reply.
+func (c *redisConn) command(args ...string) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads a simple string, error, integer, or bulk string
+// reply.  A nil bulk string returns errRedisNil.
+func readRedisReply(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cacheConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       cacheConfig
+		wantErr bool
+	}{
+		{"memory", cacheConfig{Type: cacheTypeMemory}, false},
+		{"redis", cacheConfig{Type: cacheTypeRedis, Address: "redis:6379"}, false},
+		{"redis without port", cacheConfig{Type: cacheTypeRedis, Address: "redis"}, true},
+		{"negative db", cacheConfig{Type: cacheTypeRedis, Address: "redis:6379", DB: -1}, true},
+		{"unknown", cacheConfig{Type: "memcached"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_memoryCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := makeMemoryCache(1)
+	c.now = func() time.Time { return now }
+
+	require.NoError(t, c.Set(ctx, "a", []byte("1"), time.Second))
+	got, found, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "1", string(got))
+
+	// full, so b is not stored until a expires.
+	require.NoError(t, c.Set(ctx, "b", []byte("2"), time.Second))
+	_, found, _ = c.Get(ctx, "b")
+	assert.False(t, found)
+
+	now = now.Add(2 * time.Second)
+	_, found, _ = c.Get(ctx, "a")
+	assert.False(t, found, "expired")
+	require.NoError(t, c.Set(ctx, "b", []byte("2"), time.Second))
+	_, found, _ = c.Get(ctx, "b")
+	assert.True(t, found)
+}
+
+func Test_readRedisReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    string
+		wantErr error
+	}{
+		{"simple string", "+OK\r\n", "OK", nil},
+		{"integer", ":42\r\n", "42", nil},
+		{"bulk string", "$5\r\nhe\r\no\r\n", "he\r\no", nil},
+		{"empty bulk string", "$0\r\n\r\n", "", nil},
+		{"nil", "$-1\r\n", "", errRedisNil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(tt.reply)))
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+
+	_, err := readRedisReply(bufio.NewReader(strings.NewReader("-WRONGPASS invalid password\r\n")))
+	assert.EqualError(t, err, "redis: WRONGPASS invalid password")
+}
+
+// runFakeRedis serves GET, SET, AUTH, and SELECT, ignoring expiry, and
+// returns its address and the commands it received.
+func runFakeRedis(t *testing.T) (string, func() []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var lock sync.Mutex
+	data := map[string]string{}
+	commands := []string{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := []string{}
+					for i := 0; i < count; i++ {
+						line, _ = r.ReadString('\n')
+						n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+						buf := make([]byte, n+2)
+						if _, err := io.ReadFull(r, buf); err != nil {
+							return
+						}
+						args = append(args, string(buf[:n]))
+					}
+					lock.Lock()
+					commands = append(commands, args[0])
+					switch args[0] {
+					case "GET":
+						if v, found := data[args[1]]; found {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+						} else {
+							fmt.Fprint(conn, "$-1\r\n")
+						}
+					case "SET":
+						data[args[1]] = args[2]
+						fmt.Fprint(conn, "+OK\r\n")
+					default:
+						fmt.Fprint(conn, "+OK\r\n")
+					}
+					lock.Unlock()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, commands...)
+	}
+}
+
+func Test_redisCache(t *testing.T) {
+	addr, commands := runFakeRedis(t)
+	ctx := context.Background()
+	c := makeCache(cacheConfig{Type: cacheTypeRedis, Address: addr, Password: "secret", DB: 2, KeyPrefix: "sd:"}, "response", 0)
+
+	_, found, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	require.NoError(t, c.Set(ctx, "a", []byte("hello\r\nworld"), time.Minute))
+	got, found, err := c.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "hello\r\nworld", string(got))
+	assert.Equal(t, []string{"AUTH", "SELECT", "GET", "SET", "GET"}, commands())
+
+	// another replica sharing the server sees the same value.
+	other := makeCache(cacheConfig{Type: cacheTypeRedis, Address: addr, KeyPrefix: "sd:"}, "response", 0)
+	_, found, err = other.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, found)
+}
+
+func Test_redisCache_concurrent(t *testing.T) {
+	addr, _ := runFakeRedis(t)
+	c := makeCache(cacheConfig{Type: cacheTypeRedis, Address: addr}, "response", 0).(*redisCache)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2*redisMaxIdle; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			assert.NoError(t, c.Set(context.Background(), key, []byte(key), time.Minute))
+			got, found, err := c.Get(context.Background(), key)
+			assert.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, key, string(got))
+		}(i)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, len(c.idle), redisMaxIdle)
+	assert.NotEmpty(t, c.idle, "connections are reused")
+}
+
+func Test_redisCache_unavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	c := makeCache(cacheConfig{Type: cacheTypeRedis, Address: addr}, "response", 0)
+	_, found, err := c.Get(context.Background(), "a")
+	assert.Error(t, err)
+	assert.False(t, found)
+}
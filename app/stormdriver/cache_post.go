@@ -22,7 +22,6 @@ import (
 	"net/http"
 
 	"github.com/OpsMx/go-app-base/httputil"
-	"go.uber.org/zap"
 )
 
 func handleCachePost(w http.ResponseWriter, req *http.Request) {
@@ -31,36 +30,39 @@ func handleCachePost(w http.ResponseWriter, req *http.Request) {
 	data, err := io.ReadAll(req.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		zap.S().Errorw("NewRequestWithContext", "error", err)
+		requestLogger(req.Context()).Errorw("NewRequestWithContext", "error", err)
 		return
 	}
 
+	data = aliases.resolveBody(data, aliasedBodyFields, 1)
 	var item AccountStruct
 	err = json.Unmarshal(data, &item)
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		zap.S().Errorw("Unmarshal", "error", err)
+		requestLogger(req.Context()).Errorw("Unmarshal", "error", err)
 		return
 	}
 
 	accountName := item.AccountName()
 	if accountName == "" {
-		zap.S().Warn("no account or credentials found")
+		requestLogger(req.Context()).Warn("no account or credentials found")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
+	auditRecordFrom(req.Context()).setAccounts([]string{accountName})
 	url, found := clouddriverManager.findCloudRoute(accountName)
 	if !found {
-		zap.S().Warnw("no route for account", "account", accountName)
+		requestLogger(req.Context()).Warnw("no route for account", "account", accountName)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
 	target := combineURL(url.URL, req.RequestURI)
-	responseBody, code, _, err := fetchWithBody(req.Context(), req.Method, target, url.token, req.Header, data)
+	auditRecordFrom(req.Context()).setClouddriver(url)
+	responseBody, code, _, err := fetchWithBody(withRoute(req.Context(), url), req.Method, target, url.token, req.Header, data)
 	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		zap.S().Errorw("fetchWithBody", "method", req.Method, "target", target, "hasToken", url.token != "", "error", err)
+		w.WriteHeader(downstreamErrorStatus(err))
+		requestLogger(req.Context()).Errorw("fetchWithBody", "method", req.Method, "target", target, "hasToken", url.token != "", "error", err)
 		return
 	}
 	if !httputil.StatusCodeOK(code) {
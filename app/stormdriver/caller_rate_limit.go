@@ -0,0 +1,185 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+const (
+	callerKeyUser = "user"
+	callerKeyIP   = "ip"
+
+	// callerBucketIdleTime is how long a caller's bucket is kept after
+	// its last request, unless it takes longer than this to refill.
+	callerBucketIdleTime = 10 * time.Minute
+)
+
+// callerRateLimitConfig limits the rate of requests each caller may
+// make.  Callers are identified by the x-spinnaker-user header, or by
+// the client's address if Key is "ip" or the header is missing.  If
+// RequestsPerSecond is 0, callers are not limited.  Burst defaults to
+// RequestsPerSecond, rounded up.
+type callerRateLimitConfig struct {
+	Key               string   `yaml:"key,omitempty" json:"key,omitempty"`
+	RequestsPerSecond float64  `yaml:"requestsPerSecond,omitempty" json:"requestsPerSecond,omitempty"`
+	Burst             int      `yaml:"burst,omitempty" json:"burst,omitempty"`
+	Exempt            []string `yaml:"exempt,omitempty" json:"exempt,omitempty"`
+}
+
+func (c *callerRateLimitConfig) applyDefaults() {
+	if c.RequestsPerSecond == 0 {
+		return
+	}
+	if c.Key == "" {
+		c.Key = callerKeyUser
+	}
+	if c.Burst == 0 {
+		c.Burst = int(math.Ceil(c.RequestsPerSecond))
+	}
+}
+
+func (c *callerRateLimitConfig) validate() error {
+	if c.RequestsPerSecond == 0 {
+		return nil
+	}
+	if c.RequestsPerSecond < 0 {
+		return fmt.Errorf("requestsPerSecond cannot be negative")
+	}
+	if c.Key != callerKeyUser && c.Key != callerKeyIP {
+		return fmt.Errorf("key must be %s or %s", callerKeyUser, callerKeyIP)
+	}
+	if c.Burst < 1 {
+		return fmt.Errorf("burst must be positive")
+	}
+	return nil
+}
+
+var callerRateLimited = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "caller_rate_limited_total",
+	Help:      "The number of requests rejected because the caller exceeded its rate limit.",
+})
+
+type callerBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// callerRateLimiter holds a token bucket for each caller seen recently.
+// A nil callerRateLimiter does not limit anyone.
+type callerRateLimiter struct {
+	sync.Mutex
+	conf      callerRateLimitConfig
+	exempt    map[string]bool
+	idleTime  time.Duration
+	buckets   map[string]*callerBucket
+	lastSweep time.Time
+}
+
+func makeCallerRateLimiter(conf callerRateLimitConfig) *callerRateLimiter {
+	if conf.RequestsPerSecond == 0 {
+		return nil
+	}
+	l := &callerRateLimiter{
+		conf:     conf,
+		exempt:   map[string]bool{},
+		idleTime: callerBucketIdleTime,
+		buckets:  map[string]*callerBucket{},
+	}
+	// a bucket may only be forgotten once it would have refilled.
+	refill := time.Duration(float64(conf.Burst) / conf.RequestsPerSecond * float64(time.Second))
+	if refill > l.idleTime {
+		l.idleTime = refill
+	}
+	for _, caller := range conf.Exempt {
+		l.exempt[caller] = true
+	}
+	return l
+}
+
+func (l *callerRateLimiter) callerKey(req *http.Request) string {
+	if l.conf.Key == callerKeyUser {
+		if user := req.Header.Get("x-spinnaker-user"); user != "" {
+			return user
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// reserve takes a token from the caller's bucket, returning 0 if one
+// was available, or how long the caller must wait for one.
+func (l *callerRateLimiter) reserve(caller string, now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.lastSweep) > l.idleTime {
+		for key, b := range l.buckets {
+			if now.Sub(b.lastSeen) > l.idleTime {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, found := l.buckets[caller]
+	if !found {
+		b = &callerBucket{limiter: rate.NewLimiter(rate.Limit(l.conf.RequestsPerSecond), l.conf.Burst)}
+		l.buckets[caller] = b
+	}
+	b.lastSeen = now
+	reservation := b.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+func (l *callerRateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l == nil || admissionExempt(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		caller := l.callerKey(req)
+		if l.exempt[caller] {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if delay := l.reserve(caller, time.Now()); delay > 0 {
+			callerRateLimited.Inc()
+			requestLogger(req.Context()).Warnw("caller rate limit exceeded", "caller", caller, "method", req.Method, "uri", req.RequestURI)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
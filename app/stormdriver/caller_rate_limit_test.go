@@ -0,0 +1,111 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_callerRateLimitConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  callerRateLimitConfig
+		wantErr bool
+	}{
+		{"disabled", callerRateLimitConfig{}, false},
+		{"by user", callerRateLimitConfig{Key: callerKeyUser, RequestsPerSecond: 5, Burst: 10}, false},
+		{"by ip", callerRateLimitConfig{Key: callerKeyIP, RequestsPerSecond: 0.5, Burst: 1}, false},
+		{"negative rate", callerRateLimitConfig{Key: callerKeyUser, RequestsPerSecond: -1, Burst: 1}, true},
+		{"unknown key", callerRateLimitConfig{Key: "account", RequestsPerSecond: 1, Burst: 1}, true},
+		{"no burst", callerRateLimitConfig{Key: callerKeyUser, RequestsPerSecond: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_callerRateLimiter_callerKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/applications", nil)
+	req.RemoteAddr = "10.1.2.3:4567"
+	byUser := makeCallerRateLimiter(callerRateLimitConfig{Key: callerKeyUser, RequestsPerSecond: 1, Burst: 1})
+	byIP := makeCallerRateLimiter(callerRateLimitConfig{Key: callerKeyIP, RequestsPerSecond: 1, Burst: 1})
+
+	assert.Equal(t, "10.1.2.3", byUser.callerKey(req), "falls back to the address without a user")
+	req.Header.Set("x-spinnaker-user", "alice")
+	assert.Equal(t, "alice", byUser.callerKey(req))
+	assert.Equal(t, "10.1.2.3", byIP.callerKey(req))
+}
+
+func Test_callerRateLimiter_reserve(t *testing.T) {
+	l := makeCallerRateLimiter(callerRateLimitConfig{Key: callerKeyUser, RequestsPerSecond: 1, Burst: 2})
+	now := time.Now()
+
+	assert.Zero(t, l.reserve("alice", now))
+	assert.Zero(t, l.reserve("alice", now))
+	assert.Equal(t, time.Second, l.reserve("alice", now))
+	assert.Equal(t, time.Second, l.reserve("alice", now), "rejected requests do not use tokens")
+	assert.Zero(t, l.reserve("bob", now), "callers have their own buckets")
+	assert.Zero(t, l.reserve("alice", now.Add(time.Second)))
+
+	l.reserve("bob", now.Add(l.idleTime+2*time.Second))
+	assert.NotContains(t, l.buckets, "alice", "idle buckets are forgotten")
+	assert.Contains(t, l.buckets, "bob")
+}
+
+func Test_callerRateLimiter_middleware(t *testing.T) {
+	l := makeCallerRateLimiter(callerRateLimitConfig{Key: callerKeyUser, RequestsPerSecond: 0.5, Burst: 1, Exempt: []string{"pipelines"}})
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h := l.middleware(next)
+	send := func(path string, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("x-spinnaker-user", user)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, send("/applications", "alice").Code)
+	w := send("/applications", "alice")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusNoContent, send("/health", "alice").Code)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusNoContent, send("/applications", "pipelines").Code)
+	}
+
+	var disabled *callerRateLimiter
+	assert.Nil(t, makeCallerRateLimiter(callerRateLimitConfig{}))
+	for i := 0; i < 3; i++ {
+		w = httptest.NewRecorder()
+		disabled.middleware(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/applications", nil))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	}
+}
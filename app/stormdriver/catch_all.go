@@ -0,0 +1,177 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/gorilla/mux"
+)
+
+// maxAccountSearchDepth is how deeply nested in a request body account
+// fields are looked for.
+const maxAccountSearchDepth = 4
+
+// bodyAccountNames returns the accounts named in a JSON body's
+// "account" fields, or "credentials" where there is no "account",
+// in the body itself or in the objects and lists it holds.
+func bodyAccountNames(data []byte) []string {
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return []string{}
+	}
+	found := map[string]bool{}
+	collectAccountNames(body, maxAccountSearchDepth, found)
+	ret := keysForMap(found)
+	sort.Strings(ret)
+	return ret
+}
+
+func collectAccountNames(v interface{}, depth int, found map[string]bool) {
+	if depth == 0 {
+		return
+	}
+	switch item := v.(type) {
+	case []interface{}:
+		for _, element := range item {
+			collectAccountNames(element, depth-1, found)
+		}
+	case map[string]interface{}:
+		a := AccountStruct{}
+		a.Account, _ = item["account"].(string)
+		a.Credentials, _ = item["credentials"].(string)
+		if name := a.AccountName(); name != "" {
+			found[name] = true
+		}
+		for _, element := range item {
+			collectAccountNames(element, depth-1, found)
+		}
+	}
+}
+
+// forwardByAccount handles POST, PUT, PATCH, and DELETE requests to
+// endpoints Stormdriver does not know, sending them to the clouddriver
+// owning the accounts in the query or the body.  Requests naming no
+// known account are sent to the only healthy clouddriver if there is
+// just one, and otherwise rejected; they are never sent to every
+// clouddriver, as they may not be safe to repeat.  Requests naming
+// accounts on more than one clouddriver are rejected, as Stormdriver
+// does not know how to split them.
+func (s *srv) forwardByAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			requestLogger(req.Context()).Errorw("io.ReadAll", "error", err)
+			return
+		}
+		req.Body.Close()
+
+		data = aliases.resolveBody(data, aliasedBodyFields, maxAccountSearchDepth)
+		accountNames := bodyAccountNames(data)
+		query := req.URL.Query()
+		for _, key := range aliasedQueryParameters {
+			accountNames = append(accountNames, query[key]...)
+		}
+
+		foundURLs := map[string]URLAndPriority{}
+		for _, name := range accountNames {
+			if url, found := clouddriverManager.findCloudRoute(name); found {
+				foundURLs[url.key()] = url
+			}
+		}
+		if len(foundURLs) == 0 {
+			if healthy := clouddriverManager.getHealthyClouddriverURLs(); len(healthy) == 1 {
+				foundURLs[healthy[0].key()] = healthy[0]
+			}
+		}
+		if len(foundURLs) == 0 {
+			logAndFail(w, req, data)
+			return
+		}
+
+		auditRecordFrom(req.Context()).setAccounts(accountNames)
+		if denied := s.permissions.checkWrite(req, accountNames); denied != "" {
+			httputil.SetError(w, http.StatusForbidden, "access denied to account "+denied)
+			return
+		}
+		if len(foundURLs) != 1 {
+			requestLogger(req.Context()).Warnw("multiple routes found", "accountNames", accountNames)
+			httputil.SetError(w, http.StatusBadRequest, "accounts are on more than one clouddriver: "+strings.Join(accountNames, ","))
+			return
+		}
+
+		// will contain exactly one element due to checking len(foundURLs) above
+		url := foundURLs[keysForMap(foundURLs)[0]]
+		auditRecordFrom(req.Context()).setClouddriver(url)
+		forwardWithBody(w, req, url, data)
+	}
+}
+
+// accountRoutedWrite sends a request which changes something to the
+// clouddriver owning the account in path variable v.
+func (s *srv) accountRoutedWrite(v string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			requestLogger(req.Context()).Errorw("io.ReadAll", "error", err)
+			return
+		}
+		req.Body.Close()
+
+		accountName := mux.Vars(req)[v]
+		auditRecordFrom(req.Context()).setAccounts([]string{accountName})
+		if denied := s.permissions.checkWrite(req, []string{accountName}); denied != "" {
+			httputil.SetError(w, http.StatusForbidden, "access denied to account "+denied)
+			return
+		}
+		url, found := clouddriverManager.findCloudRoute(accountName)
+		if !found {
+			requestLogger(req.Context()).Warnw("no route", "accountName", accountName)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		auditRecordFrom(req.Context()).setClouddriver(url)
+		forwardWithBody(w, req, url, data)
+	}
+}
+
+// forwardWithBody sends the request, with body, to the clouddriver at
+// url, and streams the response back.
+func forwardWithBody(w http.ResponseWriter, req *http.Request, url URLAndPriority, body []byte) {
+	target := combineURL(url.URL, req.RequestURI)
+	resp, err := fetchWithBodyStream(withRoute(req.Context(), url), req.Method, target, url.token, req.Header, body)
+	if err != nil {
+		requestLogger(req.Context()).Errorw("fetchWithBody", "error", err, "target", target, "method", req.Method, "hasToken", url.token != "")
+		w.WriteHeader(downstreamErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+	copyResponseHeaders(routeClassProxy, w.Header(), resp.Header)
+	copyContentEncoding(w.Header(), resp.Header)
+	setContentType(w, resp.Header.Get("content-type"))
+	w.WriteHeader(resp.StatusCode)
+	if _, err := streamBody(w, resp.Body); err != nil {
+		requestLogger(req.Context()).Warnw("streaming response", "target", target, "error", err)
+	}
+}
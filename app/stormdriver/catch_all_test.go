@@ -0,0 +1,159 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_bodyAccountNames(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"not json", `account=a`, []string{}},
+		{"no accounts", `{"name":"x"}`, []string{}},
+		{"account", `{"account":"a","credentials":"b"}`, []string{"a"}},
+		{"credentials", `{"credentials":"b"}`, []string{"b"}},
+		{"operation list", `[{"deployManifest":{"account":"a"}},{"resizeServerGroup":{"credentials":"b"}}]`, []string{"a", "b"}},
+		{"nested", `{"job":{"stages":[{"account":"a"},{"account":"a"}]}}`, []string{"a"}},
+		{"too deep", `{"a":{"b":{"c":{"d":{"account":"a"}}}}}`, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, bodyAccountNames([]byte(tt.body)))
+		})
+	}
+}
+
+func Test_forwardByAccount(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(name + " " + r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a := backend("a")
+	b := backend("b")
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+
+	tests := []struct {
+		name     string
+		routes   map[string]URLAndPriority
+		method   string
+		uri      string
+		body     string
+		wantCode int
+		want     string
+	}{
+		{
+			"routed by body",
+			map[string]URLAndPriority{"a1": {URL: a.URL}, "b1": {URL: b.URL}},
+			http.MethodPost, "/new/endpoint", `{"account":"b1"}`,
+			http.StatusAccepted, `b POST /new/endpoint {"account":"b1"}`,
+		},
+		{
+			"routed by query",
+			map[string]URLAndPriority{"a1": {URL: a.URL}, "b1": {URL: b.URL}},
+			http.MethodPut, "/new/endpoint?account=a1", `{}`,
+			http.StatusAccepted, `a PUT /new/endpoint?account=a1 {}`,
+		},
+		{
+			"only one clouddriver",
+			map[string]URLAndPriority{"a1": {URL: a.URL}},
+			http.MethodPost, "/new/endpoint", `{}`,
+			http.StatusAccepted, `a POST /new/endpoint {}`,
+		},
+		{
+			"delete routed by query",
+			map[string]URLAndPriority{"a1": {URL: a.URL}, "b1": {URL: b.URL}},
+			http.MethodDelete, "/new/endpoint?account=b1", ``,
+			http.StatusAccepted, `b DELETE /new/endpoint?account=b1 `,
+		},
+		{
+			"patch routed by body",
+			map[string]URLAndPriority{"a1": {URL: a.URL}, "b1": {URL: b.URL}},
+			http.MethodPatch, "/new/endpoint", `{"account":"a1"}`,
+			http.StatusAccepted, `a PATCH /new/endpoint {"account":"a1"}`,
+		},
+		{
+			"no route",
+			map[string]URLAndPriority{"a1": {URL: a.URL}, "b1": {URL: b.URL}},
+			http.MethodPost, "/new/endpoint", `{"account":"c1"}`,
+			http.StatusServiceUnavailable, ``,
+		},
+		{
+			"accounts on more than one clouddriver",
+			map[string]URLAndPriority{"a1": {URL: a.URL}, "b1": {URL: b.URL}},
+			http.MethodPost, "/new/endpoint?account=a1", `{"account":"b1"}`,
+			http.StatusBadRequest, `{"status":"error","code":400,"error":"accounts are on more than one clouddriver: b1,a1"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clouddriverManager = &ClouddriverManager{cloudAccountRoutes: tt.routes}
+			s := &srv{}
+			r := mux.NewRouter()
+			r.PathPrefix("/").HandlerFunc(s.forwardByAccount())
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.uri, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func Test_accountRoutedWrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.EscapedPath() + " " + string(body)))
+	}))
+	defer backend.Close()
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{"prod": {URL: backend.URL}},
+	}
+
+	s := &srv{}
+	r := mux.NewRouter()
+	r.HandleFunc("/manifests/{account}/{location}/{name}", s.accountRoutedWrite("account"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/manifests/prod/default/deployment%20web", strings.NewReader(`{"spec":{}}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `PATCH /manifests/prod/default/deployment%20web {"spec":{}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/manifests/staging/default/deployment%20web", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
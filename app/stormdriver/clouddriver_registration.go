@@ -0,0 +1,215 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// registeredSource is the source of clouddrivers added through the
+// administrative API.  They are handled exactly as configured ones,
+// but are not kept across restarts.
+const registeredSource = "api"
+
+var (
+	errClouddriverExists   = errors.New("clouddriver already exists")
+	errClouddriverNotOwned = errors.New("clouddriver was not registered through the API")
+)
+
+// registerClouddriver starts tracking a clouddriver.  Its accounts are
+// picked up on the next credential sync.
+func (m *ClouddriverManager) registerClouddriver(cd clouddriverConfig) (*trackedClouddriver, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.findClouddriverByName(cd.Name); !errors.Is(err, errUnknownClouddriver) {
+		return nil, fmt.Errorf("%w: %s", errClouddriverExists, cd.Name)
+	}
+	key, tracked := makeTrackedClouddriverFromSource(registeredSource, cd)
+	m.state[key] = tracked
+	healthchecker.AddCheck(cd.Name, true, makeURLChecker(cd))
+	return tracked, nil
+}
+
+// deregisterClouddriver stops tracking a clouddriver added by
+// registerClouddriver.  Its routes are dropped at once, except those a
+// swap had moved to it from accounts the clouddriver swapped out still
+// has, which go back to that clouddriver.
+// Swaps naming it are removed.
+func (m *ClouddriverManager) deregisterClouddriver(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	cd, err := m.findClouddriverByName(name)
+	if err != nil {
+		return err
+	}
+	if cd.Source != registeredSource {
+		return fmt.Errorf("%w: %s", errClouddriverNotOwned, name)
+	}
+	key := registeredSource + ":" + name
+	delete(m.state, key)
+	healthchecker.RemoveCheck("clouddriver " + key)
+	healthchecker.RemoveCheck(name)
+
+	routeKey := cd.routeKey()
+	for from, to := range m.swaps {
+		if from == name {
+			delete(m.swaps, from)
+			continue
+		}
+		if to != name {
+			continue
+		}
+		delete(m.swaps, from)
+		if fromCD, err := m.findClouddriverByName(from); err == nil {
+			route := URLAndPriority{URL: fromCD.URL, Priority: fromCD.Priority, token: fromCD.token}
+			restoreRoutes(m.cloudAccountRoutes, routeKey, route, m.syncedCloudAccounts[fromCD.routeKey()])
+			restoreRoutes(m.artifactAccountRoutes, routeKey, route, m.syncedArtifactAccounts[fromCD.routeKey()])
+		}
+	}
+
+	sharedRoute, sharedURL := false, false
+	for _, other := range m.state {
+		sharedRoute = sharedRoute || other.routeKey() == routeKey
+		sharedURL = sharedURL || other.URL == cd.URL
+	}
+	if !sharedRoute {
+		m.cloudAccounts = dropRoutesTo(m.cloudAccountRoutes, routeKey, m.cloudAccounts)
+		m.artifactAccounts = dropRoutesTo(m.artifactAccountRoutes, routeKey, m.artifactAccounts)
+		delete(m.syncedCloudAccounts, routeKey)
+		delete(m.syncedArtifactAccounts, routeKey)
+	}
+	if !sharedURL {
+		downstreamClients.register(cd.URL, clientOptions{})
+	}
+	return nil
+}
+
+// restoreRoutes points the routes with the given key back to route, for
+// the accounts route's clouddriver returned on the last sync.
+func restoreRoutes(routes map[string]URLAndPriority, key string, route URLAndPriority, accounts []trackedSpinnakerAccount) {
+	for _, account := range accounts {
+		if current, found := routes[account.Name]; found && current.key() == key {
+			routes[account.Name] = route
+		}
+	}
+}
+
+// dropRoutesTo removes the routes with the given key, and returns
+// accounts without those no longer routed anywhere.
+func dropRoutesTo(routes map[string]URLAndPriority, key string, accounts []trackedSpinnakerAccount) []trackedSpinnakerAccount {
+	for name, route := range routes {
+		if route.key() == key {
+			delete(routes, name)
+		}
+	}
+	ret := []trackedSpinnakerAccount{}
+	for _, account := range accounts {
+		if _, found := routes[account.Name]; found {
+			ret = append(ret, account)
+		}
+	}
+	return ret
+}
+
+// stillTracked returns the clouddrivers in cds which are still tracked,
+// removing the synced accounts of any which are not, so a sync which
+// was in flight when a clouddriver was removed does not restore its
+// routes.  Must be called with the lock held.
+func (m *ClouddriverManager) stillTracked(cds []URLAndPriority, synced map[string][]trackedSpinnakerAccount) []URLAndPriority {
+	tracked := map[string]bool{}
+	for _, cd := range m.state {
+		tracked[cd.routeKey()] = true
+	}
+	ret := []URLAndPriority{}
+	for _, cd := range cds {
+		if tracked[cd.key()] {
+			ret = append(ret, cd)
+		} else {
+			delete(synced, cd.key())
+		}
+	}
+	return ret
+}
+
+func (*srv) registerClouddriverRequest(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		zap.S().Errorw("io.ReadAll", "error", err)
+		return
+	}
+	var cd clouddriverConfig
+	if err := json.Unmarshal(data, &cd); err != nil {
+		httputil.SetError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if cd.Name == "" {
+		httputil.SetError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	cd.applyDefaults(getHealthchecks())
+	if err := cd.validate(); err != nil {
+		httputil.SetError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tracked, err := clouddriverManager.registerClouddriver(cd)
+	if errors.Is(err, errClouddriverExists) {
+		httputil.SetError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.SetError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	zap.S().Infow("registered clouddriver", "name", cd.Name, "url", cd.URL)
+
+	json, err := json.Marshal(tracked)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	httputil.CheckedWrite(w, json)
+}
+
+func (*srv) deregisterClouddriverRequest(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	err := clouddriverManager.deregisterClouddriver(name)
+	switch {
+	case errors.Is(err, errUnknownClouddriver):
+		httputil.SetError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, errClouddriverNotOwned):
+		httputil.SetError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		httputil.SetError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	zap.S().Infow("deregistered clouddriver", "name", name)
+	w.WriteHeader(http.StatusNoContent)
+}
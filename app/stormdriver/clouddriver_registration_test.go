@@ -0,0 +1,131 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClouddriverManager_registerClouddriver(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:static": {Name: "static", Source: "config", URL: "static-url"},
+		},
+	}
+
+	cd := clouddriverConfig{Name: "dynamic", URL: "http://dynamic:7002", Priority: 3}
+	cd.applyDefaults(healthcheckConfig{})
+	tracked, err := m.registerClouddriver(cd)
+	require.NoError(t, err)
+	assert.Equal(t, registeredSource, tracked.Source)
+	assert.Equal(t, "http://dynamic:7002/health", tracked.healthcheckURL)
+	assert.Equal(t, 3, tracked.Priority)
+	assert.Same(t, tracked, m.state["api:dynamic"])
+
+	_, err = m.registerClouddriver(clouddriverConfig{Name: "static", URL: "http://other"})
+	assert.True(t, errors.Is(err, errClouddriverExists))
+
+	err = m.deregisterClouddriver("static")
+	assert.True(t, errors.Is(err, errClouddriverNotOwned), "configured clouddrivers cannot be removed")
+
+	err = m.deregisterClouddriver("missing")
+	assert.True(t, errors.Is(err, errUnknownClouddriver))
+
+	require.NoError(t, m.deregisterClouddriver("dynamic"))
+	assert.NotContains(t, m.state, "api:dynamic")
+}
+
+func Test_ClouddriverManager_deregisterClouddriver_routes(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:static": {Name: "static", Source: "config", URL: "static-url"},
+			"api:dynamic":   {Name: "dynamic", Source: registeredSource, URL: "dynamic-url"},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a1": {URL: "dynamic-url"},
+			"a2": {URL: "dynamic-url"},
+			"a3": {URL: "static-url"},
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{
+			"art1": {URL: "dynamic-url"},
+		},
+		cloudAccounts:    []trackedSpinnakerAccount{{Name: "a1"}, {Name: "a2"}, {Name: "a3"}},
+		artifactAccounts: []trackedSpinnakerAccount{{Name: "art1"}},
+		syncedCloudAccounts: map[string][]trackedSpinnakerAccount{
+			"static-url:":  {{Name: "a2"}, {Name: "a3"}},
+			"dynamic-url:": {{Name: "a1"}, {Name: "a2"}},
+		},
+		syncedArtifactAccounts: map[string][]trackedSpinnakerAccount{
+			"dynamic-url:": {{Name: "art1"}},
+		},
+		swaps: map[string]string{"static": "dynamic"},
+	}
+
+	require.NoError(t, m.deregisterClouddriver("dynamic"))
+	assert.Empty(t, m.swaps)
+	assert.Equal(t, map[string]URLAndPriority{
+		"a2": {URL: "static-url"},
+		"a3": {URL: "static-url"},
+	}, m.cloudAccountRoutes, "swapped routes go back to the original")
+	assert.Empty(t, m.artifactAccountRoutes)
+	assert.Empty(t, m.artifactAccounts)
+	assert.Equal(t, []trackedSpinnakerAccount{{Name: "a2"}, {Name: "a3"}}, m.cloudAccounts)
+	assert.NotContains(t, m.syncedCloudAccounts, "dynamic-url:")
+	assert.NotContains(t, m.syncedArtifactAccounts, "dynamic-url:")
+}
+
+func Test_ClouddriverManager_stillTracked(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:cd1": {Name: "cd1", URL: "url1"},
+		},
+	}
+	synced := map[string][]trackedSpinnakerAccount{
+		"url1:": {{Name: "a1"}},
+		"url2:": {{Name: "a2"}},
+	}
+	cds := m.stillTracked([]URLAndPriority{{URL: "url1"}, {URL: "url2"}}, synced)
+	assert.Equal(t, []URLAndPriority{{URL: "url1"}}, cds)
+	assert.NotContains(t, synced, "url2:")
+}
+
+func Test_clouddriverConfig_validate(t *testing.T) {
+	var tests = []struct {
+		name    string
+		cd      clouddriverConfig
+		wantErr string
+	}{
+		{"minimal", clouddriverConfig{URL: "http://cd"}, ""},
+		{"no url", clouddriverConfig{}, "missing url"},
+		{"bad url", clouddriverConfig{URL: "http://cd\x7f"}, "malformed URL"},
+		{"proxy and socks5", clouddriverConfig{URL: "http://cd", Proxy: &proxyConfig{URL: "http://p"}, SOCKS5: &socks5Config{Address: "p:1080"}}, "only one of proxy and socks5 may be set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cd.validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
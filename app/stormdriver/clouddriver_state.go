@@ -0,0 +1,170 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var errCredentialsSyncFailed = errors.New("credentials sync failed")
+
+// clouddriverStatus is what /_internal/clouddrivers reports about each
+// known clouddriver.  Health is "ok", or why the last sync failed.
+type clouddriverStatus struct {
+	Name                  string    `json:"name" yaml:"name"`
+	Source                string    `json:"source" yaml:"source"`
+	URL                   string    `json:"url" yaml:"url"`
+	UIUrl                 string    `json:"uiUrl,omitempty" yaml:"uiUrl,omitempty"`
+	AgentName             string    `json:"agentName,omitempty" yaml:"agentName,omitempty"`
+	Priority              int       `json:"priority" yaml:"priority"`
+	Weight                int       `json:"weight,omitempty" yaml:"weight,omitempty"`
+	LastSuccessfulContact time.Time `json:"lastSuccessfulContact" yaml:"lastSuccessfulContact"`
+	AccountHealth         string    `json:"accountHealth" yaml:"accountHealth"`
+	ArtifactHealth        string    `json:"artifactHealth,omitempty" yaml:"artifactHealth,omitempty"`
+	InMaintenance         bool      `json:"inMaintenance,omitempty" yaml:"inMaintenance,omitempty"`
+	Quarantined           bool      `json:"quarantined,omitempty" yaml:"quarantined,omitempty"`
+	Optional              bool      `json:"optional,omitempty" yaml:"optional,omitempty"`
+	Withdrawn             bool      `json:"withdrawn,omitempty" yaml:"withdrawn,omitempty"`
+	Accounts              int       `json:"accounts" yaml:"accounts"`
+	ArtifactAccounts      int       `json:"artifactAccounts" yaml:"artifactAccounts"`
+}
+
+func healthString(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return err.Error()
+}
+
+// noteSyncHealth records whether each clouddriver asked for credentials
+// in the last sync answered, and counts consecutive failed cloud
+// credential syncs.  Must be called with the lock held.
+func (m *ClouddriverManager) noteSyncHealth(asked []URLAndPriority, synced map[string][]trackedSpinnakerAccount, artifact bool) {
+	keys := map[string]bool{}
+	for _, cd := range asked {
+		keys[cd.key()] = true
+	}
+	for _, cd := range m.state {
+		key := cd.routeKey()
+		if !keys[key] {
+			continue
+		}
+		var err error
+		if _, found := synced[key]; !found {
+			err = errCredentialsSyncFailed
+		}
+		if artifact {
+			cd.artifactHealth = err
+			continue
+		}
+		cd.accountHealth = err
+		if err != nil {
+			cd.syncFailures++
+		} else {
+			cd.syncFailures = 0
+		}
+	}
+}
+
+// lastSuccessfulContact returns when the clouddriver last answered a
+// request.
+func (m *ClouddriverManager) lastSuccessfulContact(cd *trackedClouddriver) time.Time {
+	m.Lock()
+	defer m.Unlock()
+	return m.contactOf(cd)
+}
+
+// describeContact says when a clouddriver was last heard from, for
+// health check messages.
+func describeContact(when time.Time, now time.Time) string {
+	if when.Unix() <= 0 {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", when.UTC().Format(time.RFC3339), now.Sub(when).Round(time.Second))
+}
+
+// getClouddriverStatuses returns the state of every known clouddriver,
+// sorted by name and URL.
+func (m *ClouddriverManager) getClouddriverStatuses() []clouddriverStatus {
+	m.Lock()
+	defer m.Unlock()
+	accounts := map[string]int{}
+	for _, route := range m.cloudAccountRoutes {
+		accounts[route.key()]++
+	}
+	artifactAccounts := map[string]int{}
+	for _, route := range m.artifactAccountRoutes {
+		artifactAccounts[route.key()]++
+	}
+
+	ret := []clouddriverStatus{}
+	for _, cd := range m.state {
+		status := clouddriverStatus{
+			Name:                  cd.Name,
+			Source:                cd.Source,
+			URL:                   cd.URL,
+			UIUrl:                 cd.UIUrl,
+			AgentName:             cd.AgentName,
+			Priority:              cd.Priority,
+			Weight:                cd.Weight,
+			LastSuccessfulContact: m.contactOf(cd),
+			AccountHealth:         healthString(cd.accountHealth),
+			InMaintenance:         cd.inMaintenance,
+			Quarantined:           cd.quarantined,
+			Optional:              cd.optional,
+			Withdrawn:             cd.withdrawn,
+			Accounts:              accounts[cd.routeKey()],
+			ArtifactAccounts:      artifactAccounts[cd.routeKey()],
+		}
+		if !cd.DisableArtifactAccounts {
+			status.ArtifactHealth = healthString(cd.artifactHealth)
+		}
+		ret = append(ret, status)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].URL < ret[j].URL
+	})
+	return ret
+}
+
+func clouddriverStatusRows(statuses []clouddriverStatus) [][]string {
+	ret := [][]string{{"name", "source", "url", "priority", "lastSuccessfulContact", "accountHealth", "artifactHealth", "accounts", "artifactAccounts"}}
+	for _, s := range statuses {
+		ret = append(ret, []string{
+			s.Name, s.Source, s.URL, strconv.Itoa(s.Priority),
+			s.LastSuccessfulContact.Format(time.RFC3339),
+			s.AccountHealth, s.ArtifactHealth,
+			strconv.Itoa(s.Accounts), strconv.Itoa(s.ArtifactAccounts),
+		})
+	}
+	return ret
+}
+
+func (*srv) clouddriversRequest(w http.ResponseWriter, req *http.Request) {
+	statuses := clouddriverManager.getClouddriverStatuses()
+	writeFormatted(w, req, statuses, func() [][]string {
+		return clouddriverStatusRows(statuses)
+	})
+}
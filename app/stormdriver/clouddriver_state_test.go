@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClouddriverManager_noteSyncHealth(t *testing.T) {
+	initial := errors.New("initial sync not yet performed")
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:alice": {Name: "alice", URL: "url1", accountHealth: initial},
+			"config:bob":   {Name: "bob", URL: "url2", token: "bobtoken", accountHealth: initial},
+			"config:carol": {Name: "carol", URL: "url3", accountHealth: initial},
+		},
+	}
+	asked := []URLAndPriority{{URL: "url1"}, {URL: "url2", token: "bobtoken"}}
+	synced := map[string][]trackedSpinnakerAccount{"url1:": {}}
+
+	m.noteSyncHealth(asked, synced, false)
+	assert.NoError(t, m.state["config:alice"].accountHealth)
+	assert.Equal(t, errCredentialsSyncFailed, m.state["config:bob"].accountHealth)
+	assert.Equal(t, initial, m.state["config:carol"].accountHealth, "not asked, so unchanged")
+	assert.Nil(t, m.state["config:alice"].artifactHealth)
+}
+
+func Test_ClouddriverManager_getClouddriverStatuses(t *testing.T) {
+	contact := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:bob": {Name: "bob", Source: "config", URL: "url2", token: "bobtoken", Priority: 5,
+				LastSuccessfulContact: contact, accountHealth: errCredentialsSyncFailed, DisableArtifactAccounts: true},
+			"config:alice": {Name: "alice", Source: "config", URL: "url1", LastSuccessfulContact: contact, optional: true},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a1": {URL: "url1"},
+			"a2": {URL: "url2", token: "bobtoken"},
+			"a3": {URL: "url1"},
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{
+			"gh": {URL: "url1"},
+		},
+	}
+	want := []clouddriverStatus{
+		{Name: "alice", Source: "config", URL: "url1", LastSuccessfulContact: contact, AccountHealth: "ok", ArtifactHealth: "ok",
+			Optional: true, Accounts: 2, ArtifactAccounts: 1},
+		{Name: "bob", Source: "config", URL: "url2", Priority: 5, LastSuccessfulContact: contact, AccountHealth: "credentials sync failed",
+			Accounts: 1},
+	}
+	assert.Equal(t, want, m.getClouddriverStatuses())
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = m
+
+	w := httptest.NewRecorder()
+	(&srv{}).clouddriversRequest(w, httptest.NewRequest(http.MethodGet, "/_internal/clouddrivers", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var got []clouddriverStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, want, got)
+	assert.NotContains(t, w.Body.String(), "bobtoken")
+
+	w = httptest.NewRecorder()
+	(&srv{}).clouddriversRequest(w, httptest.NewRequest(http.MethodGet, "/_internal/clouddrivers?format=csv", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "bob,config,url2,5,2022-06-01T12:00:00Z,credentials sync failed,,1,0", lines[2])
+}
+
+func Test_describeContact(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		when time.Time
+		want string
+	}{
+		{"never", time.Unix(0, 0).UTC(), "never"},
+		{"zero", time.Time{}, "never"},
+		{"recent", now.Add(-90 * time.Second), "2022-05-01T11:58:30Z (1m30s ago)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, describeContact(tt.when, now))
+		})
+	}
+}
+
+func Test_trackedClouddriver_Check_reportsLastContact(t *testing.T) {
+	backend := hedgeTestServer(t, 0, http.StatusServiceUnavailable, `{}`)
+	cd := &trackedClouddriver{Name: "east", URL: backend.URL, healthcheckURL: backend.URL + "/health",
+		healthcheckTimeout: time.Second, LastSuccessfulContact: time.Unix(0, 0).UTC()}
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{state: map[string]*trackedClouddriver{"config:east": cd}}
+
+	err := cd.Check()
+	require.Error(t, err)
+	assert.Equal(t, "healthcheck returned status 503; last successful contact never", err.Error())
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+var errUnknownClouddriver = errors.New("unknown clouddriver")
+
+// swapConflictError is returned when a swap is not safe to perform.
+type swapConflictError struct {
+	reason string
+}
+
+func (e swapConflictError) Error() string {
+	return e.reason
+}
+
+type swapRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type swapResult struct {
+	From             string   `json:"from"`
+	To               string   `json:"to"`
+	Accounts         []string `json:"accounts"`
+	ArtifactAccounts []string `json:"artifactAccounts"`
+}
+
+// findClouddriverByName returns the one clouddriver with the given name.
+// Must be called with the lock held.
+func (m *ClouddriverManager) findClouddriverByName(name string) (*trackedClouddriver, error) {
+	var ret *trackedClouddriver
+	for _, cd := range m.state {
+		if cd.Name != name {
+			continue
+		}
+		if ret != nil {
+			return nil, fmt.Errorf("more than one clouddriver is named %s", name)
+		}
+		ret = cd
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("%w: %s", errUnknownClouddriver, name)
+	}
+	return ret, nil
+}
+
+// swapClouddriver replaces all routes to the clouddriver named from with
+// routes to the one named to, and keeps doing so after each sync until
+// the swap is removed.  The swap is refused unless the replacement
+// returned every account currently routed to the original on its last sync.
+func (m *ClouddriverManager) swapClouddriver(from string, to string) (swapResult, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if from == to {
+		return swapResult{}, swapConflictError{"cannot swap a clouddriver with itself"}
+	}
+	fromCD, err := m.findClouddriverByName(from)
+	if err != nil {
+		return swapResult{}, err
+	}
+	toCD, err := m.findClouddriverByName(to)
+	if err != nil {
+		return swapResult{}, err
+	}
+	if replacement, found := m.swaps[to]; found {
+		return swapResult{}, swapConflictError{fmt.Sprintf("%s is already swapped for %s", to, replacement)}
+	}
+
+	fromKey := fromCD.routeKey()
+	toKey := toCD.routeKey()
+	accounts := routedAccountNames(fromKey, m.cloudAccountRoutes)
+	artifactAccounts := routedAccountNames(fromKey, m.artifactAccountRoutes)
+	missing := append(missingAccounts(accounts, m.syncedCloudAccounts[toKey]),
+		missingAccounts(artifactAccounts, m.syncedArtifactAccounts[toKey])...)
+	if len(missing) > 0 {
+		return swapResult{}, swapConflictError{fmt.Sprintf("%s has not synced accounts: %s", to, strings.Join(missing, ", "))}
+	}
+
+	// anything already swapped for the outgoing clouddriver moves too
+	for k, v := range m.swaps {
+		if v == from {
+			m.swaps[k] = to
+		}
+	}
+	m.swaps[from] = to
+	m.applySwaps(m.cloudAccountRoutes)
+	m.applySwaps(m.artifactAccountRoutes)
+
+	return swapResult{
+		From:             from,
+		To:               to,
+		Accounts:         accounts,
+		ArtifactAccounts: artifactAccounts,
+	}, nil
+}
+
+// removeSwap stops replacing routes for the named clouddriver.  Normal
+// routing resumes on the next sync.
+func (m *ClouddriverManager) removeSwap(from string) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, found := m.swaps[from]
+	delete(m.swaps, from)
+	return found
+}
+
+func (m *ClouddriverManager) getSwaps() []swapRequest {
+	m.Lock()
+	defer m.Unlock()
+	ret := []swapRequest{}
+	for from, to := range m.swaps {
+		ret = append(ret, swapRequest{From: from, To: to})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].From < ret[j].From })
+	return ret
+}
+
+// applySwaps rewrites routes according to the active swaps.  Swaps
+// where either clouddriver is currently unknown are skipped.
+// Must be called with the lock held.
+func (m *ClouddriverManager) applySwaps(routes map[string]URLAndPriority) {
+	for from, to := range m.swaps {
+		fromCD, err := m.findClouddriverByName(from)
+		if err != nil {
+			continue
+		}
+		toCD, err := m.findClouddriverByName(to)
+		if err != nil {
+			continue
+		}
+		fromKey := fromCD.routeKey()
+		target := URLAndPriority{URL: toCD.URL, Priority: toCD.Priority, token: toCD.token}
+		for name, route := range routes {
+			if route.key() == fromKey {
+				routes[name] = target
+			}
+		}
+	}
+}
+
+func routedAccountNames(key string, routes map[string]URLAndPriority) []string {
+	ret := []string{}
+	for name, route := range routes {
+		if route.key() == key {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func missingAccounts(names []string, synced []trackedSpinnakerAccount) []string {
+	have := map[string]bool{}
+	for _, account := range synced {
+		have[account.Name] = true
+	}
+	ret := []string{}
+	for _, name := range names {
+		if !have[name] {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func (*srv) swapClouddriverRequest(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		zap.S().Errorw("io.ReadAll", "error", err)
+		return
+	}
+	var swap swapRequest
+	if err := json.Unmarshal(data, &swap); err != nil {
+		httputil.SetError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if swap.From == "" || swap.To == "" {
+		httputil.SetError(w, http.StatusBadRequest, "from and to are required")
+		return
+	}
+
+	result, err := clouddriverManager.swapClouddriver(swap.From, swap.To)
+	var conflict swapConflictError
+	switch {
+	case errors.Is(err, errUnknownClouddriver):
+		httputil.SetError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.As(err, &conflict):
+		httputil.SetError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		httputil.SetError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	zap.S().Infow("swapped clouddriver",
+		"from", result.From,
+		"to", result.To,
+		"accounts", len(result.Accounts),
+		"artifactAccounts", len(result.ArtifactAccounts))
+
+	json, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
+
+func (*srv) listSwapsRequest(w http.ResponseWriter, req *http.Request) {
+	json, err := json.Marshal(clouddriverManager.getSwaps())
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
+
+func (*srv) removeSwapRequest(w http.ResponseWriter, req *http.Request) {
+	from := mux.Vars(req)["from"]
+	if !clouddriverManager.removeSwap(from) {
+		httputil.SetError(w, http.StatusNotFound, "no swap for "+from)
+		return
+	}
+	zap.S().Infow("removed clouddriver swap", "from", from)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeSwapTestManager() *ClouddriverManager {
+	return &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:blue":  {Name: "blue", URL: "blue-url"},
+			"config:green": {Name: "green", URL: "green-url", token: "gt", Priority: 5},
+			"config:other": {Name: "other", URL: "other-url"},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a1": {URL: "blue-url"},
+			"a2": {URL: "blue-url"},
+			"a3": {URL: "other-url"},
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{
+			"gh": {URL: "blue-url"},
+		},
+		syncedCloudAccounts: map[string][]trackedSpinnakerAccount{
+			"green-url:gt": {{Name: "a1"}, {Name: "a2"}},
+		},
+		syncedArtifactAccounts: map[string][]trackedSpinnakerAccount{
+			"green-url:gt": {{Name: "gh"}},
+		},
+		swaps: map[string]string{},
+	}
+}
+
+func Test_ClouddriverManager_swapClouddriver(t *testing.T) {
+	m := makeSwapTestManager()
+
+	result, err := m.swapClouddriver("blue", "green")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1", "a2"}, result.Accounts)
+	assert.Equal(t, []string{"gh"}, result.ArtifactAccounts)
+
+	green := URLAndPriority{URL: "green-url", Priority: 5, token: "gt"}
+	assert.Equal(t, green, m.cloudAccountRoutes["a1"])
+	assert.Equal(t, green, m.cloudAccountRoutes["a2"])
+	assert.Equal(t, URLAndPriority{URL: "other-url"}, m.cloudAccountRoutes["a3"])
+	assert.Equal(t, green, m.artifactAccountRoutes["gh"])
+
+	// a later sync which routes to blue again is rewritten
+	routes := map[string]URLAndPriority{"a1": {URL: "blue-url"}}
+	m.applySwaps(routes)
+	assert.Equal(t, green, routes["a1"])
+
+	assert.True(t, m.removeSwap("blue"))
+	assert.False(t, m.removeSwap("blue"))
+}
+
+func Test_ClouddriverManager_swapClouddriver_errors(t *testing.T) {
+	tests := []struct {
+		name         string
+		from         string
+		to           string
+		wantConflict bool
+		wantUnknown  bool
+	}{
+		{"same clouddriver", "blue", "blue", true, false},
+		{"unknown from", "red", "green", false, true},
+		{"unknown to", "blue", "red", false, true},
+		{"accounts not synced", "blue", "other", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := makeSwapTestManager()
+			_, err := m.swapClouddriver(tt.from, tt.to)
+			require.Error(t, err)
+			var conflict swapConflictError
+			assert.Equal(t, tt.wantConflict, errors.As(err, &conflict))
+			assert.Equal(t, tt.wantUnknown, errors.Is(err, errUnknownClouddriver))
+			assert.Empty(t, m.swaps)
+		})
+	}
+}
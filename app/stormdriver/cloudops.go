@@ -18,11 +18,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/OpsMx/go-app-base/httputil"
-	"go.uber.org/zap"
 )
 
 // AccountStruct is a simple parse helper which contains only a small number
@@ -45,74 +46,162 @@ func (a *AccountStruct) AccountName() string {
 	return ""
 }
 
-func (*srv) cloudOpsPost() http.HandlerFunc {
+// cloudOpsPost sends a list of operations to the clouddriver owning
+// their accounts.  If the accounts are owned by more than one
+// clouddriver, the list is split between them; see forwardSplit.
+func (s *srv) cloudOpsPost() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("content-type", "application/json")
 
 		data, err := io.ReadAll(req.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusServiceUnavailable)
-			zap.S().Errorw("reading body", "error", err)
+			requestLogger(req.Context()).Errorw("reading body", "error", err)
 			return
 		}
+		data = aliases.resolveOperations(data)
 
 		var list []map[string]AccountStruct
 		err = json.Unmarshal(data, &list)
 		if err != nil {
-			zap.S().Errorw("parse body", "error", err)
+			requestLogger(req.Context()).Errorw("parse body", "error", err)
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
 		foundURLs := map[string]URLAndPriority{}
 		foundAccounts := map[string]bool{}
+		itemRoutes := make([]string, len(list))
+		itemAccounts := make([][]string, len(list))
 
 		for idx, item := range list {
 			for requestType, subitem := range item {
 				accountName := subitem.AccountName()
 				if accountName == "" {
-					zap.S().Warnw("no account or credentials found for cloud request", "index", idx, "requestType", requestType)
+					requestLogger(req.Context()).Warnw("no account or credentials found for cloud request", "index", idx, "requestType", requestType)
 					continue
 				}
 				foundAccounts[accountName] = true
+				itemAccounts[idx] = append(itemAccounts[idx], accountName)
 				url, found := clouddriverManager.findCloudRoute(accountName)
 				if !found {
-					zap.S().Warnw("no route for account", "accountName", accountName)
+					requestLogger(req.Context()).Warnw("no route for account", "accountName", accountName)
 					continue
 				}
 				foundURLs[url.key()] = url
+				if itemRoutes[idx] == "" {
+					itemRoutes[idx] = url.key()
+				} else if itemRoutes[idx] != url.key() {
+					requestLogger(req.Context()).Warnw("operation names accounts on more than one clouddriver", "index", idx, "accountNames", itemAccounts[idx])
+				}
 			}
 		}
 
 		foundAccountNames := keysForMap(foundAccounts)
+		auditRecordFrom(req.Context()).setAccounts(foundAccountNames)
+
+		if denied := s.permissions.checkWrite(req, foundAccountNames); denied != "" {
+			httputil.SetError(w, http.StatusForbidden, "access denied to account "+denied)
+			return
+		}
+
+		entry := journal.accept(req, data, foundAccountNames)
 
 		if len(foundURLs) == 0 {
-			zap.S().Errorw("no routes found for any accounts in request", "accountNames", foundAccountNames)
+			if journal.shouldQueue(foundAccountNames) {
+				requestLogger(req.Context()).Infow("no routes found, queueing operation", "accountNames", foundAccountNames, "id", entry.ID)
+				journal.finish(entry, journalQueued, 0, "", nil)
+				writeQueuedResponse(w, entry)
+				return
+			}
+			requestLogger(req.Context()).Errorw("no routes found for any accounts in request", "accountNames", foundAccountNames)
+			journal.finish(entry, journalFailed, http.StatusServiceUnavailable, "", nil)
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
 		if len(foundURLs) != 1 {
-			zap.S().Warnw("multiple routes found", "accountNames", foundAccountNames)
+			var raw []json.RawMessage
+			if err := json.Unmarshal(data, &raw); err != nil {
+				requestLogger(req.Context()).Errorw("parse body", "error", err)
+				journal.finish(entry, journalFailed, http.StatusServiceUnavailable, "", err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			requestLogger(req.Context()).Infow("splitting operations between clouddrivers", "accountNames", foundAccountNames)
+			forwardSplit(w, req, entry, splitOperations(raw, itemRoutes, itemAccounts, foundURLs))
+			return
 		}
 
-		// will contain at least one element due to checking len(foundURLs) above
+		// will contain exactly one element due to checking len(foundURLs) above
 		foundURLNames := keysForMap(foundURLs)
 		url := foundURLs[foundURLNames[0]]
 
-		target := combineURL(url.URL, req.RequestURI)
-		responseBody, code, _, err := fetchWithBody(req.Context(), req.Method, target, url.token, req.Header, data)
-
+		auditRecordFrom(req.Context()).setClouddriver(url)
+		responseBody, event, err := submitOperation(req, url, data, foundAccountNames)
 		if err != nil {
-			zap.S().Errorw("post failed", "url", target, "error", err)
-			w.WriteHeader(http.StatusServiceUnavailable)
+			// an oversized response means the clouddriver took the
+			// operation, so it must not be sent again.
+			if journal.shouldQueue(foundAccountNames) && !errors.Is(err, errResponseTooLarge) {
+				journal.finish(entry, journalQueued, 0, "", err)
+				writeQueuedResponse(w, entry)
+				return
+			}
+			status := downstreamErrorStatus(err)
+			journal.finish(entry, journalFailed, status, "", err)
+			event.StatusCode = status
+			event.Error = err.Error()
+			events.emit(event)
+			w.WriteHeader(status)
 			return
 		}
-		if !httputil.StatusCodeOK(code) {
-			w.WriteHeader(code)
+		auditRecordFrom(req.Context()).setTaskID(event.TaskID)
+		events.emit(event)
+		if !httputil.StatusCodeOK(event.StatusCode) {
+			journal.finish(entry, journalFailed, event.StatusCode, "", nil)
+			w.WriteHeader(event.StatusCode)
 			return
 		}
+		journal.finish(entry, journalForwarded, event.StatusCode, event.TaskID, nil)
+		recordTask(req, url, event)
 		w.WriteHeader(http.StatusOK)
 		httputil.CheckedWrite(w, responseBody)
 	}
 }
+
+// submitOperation posts an operation list to the clouddriver at url,
+// returning the response and the event describing it.  The event is not
+// emitted, and its status code is 0 if err is not nil.
+func submitOperation(req *http.Request, url URLAndPriority, data []byte, accounts []string) ([]byte, opEvent, error) {
+	target := combineURL(url.URL, req.RequestURI)
+	responseBody, code, _, err := fetchWithBody(withRoute(req.Context(), url), req.Method, target, url.token, req.Header, data)
+	event := opEvent{
+		Time:        time.Now().UTC(),
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		User:        req.Header.Get("x-spinnaker-user"),
+		Accounts:    accounts,
+		Clouddriver: clouddriverManager.clouddriverNameForRoute(url),
+		StatusCode:  code,
+	}
+	if err != nil {
+		requestLogger(req.Context()).Errorw("post failed", "url", target, "error", err)
+		return nil, event, err
+	}
+	event.TaskID = taskIDFromResponse(responseBody)
+	return responseBody, event, nil
+}
+
+// recordTask remembers which clouddriver runs the task an operation
+// started, and tracks it.
+func recordTask(req *http.Request, url URLAndPriority, event opEvent) {
+	taskOwners.record(event.TaskID, url)
+	tasks.track(trackedTask{
+		id:          event.TaskID,
+		route:       url,
+		clouddriver: event.Clouddriver,
+		accounts:    event.Accounts,
+		headers:     spinnakerHeaders(req.Header),
+		started:     event.Time,
+	})
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "net/http"
+
+// compressionConfig controls whether compressed responses from a
+// clouddriver are returned to the client still compressed.  When
+// Passthrough is set, the client's Accept-Encoding is sent to the
+// clouddriver for responses streamed from a single clouddriver, and
+// the body and its Content-Encoding are returned as they arrive.
+// Responses which must be parsed, to merge them or to change them, are
+// always requested with the transport's own gzip negotiation and
+// decompressed before use.
+type compressionConfig struct {
+	Passthrough bool `yaml:"passthrough,omitempty" json:"passthrough,omitempty"`
+}
+
+var compression compressionConfig
+
+// passAcceptEncoding sets the Accept-Encoding of a request which will
+// be streamed back to the client to the client's own, if passthrough
+// is enabled.  Setting it stops the transport from decompressing the
+// response.
+func passAcceptEncoding(dst http.Header, client http.Header) {
+	if !compression.Passthrough {
+		return
+	}
+	if encoding := client.Get("Accept-Encoding"); encoding != "" {
+		dst.Set("Accept-Encoding", encoding)
+	}
+}
+
+// copyContentEncoding copies the Content-Encoding of a streamed
+// response, which the client must have to read the body whatever the
+// response header policy allows.
+func copyContentEncoding(dst http.Header, src http.Header) {
+	if encoding := src.Get("Content-Encoding"); encoding != "" {
+		dst.Set("Content-Encoding", encoding)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gzipTestServer compresses its body if the request accepts gzip.
+func gzipTestServer(t *testing.T, body string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("content-encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte(body))
+		_ = gz.Close()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	ret, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(ret)
+}
+
+func Test_fetchFrom_compression(t *testing.T) {
+	const body = `{"name":"web","kind":"deployment"}`
+	backend := gzipTestServer(t, body)
+
+	tests := []struct {
+		name           string
+		passthrough    bool
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"passthrough to a client accepting gzip", true, "gzip, deflate", "gzip"},
+		{"passthrough to a client without gzip", true, "", ""},
+		{"decompressed when disabled", false, "gzip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := compression
+			defer func() { compression = old }()
+			compression = compressionConfig{Passthrough: tt.passthrough}
+
+			req := httptest.NewRequest(http.MethodGet, "/manifests/prod/web", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			fetchFrom(context.Background(), backend.URL+"/manifests/prod/web", "", w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.wantEncoding, w.Header().Get("content-encoding"))
+			if tt.wantEncoding == "gzip" {
+				assert.Equal(t, body, gunzip(t, w.Body.Bytes()))
+			} else {
+				assert.Equal(t, body, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_fetchGet_decompressesWithPassthrough(t *testing.T) {
+	const body = `[{"name":"web"}]`
+	backend := gzipTestServer(t, body)
+
+	old := compression
+	defer func() { compression = old }()
+	compression = compressionConfig{Passthrough: true}
+
+	headers := http.Header{"Accept-Encoding": []string{"gzip"}}
+	data, code, respHeaders, err := fetchGet(context.Background(), backend.URL, "", headers)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, respHeaders.Get("content-encoding"))
+	assert.Equal(t, body, string(data))
+}
@@ -28,6 +28,7 @@ import (
 )
 
 const defaultHTTPListenPort = 7002
+const defaultShutdownDrainSeconds = 30
 const defaultSpinnakerUser = "anonymous"
 
 type clouddriverConfig struct {
@@ -37,6 +38,69 @@ type clouddriverConfig struct {
 	DisableArtifactAccounts bool   `yaml:"disableArtifactAccounts,omitempty" json:"disableArtifactAccounts,omitempty"`
 	Priority                int    `yaml:"priority,omitempty" json:"priority,omitempty"`
 	UIUrl                   string `json:"uiUrl,omitempty" yaml:"uiUrl,omitempty"`
+
+	// Proxy, if set, is used for all requests to this clouddriver.
+	Proxy *proxyConfig `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+
+	// SOCKS5, if set, is used for all connections to this clouddriver.
+	SOCKS5 *socks5Config `yaml:"socks5,omitempty" json:"socks5,omitempty"`
+
+	// Dialer overrides the global dialer preferences for this clouddriver.
+	Dialer *dialerConfig `yaml:"dialer,omitempty" json:"dialer,omitempty"`
+
+	// MaintenanceWindows are recurring periods during which this
+	// clouddriver is not routed to and its health check always passes.
+	MaintenanceWindows []maintenanceWindow `yaml:"maintenanceWindows,omitempty" json:"maintenanceWindows,omitempty"`
+
+	// RateLimit, if set, caps the rate of requests to this clouddriver.
+	RateLimit *rateLimitConfig `yaml:"rateLimit,omitempty" json:"rateLimit,omitempty"`
+
+	// TLS, if set, holds the client certificate and CA bundle used for
+	// mutual TLS with this clouddriver.
+	TLS *clientTLSConfig `yaml:"tls,omitempty" json:"tls,omitempty"`
+
+	// Retry, if set, replaces the global GET retry policy for this
+	// clouddriver.
+	Retry *retryConfig `yaml:"retry,omitempty" json:"retry,omitempty"`
+
+	// Healthcheck, if set, overrides the global health check settings
+	// for this clouddriver.
+	Healthcheck *healthcheckConfig `yaml:"healthcheck,omitempty" json:"healthcheck,omitempty"`
+
+	// Optional clouddrivers are left out of fan-out requests while
+	// shedding load.
+	Optional bool `yaml:"optional,omitempty" json:"optional,omitempty"`
+
+	// Weight is this clouddriver's share of requests which any
+	// clouddriver can answer, relative to the others.  The default is 1.
+	Weight int `yaml:"weight,omitempty" json:"weight,omitempty"`
+
+	// AccountIncludes, if set, limits the accounts this clouddriver may
+	// own to those matching one of these globs.  Accounts matching
+	// AccountExcludes are never routed to it.
+	AccountIncludes []string `yaml:"accountIncludes,omitempty" json:"accountIncludes,omitempty"`
+	AccountExcludes []string `yaml:"accountExcludes,omitempty" json:"accountExcludes,omitempty"`
+
+	// OAuth2, if set, is used to get access tokens for requests to this
+	// clouddriver, in place of a static token.
+	OAuth2 *oauth2Config `yaml:"oauth2,omitempty" json:"oauth2,omitempty"`
+
+	// TokenFile, if set, holds a bearer token sent on requests to this
+	// clouddriver.  It is re-read when it changes.
+	TokenFile string `yaml:"tokenFile,omitempty" json:"tokenFile,omitempty"`
+}
+
+func (c clouddriverConfig) clientOptions() clientOptions {
+	return clientOptions{
+		proxy:     c.Proxy,
+		socks5:    c.SOCKS5,
+		dialer:    c.Dialer,
+		rateLimit: c.RateLimit,
+		tls:       c.TLS,
+		retry:     c.Retry,
+		oauth2:    c.OAuth2,
+		tokenFile: c.TokenFile,
+	}
 }
 
 type configuration struct {
@@ -45,12 +109,123 @@ type configuration struct {
 	Controller       birger.Config         `json:"controller,omitempty" yaml:"controller,omitempty"`
 	SpinnakerUser    string                `yaml:"spinnakerUser,omitempty" json:"spinnakerUser,omitempty"`
 	Clouddrivers     []clouddriverConfig   `yaml:"clouddrivers,omitempty" json:"clouddrivers,omitempty"`
+	Admission        admissionConfig       `yaml:"admission,omitempty" json:"admission,omitempty"`
+	CallerRateLimit  callerRateLimitConfig `yaml:"callerRateLimit,omitempty" json:"callerRateLimit,omitempty"`
+	Metrics          metricsConfig         `yaml:"metrics,omitempty" json:"metrics,omitempty"`
+	Admin            adminConfig           `yaml:"admin,omitempty" json:"admin,omitempty"`
+	Dialer           dialerConfig          `yaml:"dialer,omitempty" json:"dialer,omitempty"`
+	DNS              dnsConfig             `yaml:"dns,omitempty" json:"dns,omitempty"`
+	LoadShedding     loadSheddingConfig    `yaml:"loadShedding,omitempty" json:"loadShedding,omitempty"`
+	Permissions      permissionsConfig     `yaml:"permissions,omitempty" json:"permissions,omitempty"`
+	Events           eventsConfig          `yaml:"events,omitempty" json:"events,omitempty"`
+	Audit            auditConfig           `yaml:"audit,omitempty" json:"audit,omitempty"`
+	Journal          journalConfig         `yaml:"journal,omitempty" json:"journal,omitempty"`
+	TaskTracking     taskTrackingConfig    `yaml:"taskTracking,omitempty" json:"taskTracking,omitempty"`
+	ResponseHeaders  responseHeadersConfig `yaml:"responseHeaders,omitempty" json:"responseHeaders,omitempty"`
+	TLS              serverTLSConfig       `yaml:"tls,omitempty" json:"tls,omitempty"`
+	FanOut           fanOutConfig          `yaml:"fanOut,omitempty" json:"fanOut,omitempty"`
+	Retry            *retryConfig          `yaml:"retry,omitempty" json:"retry,omitempty"`
+	Tracing          tracingConfig         `yaml:"tracing,omitempty" json:"tracing,omitempty"`
+	AccessLog        accessLogConfig       `yaml:"accessLog,omitempty" json:"accessLog,omitempty"`
+	Compression      compressionConfig     `yaml:"compression,omitempty" json:"compression,omitempty"`
+	Hedging          hedgeConfig           `yaml:"hedging,omitempty" json:"hedging,omitempty"`
+	ResponseCache    responseCacheConfig   `yaml:"responseCache,omitempty" json:"responseCache,omitempty"`
+	Search           searchConfig          `yaml:"search,omitempty" json:"search,omitempty"`
+	Cache            cacheConfig           `yaml:"cache,omitempty" json:"cache,omitempty"`
+	Discovery        discoveryConfig       `yaml:"discovery,omitempty" json:"discovery,omitempty"`
+
+	// Healthcheck controls how clouddrivers are health checked.
+	Healthcheck healthcheckConfig `yaml:"healthcheck,omitempty" json:"healthcheck,omitempty"`
+
+	// Quarantine removes the routes to clouddrivers which keep failing.
+	Quarantine quarantineConfig `yaml:"quarantine,omitempty" json:"quarantine,omitempty"`
+
+	// DownstreamConcurrency bounds the requests in flight to the
+	// clouddrivers.
+	DownstreamConcurrency downstreamConcurrencyConfig `yaml:"downstreamConcurrency,omitempty" json:"downstreamConcurrency,omitempty"`
+
+	// Vault, if set, writes secrets from Vault to the files Stormdriver
+	// reads them from.
+	Vault vaultConfig `yaml:"vault,omitempty" json:"vault,omitempty"`
+
+	// RequestHeaders chooses which of the caller's request headers are
+	// sent on to clouddrivers.  By default, all but User-Agent are.
+	RequestHeaders *headerPolicy `yaml:"requestHeaders,omitempty" json:"requestHeaders,omitempty"`
+
+	// MaxResponseBytes limits the size of a clouddriver's response
+	// body.  0 is unlimited.
+	MaxResponseBytes int64 `yaml:"maxResponseBytes,omitempty" json:"maxResponseBytes,omitempty"`
+
+	// Failover sends GETs routed by account to another clouddriver
+	// with the account when the routed one fails.
+	Failover failoverConfig `yaml:"failover,omitempty" json:"failover,omitempty"`
+
+	// FeatureFlags decides how many clouddrivers must enable a feature
+	// flag for it to be reported as enabled.
+	FeatureFlags featureFlagsConfig `yaml:"featureFlags,omitempty" json:"featureFlags,omitempty"`
+
+	// ListKeys replaces the fields used to drop duplicates from the
+	// merged lists of a route.
+	ListKeys listKeysConfig `yaml:"listKeys,omitempty" json:"listKeys,omitempty"`
+
+	// ListSorting sorts merged lists, so their order does not depend on
+	// which clouddriver answered first.
+	ListSorting listSortingConfig `yaml:"listSorting,omitempty" json:"listSorting,omitempty"`
+
+	// ArtifactFallback routes artifact fetches for unknown accounts by
+	// the artifact's type.
+	ArtifactFallback artifactFallbackConfig `yaml:"artifactFallback,omitempty" json:"artifactFallback,omitempty"`
+
+	// AccountManagement chooses where accounts created through the
+	// account management API go.
+	AccountManagement accountManagementConfig `yaml:"accountManagement,omitempty" json:"accountManagement,omitempty"`
+
+	// AccountOverrides pins account names to clouddriver names,
+	// whatever the clouddrivers return from /credentials.
+	AccountOverrides map[string]string `yaml:"accountOverrides,omitempty" json:"accountOverrides,omitempty"`
+
+	// RoutingRules route accounts by name pattern, before the routes
+	// discovered from the clouddrivers.  The first matching rule wins.
+	RoutingRules []routingRuleConfig `yaml:"routingRules,omitempty" json:"routingRules,omitempty"`
+
+	// AccountAliases maps account names clients use to the names the
+	// clouddrivers use.
+	AccountAliases map[string]string `yaml:"accountAliases,omitempty" json:"accountAliases,omitempty"`
+
+	// StreamingPaths are the path prefixes on which WebSocket and
+	// server-sent event GETs are tunneled to one clouddriver.
+	StreamingPaths []string `yaml:"streamingPaths,omitempty" json:"streamingPaths,omitempty"`
+
+	// TaskOwners chooses where the clouddriver which created each task
+	// is remembered.
+	TaskOwners taskOwnersConfig `yaml:"taskOwners,omitempty" json:"taskOwners,omitempty"`
+
+	// ControllerCredentialCheckSeconds is how often the controller's
+	// certificate and key files are checked for rotation.
+	ControllerCredentialCheckSeconds int `yaml:"controllerCredentialCheckSeconds,omitempty" json:"controllerCredentialCheckSeconds,omitempty"`
+
+	// ControllerCARefreshSeconds is how often the controller's CA bundle
+	// is re-read and the downstream TLS configuration rebuilt.
+	ControllerCARefreshSeconds int `yaml:"controllerCARefreshSeconds,omitempty" json:"controllerCARefreshSeconds,omitempty"`
+
+	// ControllerGraceSeconds is how long a clouddriver from the
+	// controller keeps its routes after being withdrawn or announced
+	// again, so controller and agent reconnects do not drop accounts.
+	// 0 or less removes withdrawn clouddrivers at once.
+	ControllerGraceSeconds *int `yaml:"controllerGraceSeconds,omitempty" json:"controllerGraceSeconds,omitempty"`
+
+	// ShutdownDrainSeconds is how long in-flight requests are given to
+	// finish on shutdown.
+	ShutdownDrainSeconds int `yaml:"shutdownDrainSeconds,omitempty" json:"shutdownDrainSeconds,omitempty"`
 }
 
 func (c *configuration) applyDefaults() {
 	if c.HTTPListenPort == 0 {
 		c.HTTPListenPort = defaultHTTPListenPort
 	}
+	if c.ShutdownDrainSeconds == 0 {
+		c.ShutdownDrainSeconds = defaultShutdownDrainSeconds
+	}
 	httputil.SetClientConfig(c.HTTPClientConfig)
 	if c.Clouddrivers == nil {
 		c.Clouddrivers = []clouddriverConfig{}
@@ -58,6 +233,34 @@ func (c *configuration) applyDefaults() {
 	if c.SpinnakerUser == "" {
 		c.SpinnakerUser = defaultSpinnakerUser
 	}
+	if c.Controller.URL != "" && c.ControllerCredentialCheckSeconds == 0 {
+		c.ControllerCredentialCheckSeconds = defaultControllerCredentialCheckSeconds
+	}
+	if c.Controller.URL != "" && c.ControllerCARefreshSeconds == 0 {
+		c.ControllerCARefreshSeconds = defaultControllerCARefreshSeconds
+	}
+	if c.Controller.URL != "" && c.ControllerGraceSeconds == nil {
+		grace := defaultControllerGraceSeconds
+		c.ControllerGraceSeconds = &grace
+	}
+	c.Admission.applyDefaults()
+	c.CallerRateLimit.applyDefaults()
+	c.LoadShedding.applyDefaults()
+	c.DownstreamConcurrency.applyDefaults()
+	c.Events.applyDefaults()
+	c.Audit.applyDefaults()
+	c.Journal.applyDefaults()
+	c.TaskTracking.applyDefaults()
+	c.ResponseCache.applyDefaults()
+	c.Search.applyDefaults()
+	c.Cache.applyDefaults()
+	c.Discovery.applyDefaults(c.TLS.enabled())
+	c.Vault.applyDefaults()
+	c.Permissions.Fiat.applyDefaults()
+	c.Tracing.applyDefaults()
+	if c.Retry != nil {
+		c.Retry.applyDefaults()
+	}
 
 	if c.Clouddrivers == nil {
 		c.Clouddrivers = []clouddriverConfig{}
@@ -68,40 +271,244 @@ func (c *configuration) applyDefaults() {
 		if len(cd.Name) == 0 {
 			cd.Name = fmt.Sprintf("clouddriver[%d]", idx)
 		}
-		if len(cd.HealthcheckURL) == 0 && len(cd.URL) != 0 {
-			cd.HealthcheckURL = combineURL(cd.URL, "/health")
-		}
+		cd.applyDefaults(c.Healthcheck)
 	}
 }
 
-func (configuration) validateURL(u string) error {
-	_, err := url.Parse(u)
-	return err
+// applyDefaults fills in the clouddriver's settings, using global for
+// health check settings it does not override.
+func (cd *clouddriverConfig) applyDefaults(global healthcheckConfig) {
+	if len(cd.HealthcheckURL) == 0 && len(cd.URL) != 0 {
+		cd.HealthcheckURL = combineURL(cd.URL, global.merge(cd.Healthcheck).path())
+	}
+	if cd.RateLimit != nil {
+		cd.RateLimit.applyDefaults()
+	}
+	if cd.Retry != nil {
+		cd.Retry.applyDefaults()
+	}
 }
 
 func (c configuration) validate() error {
+	if err := c.Metrics.validate(); err != nil {
+		return err
+	}
+	if err := c.Admin.validate(); err != nil {
+		return fmt.Errorf("admin: %v", err)
+	}
+	if err := c.Dialer.validate(); err != nil {
+		return fmt.Errorf("dialer: %v", err)
+	}
+	if err := c.DNS.validate(); err != nil {
+		return fmt.Errorf("dns: %v", err)
+	}
+	if err := c.CallerRateLimit.validate(); err != nil {
+		return fmt.Errorf("callerRateLimit: %v", err)
+	}
+	if err := c.Events.validate(); err != nil {
+		return fmt.Errorf("events: %v", err)
+	}
+	if err := c.Audit.validate(); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	if err := c.Journal.validate(); err != nil {
+		return fmt.Errorf("journal: %v", err)
+	}
+	if err := c.ResponseHeaders.validate(); err != nil {
+		return fmt.Errorf("responseHeaders: %v", err)
+	}
+	if c.RequestHeaders != nil {
+		if err := c.RequestHeaders.validate(); err != nil {
+			return fmt.Errorf("requestHeaders: %v", err)
+		}
+	}
+	if err := c.TLS.validate(); err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	if err := c.FanOut.validate(); err != nil {
+		return fmt.Errorf("fanOut: %v", err)
+	}
+	if err := c.Healthcheck.validate(); err != nil {
+		return fmt.Errorf("healthcheck: %v", err)
+	}
+	if err := c.Quarantine.validate(); err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	if err := c.Admission.validate(); err != nil {
+		return fmt.Errorf("admission: %v", err)
+	}
+	if err := c.DownstreamConcurrency.validate(); err != nil {
+		return fmt.Errorf("downstreamConcurrency: %v", err)
+	}
+	if err := validateMaxResponseBytes(c.MaxResponseBytes); err != nil {
+		return fmt.Errorf("maxResponseBytes: %v", err)
+	}
+	if c.Retry != nil {
+		if err := c.Retry.validate(); err != nil {
+			return fmt.Errorf("retry: %v", err)
+		}
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return fmt.Errorf("tracing: %v", err)
+	}
+	if err := c.AccessLog.validate(); err != nil {
+		return fmt.Errorf("accessLog: %v", err)
+	}
+	if err := c.Hedging.validate(); err != nil {
+		return fmt.Errorf("hedging: %v", err)
+	}
+	if err := c.Failover.validate(); err != nil {
+		return fmt.Errorf("failover: %v", err)
+	}
+	if err := c.ArtifactFallback.validate(); err != nil {
+		return fmt.Errorf("artifactFallback: %v", err)
+	}
+	if err := c.FeatureFlags.validate(); err != nil {
+		return fmt.Errorf("featureFlags: %v", err)
+	}
+	if err := c.ListKeys.validate(); err != nil {
+		return fmt.Errorf("listKeys: %v", err)
+	}
+	if err := c.ListSorting.validate(); err != nil {
+		return fmt.Errorf("listSorting: %v", err)
+	}
+	if err := c.ResponseCache.validate(); err != nil {
+		return fmt.Errorf("responseCache: %v", err)
+	}
+	if err := c.Search.validate(); err != nil {
+		return fmt.Errorf("search: %v", err)
+	}
+	if err := c.Cache.validate(); err != nil {
+		return fmt.Errorf("cache: %v", err)
+	}
+	if err := c.Discovery.validate(); err != nil {
+		return fmt.Errorf("discovery: %v", err)
+	}
+	if err := c.Vault.validate(); err != nil {
+		return fmt.Errorf("vault: %v", err)
+	}
+	dynamic := c.Controller.URL != "" || c.Discovery.enabled() || c.Admin.Token != ""
+	if err := c.AccountManagement.validate(c.Clouddrivers, dynamic); err != nil {
+		return fmt.Errorf("accountManagement: %v", err)
+	}
+	if err := validateAccountOverrides(c.AccountOverrides); err != nil {
+		return fmt.Errorf("accountOverrides: %v", err)
+	}
+	if _, err := compileRoutingRules(c.RoutingRules); err != nil {
+		return fmt.Errorf("routingRules: %v", err)
+	}
+	if err := c.Permissions.Fiat.validate(); err != nil {
+		return fmt.Errorf("permissions.fiat: %v", err)
+	}
+	if err := validateAccountAliases(c.AccountAliases); err != nil {
+		return fmt.Errorf("accountAliases: %v", err)
+	}
+	if err := validateStreamingPaths(c.StreamingPaths); err != nil {
+		return fmt.Errorf("streamingPaths: %v", err)
+	}
+	if err := c.TaskOwners.validate(c.Cache); err != nil {
+		return fmt.Errorf("taskOwners: %v", err)
+	}
 	for idx, cm := range c.Clouddrivers {
-		if cm.URL == "" {
-			return fmt.Errorf("clouddriver index %d missing url", idx+1)
+		if err := cm.validate(); err != nil {
+			return fmt.Errorf("clouddriver index %d: %v", idx+1, err)
 		}
-		err := c.validateURL(cm.URL)
-		if err != nil {
-			return fmt.Errorf("clouddriver index %d: malformed URL", idx+1)
+	}
+	return nil
+}
+
+func (cm clouddriverConfig) validate() error {
+	if cm.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	if _, err := url.Parse(cm.URL); err != nil {
+		return fmt.Errorf("malformed URL")
+	}
+	if _, err := url.Parse(cm.HealthcheckURL); err != nil {
+		return fmt.Errorf("malformed healthcheck URL")
+	}
+	if cm.Proxy != nil {
+		if err := cm.Proxy.validate(); err != nil {
+			return fmt.Errorf("proxy: %v", err)
 		}
-		err = c.validateURL(cm.HealthcheckURL)
-		if err != nil {
-			return fmt.Errorf("clouddriver index %d: malformed healthcheck URL", idx+1)
+	}
+	if cm.SOCKS5 != nil {
+		if cm.Proxy != nil {
+			return fmt.Errorf("only one of proxy and socks5 may be set")
+		}
+		if err := cm.SOCKS5.validate(); err != nil {
+			return fmt.Errorf("socks5: %v", err)
+		}
+	}
+	if cm.Dialer != nil {
+		if err := cm.Dialer.validate(); err != nil {
+			return fmt.Errorf("dialer: %v", err)
+		}
+	}
+	if _, err := parseMaintenanceWindows(cm.MaintenanceWindows); err != nil {
+		return err
+	}
+	if cm.RateLimit != nil {
+		if err := cm.RateLimit.validate(); err != nil {
+			return fmt.Errorf("rateLimit: %v", err)
+		}
+	}
+	if cm.TLS != nil {
+		if err := cm.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+	if cm.Retry != nil {
+		if err := cm.Retry.validate(); err != nil {
+			return fmt.Errorf("retry: %v", err)
+		}
+	}
+	if cm.Healthcheck != nil {
+		if err := cm.Healthcheck.validate(); err != nil {
+			return fmt.Errorf("healthcheck: %v", err)
+		}
+	}
+	if cm.Weight < 0 {
+		return fmt.Errorf("weight cannot be negative")
+	}
+	if err := validateAccountPatterns(cm.AccountIncludes); err != nil {
+		return fmt.Errorf("accountIncludes: %v", err)
+	}
+	if err := validateAccountPatterns(cm.AccountExcludes); err != nil {
+		return fmt.Errorf("accountExcludes: %v", err)
+	}
+	if cm.OAuth2 != nil {
+		if err := cm.OAuth2.validate(); err != nil {
+			return fmt.Errorf("oauth2: %v", err)
+		}
+		if cm.TokenFile != "" {
+			return fmt.Errorf("only one of oauth2 and tokenFile may be set")
 		}
 	}
 	return nil
 }
 
 func loadConfiguration(y []byte) (*configuration, error) {
+	return loadConfigurationWithEnv(y, os.LookupEnv)
+}
+
+// loadConfigurationWithEnv parses the configuration, expanding ${NAME}
+// references to environment variables found by lookup.
+func loadConfigurationWithEnv(y []byte, lookup func(string) (string, bool)) (*configuration, error) {
 	config := &configuration{}
-	err := yaml.Unmarshal(y, config)
+	var doc yaml.Node
+	err := yaml.Unmarshal(y, &doc)
 	if err != nil {
 		return nil, err
 	}
+	if err := expandEnvNodes(&doc, lookup); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) > 0 {
+		if err := doc.Decode(config); err != nil {
+			return nil, err
+		}
+	}
 
 	config.applyDefaults()
 
@@ -128,8 +535,8 @@ func loadConfigurationFile(filename string) *configuration {
 
 // URLAndPriority holds the URL and current priority.
 type URLAndPriority struct {
-	URL      string `json:"url,omitempty"`
-	Priority int    `json:"priority,omitempty"`
+	URL      string `json:"url,omitempty" yaml:"url,omitempty"`
+	Priority int    `json:"priority,omitempty" yaml:"priority,omitempty"`
 	token    string
 }
 
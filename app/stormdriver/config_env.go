@@ -0,0 +1,105 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// expandEnv replaces ${NAME} in s with the value of the environment
+// variable NAME, or ${NAME:-default} with default if NAME is unset or
+// empty.  $${ is a literal ${.  A $ not followed by { is left alone, so
+// passwords containing $ need no escaping.  Referencing an unset
+// variable without a default is an error, rather than silently using
+// an empty value.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		idx := strings.Index(s, "${")
+		if idx < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if idx > 0 && s[idx-1] == '$' {
+			b.WriteString(s[:idx-1])
+			b.WriteString("${")
+			s = s[idx+2:]
+			continue
+		}
+		b.WriteString(s[:idx])
+		end := strings.Index(s[idx:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		ref := s[idx+2 : idx+end]
+		s = s[idx+end+1:]
+
+		name, fallback, hasFallback := strings.Cut(ref, ":-")
+		if name == "" {
+			return "", fmt.Errorf("empty variable name in ${%s}", ref)
+		}
+		value, found := lookup(name)
+		switch {
+		case found && value != "":
+			b.WriteString(value)
+		case hasFallback:
+			b.WriteString(fallback)
+		case found:
+		default:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+	}
+}
+
+// expandEnvNodes expands environment references in every scalar value
+// in the document.  Keys are left alone.  Only the values are changed,
+// so an expanded value cannot alter the document's structure.
+func expandEnvNodes(n *yaml.Node, lookup func(string) (string, bool)) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		value, err := expandEnv(n.Value, lookup)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n.Line, err)
+		}
+		if value != n.Value {
+			n.Value = value
+			if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				// let a plain value such as ${PORT} resolve as an integer.
+				n.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			if err := expandEnvNodes(n.Content[i], lookup); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, c := range n.Content {
+			if err := expandEnvNodes(c, lookup); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
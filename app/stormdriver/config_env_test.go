@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, found := env[name]
+		return v, found
+	}
+}
+
+func Test_expandEnv(t *testing.T) {
+	lookup := testLookup(map[string]string{"HOST": "cd.example.com", "EMPTY": "", "TOKEN": "a$b"})
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"no references", "http://cd:7002", "http://cd:7002", ""},
+		{"bare dollar", "pa$$word$", "pa$$word$", ""},
+		{"reference", "http://${HOST}:7002", "http://cd.example.com:7002", ""},
+		{"value is not re-expanded", "${TOKEN}", "a$b", ""},
+		{"two references", "${HOST}/${HOST}", "cd.example.com/cd.example.com", ""},
+		{"default when unset", "${MISSING:-fallback}", "fallback", ""},
+		{"default when empty", "${EMPTY:-fallback}", "fallback", ""},
+		{"empty without default", "x${EMPTY}y", "xy", ""},
+		{"escaped", "$${HOST}", "${HOST}", ""},
+		{"unset", "${MISSING}", "", "environment variable MISSING is not set"},
+		{"unterminated", "${HOST", "", `unterminated ${ in "${HOST"`},
+		{"empty name", "${}", "", "empty variable name in ${}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnv(tt.in, lookup)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_loadConfigurationWithEnv(t *testing.T) {
+	lookup := testLookup(map[string]string{
+		"PORT":   "8080",
+		"USER":   "svc-stormdriver",
+		"CD_URL": "http://cd:7002/?q=a: b #c",
+	})
+	config, err := loadConfigurationWithEnv([]byte(`
+httpListenPort: ${PORT}
+spinnakerUser: "${USER}"
+clouddrivers:
+  - name: ${USER}
+    url: ${CD_URL}
+`), lookup)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(8080), config.HTTPListenPort)
+	assert.Equal(t, "svc-stormdriver", config.SpinnakerUser)
+	assert.Equal(t, "svc-stormdriver", config.Clouddrivers[0].Name)
+	assert.Equal(t, "http://cd:7002/?q=a: b #c", config.Clouddrivers[0].URL)
+
+	_, err = loadConfigurationWithEnv([]byte("clouddrivers:\n  - url: ${MISSING}\n"), lookup)
+	assert.EqualError(t, err, "line 2: environment variable MISSING is not set")
+}
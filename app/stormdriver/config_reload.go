@@ -0,0 +1,205 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const configSource = "config"
+
+var configReloads = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "config_reloads_total",
+	Help:      "The number of times the configuration file was reloaded, by result.",
+}, []string{"result"})
+
+// reloadSummary lists the names of the clouddrivers changed by a reload
+// or a discovery update.
+type reloadSummary struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// reconcileConfigured makes the clouddrivers from the configuration
+// file match clouddrivers.  Routes are not touched; they follow on the
+// next credential sync, so a changed clouddriver keeps serving until then.
+func (m *ClouddriverManager) reconcileConfigured(clouddrivers []clouddriverConfig) reloadSummary {
+	summary := m.reconcileSource(configSource, clouddrivers)
+	for _, name := range summary.Removed {
+		healthchecker.RemoveCheck(name)
+	}
+	// AddCheck ignores a name already in use, so a changed clouddriver's
+	// check is removed first to pick up its new URL and settings.
+	recheck := map[string]bool{}
+	for _, name := range append(summary.Added, summary.Changed...) {
+		recheck[name] = true
+	}
+	for _, cd := range clouddrivers {
+		if recheck[cd.Name] {
+			healthchecker.RemoveCheck(cd.Name)
+			healthchecker.AddCheck(cd.Name, true, makeURLChecker(cd))
+		}
+	}
+	return summary
+}
+
+// reconcileSource makes the clouddrivers tracked from source match
+// clouddrivers.  Clouddrivers from other sources are left alone.  A
+// changed clouddriver keeps its last contact time and health.
+func (m *ClouddriverManager) reconcileSource(source string, clouddrivers []clouddriverConfig) reloadSummary {
+	m.Lock()
+	defer m.Unlock()
+
+	ret := reloadSummary{}
+	wanted := map[string]clouddriverConfig{}
+	for _, cd := range clouddrivers {
+		wanted[source+":"+cd.Name] = cd
+	}
+
+	for key, old := range m.state {
+		if old.Source != source {
+			continue
+		}
+		if _, found := wanted[key]; found {
+			continue
+		}
+		delete(m.state, key)
+		healthchecker.RemoveCheck("clouddriver " + key)
+		downstreamClients.register(old.URL, clientOptions{})
+		ret.Removed = append(ret.Removed, old.Name)
+	}
+
+	for key, cd := range wanted {
+		old, found := m.state[key]
+		if found && reflect.DeepEqual(old.config, cd) {
+			url, timeout := healthcheckSettings(cd)
+			if old.healthcheckURL == url && old.healthcheckTimeout == timeout {
+				continue
+			}
+		}
+		if found && old.URL != cd.URL {
+			downstreamClients.register(old.URL, clientOptions{})
+		}
+		if found {
+			healthchecker.RemoveCheck("clouddriver " + key)
+		}
+		_, tracked := makeTrackedClouddriverFromSource(source, cd)
+		if found {
+			tracked.LastSuccessfulContact = m.contactOf(old)
+			tracked.accountHealth = old.accountHealth
+			if !tracked.DisableArtifactAccounts {
+				tracked.artifactHealth = old.artifactHealth
+			}
+			ret.Changed = append(ret.Changed, cd.Name)
+		} else {
+			ret.Added = append(ret.Added, cd.Name)
+		}
+		m.state[key] = tracked
+	}
+
+	sort.Strings(ret.Added)
+	sort.Strings(ret.Removed)
+	sort.Strings(ret.Changed)
+	return ret
+}
+
+// reloadConfiguration re-reads the configuration file and applies the
+// clouddriver list, health check settings, account overrides and
+// routing rules, and HTTP client settings.  If the file cannot be
+// loaded, or a clouddriver's token file cannot be read, the running
+// configuration is kept.  Other settings take effect on the next restart.
+func reloadConfiguration(filename string) error {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	newConf, err := loadConfiguration(buf)
+	if err != nil {
+		return err
+	}
+	if err := checkTokenFiles(newConf.Clouddrivers); err != nil {
+		return err
+	}
+
+	downstreamClients.configure(newConf.HTTPClientConfig, newConf.Dialer, makeCachingResolver(newConf.DNS))
+	downstreamClients.setRetry(newConf.Retry)
+	downstreamClients.setConcurrency(newConf.DownstreamConcurrency)
+	downstreamClients.setMaxResponseBytes(newConf.MaxResponseBytes)
+	setHealthchecks(newConf.Healthcheck)
+	summary := clouddriverManager.reconcileConfigured(newConf.Clouddrivers)
+	clouddriverManager.setAccountOverrides(newConf.AccountOverrides)
+	clouddriverManager.setQuarantine(newConf.Quarantine)
+	rules, _ := compileRoutingRules(newConf.RoutingRules) // checked by validate()
+	clouddriverManager.setRoutingRules(rules)
+	setRunningConfig(appliedOnReload(getRunningConfig(), newConf))
+	zap.S().Infow("configuration reloaded",
+		"path", filename,
+		"added", summary.Added,
+		"removed", summary.Removed,
+		"changed", summary.Changed)
+	return nil
+}
+
+// appliedOnReload returns the configuration in effect after reloaded is
+// applied to running: running, with the settings a reload applies
+// taken from reloaded, so /_internal/config does not show settings
+// which only take effect on the next restart.
+func appliedOnReload(running *configuration, reloaded *configuration) *configuration {
+	if running == nil {
+		return reloaded
+	}
+	ret := *running
+	ret.HTTPClientConfig = reloaded.HTTPClientConfig
+	ret.Dialer = reloaded.Dialer
+	ret.DNS = reloaded.DNS
+	ret.Retry = reloaded.Retry
+	ret.DownstreamConcurrency = reloaded.DownstreamConcurrency
+	ret.MaxResponseBytes = reloaded.MaxResponseBytes
+	ret.Healthcheck = reloaded.Healthcheck
+	ret.Clouddrivers = reloaded.Clouddrivers
+	ret.AccountOverrides = reloaded.AccountOverrides
+	ret.Quarantine = reloaded.Quarantine
+	ret.RoutingRules = reloaded.RoutingRules
+	return &ret
+}
+
+// watchReloadSignal reloads the configuration file each time a signal
+// arrives on sigchan.
+func watchReloadSignal(ctx context.Context, sigchan chan os.Signal, filename string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigchan:
+			if err := reloadConfiguration(filename); err != nil {
+				configReloads.WithLabelValues("failure").Inc()
+				zap.S().Errorw("unable to reload configuration, keeping the current one", "path", filename, "error", err)
+				continue
+			}
+			configReloads.WithLabelValues("success").Inc()
+		}
+	}
+}
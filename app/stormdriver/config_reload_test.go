@@ -0,0 +1,123 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClouddriverManager_reconcileConfigured(t *testing.T) {
+	contact := time.Unix(1000, 0).UTC()
+	cd := func(name string, url string, priority int) clouddriverConfig {
+		ret := clouddriverConfig{Name: name, URL: url, Priority: priority}
+		ret.applyDefaults(healthcheckConfig{})
+		return ret
+	}
+	m := &ClouddriverManager{state: map[string]*trackedClouddriver{}}
+	for _, c := range []clouddriverConfig{cd("same", "http://same", 0), cd("bumped", "http://bumped", 1), cd("gone", "http://gone", 0)} {
+		key, tracked := makeTrackedClouddriverFromConfig(c)
+		tracked.LastSuccessfulContact = contact
+		tracked.accountHealth = nil
+		m.state[key] = tracked
+	}
+	same := m.state["config:same"]
+	m.state["api:registered"] = &trackedClouddriver{Name: "registered", Source: registeredSource}
+	m.state["controller:agent:remote"] = &trackedClouddriver{Name: "remote", Source: "controller"}
+
+	summary := m.reconcileConfigured([]clouddriverConfig{
+		cd("same", "http://same", 0),
+		cd("bumped", "http://bumped", 5),
+		cd("new", "http://new", 0),
+	})
+	assert.Equal(t, reloadSummary{Added: []string{"new"}, Removed: []string{"gone"}, Changed: []string{"bumped"}}, summary)
+
+	assert.Same(t, same, m.state["config:same"], "unchanged clouddrivers are kept as is")
+	assert.NotContains(t, m.state, "config:gone")
+	assert.Contains(t, m.state, "api:registered")
+	assert.Contains(t, m.state, "controller:agent:remote")
+
+	bumped := m.state["config:bumped"]
+	assert.Equal(t, 5, bumped.Priority)
+	assert.Equal(t, contact, bumped.LastSuccessfulContact)
+	assert.NoError(t, bumped.accountHealth, "health carries over")
+
+	added := m.state["config:new"]
+	assert.Equal(t, "http://new", added.URL)
+	assert.Error(t, added.accountHealth)
+}
+
+func Test_ClouddriverManager_reconcileConfigured_healthchecks(t *testing.T) {
+	defer setHealthchecks(getHealthchecks())
+	setHealthchecks(healthcheckConfig{TimeoutSeconds: 5})
+
+	cd := clouddriverConfig{Name: "cd", URL: "http://cd"}
+	cd.applyDefaults(healthcheckConfig{})
+	m := &ClouddriverManager{state: map[string]*trackedClouddriver{}}
+	key, tracked := makeTrackedClouddriverFromConfig(cd)
+	m.state[key] = tracked
+
+	assert.Equal(t, reloadSummary{}, m.reconcileConfigured([]clouddriverConfig{cd}))
+
+	setHealthchecks(healthcheckConfig{TimeoutSeconds: 10})
+	assert.Equal(t, reloadSummary{Changed: []string{"cd"}}, m.reconcileConfigured([]clouddriverConfig{cd}))
+	assert.Equal(t, 10*time.Second, m.state[key].healthcheckTimeout)
+}
+
+func Test_reloadConfiguration(t *testing.T) {
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{state: map[string]*trackedClouddriver{}}
+
+	path := filepath.Join(t.TempDir(), "stormdriver.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("clouddrivers:\n  - name: one\n    url: http://one\n"), 0600))
+	require.NoError(t, reloadConfiguration(path))
+	assert.Contains(t, clouddriverManager.state, "config:one")
+
+	// a broken file leaves the running configuration alone.
+	require.NoError(t, os.WriteFile(path, []byte("clouddrivers:\n  - name: two\n"), 0600))
+	assert.Error(t, reloadConfiguration(path))
+	assert.Contains(t, clouddriverManager.state, "config:one")
+
+	err := reloadConfiguration(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func Test_appliedOnReload(t *testing.T) {
+	running := &configuration{
+		Clouddrivers: []clouddriverConfig{{Name: "one", URL: "http://one"}},
+		Failover:     failoverConfig{MaxAttempts: 2},
+	}
+	reloaded := &configuration{
+		Clouddrivers:     []clouddriverConfig{{Name: "two", URL: "http://two"}},
+		Failover:         failoverConfig{MaxAttempts: 5},
+		MaxResponseBytes: 1024,
+	}
+	got := appliedOnReload(running, reloaded)
+	assert.Equal(t, reloaded.Clouddrivers, got.Clouddrivers)
+	assert.Equal(t, int64(1024), got.MaxResponseBytes)
+	assert.Equal(t, 2, got.Failover.MaxAttempts, "not applied until restart")
+	assert.Equal(t, 2, running.Failover.MaxAttempts, "running is not changed")
+
+	assert.Same(t, reloaded, appliedOnReload(nil, reloaded))
+}
@@ -34,9 +34,12 @@ func Test_ParseFile(t *testing.T) {
 			"empty sets defaults",
 			[]byte(``),
 			&configuration{
-				HTTPListenPort: defaultHTTPListenPort,
-				SpinnakerUser:  defaultSpinnakerUser,
-				Clouddrivers:   []clouddriverConfig{},
+				HTTPListenPort:       defaultHTTPListenPort,
+				SpinnakerUser:        defaultSpinnakerUser,
+				ShutdownDrainSeconds: defaultShutdownDrainSeconds,
+				Search:               searchConfig{CacheTTLSeconds: defaultSearchCacheTTLSeconds, MaxResults: defaultSearchMaxResults, TimeoutSeconds: defaultSearchTimeoutSeconds},
+				Cache:                cacheConfig{Type: cacheTypeMemory},
+				Clouddrivers:         []clouddriverConfig{},
 			},
 			false,
 		},
@@ -44,9 +47,12 @@ func Test_ParseFile(t *testing.T) {
 			"defaults do not override integer",
 			[]byte(`httpListenPort: 1234`),
 			&configuration{
-				HTTPListenPort: 1234,
-				SpinnakerUser:  defaultSpinnakerUser,
-				Clouddrivers:   []clouddriverConfig{},
+				HTTPListenPort:       1234,
+				SpinnakerUser:        defaultSpinnakerUser,
+				ShutdownDrainSeconds: defaultShutdownDrainSeconds,
+				Search:               searchConfig{CacheTTLSeconds: defaultSearchCacheTTLSeconds, MaxResults: defaultSearchMaxResults, TimeoutSeconds: defaultSearchTimeoutSeconds},
+				Cache:                cacheConfig{Type: cacheTypeMemory},
+				Clouddrivers:         []clouddriverConfig{},
 			},
 			false,
 		},
@@ -54,9 +60,12 @@ func Test_ParseFile(t *testing.T) {
 			"defaults do not override string",
 			[]byte(`spinnakerUser: michael`),
 			&configuration{
-				HTTPListenPort: defaultHTTPListenPort,
-				SpinnakerUser:  "michael",
-				Clouddrivers:   []clouddriverConfig{},
+				HTTPListenPort:       defaultHTTPListenPort,
+				SpinnakerUser:        "michael",
+				ShutdownDrainSeconds: defaultShutdownDrainSeconds,
+				Search:               searchConfig{CacheTTLSeconds: defaultSearchCacheTTLSeconds, MaxResults: defaultSearchMaxResults, TimeoutSeconds: defaultSearchTimeoutSeconds},
+				Cache:                cacheConfig{Type: cacheTypeMemory},
+				Clouddrivers:         []clouddriverConfig{},
 			},
 			false,
 		},
@@ -66,11 +75,14 @@ func Test_ParseFile(t *testing.T) {
   - url: abcd
   - url: wxyz`),
 			&configuration{
-				HTTPListenPort: defaultHTTPListenPort,
-				SpinnakerUser:  defaultSpinnakerUser,
+				HTTPListenPort:       defaultHTTPListenPort,
+				SpinnakerUser:        defaultSpinnakerUser,
+				ShutdownDrainSeconds: defaultShutdownDrainSeconds,
+				Search:               searchConfig{CacheTTLSeconds: defaultSearchCacheTTLSeconds, MaxResults: defaultSearchMaxResults, TimeoutSeconds: defaultSearchTimeoutSeconds},
+				Cache:                cacheConfig{Type: cacheTypeMemory},
 				Clouddrivers: []clouddriverConfig{
-					{"clouddriver[0]", "abcd", "abcd/health", false, 0, ""},
-					{"clouddriver[1]", "wxyz", "wxyz/health", false, 0, ""},
+					{Name: "clouddriver[0]", URL: "abcd", HealthcheckURL: "abcd/health"},
+					{Name: "clouddriver[1]", URL: "wxyz", HealthcheckURL: "wxyz/health"},
 				},
 			},
 			false,
@@ -83,11 +95,14 @@ func Test_ParseFile(t *testing.T) {
   - url: wxyz
     healthcheckUrl: pqrs`),
 			&configuration{
-				HTTPListenPort: defaultHTTPListenPort,
-				SpinnakerUser:  defaultSpinnakerUser,
+				HTTPListenPort:       defaultHTTPListenPort,
+				SpinnakerUser:        defaultSpinnakerUser,
+				ShutdownDrainSeconds: defaultShutdownDrainSeconds,
+				Search:               searchConfig{CacheTTLSeconds: defaultSearchCacheTTLSeconds, MaxResults: defaultSearchMaxResults, TimeoutSeconds: defaultSearchTimeoutSeconds},
+				Cache:                cacheConfig{Type: cacheTypeMemory},
 				Clouddrivers: []clouddriverConfig{
-					{"alice", "abcd", "abcd/health", false, 0, ""},
-					{"clouddriver[1]", "wxyz", "pqrs", false, 0, ""},
+					{Name: "alice", URL: "abcd", HealthcheckURL: "abcd/health"},
+					{Name: "clouddriver[1]", URL: "wxyz", HealthcheckURL: "pqrs"},
 				},
 			},
 			false,
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	consulSource         = "consul"
+	defaultConsulAddress = "http://127.0.0.1:8500"
+)
+
+// consulDiscoveryConfig finds clouddrivers as the passing instances of a
+// Consul service, optionally with a tag, and can register Stormdriver.
+// Service metadata sets priority, disableArtifactAccounts, uiUrl, and
+// scheme, as annotations do for the controller.
+type consulDiscoveryConfig struct {
+	Address            string `yaml:"address,omitempty" json:"address,omitempty"`
+	Token              string `yaml:"token,omitempty" json:"token,omitempty"`
+	Service            string `yaml:"service,omitempty" json:"service,omitempty"`
+	Tag                string `yaml:"tag,omitempty" json:"tag,omitempty"`
+	IntervalSeconds    int    `yaml:"intervalSeconds,omitempty" json:"intervalSeconds,omitempty"`
+	registrationConfig `yaml:",inline" json:",inline"`
+}
+
+func (c *consulDiscoveryConfig) applyDefaults(serverTLS bool) {
+	if c.Address == "" {
+		c.Address = defaultConsulAddress
+	}
+	if c.IntervalSeconds == 0 {
+		c.IntervalSeconds = defaultDiscoveryIntervalSeconds
+	}
+	c.registrationConfig.applyDefaults(serverTLS)
+}
+
+func (c consulDiscoveryConfig) validate() error {
+	if c.Service == "" {
+		return errors.New("service is required")
+	}
+	if _, err := url.Parse(c.Address); err != nil {
+		return fmt.Errorf("address: %v", err)
+	}
+	if c.IntervalSeconds < 0 {
+		return errors.New("intervalSeconds cannot be negative")
+	}
+	return c.registrationConfig.validate()
+}
+
+// consulServiceEntry is the part of a /v1/health/service entry which
+// discovery uses.
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+type consulDiscoverer struct {
+	conf     consulDiscoveryConfig
+	address  string
+	client   *http.Client
+	instance registeredInstance
+}
+
+func makeConsulDiscoverer(c consulDiscoveryConfig, listenPort uint16) (*consulDiscoverer, error) {
+	d := &consulDiscoverer{
+		conf:    c,
+		address: strings.TrimSuffix(c.Address, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.Register {
+		instance, err := c.instance(listenPort)
+		if err != nil {
+			return nil, err
+		}
+		d.instance = instance
+	}
+	return d, nil
+}
+
+func (d *consulDiscoverer) headers() map[string]string {
+	if d.conf.Token == "" {
+		return nil
+	}
+	return map[string]string{"x-consul-token": d.conf.Token}
+}
+
+// discover returns a clouddriver for each instance passing its checks.
+func (d *consulDiscoverer) discover(ctx context.Context) ([]clouddriverConfig, error) {
+	q := url.Values{}
+	q.Set("passing", "true")
+	if d.conf.Tag != "" {
+		q.Set("tag", d.conf.Tag)
+	}
+	u := d.address + "/v1/health/service/" + url.PathEscape(d.conf.Service) + "?" + q.Encode()
+	body, err := discoveryRequest(ctx, d.client, http.MethodGet, u, d.headers(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var entries []consulServiceEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, err
+	}
+	ret := []clouddriverConfig{}
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		scheme := entry.Service.Meta["scheme"]
+		if scheme == "" {
+			scheme = "http"
+		}
+		u := scheme + "://" + net.JoinHostPort(host, strconv.Itoa(entry.Service.Port))
+		ret = append(ret, clouddriverFromMetadata(entry.Service.ID, u, entry.Service.Meta, ""))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+// register adds Stormdriver to the local agent, with an HTTP check on
+// /health so it is removed from the catalog if it stops answering.
+func (d *consulDiscoverer) register(ctx context.Context) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"ID":      d.instance.id,
+		"Name":    d.instance.name,
+		"Address": d.instance.address,
+		"Port":    d.instance.port,
+		"Meta":    map[string]string{"scheme": d.instance.baseScheme()},
+		"Check": map[string]string{
+			"HTTP":                           d.instance.baseURL() + "/health",
+			"Interval":                       "10s",
+			"DeregisterCriticalServiceAfter": "5m",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = discoveryRequest(ctx, d.client, http.MethodPut, d.address+"/v1/agent/service/register", d.headers(), body)
+	return err
+}
+
+// renew registers again, as the agent forgets services if it restarts.
+// Registering is idempotent.
+func (d *consulDiscoverer) renew(ctx context.Context) error {
+	return d.register(ctx)
+}
+
+func (d *consulDiscoverer) deregister(ctx context.Context) error {
+	u := d.address + "/v1/agent/service/deregister/" + url.PathEscape(d.instance.id)
+	_, err := discoveryRequest(ctx, d.client, http.MethodPut, u, d.headers(), nil)
+	return err
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_consulDiscoverer_discover(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/health/service/clouddriver", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("passing"))
+		assert.Equal(t, "prod", r.URL.Query().Get("tag"))
+		assert.Equal(t, "sekrit", r.Header.Get("x-consul-token"))
+		_, _ = w.Write([]byte(`[
+		  {"Node": {"Address": "10.0.0.2"}, "Service": {"ID": "cd-2", "Port": 7002, "Meta": {"priority": "3", "scheme": "https"}}},
+		  {"Node": {"Address": "10.0.0.1"}, "Service": {"ID": "cd-1", "Address": "cd-1.internal", "Port": 7002}}
+		]`))
+	}))
+	defer consul.Close()
+
+	c := consulDiscoveryConfig{Address: consul.URL, Token: "sekrit", Service: "clouddriver", Tag: "prod"}
+	c.applyDefaults(false)
+	d, err := makeConsulDiscoverer(c, 7002)
+	require.NoError(t, err)
+	got, err := d.discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []clouddriverConfig{
+		{Name: "cd-1", URL: "http://cd-1.internal:7002"},
+		{Name: "cd-2", URL: "https://10.0.0.2:7002", Priority: 3},
+	}, got)
+}
+
+func Test_consulDiscoverer_registration(t *testing.T) {
+	var lock sync.Mutex
+	calls := []string{}
+	var registered map[string]interface{}
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/v1/agent/service/register" {
+			body, _ := io.ReadAll(r.Body)
+			require.NoError(t, json.Unmarshal(body, &registered))
+		}
+	}))
+	defer consul.Close()
+
+	c := consulDiscoveryConfig{Address: consul.URL, Service: "clouddriver", registrationConfig: registrationConfig{Register: true, AdvertiseAddress: "10.1.1.1"}}
+	c.applyDefaults(false)
+	d, err := makeConsulDiscoverer(c, 7002)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runRegistration(ctx, consulSource, time.Hour, d)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(calls) == 1
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, []string{
+		"PUT /v1/agent/service/register",
+		"PUT /v1/agent/service/deregister/stormdriver-10.1.1.1-7002",
+	}, calls)
+	assert.Equal(t, "stormdriver", registered["Name"])
+	assert.Equal(t, "http://10.1.1.1:7002/health", registered["Check"].(map[string]interface{})["HTTP"])
+}
+
+func Test_consulDiscoverer_register_https(t *testing.T) {
+	var registered map[string]interface{}
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &registered))
+	}))
+	defer consul.Close()
+
+	c := consulDiscoveryConfig{Address: consul.URL, Service: "clouddriver", registrationConfig: registrationConfig{Register: true, AdvertiseAddress: "10.1.1.1"}}
+	c.applyDefaults(true)
+	assert.Equal(t, "https", c.AdvertiseScheme, "https when serving TLS")
+	d, err := makeConsulDiscoverer(c, 7002)
+	require.NoError(t, err)
+	require.NoError(t, d.register(context.Background()))
+	assert.Equal(t, "https://10.1.1.1:7002/health", registered["Check"].(map[string]interface{})["HTTP"])
+	assert.Equal(t, "https", registered["Meta"].(map[string]interface{})["scheme"])
+}
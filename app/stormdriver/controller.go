@@ -0,0 +1,237 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/birger"
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultControllerCredentialCheckSeconds = 60
+	defaultControllerCARefreshSeconds       = 300
+)
+
+// controllerSession owns the birger ControllerManager.  The manager fetches
+// a token for each service once and keeps it for its lifetime, so when
+// the controller credentials change the only way to pick up new tokens
+// is to replace the manager.  The session does this transparently: all
+// updates are forwarded to a single long-lived channel, and replaced
+// managers are shut down in the background.
+type controllerSession struct {
+	sync.Mutex
+	conf        birger.Config
+	serviceType []string
+	manager     *birger.ControllerManager
+	generation  int
+	fingerprint string
+	updates     chan birger.ServiceUpdate
+	reconnect   chan struct{}
+	caRefresh   chan struct{}
+	caPEM       []byte
+}
+
+func makeControllerSession(conf birger.Config, serviceTypes []string) *controllerSession {
+	s := &controllerSession{
+		conf:        conf,
+		serviceType: serviceTypes,
+		updates:     make(chan birger.ServiceUpdate),
+		reconnect:   make(chan struct{}, 1),
+		caRefresh:   make(chan struct{}, 1),
+	}
+	s.fingerprint, _ = s.credentialFingerprint()
+	s.observeCertificate()
+	s.start()
+	return s
+}
+
+// observeCertificate records the controller client certificate's expiry.
+func (s *controllerSession) observeCertificate() {
+	if s.conf.CertificatePath == "" {
+		return
+	}
+	if err := tlsObservations.observeCertificateFile(controllerClientCertificate, s.conf.CertificatePath); err != nil {
+		zap.S().Warnw("unable to read controller certificate", "path", s.conf.CertificatePath, "error", err)
+	}
+}
+
+// start creates a new manager and begins forwarding its updates.
+func (s *controllerSession) start() {
+	s.Lock()
+	old := s.manager
+	s.generation++
+	generation := s.generation
+	s.manager = birger.MakeControllerManager(s.conf, s.serviceType)
+	manager := s.manager
+	s.Unlock()
+
+	go s.forward(manager, generation)
+	if old != nil {
+		go old.Shutdown()
+	}
+}
+
+// forward copies updates from one manager until its channel is closed.
+// Once a manager has been replaced, anything it still sends is dropped.
+func (s *controllerSession) forward(manager *birger.ControllerManager, generation int) {
+	for update := range manager.UpdateChan {
+		s.Lock()
+		current := s.generation == generation
+		s.Unlock()
+		if current {
+			s.updates <- update
+		}
+	}
+}
+
+// Check implements the health check interface using the current manager.
+func (s *controllerSession) Check() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.manager.Check()
+}
+
+func (s *controllerSession) getCACertPEM() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.manager.GetCACertPEM()
+}
+
+// credentialFingerprint hashes the contents of the controller's
+// certificate authority, certificate, and key files.
+func (s *controllerSession) credentialFingerprint() (string, error) {
+	conf := s.conf
+	h := sha256.New()
+	for _, path := range []string{conf.CAPath, conf.CertificatePath, conf.KeyPath} {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// requestReconnect asks the session to re-establish the controller
+// connection, fetching fresh tokens for all services.
+func (s *controllerSession) requestReconnect() {
+	select {
+	case s.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// watchCredentials checks the credential files periodically, and replaces
+// the manager when they change or a reconnect is requested.
+func (s *controllerSession) watchCredentials(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.reconnect:
+			zap.S().Infow("reconnecting to controller on request")
+			s.start()
+		case <-t.C:
+			fingerprint, err := s.credentialFingerprint()
+			if err != nil {
+				zap.S().Warnw("unable to read controller credentials", "error", err)
+				continue
+			}
+			if fingerprint == s.fingerprint {
+				continue
+			}
+			zap.S().Infow("controller credentials changed, reconnecting")
+			s.fingerprint = fingerprint
+			s.observeCertificate()
+			s.start()
+		}
+	}
+}
+
+// requestCARefresh asks the session to re-read the controller CA bundle
+// now, rather than waiting for the next periodic check.
+func (s *controllerSession) requestCARefresh() {
+	select {
+	case s.caRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// loadCA reads the controller CA bundle and, if it differs from the
+// one currently in use, rebuilds the TLS configuration used for all
+// downstream connections.
+func (s *controllerSession) loadCA() error {
+	caCert, err := s.getCACertPEM()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(caCert, s.caPEM) {
+		return nil
+	}
+	cfg, err := makeTLSConfigWithCA(caCert)
+	if err != nil {
+		return err
+	}
+	if s.caPEM != nil {
+		zap.S().Infow("controller CA bundle changed, rebuilding TLS configuration")
+	}
+	s.caPEM = caCert
+	downstreamClients.setTLSConfig(cfg)
+	return nil
+}
+
+// watchCA periodically re-reads the controller CA bundle, or sooner when
+// a downstream connection fails certificate verification.
+func (s *controllerSession) watchCA(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.caRefresh:
+		case <-t.C:
+		}
+		if err := s.loadCA(); err != nil {
+			zap.S().Warnw("unable to refresh controller CA bundle", "error", err)
+		}
+	}
+}
+
+func (*srv) controllerReconnectRequest(w http.ResponseWriter, req *http.Request) {
+	if controller == nil {
+		httputil.SetError(w, http.StatusNotFound, "controller not configured")
+		return
+	}
+	controller.requestReconnect()
+	w.WriteHeader(http.StatusAccepted)
+}
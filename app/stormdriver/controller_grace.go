@@ -0,0 +1,144 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultControllerGraceSeconds = 60
+
+// setControllerGrace sets how long a clouddriver the controller stops
+// announcing, or re-announces, keeps its routes while it reconnects.
+// 0 removes withdrawn clouddrivers at once.
+func (m *ClouddriverManager) setControllerGrace(grace time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.controllerGrace = grace
+}
+
+// withdraw handles the controller no longer announcing a clouddriver.
+// It is kept, with its routes, until the grace period ends, in case
+// the controller or agent is only reconnecting.  Must be called with
+// the lock held.
+func (m *ClouddriverManager) withdraw(key string, now time.Time) {
+	cd, found := m.state[key]
+	if !found {
+		return
+	}
+	if m.controllerGrace <= 0 {
+		m.removeClouddriver(key)
+		return
+	}
+	if !cd.withdrawn {
+		zap.S().Infow("clouddriver withdrawn by controller, keeping routes", "clouddriver", cd.Name, "agent", cd.AgentName, "grace", m.controllerGrace)
+	}
+	cd.withdrawn = true
+	cd.graceUntil = now.Add(m.controllerGrace)
+}
+
+// removeClouddriver forgets a clouddriver.  Its routes are dropped by
+// the next sync.  Must be called with the lock held.
+func (m *ClouddriverManager) removeClouddriver(key string) {
+	delete(m.state, key)
+	healthchecker.RemoveCheck("clouddriver " + key)
+}
+
+// expireWithdrawn removes the withdrawn clouddrivers whose grace period
+// has ended.  Must be called with the lock held.
+func (m *ClouddriverManager) expireWithdrawn(now time.Time) {
+	for key, cd := range m.state {
+		if cd.withdrawn && !now.Before(cd.graceUntil) {
+			zap.S().Infow("clouddriver grace period ended, removing", "clouddriver", cd.Name, "agent", cd.AgentName)
+			m.removeClouddriver(key)
+		}
+	}
+}
+
+// reannounce replaces a clouddriver the controller has announced again,
+// carrying over what is known about it.  A new token changes its route
+// key, so routes and synced accounts are moved to the new key rather
+// than waiting for the next sync.  Must be called with the lock held.
+func (m *ClouddriverManager) reannounce(old *trackedClouddriver, tracked *trackedClouddriver, now time.Time) {
+	tracked.LastSuccessfulContact = m.contactOf(old)
+	tracked.accountHealth = old.accountHealth
+	tracked.artifactHealth = old.artifactHealth
+	if m.controllerGrace > 0 {
+		tracked.graceUntil = now.Add(m.controllerGrace)
+	}
+	if old.withdrawn {
+		zap.S().Infow("clouddriver announced again by controller", "clouddriver", tracked.Name, "agent", tracked.AgentName)
+	}
+
+	oldKey := old.routeKey()
+	newKey := tracked.routeKey()
+	if oldKey == newKey {
+		return
+	}
+	route := URLAndPriority{URL: tracked.URL, Priority: tracked.Priority, token: tracked.token}
+	retargetRoutes(m.cloudAccountRoutes, oldKey, route)
+	retargetRoutes(m.artifactAccountRoutes, oldKey, route)
+	moveSynced(m.syncedCloudAccounts, oldKey, newKey)
+	moveSynced(m.syncedArtifactAccounts, oldKey, newKey)
+}
+
+func retargetRoutes(routes map[string]URLAndPriority, oldKey string, route URLAndPriority) {
+	for name, current := range routes {
+		if current.key() == oldKey {
+			routes[name] = route
+		}
+	}
+}
+
+func moveSynced(synced map[string][]trackedSpinnakerAccount, oldKey string, newKey string) {
+	if accounts, found := synced[oldKey]; found {
+		delete(synced, oldKey)
+		synced[newKey] = accounts
+	}
+}
+
+// retainDuringGrace keeps the accounts a clouddriver returned on the
+// previous sync if it failed to answer this one while in its grace
+// period, so a reconnecting agent does not briefly lose its routes.
+// Retained accounts are added to synced, routes, and the returned
+// accounts.  Must be called with the lock held.
+func (m *ClouddriverManager) retainDuringGrace(asked []URLAndPriority, synced map[string][]trackedSpinnakerAccount, previous map[string][]trackedSpinnakerAccount, routes map[string]URLAndPriority, accounts []trackedSpinnakerAccount, now time.Time) []trackedSpinnakerAccount {
+	inGrace := map[string]bool{}
+	for _, cd := range m.state {
+		if now.Before(cd.graceUntil) {
+			inGrace[cd.routeKey()] = true
+		}
+	}
+	for _, cd := range asked {
+		key := cd.key()
+		if !inGrace[key] {
+			continue
+		}
+		if _, found := synced[key]; found {
+			continue
+		}
+		retained, found := previous[key]
+		if !found {
+			continue
+		}
+		synced[key] = retained
+		accounts = mergeIfUnique(cd, retained, routes, accounts)
+	}
+	return accounts
+}
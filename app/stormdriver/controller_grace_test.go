@@ -0,0 +1,136 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpsMx/go-app-base/birger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClouddriverManager_handleUpdate_reconnect(t *testing.T) {
+	m := &ClouddriverManager{
+		state:                 map[string]*trackedClouddriver{},
+		cloudAccountRoutes:    map[string]URLAndPriority{},
+		artifactAccountRoutes: map[string]URLAndPriority{},
+	}
+	m.setControllerGrace(time.Minute)
+	update := birger.ServiceUpdate{Operation: "update", Name: "cd", AgentName: "agent1", URL: "http://agent1", Token: "old"}
+	m.handleUpdate(update)
+	key := "controller:agent1:cd"
+	require.Contains(t, m.state, key)
+
+	oldRoute := URLAndPriority{URL: "http://agent1", token: "old"}
+	m.cloudAccountRoutes["acct"] = oldRoute
+	m.artifactAccountRoutes["artifacts"] = oldRoute
+	m.syncedCloudAccounts = map[string][]trackedSpinnakerAccount{oldRoute.key(): {{Name: "acct"}}}
+	m.syncedArtifactAccounts = map[string][]trackedSpinnakerAccount{oldRoute.key(): {{Name: "artifacts"}}}
+
+	m.handleUpdate(birger.ServiceUpdate{Operation: "delete", Name: "cd", AgentName: "agent1"})
+	require.Contains(t, m.state, key, "withdrawn clouddrivers are kept during the grace period")
+	assert.True(t, m.state[key].withdrawn)
+	assert.Equal(t, oldRoute, m.cloudAccountRoutes["acct"])
+
+	update.Token = "new"
+	m.handleUpdate(update)
+	require.Contains(t, m.state, key)
+	assert.False(t, m.state[key].withdrawn)
+	newRoute := URLAndPriority{URL: "http://agent1", token: "new"}
+	assert.Equal(t, newRoute, m.cloudAccountRoutes["acct"], "routes follow the new token")
+	assert.Equal(t, newRoute, m.artifactAccountRoutes["artifacts"])
+	assert.Equal(t, []trackedSpinnakerAccount{{Name: "acct"}}, m.syncedCloudAccounts[newRoute.key()])
+	assert.NotContains(t, m.syncedCloudAccounts, oldRoute.key())
+	assert.Contains(t, m.syncedArtifactAccounts, newRoute.key())
+}
+
+func Test_ClouddriverManager_withdraw(t *testing.T) {
+	now := time.Now()
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"controller:a:cd": {Name: "cd", URL: "url1"},
+		},
+	}
+	m.setControllerGrace(time.Minute)
+	m.withdraw("controller:a:cd", now)
+	m.withdraw("controller:a:missing", now)
+	m.expireWithdrawn(now.Add(59 * time.Second))
+	assert.Contains(t, m.state, "controller:a:cd")
+	m.expireWithdrawn(now.Add(time.Minute))
+	assert.NotContains(t, m.state, "controller:a:cd")
+
+	m.state["controller:a:cd"] = &trackedClouddriver{Name: "cd", URL: "url1"}
+	m.setControllerGrace(0)
+	m.withdraw("controller:a:cd", now)
+	assert.NotContains(t, m.state, "controller:a:cd", "without a grace period, withdrawn clouddrivers are removed at once")
+}
+
+func Test_ClouddriverManager_retainDuringGrace(t *testing.T) {
+	now := time.Now()
+	reconnecting := URLAndPriority{URL: "url1", token: "t1"}
+	settled := URLAndPriority{URL: "url2"}
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"controller:a:cd1": {Name: "cd1", URL: "url1", token: "t1", graceUntil: now.Add(time.Second)},
+			"controller:b:cd2": {Name: "cd2", URL: "url2", graceUntil: now.Add(-time.Second)},
+		},
+	}
+	previous := map[string][]trackedSpinnakerAccount{
+		reconnecting.key(): {{Name: "acct1"}},
+		settled.key():      {{Name: "acct2"}},
+	}
+	synced := map[string][]trackedSpinnakerAccount{}
+	routes := map[string]URLAndPriority{}
+
+	accounts := m.retainDuringGrace([]URLAndPriority{reconnecting, settled}, synced, previous, routes, []trackedSpinnakerAccount{}, now)
+	assert.Equal(t, []trackedSpinnakerAccount{{Name: "acct1"}}, accounts)
+	assert.Equal(t, map[string]URLAndPriority{"acct1": reconnecting}, routes)
+	assert.Equal(t, previous[reconnecting.key()], synced[reconnecting.key()], "retained accounts survive further failed syncs")
+	assert.NotContains(t, synced, settled.key())
+}
+
+func Test_configuration_controllerGraceSeconds(t *testing.T) {
+	c, err := loadConfiguration([]byte("controller:\n  url: https://controller:9003\n"))
+	require.NoError(t, err)
+	require.NotNil(t, c.ControllerGraceSeconds)
+	assert.Equal(t, defaultControllerGraceSeconds, *c.ControllerGraceSeconds)
+
+	c, err = loadConfiguration([]byte("controller:\n  url: https://controller:9003\ncontrollerGraceSeconds: 0\n"))
+	require.NoError(t, err)
+	require.NotNil(t, c.ControllerGraceSeconds)
+	assert.Equal(t, 0, *c.ControllerGraceSeconds, "0 is kept, removing withdrawn clouddrivers at once")
+}
+
+func Test_ClouddriverManager_getHealthyClouddriverURLs_withdrawn(t *testing.T) {
+	present := URLAndPriority{URL: "url1"}
+	withdrawn := URLAndPriority{URL: "url2"}
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"controller:a:cd1": {Name: "cd1", URL: "url1"},
+			"controller:b:cd2": {Name: "cd2", URL: "url2", withdrawn: true},
+		},
+		cloudAccountRoutes:    map[string]URLAndPriority{"acct1": present, "acct2": withdrawn},
+		artifactAccountRoutes: map[string]URLAndPriority{},
+	}
+	assert.Equal(t, []URLAndPriority{present}, m.getHealthyClouddriverURLs(), "withdrawn clouddrivers get no fan-out requests")
+
+	route, found := m.findCloudRoute("acct2")
+	assert.True(t, found, "but keep their routes")
+	assert.Equal(t, withdrawn, route)
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// ownerOnlyCredentialFields are taken only from the clouddriver an
+// account is routed to, never merged from others.  Merging permissions
+// would grant access the routed clouddriver does not.
+var ownerOnlyCredentialFields = []string{"permissions"}
+
+// credentialsList proxies /credentials.  With ?expand=true, Gate asks
+// for each account's details, such as regions, permissions, and
+// dockerRegistries, so an account listed by more than one clouddriver
+// is merged rather than taken from whichever answered first.
+func (s *srv) credentialsList() http.HandlerFunc {
+	plain := s.fetchFilteredList("name", s.filterCredentials)
+	expanded := s.fetchCombinedList(combineExpandedCredentials, "name", s.filterCredentials)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("expand") == "true" {
+			expanded(w, req)
+			return
+		}
+		plain(w, req)
+	}
+}
+
+// combineExpandedCredentials merges expanded /credentials lists, using
+// the clouddriver each account is routed to as the owner of its entry.
+func combineExpandedCredentials(c chan listFetchResult, count int, key string, stats mergeCounts) []interface{} {
+	return combineOwnedLists(c, count, key, credentialsOwner, stats)
+}
+
+// credentialsOwner returns the name of the clouddriver the account is
+// routed to, as used for listFetchResult.source, or "" if it has none.
+func credentialsOwner(item map[string]interface{}) string {
+	route, found := clouddriverManager.findCloudRoute(getKeyValue(item, "name"))
+	if !found {
+		return ""
+	}
+	return mergeSource(route)
+}
+
+// combineOwnedLists merges the lists, combining items with the same key
+// into one.  The fields of the entry from owner(item), or if it did not
+// return one, the first entry, win over the others; lists and maps are
+// merged as for map responses, except for ownerOnlyCredentialFields.
+// Items without a key are dropped.
+func combineOwnedLists(c chan listFetchResult, count int, key string, owner func(map[string]interface{}) string, stats mergeCounts) []interface{} {
+	type entry struct {
+		source string
+		item   map[string]interface{}
+	}
+	order := []string{}
+	entries := map[string][]entry{}
+	for i := 0; i < count; i++ {
+		j := <-c
+		if j.result.err != nil {
+			zap.S().Errorw("failed to fetch", "error", j.result.err)
+			continue
+		}
+		stats.add(j.source, len(j.data), 0)
+		for _, item := range j.data {
+			itemKey := getListKey(item, key)
+			if itemKey == "" {
+				continue
+			}
+			if _, seen := entries[itemKey]; seen {
+				stats.add(j.source, 0, 1)
+			} else {
+				order = append(order, itemKey)
+			}
+			// getListKey only finds keys in objects.
+			entries[itemKey] = append(entries[itemKey], entry{j.source, item.(map[string]interface{})})
+		}
+	}
+
+	ret := make([]interface{}, 0, len(order))
+	for _, itemKey := range order {
+		found := entries[itemKey]
+		primary := 0
+		if len(found) > 1 {
+			name := owner(found[0].item)
+			for i, e := range found {
+				if e.source == name {
+					primary = i
+					break
+				}
+			}
+		}
+		merged := map[string]interface{}{}
+		for i, e := range found {
+			if i != primary {
+				mergeMaps(merged, e.item)
+			}
+		}
+		// merged last, so its values replace the others'.
+		mergeMaps(merged, found[primary].item)
+		for _, field := range ownerOnlyCredentialFields {
+			if v, ok := found[primary].item[field]; ok {
+				merged[field] = v
+			} else {
+				delete(merged, field)
+			}
+		}
+		ret = append(ret, merged)
+	}
+	return ret
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_combineOwnedLists(t *testing.T) {
+	owners := map[string]string{"prod": "cd2"}
+	owner := func(item map[string]interface{}) string {
+		return owners[getKeyValue(item, "name")]
+	}
+	tests := []struct {
+		name    string
+		results []listFetchResult
+		want    []interface{}
+	}{
+		{
+			"accounts on one clouddriver are unchanged",
+			[]listFetchResult{
+				{source: "cd1", data: []interface{}{
+					map[string]interface{}{"name": "dev", "regions": []interface{}{"us-east-1"}},
+				}},
+				{source: "cd2", data: []interface{}{
+					map[string]interface{}{"name": "prod", "regions": []interface{}{"us-west-2"}},
+				}},
+			},
+			[]interface{}{
+				map[string]interface{}{"name": "dev", "regions": []interface{}{"us-east-1"}},
+				map[string]interface{}{"name": "prod", "regions": []interface{}{"us-west-2"}},
+			},
+		},
+		{
+			"the owner's values win, lists and maps are merged",
+			[]listFetchResult{
+				{source: "cd1", data: []interface{}{
+					map[string]interface{}{
+						"name":             "prod",
+						"environment":      "staging",
+						"regions":          []interface{}{"us-east-1"},
+						"dockerRegistries": map[string]interface{}{"hub": "index.docker.io"},
+						"extra":            "from cd1",
+					},
+				}},
+				{source: "cd2", data: []interface{}{
+					map[string]interface{}{
+						"name":             "prod",
+						"environment":      "prod",
+						"regions":          []interface{}{"us-east-1", "us-west-2"},
+						"dockerRegistries": map[string]interface{}{"gcr": "gcr.io"},
+					},
+				}},
+			},
+			[]interface{}{
+				map[string]interface{}{
+					"name":             "prod",
+					"environment":      "prod",
+					"regions":          []interface{}{"us-east-1", "us-west-2"},
+					"dockerRegistries": map[string]interface{}{"hub": "index.docker.io", "gcr": "gcr.io"},
+					"extra":            "from cd1",
+				},
+			},
+		},
+		{
+			"permissions come only from the owner",
+			[]listFetchResult{
+				{source: "cd1", data: []interface{}{
+					map[string]interface{}{"name": "prod", "permissions": map[string]interface{}{
+						"READ": []interface{}{"everyone"},
+					}},
+				}},
+				{source: "cd2", data: []interface{}{
+					map[string]interface{}{"name": "prod", "permissions": map[string]interface{}{
+						"READ": []interface{}{"admins"},
+					}},
+				}},
+			},
+			[]interface{}{
+				map[string]interface{}{"name": "prod", "permissions": map[string]interface{}{
+					"READ": []interface{}{"admins"},
+				}},
+			},
+		},
+		{
+			"permissions the owner does not set are not taken from others",
+			[]listFetchResult{
+				{source: "cd1", data: []interface{}{
+					map[string]interface{}{"name": "prod", "permissions": map[string]interface{}{
+						"READ": []interface{}{"everyone"},
+					}},
+				}},
+				{source: "cd2", data: []interface{}{
+					map[string]interface{}{"name": "prod"},
+				}},
+			},
+			[]interface{}{
+				map[string]interface{}{"name": "prod"},
+			},
+		},
+		{
+			"without an owner, the first answer wins",
+			[]listFetchResult{
+				{source: "cd1", data: []interface{}{
+					map[string]interface{}{"name": "dev", "environment": "one"},
+				}},
+				{source: "cd2", data: []interface{}{
+					map[string]interface{}{"name": "dev", "environment": "two"},
+				}},
+			},
+			[]interface{}{
+				map[string]interface{}{"name": "dev", "environment": "one"},
+			},
+		},
+		{
+			"errors and items without names are skipped",
+			[]listFetchResult{
+				{source: "cd1", result: fetchResult{err: fmt.Errorf("unreachable")}},
+				{source: "cd2", data: []interface{}{
+					map[string]interface{}{"type": "kubernetes"},
+					map[string]interface{}{"name": "prod"},
+				}},
+			},
+			[]interface{}{
+				map[string]interface{}{"name": "prod"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := make(chan listFetchResult, len(tt.results))
+			for _, r := range tt.results {
+				c <- r
+			}
+			got := combineOwnedLists(c, len(tt.results), "name", owner, nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/gorilla/mux"
+)
+
+// routeMetadata describes how an account is routed, for support tooling.
+type routeMetadata struct {
+	Clouddriver string    `json:"clouddriver,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	AgentName   string    `json:"agentName,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Priority    int       `json:"priority"`
+	Imported    bool      `json:"imported,omitempty"`
+	LastSync    time.Time `json:"lastSync"`
+}
+
+// describeCloudRoute returns the route for a cloud account, and
+// what is known about the clouddriver it points to.
+func (m *ClouddriverManager) describeCloudRoute(name string) (routeMetadata, URLAndPriority, bool) {
+	m.Lock()
+	defer m.Unlock()
+	imported := false
+	route, found := m.cloudAccountRoutes[name]
+	if !found {
+		route, found = m.findImportedRoute(name, false)
+		imported = true
+	}
+	if !found {
+		return routeMetadata{}, URLAndPriority{}, false
+	}
+	meta := routeMetadata{
+		URL:      route.URL,
+		Priority: route.Priority,
+		Imported: imported,
+		LastSync: m.lastCloudSync,
+	}
+	for _, cd := range m.state {
+		if cd.routeKey() == route.key() {
+			meta.Clouddriver = cd.Name
+			meta.Source = cd.Source
+			meta.AgentName = cd.AgentName
+			break
+		}
+	}
+	return meta, route, true
+}
+
+// addRouteMetadata adds meta to a JSON object as "stormdriverMetadata".
+// If data is not a JSON object, it returns false.
+func addRouteMetadata(data []byte, meta routeMetadata) ([]byte, bool) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil || doc == nil {
+		return nil, false
+	}
+	doc["stormdriverMetadata"] = meta
+	ret, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false
+	}
+	return ret, true
+}
+
+// credentialsByAccount proxies /credentials/{account}.  With
+// ?stormdriverMetadata=true, the response is enriched with how the
+// account is routed; the parameter is not sent to clouddriver.
+// Accounts the request may not read are refused, as they are left out
+// of /credentials.
+func (s *srv) credentialsByAccount() http.HandlerFunc {
+	plain := s.singleItemByIDPath("account")
+	return func(w http.ResponseWriter, req *http.Request) {
+		accountName := mux.Vars(req)["account"]
+		if !s.permissions.checkRead(req, accountName) {
+			httputil.SetError(w, http.StatusForbidden, "access denied to account "+aliases.alias(accountName))
+			return
+		}
+		query := req.URL.Query()
+		withMetadata := query.Get("stormdriverMetadata") == "true"
+		if !withMetadata && aliases.alias(accountName) == accountName {
+			plain(w, req)
+			return
+		}
+		meta, route, found := clouddriverManager.describeCloudRoute(accountName)
+		if !found {
+			requestLogger(req.Context()).Warnw("no route", "accountName", accountName)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		query.Del("stormdriverMetadata")
+		uri := req.URL.EscapedPath()
+		if encoded := query.Encode(); encoded != "" {
+			uri += "?" + encoded
+		}
+		target := combineURL(route.URL, uri)
+		data, code, headers, err := fetchGet(withRoute(req.Context(), route), target, route.token, req.Header)
+		if err != nil {
+			requestLogger(req.Context()).Errorw("fetchGet", "target", target, "hasToken", route.token != "", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if httputil.StatusCodeOK(code) {
+			if withMetadata {
+				if enriched, ok := addRouteMetadata(data, meta); ok {
+					data = enriched
+				}
+			}
+			data = aliases.renameAccountDocument(data)
+		}
+		setContentType(w, headers.Get("content-type"))
+		w.WriteHeader(code)
+		httputil.CheckedWrite(w, data)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClouddriverManager_describeCloudRoute(t *testing.T) {
+	synced := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"controller:agent1:cd": {Name: "cd", Source: "controller", AgentName: "agent1", URL: "url1", token: "t"},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a1": {URL: "url1", Priority: 5, token: "t"},
+		},
+		lastCloudSync: synced,
+	}
+
+	meta, route, found := m.describeCloudRoute("a1")
+	require.True(t, found)
+	assert.Equal(t, URLAndPriority{URL: "url1", Priority: 5, token: "t"}, route)
+	assert.Equal(t, routeMetadata{
+		Clouddriver: "cd",
+		Source:      "controller",
+		AgentName:   "agent1",
+		URL:         "url1",
+		Priority:    5,
+		LastSync:    synced,
+	}, meta)
+
+	_, _, found = m.describeCloudRoute("missing")
+	assert.False(t, found)
+}
+
+func Test_addRouteMetadata(t *testing.T) {
+	meta := routeMetadata{Clouddriver: "cd", Priority: 1, LastSync: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)}
+
+	got, ok := addRouteMetadata([]byte(`{"name":"a1"}`), meta)
+	require.True(t, ok)
+	assert.JSONEq(t, `{"name":"a1","stormdriverMetadata":{"clouddriver":"cd","priority":1,"lastSync":"2022-06-01T12:00:00Z"}}`, string(got))
+
+	_, ok = addRouteMetadata([]byte(`["not an object"]`), meta)
+	assert.False(t, ok)
+	_, ok = addRouteMetadata([]byte(`null`), meta)
+	assert.False(t, ok)
+}
+
+func Test_credentialsByAccount_permissions(t *testing.T) {
+	a := hedgeTestServer(t, 0, http.StatusOK, `{"name":"prod"}`)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{"prod": {URL: a.URL}},
+		cloudAccounts: []trackedSpinnakerAccount{
+			{Name: "prod", permissions: accountPermissions{"READ": {"ops"}}},
+		},
+	}
+
+	s := &srv{permissions: makePermissionChecker(permissionsConfig{Enforce: true})}
+	r := mux.NewRouter()
+	r.HandleFunc("/credentials/{account}", s.credentialsByAccount())
+
+	tests := []struct {
+		roles    string
+		wantCode int
+	}{
+		{"ops", http.StatusOK},
+		{"dev", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.roles, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/credentials/prod", nil)
+			req.Header.Set("x-spinnaker-roles", tt.roles)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
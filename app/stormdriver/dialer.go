@@ -0,0 +1,232 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	ipPreferenceAny  = "any"
+	ipPreferenceIPv4 = "ipv4"
+	ipPreferenceIPv6 = "ipv6"
+
+	// defaultFallbackDelay matches the Go standard library's delay before
+	// starting a happy eyeballs fallback connection.
+	defaultFallbackDelay = 300 * time.Millisecond
+)
+
+// dialerConfig controls how connections to clouddrivers are made when a
+// host has both IPv4 and IPv6 addresses.  IPPreference is one of "any"
+// (the default, using the system's address ordering), "ipv4", or "ipv6".
+// HappyEyeballs, enabled by default, races the other address family
+// if the preferred one does not connect quickly; when disabled, each
+// address is tried in turn.
+type dialerConfig struct {
+	IPPreference  string `yaml:"ipPreference,omitempty" json:"ipPreference,omitempty"`
+	HappyEyeballs *bool  `yaml:"happyEyeballs,omitempty" json:"happyEyeballs,omitempty"`
+}
+
+func (c dialerConfig) validate() error {
+	switch c.IPPreference {
+	case "", ipPreferenceAny, ipPreferenceIPv4, ipPreferenceIPv6:
+		return nil
+	default:
+		return fmt.Errorf("ipPreference must be one of %s, %s, or %s", ipPreferenceAny, ipPreferenceIPv4, ipPreferenceIPv6)
+	}
+}
+
+func (c dialerConfig) isDefault() bool {
+	return (c.IPPreference == "" || c.IPPreference == ipPreferenceAny) && c.HappyEyeballs == nil
+}
+
+// merge returns c with any fields set in override replacing its own.
+func (c dialerConfig) merge(override *dialerConfig) dialerConfig {
+	if override == nil {
+		return c
+	}
+	if override.IPPreference != "" {
+		c.IPPreference = override.IPPreference
+	}
+	if override.HappyEyeballs != nil {
+		c.HappyEyeballs = override.HappyEyeballs
+	}
+	return c
+}
+
+func (c dialerConfig) happyEyeballs() bool {
+	return c.HappyEyeballs == nil || *c.HappyEyeballs
+}
+
+// ipResolver looks up the addresses for a hostname.
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dialContext returns a dial function for d which applies this
+// configuration, resolving names with resolver if it is not nil.
+// d is modified to disable happy eyeballs if needed.
+func (c dialerConfig) dialContext(d *net.Dialer, resolver *cachingResolver) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !c.happyEyeballs() {
+		d.FallbackDelay = -1
+	}
+	anyFamily := c.IPPreference == "" || c.IPPreference == ipPreferenceAny
+	if anyFamily && resolver == nil {
+		return d.DialContext
+	}
+	var lookup ipResolver = net.DefaultResolver
+	if resolver != nil {
+		lookup = resolver
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || network != "tcp" || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		addrs, err := lookup.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if !anyFamily {
+			addrs = sortAddrs(addrs, c.IPPreference)
+		}
+		primaries, fallbacks := partitionAddrs(addrs)
+		if !c.happyEyeballs() || len(fallbacks) == 0 {
+			return dialSerial(ctx, d, network, port, append(primaries, fallbacks...))
+		}
+		return dialParallel(ctx, d, network, port, primaries, fallbacks)
+	}
+}
+
+// sortAddrs orders addrs with those of the preferred family first,
+// otherwise keeping the resolver's order.
+func sortAddrs(addrs []net.IPAddr, preference string) []net.IPAddr {
+	ret := make([]net.IPAddr, len(addrs))
+	copy(ret, addrs)
+	rank := func(a net.IPAddr) int {
+		isIPv4 := a.IP.To4() != nil
+		if isIPv4 == (preference == ipPreferenceIPv4) {
+			return 0
+		}
+		return 1
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return rank(ret[i]) < rank(ret[j])
+	})
+	return ret
+}
+
+// partitionAddrs splits addrs into those of the same family as the
+// first, and the rest.
+func partitionAddrs(addrs []net.IPAddr) (primaries []net.IPAddr, fallbacks []net.IPAddr) {
+	for _, a := range addrs {
+		if len(primaries) == 0 || (a.IP.To4() != nil) == (primaries[0].IP.To4() != nil) {
+			primaries = append(primaries, a)
+		} else {
+			fallbacks = append(fallbacks, a)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial tries each address in turn, returning the first connection
+// made, or the first error if none succeed.
+func dialSerial(ctx context.Context, d *net.Dialer, network string, port string, addrs []net.IPAddr) (net.Conn, error) {
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no addresses to dial")
+	}
+	return nil, firstErr
+}
+
+// dialParallel dials the primary addresses, and starts on the fallbacks
+// if the primaries fail or have not connected after the fallback delay.
+func dialParallel(ctx context.Context, d *net.Dialer, network string, port string, primaries []net.IPAddr, fallbacks []net.IPAddr) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 2)
+	start := func(addrs []net.IPAddr) {
+		conn, err := dialSerial(ctx, d, network, port, addrs)
+		results <- result{conn, err}
+	}
+
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = defaultFallbackDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	go start(primaries)
+	pending := 1
+	fallbackStarted := false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go start(fallbacks)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// close the losing connection, if any
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go start(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
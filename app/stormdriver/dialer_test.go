@@ -0,0 +1,82 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ips(addrs ...string) []net.IPAddr {
+	ret := []net.IPAddr{}
+	for _, a := range addrs {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	return ret
+}
+
+func Test_sortAddrs(t *testing.T) {
+	addrs := ips("2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2")
+	tests := []struct {
+		preference string
+		want       []net.IPAddr
+	}{
+		{ipPreferenceIPv4, ips("10.0.0.1", "10.0.0.2", "2001:db8::1", "2001:db8::2")},
+		{ipPreferenceIPv6, ips("2001:db8::1", "2001:db8::2", "10.0.0.1", "10.0.0.2")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.preference, func(t *testing.T) {
+			assert.Equal(t, tt.want, sortAddrs(addrs, tt.preference))
+		})
+	}
+}
+
+func Test_partitionAddrs(t *testing.T) {
+	primaries, fallbacks := partitionAddrs(ips("10.0.0.1", "2001:db8::1", "10.0.0.2"))
+	assert.Equal(t, ips("10.0.0.1", "10.0.0.2"), primaries)
+	assert.Equal(t, ips("2001:db8::1"), fallbacks)
+}
+
+func Test_dialerConfig_merge(t *testing.T) {
+	off := false
+	global := dialerConfig{IPPreference: ipPreferenceIPv6}
+	assert.Equal(t, global, global.merge(nil))
+	assert.Equal(t, dialerConfig{IPPreference: ipPreferenceIPv6, HappyEyeballs: &off}, global.merge(&dialerConfig{HappyEyeballs: &off}))
+	assert.Equal(t, dialerConfig{IPPreference: ipPreferenceIPv4}, global.merge(&dialerConfig{IPPreference: ipPreferenceIPv4}))
+}
+
+func Test_dialerConfig_validate(t *testing.T) {
+	assert.NoError(t, dialerConfig{}.validate())
+	assert.NoError(t, dialerConfig{IPPreference: ipPreferenceIPv4}.validate())
+	assert.Error(t, dialerConfig{IPPreference: "ipv5"}.validate())
+}
+
+func Test_dialParallel_fallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// nothing listens on the primary, so the fallback must connect.
+	conn, err := dialParallel(context.Background(), &net.Dialer{}, "tcp", port, ips("::1"), ips("127.0.0.1"))
+	require.NoError(t, err)
+	conn.Close()
+}
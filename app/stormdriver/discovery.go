@@ -0,0 +1,394 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const defaultDiscoveryIntervalSeconds = 30
+
+var discoveryErrors = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "discovery_errors_total",
+	Help:      "The number of failed attempts to discover clouddrivers, by source.",
+}, []string{"source"})
+
+// discoveryConfig holds the sources, other than the configuration file
+// and the controller, which clouddrivers are discovered from.
+type discoveryConfig struct {
+	Kubernetes *kubernetesDiscoveryConfig `yaml:"kubernetes,omitempty" json:"kubernetes,omitempty"`
+	SRV        *srvDiscoveryConfig        `yaml:"srv,omitempty" json:"srv,omitempty"`
+	Consul     *consulDiscoveryConfig     `yaml:"consul,omitempty" json:"consul,omitempty"`
+	Eureka     *eurekaDiscoveryConfig     `yaml:"eureka,omitempty" json:"eureka,omitempty"`
+}
+
+// applyDefaults fills in unset values.  serverTLS is true if
+// Stormdriver serves HTTPS, so it is advertised as such by default.
+func (c *discoveryConfig) applyDefaults(serverTLS bool) {
+	if c.Kubernetes != nil {
+		c.Kubernetes.applyDefaults()
+	}
+	if c.SRV != nil {
+		c.SRV.applyDefaults()
+	}
+	if c.Consul != nil {
+		c.Consul.applyDefaults(serverTLS)
+	}
+	if c.Eureka != nil {
+		c.Eureka.applyDefaults(serverTLS)
+	}
+}
+
+func (c discoveryConfig) validate() error {
+	if c.Kubernetes != nil {
+		if err := c.Kubernetes.validate(); err != nil {
+			return fmt.Errorf("kubernetes: %v", err)
+		}
+	}
+	if c.SRV != nil {
+		if err := c.SRV.validate(); err != nil {
+			return fmt.Errorf("srv: %v", err)
+		}
+	}
+	if c.Consul != nil {
+		if err := c.Consul.validate(); err != nil {
+			return fmt.Errorf("consul: %v", err)
+		}
+	}
+	if c.Eureka != nil {
+		if err := c.Eureka.validate(); err != nil {
+			return fmt.Errorf("eureka: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c discoveryConfig) enabled() bool {
+	return c.Kubernetes != nil || c.SRV != nil || c.Consul != nil || c.Eureka != nil
+}
+
+// discoverer returns the complete set of clouddrivers a source knows of.
+type discoverer interface {
+	discover(ctx context.Context) ([]clouddriverConfig, error)
+}
+
+// discoverySource is one configured source of clouddrivers.
+type discoverySource struct {
+	name      string
+	interval  time.Duration
+	d         discoverer
+	registrar registrar
+}
+
+// makeDiscoverySources returns the configured sources.  registrar is
+// set only for those asked to register Stormdriver, on listenPort.
+func makeDiscoverySources(c discoveryConfig, listenPort uint16) ([]discoverySource, error) {
+	sources := []discoverySource{}
+	if c.Kubernetes != nil {
+		d, err := makeKubernetesDiscoverer(*c.Kubernetes)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes discovery: %v", err)
+		}
+		sources = append(sources, discoverySource{name: kubernetesSource, interval: time.Duration(c.Kubernetes.IntervalSeconds) * time.Second, d: d})
+	}
+	if c.SRV != nil {
+		sources = append(sources, discoverySource{name: srvSource, interval: time.Duration(c.SRV.IntervalSeconds) * time.Second, d: makeSRVDiscoverer(*c.SRV)})
+	}
+	if c.Consul != nil {
+		d, err := makeConsulDiscoverer(*c.Consul, listenPort)
+		if err != nil {
+			return nil, fmt.Errorf("consul discovery: %v", err)
+		}
+		source := discoverySource{name: consulSource, interval: time.Duration(c.Consul.IntervalSeconds) * time.Second, d: d}
+		if c.Consul.Register {
+			source.registrar = d
+		}
+		sources = append(sources, source)
+	}
+	if c.Eureka != nil {
+		d, err := makeEurekaDiscoverer(*c.Eureka, listenPort)
+		if err != nil {
+			return nil, fmt.Errorf("eureka discovery: %v", err)
+		}
+		source := discoverySource{name: eurekaSource, interval: time.Duration(c.Eureka.IntervalSeconds) * time.Second, d: d}
+		if c.Eureka.Register {
+			source.registrar = d
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// startDiscovery begins polling each configured source, and registering
+// with those asked to.  listenPort is the port registered.
+func startDiscovery(ctx context.Context, c discoveryConfig, m *ClouddriverManager, listenPort uint16) error {
+	sources, err := makeDiscoverySources(c, listenPort)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		go runDiscovery(ctx, m, source.name, source.interval, source.d)
+		if source.registrar != nil {
+			go runRegistration(ctx, source.name, source.interval, source.registrar)
+		}
+	}
+	return nil
+}
+
+// discoverOnce polls each configured source a single time, without
+// registering.
+func discoverOnce(ctx context.Context, c discoveryConfig, m *ClouddriverManager) error {
+	sources, err := makeDiscoverySources(c, 0)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		pollDiscovery(ctx, m, source.name, source.d)
+	}
+	return nil
+}
+
+// runDiscovery polls d every interval, and makes the clouddrivers tracked
+// from source match what it returns.  If a poll fails, the clouddrivers
+// found last time are kept.
+func runDiscovery(ctx context.Context, m *ClouddriverManager, source string, interval time.Duration, d discoverer) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		pollDiscovery(ctx, m, source, d)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func pollDiscovery(ctx context.Context, m *ClouddriverManager, source string, d discoverer) {
+	clouddrivers, err := d.discover(ctx)
+	if err != nil {
+		discoveryErrors.WithLabelValues(source).Inc()
+		zap.S().Warnw("unable to discover clouddrivers", "source", source, "error", err)
+		return
+	}
+	for idx := range clouddrivers {
+		clouddrivers[idx].applyDefaults(getHealthchecks())
+	}
+	summary := m.reconcileSource(source, clouddrivers)
+	if len(summary.Added)+len(summary.Removed)+len(summary.Changed) > 0 {
+		zap.S().Infow("discovered clouddrivers changed",
+			"source", source,
+			"added", summary.Added,
+			"removed", summary.Removed,
+			"changed", summary.Changed)
+	}
+}
+
+// clouddriverFromMetadata builds a clouddriver from a discovered name and
+// URL, applying the priority, weight, disableArtifactAccounts, and uiUrl
+// keys (after prefix) from metadata, as the controller does with
+// annotations.
+func clouddriverFromMetadata(name string, url string, metadata map[string]string, prefix string) clouddriverConfig {
+	cd := clouddriverConfig{
+		Name:                    name,
+		URL:                     url,
+		UIUrl:                   metadata[prefix+"uiUrl"],
+		DisableArtifactAccounts: yesno(metadata[prefix+"disableArtifactAccounts"]),
+	}
+	if strpri := metadata[prefix+"priority"]; strpri != "" {
+		priority, err := strconv.Atoi(strpri)
+		if err != nil {
+			zap.S().Warnw("priority is not parsable", "clouddriver", name, "badPriority", strpri, "error", err)
+		}
+		cd.Priority = priority
+	}
+	if strweight := metadata[prefix+"weight"]; strweight != "" {
+		weight, err := strconv.Atoi(strweight)
+		if err != nil || weight < 0 {
+			zap.S().Warnw("weight is not parsable", "clouddriver", name, "badWeight", strweight, "error", err)
+			weight = 0
+		}
+		cd.Weight = weight
+	}
+	return cd
+}
+
+// errDiscoveryNotFound is returned by discoveryRequest for a 404.
+var errDiscoveryNotFound = errors.New("not found")
+
+// discoveryRequest sends a request to a service registry, returning the
+// response body if the status is successful.
+func discoveryRequest(ctx context.Context, client *http.Client, method string, url string, headers map[string]string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("accept", "application/json")
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errDiscoveryNotFound
+	}
+	if !httputil.StatusCodeOK(resp.StatusCode) {
+		return nil, fmt.Errorf("%s %s: status %d: %s", method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// registrationConfig controls whether and how Stormdriver advertises
+// itself in a service registry.  AdvertiseAddress defaults to the host
+// name, and AdvertiseScheme to https if Stormdriver serves TLS.
+type registrationConfig struct {
+	Register         bool   `yaml:"register,omitempty" json:"register,omitempty"`
+	RegisterAs       string `yaml:"registerAs,omitempty" json:"registerAs,omitempty"`
+	AdvertiseAddress string `yaml:"advertiseAddress,omitempty" json:"advertiseAddress,omitempty"`
+	AdvertiseScheme  string `yaml:"advertiseScheme,omitempty" json:"advertiseScheme,omitempty"`
+}
+
+func (c *registrationConfig) applyDefaults(serverTLS bool) {
+	if !c.Register {
+		return
+	}
+	if c.RegisterAs == "" {
+		c.RegisterAs = appName
+	}
+	if c.AdvertiseScheme == "" {
+		c.AdvertiseScheme = "http"
+		if serverTLS {
+			c.AdvertiseScheme = "https"
+		}
+	}
+}
+
+func (c registrationConfig) validate() error {
+	if c.AdvertiseScheme != "" && c.AdvertiseScheme != "http" && c.AdvertiseScheme != "https" {
+		return fmt.Errorf("advertiseScheme must be http or https, not %q", c.AdvertiseScheme)
+	}
+	return nil
+}
+
+// registeredInstance is what Stormdriver registers as.
+type registeredInstance struct {
+	id      string
+	name    string
+	scheme  string
+	address string
+	port    uint16
+}
+
+func (c registrationConfig) instance(port uint16) (registeredInstance, error) {
+	address := c.AdvertiseAddress
+	if address == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return registeredInstance{}, err
+		}
+		address = hostname
+	}
+	return registeredInstance{
+		id:      fmt.Sprintf("%s-%s-%d", c.RegisterAs, address, port),
+		name:    c.RegisterAs,
+		scheme:  c.AdvertiseScheme,
+		address: address,
+		port:    port,
+	}, nil
+}
+
+func (i registeredInstance) baseScheme() string {
+	if i.scheme == "" {
+		return "http"
+	}
+	return i.scheme
+}
+
+func (i registeredInstance) baseURL() string {
+	return i.baseScheme() + "://" + net.JoinHostPort(i.address, strconv.Itoa(int(i.port)))
+}
+
+// registrar advertises Stormdriver in a service registry.  renew is
+// called periodically to keep the registration alive.
+type registrar interface {
+	register(ctx context.Context) error
+	renew(ctx context.Context) error
+	deregister(ctx context.Context) error
+}
+
+// runRegistration registers, renews every interval, and deregisters when
+// ctx is cancelled, so the registry stops sending clients while the
+// server drains.
+func runRegistration(ctx context.Context, source string, interval time.Duration, r registrar) {
+	registered := false
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		var err error
+		if registered {
+			err = r.renew(ctx)
+		} else if err = r.register(ctx); err == nil {
+			registered = true
+			zap.S().Infow("registered with service registry", "source", source)
+		}
+		if err != nil {
+			if errors.Is(err, errDiscoveryNotFound) {
+				registered = false
+			}
+			zap.S().Warnw("unable to register with service registry", "source", source, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			if registered {
+				dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := r.deregister(dctx); err != nil {
+					zap.S().Warnw("unable to deregister from service registry", "source", source, "error", err)
+				}
+				cancel()
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
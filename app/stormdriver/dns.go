@@ -0,0 +1,149 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dnsConfig controls how clouddriver hostnames are resolved.  Servers,
+// if set, are used instead of the system resolvers, in rotation.
+// Successful lookups are cached for CacheTTLSeconds, and if a later
+// lookup fails the expired entry is used instead.  Pins map hostnames to
+// fixed addresses, which is useful for split-horizon names.
+type dnsConfig struct {
+	Servers         []string            `yaml:"servers,omitempty" json:"servers,omitempty"`
+	CacheTTLSeconds int                 `yaml:"cacheTTLSeconds,omitempty" json:"cacheTTLSeconds,omitempty"`
+	Pins            map[string][]string `yaml:"pins,omitempty" json:"pins,omitempty"`
+}
+
+func (c dnsConfig) isDefault() bool {
+	return len(c.Servers) == 0 && c.CacheTTLSeconds == 0 && len(c.Pins) == 0
+}
+
+func (c dnsConfig) validate() error {
+	for _, server := range c.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("server %q: %v", server, err)
+		}
+	}
+	if c.CacheTTLSeconds < 0 {
+		return fmt.Errorf("cacheTTLSeconds cannot be negative")
+	}
+	for host, addrs := range c.Pins {
+		for _, addr := range addrs {
+			if net.ParseIP(addr) == nil {
+				return fmt.Errorf("pin %s: invalid address %q", host, addr)
+			}
+		}
+	}
+	return nil
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// cachingResolver resolves hostnames for the clouddriver dialers.
+type cachingResolver struct {
+	sync.Mutex
+	ttl    time.Duration
+	pins   map[string][]net.IPAddr
+	cache  map[string]dnsCacheEntry
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// makeCachingResolver returns a resolver for the configuration, or nil
+// if the system resolver should be used as-is.
+func makeCachingResolver(c dnsConfig) *cachingResolver {
+	if c.isDefault() {
+		return nil
+	}
+	r := &cachingResolver{
+		ttl:    time.Duration(c.CacheTTLSeconds) * time.Second,
+		pins:   map[string][]net.IPAddr{},
+		cache:  map[string]dnsCacheEntry{},
+		lookup: makeNetResolver(c.Servers).LookupIPAddr,
+	}
+	for host, addrs := range c.Pins {
+		for _, addr := range addrs {
+			r.pins[canonicalHost(host)] = append(r.pins[canonicalHost(host)], net.IPAddr{IP: net.ParseIP(addr)})
+		}
+	}
+	return r
+}
+
+// makeNetResolver returns a resolver which queries servers in rotation,
+// or the default resolver if none are given.
+func makeNetResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// LookupIPAddr returns the pinned addresses for host, a cached result,
+// or the result of a new lookup.
+func (r *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key := canonicalHost(host)
+	if addrs, found := r.pins[key]; found {
+		return addrs, nil
+	}
+
+	r.Lock()
+	entry, cached := r.cache[key]
+	r.Unlock()
+	if cached && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		if cached {
+			zap.S().Warnw("DNS lookup failed, using expired cache entry", "host", host, "error", err)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	if r.ttl > 0 {
+		r.Lock()
+		r.cache[key] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(r.ttl)}
+		r.Unlock()
+	}
+	return addrs, nil
+}
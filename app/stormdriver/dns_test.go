@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cachingResolver_LookupIPAddr(t *testing.T) {
+	lookups := 0
+	var lookupErr error
+	r := makeCachingResolver(dnsConfig{
+		CacheTTLSeconds: 60,
+		Pins:            map[string][]string{"Pinned.Example.com.": {"10.1.1.1"}},
+	})
+	r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return ips("10.0.0.1"), nil
+	}
+	ctx := context.Background()
+
+	got, err := r.LookupIPAddr(ctx, "pinned.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, ips("10.1.1.1"), got)
+	assert.Equal(t, 0, lookups, "pinned names are not looked up")
+
+	got, err = r.LookupIPAddr(ctx, "clouddriver.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, ips("10.0.0.1"), got)
+	_, err = r.LookupIPAddr(ctx, "clouddriver.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookups, "second lookup is cached")
+
+	// expire the entry and fail the lookup: the stale entry is used.
+	r.cache["clouddriver.example.com"] = dnsCacheEntry{addrs: ips("10.0.0.1"), expires: time.Now().Add(-time.Second)}
+	lookupErr = errors.New("timeout")
+	got, err = r.LookupIPAddr(ctx, "clouddriver.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, ips("10.0.0.1"), got)
+
+	_, err = r.LookupIPAddr(ctx, "unknown.example.com")
+	assert.Error(t, err)
+}
+
+func Test_dnsConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       dnsConfig
+		wantErr bool
+	}{
+		{"empty", dnsConfig{}, false},
+		{"valid", dnsConfig{Servers: []string{"10.0.0.53:53"}, CacheTTLSeconds: 30, Pins: map[string][]string{"a": {"::1"}}}, false},
+		{"server without port", dnsConfig{Servers: []string{"10.0.0.53"}}, true},
+		{"negative ttl", dnsConfig{CacheTTLSeconds: -1}, true},
+		{"bad pin", dnsConfig{Pins: map[string][]string{"a": {"not-an-ip"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, tt.c.validate() != nil)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultDownstreamMaxQueueWaitSeconds = 10
+
+var errConcurrencyLimited = errors.New("too many concurrent clouddriver requests")
+
+// downstreamConcurrencyConfig bounds the number of requests in flight
+// to all clouddrivers (MaxConcurrent) and to each one
+// (MaxConcurrentPerClouddriver).  Requests over either limit wait for
+// up to MaxQueueWaitSeconds, then fail.  A limit of 0 is unlimited.
+type downstreamConcurrencyConfig struct {
+	MaxConcurrent               int `yaml:"maxConcurrent,omitempty" json:"maxConcurrent,omitempty"`
+	MaxConcurrentPerClouddriver int `yaml:"maxConcurrentPerClouddriver,omitempty" json:"maxConcurrentPerClouddriver,omitempty"`
+	MaxQueueWaitSeconds         int `yaml:"maxQueueWaitSeconds,omitempty" json:"maxQueueWaitSeconds,omitempty"`
+}
+
+func (c *downstreamConcurrencyConfig) enabled() bool {
+	return c.MaxConcurrent > 0 || c.MaxConcurrentPerClouddriver > 0
+}
+
+func (c *downstreamConcurrencyConfig) applyDefaults() {
+	if c.enabled() && c.MaxQueueWaitSeconds == 0 {
+		c.MaxQueueWaitSeconds = defaultDownstreamMaxQueueWaitSeconds
+	}
+}
+
+func (c *downstreamConcurrencyConfig) validate() error {
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("maxConcurrent cannot be negative")
+	}
+	if c.MaxConcurrentPerClouddriver < 0 {
+		return fmt.Errorf("maxConcurrentPerClouddriver cannot be negative")
+	}
+	if c.MaxQueueWaitSeconds < 0 {
+		return fmt.Errorf("maxQueueWaitSeconds cannot be negative")
+	}
+	return nil
+}
+
+var (
+	downstreamInFlight = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Namespace: "stormdriver",
+		Name:      "downstream_requests_in_flight",
+		Help:      "The number of requests to clouddrivers holding a concurrency slot.",
+	})
+	downstreamConcurrencyRejected = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Namespace: "stormdriver",
+		Name:      "downstream_concurrency_rejected_total",
+		Help:      "Requests to clouddrivers which waited too long for a concurrency slot.",
+	})
+)
+
+// semaphore is a counting semaphore.  A nil semaphore is unlimited.
+type semaphore chan struct{}
+
+func makeSemaphore(size int) semaphore {
+	if size == 0 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+func (s semaphore) acquire(ctx context.Context) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// downstreamLimiter holds the global semaphore and one for each
+// clouddriver, by the key of the route the request was sent on, so
+// clouddrivers sharing a host, or a URL behind one agent, are limited
+// separately.  Requests not sent on a route are limited by scheme and
+// host.
+type downstreamLimiter struct {
+	sync.Mutex
+	conf         downstreamConcurrencyConfig
+	global       semaphore
+	maxQueueWait time.Duration
+	clouddrivers map[string]semaphore
+}
+
+// makeDownstreamLimiter returns nil if no limits are set.
+func makeDownstreamLimiter(conf downstreamConcurrencyConfig) *downstreamLimiter {
+	if !conf.enabled() {
+		return nil
+	}
+	return &downstreamLimiter{
+		conf:         conf,
+		global:       makeSemaphore(conf.MaxConcurrent),
+		maxQueueWait: time.Duration(conf.MaxQueueWaitSeconds) * time.Second,
+		clouddrivers: map[string]semaphore{},
+	}
+}
+
+func (l *downstreamLimiter) semaphoreFor(req *http.Request) semaphore {
+	if l.conf.MaxConcurrentPerClouddriver == 0 {
+		return nil
+	}
+	key := req.URL.Scheme + "://" + req.URL.Host
+	if target, found := downstreamTargetFor(req.Context()); found {
+		key = target.routeKey
+	}
+	l.Lock()
+	defer l.Unlock()
+	s, found := l.clouddrivers[key]
+	if !found {
+		s = makeSemaphore(l.conf.MaxConcurrentPerClouddriver)
+		l.clouddrivers[key] = s
+	}
+	return s
+}
+
+// acquire waits for a slot for the clouddriver, then a global one, so
+// requests queued for a busy clouddriver do not hold global slots.  If
+// true is returned, the returned function must be called to release them.
+func (l *downstreamLimiter) acquire(req *http.Request) (func(), bool) {
+	ctx, cancel := context.WithTimeout(req.Context(), l.maxQueueWait)
+	defer cancel()
+	perClouddriver := l.semaphoreFor(req)
+	if !perClouddriver.acquire(ctx) {
+		return nil, false
+	}
+	if !l.global.acquire(ctx) {
+		perClouddriver.release()
+		return nil, false
+	}
+	downstreamInFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			downstreamInFlight.Dec()
+			l.global.release()
+			perClouddriver.release()
+		})
+	}, true
+}
+
+// concurrencyLimitedTransport holds a slot from the limiter until the
+// response body is closed.  Streaming requests, such as watches, may
+// stay open indefinitely, so they are not limited.
+type concurrencyLimitedTransport struct {
+	limiter *downstreamLimiter
+	next    http.RoundTripper
+}
+
+func (t *concurrencyLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isStreaming(req.Context()) {
+		return t.next.RoundTrip(req)
+	}
+	release, ok := t.limiter.acquire(req)
+	if !ok {
+		closeRequestBody(req)
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		downstreamConcurrencyRejected.Inc()
+		return nil, errConcurrencyLimited
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody calls release when it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
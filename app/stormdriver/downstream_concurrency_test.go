@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingRoundTripper answers each request once release is closed.
+type blockingRoundTripper struct {
+	release chan struct{}
+}
+
+func (b *blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-b.release
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func Test_downstreamLimiter_acquire(t *testing.T) {
+	l := makeDownstreamLimiter(downstreamConcurrencyConfig{MaxConcurrent: 3, MaxConcurrentPerClouddriver: 2, MaxQueueWaitSeconds: 1})
+	l.maxQueueWait = 20 * time.Millisecond
+	east := httptest.NewRequest(http.MethodGet, "http://east:7002/applications", nil)
+	west := httptest.NewRequest(http.MethodGet, "http://west:7002/applications", nil)
+
+	release1, ok := l.acquire(east)
+	require.True(t, ok)
+	_, ok = l.acquire(east)
+	require.True(t, ok)
+	_, ok = l.acquire(east)
+	assert.False(t, ok, "per-clouddriver limit reached")
+	_, ok = l.acquire(west)
+	require.True(t, ok)
+	_, ok = l.acquire(west)
+	assert.False(t, ok, "global limit reached")
+	assert.Len(t, l.clouddrivers["http://west:7002"], 1, "per-clouddriver slot given back")
+
+	release1()
+	release1()
+	assert.Len(t, l.global, 2, "release is idempotent")
+	_, ok = l.acquire(west)
+	assert.True(t, ok)
+}
+
+func Test_downstreamLimiter_byRoute(t *testing.T) {
+	l := makeDownstreamLimiter(downstreamConcurrencyConfig{MaxConcurrentPerClouddriver: 1, MaxQueueWaitSeconds: 1})
+	l.maxQueueWait = 20 * time.Millisecond
+	routed := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://agent:8080/applications", nil)
+		return req.WithContext(withRoute(req.Context(), URLAndPriority{URL: "http://agent:8080", token: token}))
+	}
+
+	_, ok := l.acquire(routed("a"))
+	require.True(t, ok)
+	_, ok = l.acquire(routed("b"))
+	assert.True(t, ok, "clouddrivers sharing a URL are limited separately")
+	_, ok = l.acquire(routed("a"))
+	assert.False(t, ok)
+}
+
+func Test_concurrencyLimitedTransport(t *testing.T) {
+	next := &blockingRoundTripper{release: make(chan struct{})}
+	limiter := makeDownstreamLimiter(downstreamConcurrencyConfig{MaxConcurrent: 1, MaxQueueWaitSeconds: 1})
+	limiter.maxQueueWait = 20 * time.Millisecond
+	transport := &concurrencyLimitedTransport{limiter: limiter, next: next}
+
+	first := make(chan *http.Response)
+	go func() {
+		resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://east:7002/applications", nil))
+		assert.NoError(t, err)
+		first <- resp
+	}()
+	require.Eventually(t, func() bool { return len(limiter.global) == 1 }, time.Second, time.Millisecond)
+
+	body := strings.NewReader("[]")
+	req := httptest.NewRequest(http.MethodPost, "http://east:7002/kubernetes/ops", body)
+	_, err := transport.RoundTrip(req)
+	assert.ErrorIs(t, err, errConcurrencyLimited)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://east:7002/applications", nil).WithContext(ctx))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	forged := httptest.NewRequest(http.MethodGet, "http://east:7002/events", nil)
+	forged.Header.Set("Accept", "text/event-stream")
+	_, err = transport.RoundTrip(forged)
+	assert.ErrorIs(t, err, errConcurrencyLimited, "asking to stream is not enough")
+
+	watch := httptest.NewRequest(http.MethodGet, "http://east:7002/events", nil)
+	watch = watch.WithContext(withStreaming(watch.Context()))
+	close(next.release)
+	_, err = transport.RoundTrip(watch)
+	assert.NoError(t, err, "streaming requests are not limited")
+
+	resp := <-first
+	assert.Len(t, limiter.global, 1, "slot held until the body is closed")
+	resp.Body.Close()
+	assert.Empty(t, limiter.global)
+}
+
+func Test_clientRegistry_setConcurrency(t *testing.T) {
+	r := &clientRegistry{config: defaultHTTPClientConfig, destinations: map[string]*destinationClient{}}
+	r.setConcurrency(downstreamConcurrencyConfig{MaxConcurrent: 5, MaxQueueWaitSeconds: 1})
+	assert.NotNil(t, r.concurrency)
+	r.setConcurrency(downstreamConcurrencyConfig{})
+	assert.Nil(t, r.concurrency)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// downstreamTarget identifies the clouddriver an outgoing request is
+// routed to.
+type downstreamTarget struct {
+	name     string
+	routeKey string
+}
+
+type downstreamTargetKey struct{}
+
+// withClouddriver records the clouddriver requests made with ctx are
+// routed to, so the downstream transport can name it and note its
+// contact without searching for it.
+func withClouddriver(ctx context.Context, name string, routeKey string) context.Context {
+	return context.WithValue(ctx, downstreamTargetKey{}, downstreamTarget{name: name, routeKey: routeKey})
+}
+
+// withRoute is withClouddriver for the clouddriver a route points to.
+func withRoute(ctx context.Context, route URLAndPriority) context.Context {
+	name := ""
+	if clouddriverManager != nil {
+		name = clouddriverManager.clouddriverNameForRoute(route)
+	}
+	return withClouddriver(ctx, name, route.key())
+}
+
+func downstreamTargetFor(ctx context.Context) (downstreamTarget, bool) {
+	target, found := ctx.Value(downstreamTargetKey{}).(downstreamTarget)
+	return target, found
+}
+
+// contactTime is when a route key last answered, in Unix nanoseconds.
+type contactTime struct {
+	atomic.Int64
+}
+
+// noteContact records that the clouddrivers a route key points to
+// answered at the given time.
+func (m *ClouddriverManager) noteContact(routeKey string, when time.Time) {
+	v, found := m.contacts.Load(routeKey)
+	if !found {
+		v, _ = m.contacts.LoadOrStore(routeKey, &contactTime{})
+	}
+	last := v.(*contactTime)
+	for {
+		prev := last.Load()
+		if when.UnixNano() <= prev || last.CompareAndSwap(prev, when.UnixNano()) {
+			return
+		}
+	}
+}
+
+// contactOf returns when cd last answered.  Must be called with the
+// lock held.
+func (m *ClouddriverManager) contactOf(cd *trackedClouddriver) time.Time {
+	ret := cd.LastSuccessfulContact
+	if v, found := m.contacts.Load(cd.routeKey()); found {
+		if when := time.Unix(0, v.(*contactTime).Load()).UTC(); when.After(ret) {
+			ret = when
+		}
+	}
+	return ret
+}
+
+func downstreamClouddriverName(req *http.Request) string {
+	target, _ := downstreamTargetFor(req.Context())
+	return target.name
+}
+
+// downstreamSpanName names the client span for a request to a
+// clouddriver after it, so each leg of a fan-out is easy to pick out.
+func downstreamSpanName(_ string, req *http.Request) string {
+	if name := downstreamClouddriverName(req); name != "" {
+		return "clouddriver " + name + " " + req.Method
+	}
+	return "HTTP " + req.Method
+}
+
+// clouddriverSpanTransport adds the clouddriver's name to the client
+// span otelhttp started for the request, and notes when the clouddriver
+// last answered.  It must be wrapped by the
+// otelhttp transport.
+type clouddriverSpanTransport struct {
+	next http.RoundTripper
+}
+
+func (t *clouddriverSpanTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(req.Context())
+	if span.IsRecording() {
+		if name := downstreamClouddriverName(req); name != "" {
+			span.SetAttributes(attribute.String("clouddriver.name", name))
+		}
+	}
+	resp, err := t.next.RoundTrip(req)
+	// Only what a health check would count as healthy is contact; an
+	// agent answering every call with an error is not working.
+	if target, found := downstreamTargetFor(req.Context()); found && err == nil && resp.StatusCode >= 200 && resp.StatusCode < 400 && clouddriverManager != nil {
+		clouddriverManager.noteContact(target.routeKey, time.Now().UTC())
+	}
+	return resp, err
+}
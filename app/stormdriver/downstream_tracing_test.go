@@ -0,0 +1,158 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_withRoute(t *testing.T) {
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{state: map[string]*trackedClouddriver{
+		"config:east":  {Name: "east", URL: "http://east:7002"},
+		"agent:west-a": {Name: "west-a", URL: "http://agent:8080", token: "a"},
+		"agent:west-b": {Name: "west-b", URL: "http://agent:8080", token: "b"},
+	}}
+	tests := []struct {
+		name  string
+		route URLAndPriority
+		want  string
+	}{
+		{"by url", URLAndPriority{URL: "http://east:7002"}, "east"},
+		{"shared url told apart by token", URLAndPriority{URL: "http://agent:8080", token: "b"}, "west-b"},
+		{"unknown", URLAndPriority{URL: "http://kafka:8082"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, found := downstreamTargetFor(withRoute(context.Background(), tt.route))
+			assert.True(t, found)
+			assert.Equal(t, tt.want, target.name)
+			assert.Equal(t, tt.route.key(), target.routeKey)
+		})
+	}
+	_, found := downstreamTargetFor(context.Background())
+	assert.False(t, found)
+}
+
+func Test_downstreamSpans(t *testing.T) {
+	backend := hedgeTestServer(t, 0, http.StatusNotFound, `{}`)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	oldProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(oldProvider)
+	otel.SetTracerProvider(tp)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{state: map[string]*trackedClouddriver{
+		"config:east": {Name: "east", URL: backend.URL},
+	}}
+
+	r := &clientRegistry{destinations: map[string]*destinationClient{}}
+	r.configure(httputil.ClientConfig{}, dialerConfig{}, nil)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "server")
+	ctx = withRoute(ctx, URLAndPriority{URL: backend.URL})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL+"/credentials", nil)
+	require.NoError(t, err)
+	resp, err := r.clientFor(req.URL.String()).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	parent.End()
+
+	var leg sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "clouddriver east GET" {
+			leg = span
+		}
+	}
+	require.NotNil(t, leg)
+	assert.Equal(t, parent.SpanContext().SpanID(), leg.Parent().SpanID())
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range leg.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, "east", attrs["clouddriver.name"].AsString())
+	assert.Equal(t, int64(http.StatusNotFound), attrs["http.status_code"].AsInt64())
+}
+
+func Test_clouddriverSpanTransport_notesContact(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   bool
+	}{
+		{"success", http.StatusOK, true},
+		{"redirect", http.StatusFound, true},
+		{"client error", http.StatusNotFound, false},
+		{"server error", http.StatusBadGateway, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := hedgeTestServer(t, 0, tt.status, `{}`)
+			epoch := time.Unix(0, 0).UTC()
+			cd := &trackedClouddriver{Name: "east", URL: backend.URL, LastSuccessfulContact: epoch}
+
+			oldManager := clouddriverManager
+			defer func() { clouddriverManager = oldManager }()
+			clouddriverManager = &ClouddriverManager{state: map[string]*trackedClouddriver{"config:east": cd}}
+
+			r := &clientRegistry{destinations: map[string]*destinationClient{}}
+			r.configure(httputil.ClientConfig{}, dialerConfig{}, nil)
+			ctx := withClouddriver(context.Background(), cd.Name, cd.routeKey())
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL+"/credentials", nil)
+			require.NoError(t, err)
+			before := time.Now()
+			resp, err := r.clientFor(req.URL.String()).Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			contact := clouddriverManager.lastSuccessfulContact(cd)
+			if tt.want {
+				assert.False(t, contact.Before(before.Add(-time.Second)))
+			} else {
+				assert.Equal(t, epoch, contact)
+			}
+		})
+	}
+}
+
+func Test_ClouddriverManager_noteContact(t *testing.T) {
+	cd := &trackedClouddriver{Name: "east", URL: "http://east", LastSuccessfulContact: time.Unix(100, 0).UTC()}
+	m := &ClouddriverManager{state: map[string]*trackedClouddriver{"config:east": cd}}
+	assert.Equal(t, time.Unix(100, 0).UTC(), m.contactOf(cd))
+
+	m.noteContact(cd.routeKey(), time.Unix(200, 0))
+	m.noteContact(cd.routeKey(), time.Unix(150, 0))
+	assert.Equal(t, time.Unix(200, 0).UTC(), m.contactOf(cd), "contact never moves back")
+
+	m.noteContact("http://west:", time.Unix(300, 0))
+	assert.Equal(t, time.Unix(200, 0).UTC(), m.contactOf(cd), "other route keys are separate")
+}
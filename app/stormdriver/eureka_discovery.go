@@ -0,0 +1,209 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const eurekaSource = "eureka"
+
+// eurekaDiscoveryConfig finds clouddrivers as the UP instances of a
+// Eureka application, and can register Stormdriver.  URL is the Eureka
+// REST base, such as http://eureka:8761/eureka.  Instance metadata sets
+// priority, disableArtifactAccounts, and uiUrl.
+type eurekaDiscoveryConfig struct {
+	URL                string `yaml:"url,omitempty" json:"url,omitempty"`
+	Application        string `yaml:"application,omitempty" json:"application,omitempty"`
+	IntervalSeconds    int    `yaml:"intervalSeconds,omitempty" json:"intervalSeconds,omitempty"`
+	registrationConfig `yaml:",inline" json:",inline"`
+}
+
+func (c *eurekaDiscoveryConfig) applyDefaults(serverTLS bool) {
+	if c.IntervalSeconds == 0 {
+		c.IntervalSeconds = defaultDiscoveryIntervalSeconds
+	}
+	c.registrationConfig.applyDefaults(serverTLS)
+}
+
+func (c eurekaDiscoveryConfig) validate() error {
+	if c.URL == "" {
+		return errors.New("url is required")
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return fmt.Errorf("url: %v", err)
+	}
+	if c.Application == "" {
+		return errors.New("application is required")
+	}
+	if c.IntervalSeconds < 0 {
+		return errors.New("intervalSeconds cannot be negative")
+	}
+	return c.registrationConfig.validate()
+}
+
+// eurekaPort is a port as Eureka's JSON encodes it.
+type eurekaPort struct {
+	Port    int    `json:"$"`
+	Enabled string `json:"@enabled"`
+}
+
+type eurekaInstance struct {
+	InstanceID string            `json:"instanceId"`
+	HostName   string            `json:"hostName"`
+	App        string            `json:"app"`
+	IPAddr     string            `json:"ipAddr"`
+	VIPAddress string            `json:"vipAddress,omitempty"`
+	Status     string            `json:"status"`
+	Port       eurekaPort        `json:"port"`
+	SecurePort eurekaPort        `json:"securePort"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+
+	HealthCheckURL string `json:"healthCheckUrl,omitempty"`
+	StatusPageURL  string `json:"statusPageUrl,omitempty"`
+	HomePageURL    string `json:"homePageUrl,omitempty"`
+
+	DataCenterInfo struct {
+		Class string `json:"@class"`
+		Name  string `json:"name"`
+	} `json:"dataCenterInfo"`
+}
+
+type eurekaApplication struct {
+	Application struct {
+		Instance []eurekaInstance `json:"instance"`
+	} `json:"application"`
+}
+
+type eurekaDiscoverer struct {
+	conf     eurekaDiscoveryConfig
+	base     string
+	client   *http.Client
+	instance registeredInstance
+}
+
+func makeEurekaDiscoverer(c eurekaDiscoveryConfig, listenPort uint16) (*eurekaDiscoverer, error) {
+	d := &eurekaDiscoverer{
+		conf:   c,
+		base:   strings.TrimSuffix(c.URL, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.Register {
+		instance, err := c.instance(listenPort)
+		if err != nil {
+			return nil, err
+		}
+		d.instance = instance
+	}
+	return d, nil
+}
+
+func (d *eurekaDiscoverer) appURL(app string) string {
+	return d.base + "/apps/" + url.PathEscape(strings.ToUpper(app))
+}
+
+// discover returns a clouddriver for each instance which is UP.  An
+// unknown application has no instances.
+func (d *eurekaDiscoverer) discover(ctx context.Context) ([]clouddriverConfig, error) {
+	body, err := discoveryRequest(ctx, d.client, http.MethodGet, d.appURL(d.conf.Application), nil, nil)
+	if errors.Is(err, errDiscoveryNotFound) {
+		return []clouddriverConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var app eurekaApplication
+	if err := json.Unmarshal(body, &app); err != nil {
+		return nil, err
+	}
+	ret := []clouddriverConfig{}
+	for _, instance := range app.Application.Instance {
+		if instance.Status != "UP" {
+			continue
+		}
+		scheme, port := "http", instance.Port.Port
+		if instance.SecurePort.Enabled == "true" {
+			scheme, port = "https", instance.SecurePort.Port
+		}
+		host := instance.HostName
+		if host == "" {
+			host = instance.IPAddr
+		}
+		name := instance.InstanceID
+		if name == "" {
+			name = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		u := scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+		ret = append(ret, clouddriverFromMetadata(name, u, instance.Metadata, ""))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func (d *eurekaDiscoverer) register(ctx context.Context) error {
+	base := d.instance.baseURL()
+	port := eurekaPort{Port: int(d.instance.port), Enabled: "true"}
+	securePort := eurekaPort{Port: 443, Enabled: "false"}
+	if d.instance.baseScheme() == "https" {
+		port.Enabled, securePort = "false", port
+	}
+	instance := eurekaInstance{
+		InstanceID:     d.instance.id,
+		HostName:       d.instance.address,
+		App:            strings.ToUpper(d.instance.name),
+		IPAddr:         d.instance.address,
+		VIPAddress:     d.instance.name,
+		Status:         "UP",
+		Port:           port,
+		SecurePort:     securePort,
+		HealthCheckURL: base + "/health",
+		StatusPageURL:  base + "/health",
+		HomePageURL:    base + "/",
+	}
+	instance.DataCenterInfo.Class = "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"
+	instance.DataCenterInfo.Name = "MyOwn"
+	body, err := json.Marshal(map[string]eurekaInstance{"instance": instance})
+	if err != nil {
+		return err
+	}
+	_, err = discoveryRequest(ctx, d.client, http.MethodPost, d.appURL(d.instance.name), nil, body)
+	return err
+}
+
+// renew sends a heartbeat.  Eureka answers 404 if it has forgotten the
+// instance, and runRegistration then registers again.
+func (d *eurekaDiscoverer) renew(ctx context.Context) error {
+	u := d.appURL(d.instance.name) + "/" + url.PathEscape(d.instance.id)
+	_, err := discoveryRequest(ctx, d.client, http.MethodPut, u, nil, nil)
+	return err
+}
+
+func (d *eurekaDiscoverer) deregister(ctx context.Context) error {
+	u := d.appURL(d.instance.name) + "/" + url.PathEscape(d.instance.id)
+	_, err := discoveryRequest(ctx, d.client, http.MethodDelete, u, nil, nil)
+	return err
+}
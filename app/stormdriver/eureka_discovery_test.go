@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_eurekaDiscoverer_discover(t *testing.T) {
+	eureka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eureka/apps/CLOUDDRIVER" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"application": {"name": "CLOUDDRIVER", "instance": [
+		  {"instanceId": "cd-1", "hostName": "cd-1.internal", "status": "UP",
+		   "port": {"$": 7002, "@enabled": "true"}, "securePort": {"$": 443, "@enabled": "false"},
+		   "metadata": {"disableArtifactAccounts": "true"}},
+		  {"instanceId": "cd-2", "hostName": "cd-2.internal", "status": "UP",
+		   "port": {"$": 7002, "@enabled": "false"}, "securePort": {"$": 8443, "@enabled": "true"}},
+		  {"instanceId": "cd-3", "hostName": "cd-3.internal", "status": "OUT_OF_SERVICE",
+		   "port": {"$": 7002, "@enabled": "true"}}
+		]}}`))
+	}))
+	defer eureka.Close()
+
+	c := eurekaDiscoveryConfig{URL: eureka.URL + "/eureka/", Application: "clouddriver"}
+	c.applyDefaults(false)
+	d, err := makeEurekaDiscoverer(c, 7002)
+	require.NoError(t, err)
+	got, err := d.discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []clouddriverConfig{
+		{Name: "cd-1", URL: "http://cd-1.internal:7002", DisableArtifactAccounts: true},
+		{Name: "cd-2", URL: "https://cd-2.internal:8443"},
+	}, got)
+
+	d.conf.Application = "unknown"
+	got, err = d.discover(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func Test_eurekaDiscoverer_renew(t *testing.T) {
+	registered := false
+	eureka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/eureka/apps/STORMDRIVER":
+			registered = true
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut && r.URL.Path == "/eureka/apps/STORMDRIVER/stormdriver-sd-1-7002" && registered:
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer eureka.Close()
+
+	c := eurekaDiscoveryConfig{URL: eureka.URL + "/eureka", Application: "clouddriver", registrationConfig: registrationConfig{Register: true, AdvertiseAddress: "sd-1"}}
+	c.applyDefaults(false)
+	d, err := makeEurekaDiscoverer(c, 7002)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, d.renew(context.Background()), errDiscoveryNotFound, "not registered yet")
+	require.NoError(t, d.register(context.Background()))
+	assert.NoError(t, d.renew(context.Background()))
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	eventsTypeWebhook   = "webhook"
+	eventsTypeKafkaREST = "kafkaRest"
+	eventsTypeNATS      = "nats"
+
+	defaultEventsQueueSize = 1000
+	natsWriteTimeout       = 10 * time.Second
+)
+
+// eventsConfig enables publishing an event for each operation forwarded
+// to a clouddriver.  Type is one of "webhook" (a JSON POST to URL),
+// "kafkaRest" (a Kafka REST proxy at URL, publishing to Topic), or
+// "nats" (a NATS server at a nats:// URL, publishing to Topic as the
+// subject).  If Type is empty, no events are published.
+type eventsConfig struct {
+	Type      string `yaml:"type,omitempty" json:"type,omitempty"`
+	URL       string `yaml:"url,omitempty" json:"url,omitempty"`
+	Topic     string `yaml:"topic,omitempty" json:"topic,omitempty"`
+	QueueSize int    `yaml:"queueSize,omitempty" json:"queueSize,omitempty"`
+}
+
+func (c *eventsConfig) applyDefaults() {
+	if c.Type != "" && c.QueueSize == 0 {
+		c.QueueSize = defaultEventsQueueSize
+	}
+}
+
+func (c eventsConfig) validate() error {
+	switch c.Type {
+	case "":
+		return nil
+	case eventsTypeWebhook:
+	case eventsTypeKafkaREST, eventsTypeNATS:
+		if c.Topic == "" {
+			return fmt.Errorf("topic is required for %s", c.Type)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	if c.Type == eventsTypeNATS && u.Scheme != "nats" {
+		return fmt.Errorf("nats url must use the nats:// scheme")
+	}
+	if c.Type != eventsTypeNATS && u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must use http or https")
+	}
+	return nil
+}
+
+// opEvent describes an operation forwarded to a clouddriver.
+type opEvent struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	User        string    `json:"user,omitempty"`
+	Accounts    []string  `json:"accounts,omitempty"`
+	Clouddriver string    `json:"clouddriver,omitempty"`
+	TaskID      string    `json:"taskId,omitempty"`
+	StatusCode  int       `json:"statusCode"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// taskIDFromResponse returns the task id from a clouddriver operation
+// response, such as {"id": "...", "resourceUri": "/task/..."}.
+func taskIDFromResponse(body []byte) string {
+	var ref struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &ref); err != nil {
+		return ""
+	}
+	return ref.ID
+}
+
+var eventsDropped = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "events_dropped_total",
+	Help:      "Operation events dropped because the queue was full or publishing failed.",
+})
+
+type eventSink interface {
+	publish(ctx context.Context, payload []byte) error
+}
+
+// eventPublisher queues events and publishes them in the background,
+// so a slow or unavailable event bus never delays an operation.
+// A nil eventPublisher discards events.
+type eventPublisher struct {
+	sink  eventSink
+	queue chan opEvent
+}
+
+var events *eventPublisher
+
+func makeEventPublisher(conf eventsConfig) *eventPublisher {
+	var sink eventSink
+	switch conf.Type {
+	case eventsTypeWebhook:
+		sink = &webhookSink{url: conf.URL}
+	case eventsTypeKafkaREST:
+		sink = &kafkaRESTSink{url: combineURL(conf.URL, "/topics/"+url.PathEscape(conf.Topic))}
+	case eventsTypeNATS:
+		sink = &natsSink{url: conf.URL, subject: conf.Topic}
+	default:
+		return nil
+	}
+	return &eventPublisher{
+		sink:  sink,
+		queue: make(chan opEvent, conf.QueueSize),
+	}
+}
+
+func (p *eventPublisher) emit(e opEvent) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- e:
+	default:
+		eventsDropped.Inc()
+	}
+}
+
+func (p *eventPublisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-p.queue:
+			payload, err := json.Marshal(e)
+			if err != nil {
+				eventsDropped.Inc()
+				continue
+			}
+			publishCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err = p.sink.publish(publishCtx, payload)
+			cancel()
+			if err != nil {
+				eventsDropped.Inc()
+				zap.S().Warnw("unable to publish event", "error", err)
+			}
+		}
+	}
+}
+
+type webhookSink struct {
+	url string
+}
+
+func (s *webhookSink) publish(ctx context.Context, payload []byte) error {
+	return postJSON(ctx, s.url, "application/json", payload)
+}
+
+type kafkaRESTSink struct {
+	url string
+}
+
+func (s *kafkaRESTSink) publish(ctx context.Context, payload []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]json.RawMessage{{"value": payload}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.url, "application/vnd.kafka.json.v2+json", body)
+}
+
+func postJSON(ctx context.Context, target string, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", contentType)
+	resp, err := downstreamClients.clientFor(target).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if !httputil.StatusCodeOK(resp.StatusCode) {
+		return fmt.Errorf("%s returned status %d", target, resp.StatusCode)
+	}
+	return nil
+}
+
+// natsSink publishes using the NATS client protocol directly, which
+// for publishing is only a few lines of text.  The connection is made
+// on first use, and again after any error.
+type natsSink struct {
+	sync.Mutex
+	url     string
+	subject string
+	conn    net.Conn
+}
+
+func (s *natsSink) connect(ctx context.Context) error {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	// the server speaks first, with an INFO line.
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from nats server: %q", strings.TrimSpace(line))
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": appName}
+	if u.User != nil {
+		options["user"] = u.User.Username()
+		options["pass"], _ = u.User.Password()
+	}
+	connect, _ := json.Marshal(options)
+	_ = conn.SetWriteDeadline(natsWriteDeadline(ctx))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	go s.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop answers the server's keepalive pings, and logs errors.
+func (s *natsSink) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			s.drop(conn)
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			s.Lock()
+			_ = conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+			_, err = conn.Write([]byte("PONG\r\n"))
+			s.Unlock()
+			if err != nil {
+				s.drop(conn)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			zap.S().Warnw("nats server error", "message", strings.TrimSpace(line))
+		}
+	}
+}
+
+func (s *natsSink) drop(conn net.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	conn.Close()
+	if s.conn == conn {
+		s.conn = nil
+	}
+}
+
+// natsWriteDeadline returns when a write to the server must finish:
+// the context's deadline, or natsWriteTimeout from now if it is sooner
+// or there is none, so a stuck server cannot block the publisher.
+func natsWriteDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(natsWriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+func (s *natsSink) publish(ctx context.Context, payload []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", s.subject, len(payload), payload)
+	_ = s.conn.SetWriteDeadline(natsWriteDeadline(ctx))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_taskIDFromResponse(t *testing.T) {
+	assert.Equal(t, "01G5", taskIDFromResponse([]byte(`{"id":"01G5","resourceUri":"/task/01G5"}`)))
+	assert.Equal(t, "", taskIDFromResponse([]byte(`not json`)))
+}
+
+func Test_eventsConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       eventsConfig
+		wantErr bool
+	}{
+		{"disabled", eventsConfig{}, false},
+		{"webhook", eventsConfig{Type: eventsTypeWebhook, URL: "https://hooks.example.com/ops"}, false},
+		{"kafka without topic", eventsConfig{Type: eventsTypeKafkaREST, URL: "http://kafka-rest:8082"}, true},
+		{"nats", eventsConfig{Type: eventsTypeNATS, URL: "nats://nats:4222", Topic: "spinnaker.ops"}, false},
+		{"nats with http url", eventsConfig{Type: eventsTypeNATS, URL: "http://nats:4222", Topic: "spinnaker.ops"}, true},
+		{"unknown type", eventsConfig{Type: "carrier-pigeon"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, tt.c.validate() != nil)
+		})
+	}
+}
+
+func Test_kafkaRESTSink_publish(t *testing.T) {
+	var gotPath, gotContentType string
+	var gotBody map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotContentType = r.Header.Get("content-type")
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+	}))
+	defer server.Close()
+
+	p := makeEventPublisher(eventsConfig{Type: eventsTypeKafkaREST, URL: server.URL, Topic: "ops"})
+	require.NoError(t, p.sink.publish(context.Background(), []byte(`{"taskId":"t1"}`)))
+	assert.Equal(t, "/topics/ops", gotPath)
+	assert.Equal(t, "application/vnd.kafka.json.v2+json", gotContentType)
+	assert.Equal(t, map[string]interface{}{
+		"records": []interface{}{map[string]interface{}{"value": map[string]interface{}{"taskId": "t1"}}},
+	}, gotBody)
+}
+
+func Test_natsSink_publish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		reader := bufio.NewReader(conn)
+		lines := []string{}
+		for len(lines) < 3 {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		received <- lines
+	}()
+
+	s := &natsSink{url: "nats://" + l.Addr().String(), subject: "spinnaker.ops"}
+	require.NoError(t, s.publish(context.Background(), []byte(`{"taskId":"t1"}`)))
+	lines := <-received
+	assert.True(t, strings.HasPrefix(lines[0], "CONNECT {"))
+	assert.Equal(t, "PUB spinnaker.ops 15", lines[1])
+	assert.Equal(t, `{"taskId":"t1"}`, lines[2])
+}
+
+func Test_natsSink_publishWriteDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// greet, then never read.
+		_, _ = io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		<-done
+	}()
+
+	s := &natsSink{url: "nats://" + l.Addr().String(), subject: "spinnaker.ops"}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = s.publish(ctx, bytes.Repeat([]byte("x"), 64*1024*1024))
+	assert.Error(t, err, "a server which does not read times out")
+	assert.Nil(t, s.conn)
+}
+
+func Test_eventPublisher_emit(t *testing.T) {
+	var nilPublisher *eventPublisher
+	nilPublisher.emit(opEvent{}) // must not panic
+
+	p := &eventPublisher{queue: make(chan opEvent, 1)}
+	p.emit(opEvent{TaskID: "t1"})
+	p.emit(opEvent{TaskID: "t2"}) // dropped, queue full
+	assert.Equal(t, "t1", (<-p.queue).TaskID)
+	assert.Len(t, p.queue, 0)
+}
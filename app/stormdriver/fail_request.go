@@ -21,8 +21,6 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
-
-	"go.uber.org/zap"
 )
 
 func (s *srv) failAndLog() http.HandlerFunc {
@@ -30,24 +28,29 @@ func (s *srv) failAndLog() http.HandlerFunc {
 		reqBody, err := io.ReadAll(req.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			zap.S().Errorw("io.ReadAll", "error", err)
+			requestLogger(req.Context()).Errorw("io.ReadAll", "error", err)
 			return
 		}
 		req.Body.Close()
+		logAndFail(w, req, reqBody)
+	}
+}
 
-		t := tracerContents{
-			Method: req.Method,
-			Request: tracerHTTP{
-				Body:    base64.StdEncoding.EncodeToString(reqBody),
-				Headers: simplifyHeadersForLogging(req.Header),
-				URI:     req.RequestURI,
-			},
-		}
-		json, _ := json.Marshal(t)
+// logAndFail logs a request Stormdriver cannot route, with its body,
+// and rejects it.
+func logAndFail(w http.ResponseWriter, req *http.Request, reqBody []byte) {
+	t := tracerContents{
+		Method: req.Method,
+		Request: tracerHTTP{
+			Body:    base64.StdEncoding.EncodeToString(reqBody),
+			Headers: simplifyHeadersForLogging(req.Header),
+			URI:     req.RequestURI,
+		},
+	}
+	json, _ := json.Marshal(t)
 
-		zap.S().Infof("%s", json)
+	requestLogger(req.Context()).Infof("%s", json)
 
-		// return not available for all of these
-		w.WriteHeader(http.StatusServiceUnavailable)
-	}
+	// return not available for all of these
+	w.WriteHeader(http.StatusServiceUnavailable)
 }
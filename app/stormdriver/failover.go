@@ -0,0 +1,104 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// failoverConfig limits how many clouddrivers a GET routed by account
+// is tried on.  When the routed clouddriver cannot be reached or
+// returns a 5xx, the request is sent to the next highest priority
+// clouddriver which also returned the account on the last sync.
+// MaxAttempts of 0 tries every such clouddriver, and 1 disables
+// failover.
+type failoverConfig struct {
+	MaxAttempts int `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"`
+}
+
+func (c failoverConfig) validate() error {
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts cannot be negative")
+	}
+	return nil
+}
+
+var failover failoverConfig
+
+var failovers = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "failovers_total",
+	Help:      "Account-routed lookups sent to another clouddriver, by why the previous one failed: error or status.",
+}, []string{"reason"})
+
+// limit returns the routes to try, in order.
+func (c failoverConfig) limit(routes []URLAndPriority) []URLAndPriority {
+	if c.MaxAttempts > 0 && len(routes) > c.MaxAttempts {
+		return routes[:c.MaxAttempts]
+	}
+	return routes
+}
+
+// failoverReason says why a response should be given up on in favour
+// of the next clouddriver, or "" if it should be used.  A response too
+// large for one clouddriver is too large for all of them.
+func failoverReason(resp *http.Response, err error) string {
+	if err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			return ""
+		}
+		return "error"
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "status"
+	}
+	return ""
+}
+
+// fetchFromRoutes streams the response to a GET of the request's URI
+// from the first of routes which answers without an error or 5xx.  The
+// last route's response is used, whatever it is.
+func fetchFromRoutes(ctx context.Context, routes []URLAndPriority, w http.ResponseWriter, req *http.Request) {
+	routes = failover.limit(routes)
+	for idx, route := range routes {
+		target := combineURL(route.URL, req.RequestURI)
+		resp, err := fetchGetStream(withRoute(ctx, route), target, route.token, req.Header)
+		if idx < len(routes)-1 && ctx.Err() == nil {
+			if reason := failoverReason(resp, err); reason != "" {
+				status := -1
+				if err == nil {
+					status = resp.StatusCode
+					_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+					resp.Body.Close()
+				}
+				requestLogger(ctx).Warnw("failing over to next clouddriver",
+					"target", target, "next", routes[idx+1].URL, "statusCode", status, "error", err)
+				failovers.WithLabelValues(reason).Inc()
+				continue
+			}
+		}
+		streamFetched(ctx, target, route.token, resp, err, w)
+		return
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fetchFromRoutes(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	tests := []struct {
+		name        string
+		maxAttempts int
+		first       *httptest.Server
+		firstURL    string
+		wantCode    int
+		want        string
+	}{
+		{"primary answers", 0, hedgeTestServer(t, 0, http.StatusOK, "primary"), "", http.StatusOK, "primary"},
+		{"primary 5xx fails over", 0, hedgeTestServer(t, 0, http.StatusBadGateway, "primary"), "", http.StatusOK, "second"},
+		{"primary unreachable fails over", 0, nil, downURL, http.StatusOK, "second"},
+		{"primary 4xx is used", 0, hedgeTestServer(t, 0, http.StatusNotFound, "primary"), "", http.StatusNotFound, "primary"},
+		{"failover disabled", 1, hedgeTestServer(t, 0, http.StatusBadGateway, "primary"), "", http.StatusBadGateway, "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old failoverConfig) { failover = old }(failover)
+			failover = failoverConfig{MaxAttempts: tt.maxAttempts}
+			firstURL := tt.firstURL
+			if tt.first != nil {
+				firstURL = tt.first.URL
+			}
+			second := hedgeTestServer(t, 0, http.StatusOK, "second")
+			routes := []URLAndPriority{{URL: firstURL}, {URL: second.URL}}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/instances/a/us-east-1/i-1", nil)
+			fetchFromRoutes(context.Background(), routes, w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func Test_fetchFromRoutes_lastRouteFails(t *testing.T) {
+	a := hedgeTestServer(t, 0, http.StatusInternalServerError, "a")
+	b := hedgeTestServer(t, 0, http.StatusServiceUnavailable, "b")
+	w := httptest.NewRecorder()
+	fetchFromRoutes(context.Background(), []URLAndPriority{{URL: a.URL}, {URL: b.URL}}, w, httptest.NewRequest(http.MethodGet, "/x", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "the last clouddriver's answer is used")
+	assert.Equal(t, "b", w.Body.String())
+}
+
+func Test_findArtifactRouteCandidates(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"a": {Name: "a", URL: "http://a", Priority: 1},
+			"b": {Name: "b", URL: "http://b"},
+		},
+		swaps: map[string]string{},
+		artifactAccountRoutes: map[string]URLAndPriority{
+			"github": {URL: "http://a", Priority: 1},
+		},
+	}
+	m.syncedArtifactAccounts = map[string][]trackedSpinnakerAccount{
+		m.state["a"].routeKey(): {{Name: "github"}},
+		m.state["b"].routeKey(): {{Name: "github"}},
+	}
+	got, found := m.findArtifactRouteCandidates("github")
+	assert.True(t, found)
+	assert.Equal(t, []URLAndPriority{{URL: "http://a", Priority: 1}, {URL: "http://b"}}, got)
+}
+
+func Test_findCloudRouteCandidates_pinned(t *testing.T) {
+	rules, err := compileRoutingRules([]routingRuleConfig{{Glob: "ruled-*", Clouddriver: "a"}})
+	require.NoError(t, err)
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"a": {Name: "a", URL: "http://a", Priority: 1},
+			"b": {Name: "b", URL: "http://b", Priority: 5},
+		},
+		swaps:            map[string]string{},
+		accountOverrides: map[string]string{"pinned": "a", "dangling": "missing"},
+		warnedOverrides:  map[string]bool{},
+		routingRules:     rules,
+		warnedRules:      map[string]bool{},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"pinned":   {URL: "http://a", Priority: 1},
+			"ruled-1":  {URL: "http://a", Priority: 1},
+			"dangling": {URL: "http://a", Priority: 1},
+		},
+	}
+	m.syncedCloudAccounts = map[string][]trackedSpinnakerAccount{
+		m.state["a"].routeKey(): {{Name: "pinned"}, {Name: "ruled-1"}, {Name: "dangling"}},
+		m.state["b"].routeKey(): {{Name: "pinned"}, {Name: "ruled-1"}, {Name: "dangling"}},
+	}
+
+	for _, account := range []string{"pinned", "ruled-1"} {
+		got, found := m.findCloudRouteCandidates(account)
+		assert.True(t, found)
+		assert.Equal(t, []URLAndPriority{{URL: "http://a", Priority: 1}}, got, "%s does not fail over", account)
+	}
+
+	got, found := m.findCloudRouteCandidates("dangling")
+	assert.True(t, found)
+	assert.Len(t, got, 2, "an override which cannot be applied does not pin")
+}
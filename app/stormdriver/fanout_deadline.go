@@ -0,0 +1,89 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// fanOutConfig bounds how long a request sent to every clouddriver
+// waits for their answers.  When the deadline passes, the clouddrivers
+// which have not answered are left out of the merged response.
+// Routes are path templates, such as "/applications/{name}/serverGroups",
+// and override TimeoutSeconds.  A timeout of 0 means no deadline.
+// If ScopeToAccounts is set, requests listing accounts in
+// X-SPINNAKER-ACCOUNTS are only sent to the clouddrivers owning them.
+type fanOutConfig struct {
+	TimeoutSeconds  int            `yaml:"timeoutSeconds,omitempty" json:"timeoutSeconds,omitempty"`
+	Routes          map[string]int `yaml:"routes,omitempty" json:"routes,omitempty"`
+	ScopeToAccounts bool           `yaml:"scopeToAccounts,omitempty" json:"scopeToAccounts,omitempty"`
+}
+
+func (c fanOutConfig) validate() error {
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeoutSeconds cannot be negative")
+	}
+	for route, seconds := range c.Routes {
+		if seconds < 0 {
+			return fmt.Errorf("routes: %s: timeout cannot be negative", route)
+		}
+	}
+	return nil
+}
+
+func (c fanOutConfig) timeoutFor(route string) time.Duration {
+	if seconds, found := c.Routes[route]; found {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+var fanOutDeadlines fanOutConfig
+
+var fanOutDeadlinesExceeded = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "fanout_deadlines_exceeded_total",
+	Help:      "Fan-out requests answered with partial results because the deadline passed.",
+}, []string{"route"})
+
+// fanOutContext returns the context to use for each clouddriver request
+// made while handling req.
+func fanOutContext(req *http.Request) (context.Context, context.CancelFunc) {
+	timeout := fanOutDeadlines.timeoutFor(routeTemplate(req))
+	if timeout == 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), timeout)
+}
+
+// noteFanOutDeadline records a fan-out which returned partial results
+// because ctx, from fanOutContext, passed its deadline.
+func noteFanOutDeadline(ctx context.Context, req *http.Request) {
+	if ctx.Err() != context.DeadlineExceeded || req.Context().Err() != nil {
+		return
+	}
+	route := routeTemplate(req)
+	fanOutDeadlinesExceeded.WithLabelValues(route).Inc()
+	zap.S().Warnw("fan-out deadline passed, returning partial results", "route", route, "timeout", fanOutDeadlines.timeoutFor(route))
+}
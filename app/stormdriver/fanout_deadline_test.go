@@ -0,0 +1,84 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fanOutConfig_timeoutFor(t *testing.T) {
+	c := fanOutConfig{
+		TimeoutSeconds: 10,
+		Routes: map[string]int{
+			"/applications/{name}/serverGroups": 30,
+			"/credentials":                      0,
+		},
+	}
+	assert.Equal(t, 10*time.Second, c.timeoutFor("/applications"))
+	assert.Equal(t, 30*time.Second, c.timeoutFor("/applications/{name}/serverGroups"))
+	assert.Equal(t, time.Duration(0), c.timeoutFor("/credentials"), "0 disables the default")
+	assert.Error(t, fanOutConfig{TimeoutSeconds: -1}.validate())
+	assert.Error(t, fanOutConfig{Routes: map[string]int{"/x": -1}}.validate())
+}
+
+func Test_fetchList_deadline(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"name":"fast"}]`))
+	}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		_, _ = w.Write([]byte(`[{"name":"slow"}]`))
+	}))
+	defer slow.Close()
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a": {URL: fast.URL},
+			"b": {URL: slow.URL},
+		},
+	}
+	oldDeadlines := fanOutDeadlines
+	defer func() { fanOutDeadlines = oldDeadlines }()
+	fanOutDeadlines = fanOutConfig{Routes: map[string]int{"/applications": 1}}
+
+	s := &srv{}
+	r := mux.NewRouter()
+	r.HandleFunc("/applications", s.fetchList("name"))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/applications", nil))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, http.StatusOK, w.Code)
+	var got []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, []map[string]interface{}{{"name": "fast"}}, got)
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// unscopedFanOutRoutes list every account, so are always sent to every
+// clouddriver.
+var unscopedFanOutRoutes = map[string]bool{
+	"/credentials":           true,
+	"/artifacts/credentials": true,
+}
+
+// requestAccounts returns the account names in X-SPINNAKER-ACCOUNTS.
+func requestAccounts(req *http.Request) []string {
+	ret := []string{}
+	for _, header := range req.Header.Values("x-spinnaker-accounts") {
+		for _, name := range strings.Split(header, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				ret = append(ret, aliases.resolve(name))
+			}
+		}
+	}
+	return ret
+}
+
+// fanOutTargets returns the clouddrivers to send req to.  This is
+// every healthy clouddriver unless fanOut.scopeToAccounts is set and
+// the request lists accounts in X-SPINNAKER-ACCOUNTS, in which case
+// only the clouddrivers owning those accounts are asked.
+func fanOutTargets(req *http.Request) []URLAndPriority {
+	cds := clouddriverManager.getHealthyClouddriverURLs()
+	if !fanOutDeadlines.ScopeToAccounts || unscopedFanOutRoutes[routeTemplate(req)] {
+		return cds
+	}
+	owners := map[string]bool{}
+	for _, name := range requestAccounts(req) {
+		if route, found := clouddriverManager.findCloudRoute(name); found {
+			owners[route.key()] = true
+		}
+	}
+	if len(owners) == 0 {
+		return cds
+	}
+	ret := []URLAndPriority{}
+	for _, cd := range cds {
+		if owners[cd.key()] {
+			ret = append(ret, cd)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_fanOutTargets(t *testing.T) {
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a1": {URL: "http://a"},
+			"a2": {URL: "http://a"},
+			"b1": {URL: "http://b"},
+			"c1": {URL: "http://c"},
+		},
+	}
+	oldDeadlines := fanOutDeadlines
+	defer func() { fanOutDeadlines = oldDeadlines }()
+
+	tests := []struct {
+		name     string
+		scope    bool
+		path     string
+		accounts string
+		want     []string
+	}{
+		{"scoping disabled", false, "/applications", "a1", []string{"http://a", "http://b", "http://c"}},
+		{"no header", true, "/applications", "", []string{"http://a", "http://b", "http://c"}},
+		{"one owner", true, "/applications", "a1,a2", []string{"http://a"}},
+		{"two owners", true, "/applications", "a1, c1", []string{"http://a", "http://c"}},
+		{"unknown accounts", true, "/applications", "zzz", []string{"http://a", "http://b", "http://c"}},
+		{"credentials are never scoped", true, "/credentials", "a1", []string{"http://a", "http://b", "http://c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fanOutDeadlines = fanOutConfig{ScopeToAccounts: tt.scope}
+			var got []string
+			r := mux.NewRouter()
+			r.HandleFunc(tt.path, func(w http.ResponseWriter, req *http.Request) {
+				for _, cd := range fanOutTargets(req) {
+					got = append(got, cd.URL)
+				}
+			})
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accounts != "" {
+				req.Header.Set("x-spinnaker-accounts", tt.accounts)
+			}
+			r.ServeHTTP(httptest.NewRecorder(), req)
+			sort.Strings(got)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	featureFlagPolicyAny    = "any"
+	featureFlagPolicyAll    = "all"
+	featureFlagPolicyQuorum = "quorum"
+)
+
+// featureFlagsConfig decides when a feature flag is reported as enabled
+// to Deck, given the answers from every clouddriver.  With "any", the
+// default, one clouddriver with the flag enabled is enough.  With "all",
+// every clouddriver asked must have it enabled, so a clouddriver which
+// does not answer disables every flag, and with "quorum", at least
+// Quorum of them must.  A clouddriver which does not list a flag counts
+// as having it disabled.
+type featureFlagsConfig struct {
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+	Quorum int    `yaml:"quorum,omitempty" json:"quorum,omitempty"`
+}
+
+func (c featureFlagsConfig) validate() error {
+	switch c.Policy {
+	case "", featureFlagPolicyAny, featureFlagPolicyAll:
+		if c.Quorum != 0 {
+			return fmt.Errorf("quorum is only used with the %s policy", featureFlagPolicyQuorum)
+		}
+	case featureFlagPolicyQuorum:
+		if c.Quorum < 1 {
+			return fmt.Errorf("quorum must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown policy %q", c.Policy)
+	}
+	return nil
+}
+
+var featureFlags featureFlagsConfig
+
+// enabled returns whether a flag enabled on count of the asked
+// clouddrivers is enabled.
+func (c featureFlagsConfig) enabled(count int, asked int) bool {
+	switch c.Policy {
+	case featureFlagPolicyAll:
+		return count == asked
+	case featureFlagPolicyQuorum:
+		return count >= c.Quorum
+	default:
+		return count > 0
+	}
+}
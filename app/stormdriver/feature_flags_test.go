@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_featureFlagsConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       featureFlagsConfig
+		wantErr bool
+	}{
+		{"default", featureFlagsConfig{}, false},
+		{"any", featureFlagsConfig{Policy: "any"}, false},
+		{"all", featureFlagsConfig{Policy: "all"}, false},
+		{"quorum", featureFlagsConfig{Policy: "quorum", Quorum: 2}, false},
+		{"quorum without a count", featureFlagsConfig{Policy: "quorum"}, true},
+		{"count without quorum", featureFlagsConfig{Policy: "all", Quorum: 2}, true},
+		{"unknown policy", featureFlagsConfig{Policy: "most"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_combineFeatureLists_policy(t *testing.T) {
+	// "stage" is enabled on two of three clouddrivers, and missing from
+	// the third.  "other" is enabled on all three, and "old" on none.
+	responses := []featureFetchResult{
+		{data: []featureFlag{{"stage", true}, {"other", true}, {"old", false}}},
+		{data: []featureFlag{{"stage", true}, {"other", true}}},
+		{data: []featureFlag{{"other", true}, {"old", false}}},
+		{data: []featureFlag{{"stage", true}}, result: fetchResult{err: fmt.Errorf("unreachable")}},
+	}
+	tests := []struct {
+		name   string
+		policy featureFlagsConfig
+		want   []featureFlag
+	}{
+		{
+			"any",
+			featureFlagsConfig{},
+			[]featureFlag{{"stage", true}, {"other", true}, {"old", false}},
+		},
+		{
+			"all, with one clouddriver not answering",
+			featureFlagsConfig{Policy: featureFlagPolicyAll},
+			[]featureFlag{{"stage", false}, {"other", false}, {"old", false}},
+		},
+		{
+			"quorum met",
+			featureFlagsConfig{Policy: featureFlagPolicyQuorum, Quorum: 2},
+			[]featureFlag{{"stage", true}, {"other", true}, {"old", false}},
+		},
+		{
+			"quorum not met",
+			featureFlagsConfig{Policy: featureFlagPolicyQuorum, Quorum: 3},
+			[]featureFlag{{"stage", false}, {"other", true}, {"old", false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := make(chan featureFetchResult, len(responses))
+			for _, r := range responses {
+				c <- r
+			}
+			ret := combineFeatureLists(c, len(responses), tt.policy, nil)
+			assert.ElementsMatch(t, tt.want, ret)
+		})
+	}
+}
+
+func Test_combineFeatureLists_all(t *testing.T) {
+	c := make(chan featureFetchResult, 2)
+	c <- featureFetchResult{data: []featureFlag{{"stage", true}, {"other", true}}}
+	c <- featureFetchResult{data: []featureFlag{{"stage", true}}}
+	ret := combineFeatureLists(c, 2, featureFlagsConfig{Policy: featureFlagPolicyAll}, nil)
+	assert.ElementsMatch(t, []featureFlag{{"stage", true}, {"other", false}}, ret)
+}
+
+func Test_combineFeatureLists_countsEachClouddriverOnce(t *testing.T) {
+	c := make(chan featureFetchResult, 2)
+	c <- featureFetchResult{data: []featureFlag{{"stage", true}, {"stage", true}}}
+	c <- featureFetchResult{data: []featureFlag{}}
+	ret := combineFeatureLists(c, 2, featureFlagsConfig{Policy: featureFlagPolicyQuorum, Quorum: 2}, nil)
+	assert.Equal(t, []featureFlag{{"stage", false}}, ret)
+}
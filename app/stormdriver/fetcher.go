@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/OpsMx/go-app-base/httputil"
 	"github.com/gorilla/mux"
@@ -35,6 +36,7 @@ type fetchResult struct {
 
 type listFetchResult struct {
 	result fetchResult
+	source string
 	data   []interface{}
 }
 
@@ -45,11 +47,13 @@ type featureFlag struct {
 
 type featureFetchResult struct {
 	result fetchResult
+	source string
 	data   []featureFlag
 }
 
 type mapFetchResult struct {
 	result fetchResult
+	source string
 	data   map[string]interface{}
 }
 
@@ -59,7 +63,7 @@ type singletonFetchResult struct {
 	statusCode int
 }
 
-func fetchListFromOneEndpoint(ctx context.Context, c chan listFetchResult, url string, token string, headers http.Header) {
+func fetchListFromOneEndpoint(ctx context.Context, c chan listFetchResult, source string, url string, token string, headers http.Header) {
 	bytes, statusCode, _, err := fetchGet(ctx, url, token, headers)
 
 	if err != nil {
@@ -69,7 +73,7 @@ func fetchListFromOneEndpoint(ctx context.Context, c chan listFetchResult, url s
 	}
 
 	if statusCode == http.StatusNotFound {
-		c <- listFetchResult{fetchResult{nil}, []interface{}{}}
+		c <- listFetchResult{source: source, data: []interface{}{}}
 		return
 	}
 
@@ -91,6 +95,7 @@ func fetchListFromOneEndpoint(ctx context.Context, c chan listFetchResult, url s
 
 	c <- listFetchResult{
 		result: fetchResult{err: nil},
+		source: source,
 		data:   data,
 	}
 }
@@ -136,7 +141,11 @@ func getKeyValue(item interface{}, target string) string {
 	return ""
 }
 
-func combineUniqueLists(c chan listFetchResult, count int, key string) []interface{} {
+// combineUniqueLists merges the lists, dropping items whose key was
+// already seen, unless key is "".  key may name several fields,
+// separated by commas.  If stats is not nil, what each source
+// contributed is counted there.
+func combineUniqueLists(c chan listFetchResult, count int, key string, stats mergeCounts) []interface{} {
 	ret := []interface{}{}
 	seen := map[string]bool{}
 
@@ -146,137 +155,266 @@ func combineUniqueLists(c chan listFetchResult, count int, key string) []interfa
 			zap.S().Errorw("failed to fetch", "error", j.result.err)
 			continue
 		}
+		stats.add(j.source, len(j.data), 0)
 		if key == "" {
 			ret = append(ret, j.data...)
 			continue
 		}
 
 		for _, item := range j.data {
-			itemKey := getKeyValue(item, key)
-			if itemKey != "" && !seen[itemKey] {
-				seen[itemKey] = true
-				ret = append(ret, item)
+			itemKey := getListKey(item, key)
+			if itemKey == "" {
+				continue
 			}
+			if seen[itemKey] {
+				stats.add(j.source, 0, 1)
+				continue
+			}
+			seen[itemKey] = true
+			ret = append(ret, item)
 		}
 	}
 	return ret
 }
 
-func combineFeatureLists(c chan featureFetchResult, count int) []featureFlag {
-	flags := map[string]bool{}
+// combineFeatureLists merges the flags, enabling each one as policy
+// decides from how many clouddrivers have it enabled.
+func combineFeatureLists(c chan featureFetchResult, count int, policy featureFlagsConfig, stats mergeCounts) []featureFlag {
+	enabled := map[string]int{}
 	for i := 0; i < count; i++ {
 		j := <-c
 		if j.result.err != nil {
 			zap.S().Errorw("failed to fetch", "error", j.result.err)
 		} else {
+			stats.add(j.source, len(j.data), 0)
+			counted := map[string]bool{}
 			for _, flag := range j.data {
-				flags[flag.Name] = flags[flag.Name] || flag.Enabled
+				if _, seen := enabled[flag.Name]; seen {
+					stats.add(j.source, 0, 1)
+				} else {
+					enabled[flag.Name] = 0
+				}
+				if flag.Enabled && !counted[flag.Name] {
+					counted[flag.Name] = true
+					enabled[flag.Name]++
+				}
 			}
 		}
 	}
 
-	ret := make([]featureFlag, 0, len(flags))
-	for name, value := range flags {
-		ret = append(ret, featureFlag{name, value})
+	ret := make([]featureFlag, 0, len(enabled))
+	for name, n := range enabled {
+		ret = append(ret, featureFlag{name, policy.enabled(n, count)})
 	}
 	return ret
 }
 
-func combineMaps(c chan mapFetchResult, count int) map[string]interface{} {
+func combineMaps(c chan mapFetchResult, count int, stats mergeCounts) map[string]interface{} {
 	ret := make(map[string]interface{})
 	for i := 0; i < count; i++ {
 		j := <-c
 		if j.result.err != nil {
 			zap.S().Errorw("failed to fetch", "error", j.result.err)
 		} else {
-			for k, v := range j.data {
-				ret[k] = v
-			}
+			stats.add(j.source, len(j.data), 0)
+			_, duplicates := mergeMaps(ret, j.data)
+			stats.add(j.source, 0, duplicates)
 		}
 	}
 	return ret
 }
 
+// fetchGet performs a GET, retrying according to the retry policy for
+// the clouddriver at url.
 func fetchGet(ctx context.Context, url string, token string, headers http.Header) ([]byte, int, http.Header, error) {
+	policy := downstreamClients.retryFor(url)
+	for attempt := 1; ; attempt++ {
+		body, statusCode, respHeaders, err := fetchGetOnce(ctx, url, token, headers)
+		if !policy.shouldRetry(attempt, statusCode, err) {
+			return body, statusCode, respHeaders, err
+		}
+		if !sleepContext(ctx, policy.backoff(attempt)) {
+			return body, statusCode, respHeaders, err
+		}
+		getRetries.WithLabelValues(retryReason(statusCode, err)).Inc()
+	}
+}
+
+func fetchGetOnce(ctx context.Context, url string, token string, headers http.Header) ([]byte, int, http.Header, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	httpRequest, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := doGet(ctx, url, token, headers, false)
 	if err != nil {
-		zap.S().Errorw("http.NewRequestWithContext", "error", err)
 		return []byte{}, -1, http.Header{}, err
 	}
 
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		requestLogger(ctx).Errorw("io.ReadAll", "error", err)
+		return []byte{}, -2, http.Header{}, err
+	}
+
+	return respBody, resp.StatusCode, resp.Header, nil
+}
+
+// doGet sends a GET to url.  If streamed is true, the response will
+// be streamed to the client rather than parsed, so its encoding may be
+// passed through.
+func doGet(ctx context.Context, url string, token string, headers http.Header, streamed bool) (*http.Response, error) {
+	if streamed {
+		ctx = withPassthrough(ctx)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		requestLogger(ctx).Errorw("http.NewRequestWithContext", "error", err)
+		return nil, err
+	}
+
 	copyHeaders(httpRequest.Header, headers)
+	if streamed {
+		passAcceptEncoding(httpRequest.Header, headers)
+	}
 	httpRequest.Header.Set("Accept", "application/json")
+	noteClouddriver(ctx, url)
 	if token != "" {
 		httpRequest.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
 	}
-	resp, err := http.DefaultClient.Do(httpRequest)
+	resp, err := downstreamClients.clientFor(url).Do(httpRequest)
+	if err != nil {
+		noteDownstreamError(err)
+		requestLogger(ctx).Errorw("client.Do", "error", err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fetchGetStream is fetchGet, but returns the response with its body
+// unread, for streaming to the client.  Retries happen only before any
+// of a body is used.  The caller must close the body.
+func fetchGetStream(ctx context.Context, url string, token string, headers http.Header) (*http.Response, error) {
+	policy := downstreamClients.retryFor(url)
+	for attempt := 1; ; attempt++ {
+		resp, err := doGet(ctx, url, token, headers, true)
+		statusCode := -1
+		if err == nil {
+			statusCode = resp.StatusCode
+		}
+		if !policy.shouldRetry(attempt, statusCode, err) {
+			return resp, err
+		}
+		if !sleepContext(ctx, policy.backoff(attempt)) {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		getRetries.WithLabelValues(retryReason(statusCode, err)).Inc()
+	}
+}
+
+func fetchWithBody(ctx context.Context, method string, url string, token string, headers http.Header, body []byte) ([]byte, int, http.Header, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := doWithBody(ctx, method, url, token, headers, body, false)
 	if err != nil {
-		zap.S().Errorw("http.DefaultClient.Do", "error", err)
 		return []byte{}, -1, http.Header{}, err
 	}
 
 	defer resp.Body.Close()
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		zap.S().Errorw("io.ReadAll", "error", err)
+		requestLogger(ctx).Errorw("io.ReadAll", "method", method, "url", url, "hasToken", token != "", "error", err)
 		return []byte{}, -2, http.Header{}, err
 	}
 
 	return respBody, resp.StatusCode, resp.Header, nil
 }
 
-func fetchWithBody(ctx context.Context, method string, url string, token string, headers http.Header, body []byte) ([]byte, int, http.Header, error) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// fetchWithBodyStream is fetchWithBody, but returns the response with
+// its body unread, and its encoding passed through if enabled.  The
+// caller must close the body.
+func fetchWithBodyStream(ctx context.Context, method string, url string, token string, headers http.Header, body []byte) (*http.Response, error) {
+	return doWithBody(ctx, method, url, token, headers, body, true)
+}
 
+func doWithBody(ctx context.Context, method string, url string, token string, headers http.Header, body []byte, streamed bool) (*http.Response, error) {
+	if streamed {
+		ctx = withPassthrough(ctx)
+	}
 	httpRequest, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
-		zap.S().Errorw("http.NewRequestWithContext", "method", method, "url", url, "hasToken", token != "", "error", err)
-		return []byte{}, -1, http.Header{}, err
+		requestLogger(ctx).Errorw("http.NewRequestWithContext", "method", method, "url", url, "hasToken", token != "", "error", err)
+		return nil, err
 	}
 
 	copyHeaders(httpRequest.Header, headers)
+	if streamed {
+		passAcceptEncoding(httpRequest.Header, headers)
+	}
 	httpRequest.Header.Set("Accept", "application/json")
 	httpRequest.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	noteClouddriver(ctx, url)
 	if token != "" {
 		httpRequest.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
 	}
 
-	resp, err := http.DefaultClient.Do(httpRequest)
+	resp, err := downstreamClients.clientFor(url).Do(httpRequest)
 	if err != nil {
-		zap.S().Errorw("http.DefaultClient.Do", "method", method, "url", url, "hasToken", token != "", "error", err)
-		return []byte{}, -1, http.Header{}, err
+		noteDownstreamError(err)
+		requestLogger(ctx).Errorw("client.Do", "method", method, "url", url, "hasToken", token != "", "error", err)
+		return nil, err
 	}
+	return resp, nil
+}
 
-	defer resp.Body.Close()
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		zap.S().Errorw("io.ReadAll", "method", method, "url", url, "hasToken", token != "", "error", err)
-		return []byte{}, -2, http.Header{}, err
-	}
+// fetchList merges the lists every clouddriver returns, dropping items
+// whose key was already seen.  key may name several fields, separated
+// by commas, and listKeys may replace it per route.
+func (s *srv) fetchList(key string) http.HandlerFunc {
+	return s.fetchFilteredList(key, nil)
+}
 
-	return respBody, resp.StatusCode, resp.Header, nil
+// listCombiner merges the lists from count clouddrivers, dropping
+// duplicate items by key.
+type listCombiner func(c chan listFetchResult, count int, key string, stats mergeCounts) []interface{}
+
+// fetchFilteredList is fetchList, with the combined list passed through
+// filter before it is returned.
+func (s *srv) fetchFilteredList(key string, filter func(*http.Request, []interface{}) []interface{}) http.HandlerFunc {
+	return s.fetchCombinedList(combineUniqueLists, key, filter)
 }
 
-func (*srv) fetchList(key string) http.HandlerFunc {
+// fetchCombinedList is fetchFilteredList, with the lists merged by combine.
+func (*srv) fetchCombinedList(combine listCombiner, key string, filter func(*http.Request, []interface{}) []interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("content-type", "application/json")
 
 		retchan := make(chan listFetchResult)
-		cds := clouddriverManager.getHealthyClouddriverURLs()
+		cds := fanOutTargets(req)
+		ctx, cancel := fanOutContext(req)
+		defer cancel()
 
 		for _, url := range cds {
-			go fetchListFromOneEndpoint(req.Context(), retchan, combineURL(url.URL, req.RequestURI), url.token, req.Header)
+			go fetchListFromOneEndpoint(withRoute(ctx, url), retchan, mergeSource(url), combineURL(url.URL, req.RequestURI), url.token, req.Header)
 		}
 
-		ret := combineUniqueLists(retchan, len(cds), key)
+		route := routeTemplate(req)
+		key := listKeys.keyFor(route, key)
+		stats := mergeCounts{}
+		ret := combine(retchan, len(cds), key, stats)
+		noteFanOutDeadline(ctx, req)
+		mergeStatistics.record(route, stats)
+		listSorting.sortMerged(route, key, ret)
+		if filter != nil {
+			ret = filter(req, ret)
+		}
 
 		outjson, err := json.Marshal(ret)
 		if err != nil {
-			zap.S().Errorw("json.Marshal", "error", err)
+			requestLogger(req.Context()).Errorw("json.Marshal", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		} else {
 			w.WriteHeader(http.StatusOK)
@@ -293,68 +431,97 @@ func (s *srv) singleItemByOptionalQueryID(v string) http.HandlerFunc {
 			return
 		}
 
-		url, found := clouddriverManager.findCloudRoute(accountName)
+		routes, found := clouddriverManager.findCloudRouteCandidates(accountName)
 		if !found {
-			zap.S().Warnw("no route", "accountName", accountName)
+			requestLogger(req.Context()).Warnw("no route", "accountName", accountName)
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
-		target := combineURL(url.URL, req.RequestURI)
-		fetchFrom(req.Context(), target, url.token, w, req)
+		fetchFromRoutes(req.Context(), routes, w, req)
 	}
 }
 
 func (s *srv) singleArtifactItemByIDPath(v string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		accountName := mux.Vars(req)[v]
-		url, found := clouddriverManager.findArtifactRoute(accountName)
+		routes, found := clouddriverManager.findArtifactRouteCandidates(accountName)
 		if !found {
-			zap.S().Warnw("no route for artifactAccount", "accountName", accountName)
+			requestLogger(req.Context()).Warnw("no route for artifactAccount", "accountName", accountName)
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
-
-		target := combineURL(url.URL, req.RequestURI)
-		fetchFrom(req.Context(), target, url.token, w, req)
+		fetchFromRoutes(req.Context(), routes, w, req)
 	}
 }
 
 func (s *srv) singleItemByIDPath(v string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		accountName := mux.Vars(req)[v]
-		url, found := clouddriverManager.findCloudRoute(accountName)
+		routes, found := clouddriverManager.findCloudRouteCandidates(accountName)
 		if !found {
-			zap.S().Warnw("no route", "accountName", accountName)
+			requestLogger(req.Context()).Warnw("no route", "accountName", accountName)
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
-
-		target := combineURL(url.URL, req.RequestURI)
-		fetchFrom(req.Context(), target, url.token, w, req)
+		if hedging.DelayMillis > 0 && len(routes) > 1 {
+			r := hedgedFetch(req.Context(), routes, req.RequestURI, req.Header, time.Duration(hedging.DelayMillis)*time.Millisecond)
+			writeFetched(req.Context(), w, r.target, r.token, r.data, r.statusCode, r.headers, r.err)
+			return
+		}
+		fetchFromRoutes(req.Context(), routes, w, req)
 	}
 }
 
+// fetchFrom streams the response to a GET of target to the client.
 func fetchFrom(ctx context.Context, target string, token string, w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("content-type", "application/json")
+	resp, err := fetchGetStream(ctx, target, token, req.Header)
+	streamFetched(ctx, target, token, resp, err, w)
+}
 
-	data, code, headers, err := fetchGet(ctx, target, token, req.Header)
+// streamFetched streams the response to a GET of target, or the error
+// fetching it, to the client.
+func streamFetched(ctx context.Context, target string, token string, resp *http.Response, err error, w http.ResponseWriter) {
 	if err != nil {
-		zap.S().Errorw("fetchGet", "target", target, "hasToken", token != "", "error", err)
-		w.WriteHeader(http.StatusServiceUnavailable)
+		requestLogger(ctx).Errorw("fetchGet", "target", target, "hasToken", token != "", "error", err)
+		w.WriteHeader(downstreamErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if !httputil.StatusCodeOK(resp.StatusCode) {
+		if resp.ContentLength != 0 {
+			setContentType(w, resp.Header.Get("content-type"))
+		}
+	} else {
+		copyResponseHeaders(routeClassAccount, w.Header(), resp.Header)
+		setContentType(w, resp.Header.Get("content-type"))
+	}
+	copyContentEncoding(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := streamBody(w, resp.Body); err != nil {
+		requestLogger(ctx).Warnw("streaming response", "target", target, "error", err)
+	}
+}
+
+// writeFetched sends the result of a fetchGet to target as the response.
+func writeFetched(ctx context.Context, w http.ResponseWriter, target string, token string, data []byte, code int, headers http.Header, err error) {
+	if err != nil {
+		requestLogger(ctx).Errorw("fetchGet", "target", target, "hasToken", token != "", "error", err)
+		w.WriteHeader(downstreamErrorStatus(err))
 		return
 	}
 
 	if !httputil.StatusCodeOK(code) {
-		w.WriteHeader(code)
 		if len(data) > 0 {
-			w.Header().Set("content-type", headers.Get("content-type"))
-			httputil.CheckedWrite(w, data)
+			setContentType(w, headers.Get("content-type"))
 		}
+		w.WriteHeader(code)
+		httputil.CheckedWrite(w, data)
 		return
 	}
 
-	copyHeaders(w.Header(), headers)
-	w.Header().Set("content-type", headers.Get("content-type"))
+	copyResponseHeaders(routeClassAccount, w.Header(), headers)
+	setContentType(w, headers.Get("content-type"))
 	w.WriteHeader(code)
 	httputil.CheckedWrite(w, data)
 }
@@ -379,12 +546,15 @@ func (*srv) broadcast() http.HandlerFunc {
 
 		retchan := make(chan singletonFetchResult)
 		cds := clouddriverManager.getHealthyClouddriverURLs()
+		ctx, cancel := fanOutContext(req)
+		defer cancel()
 
 		for _, url := range cds {
-			go fetchSingletonFromOneEndpoint(req.Context(), retchan, combineURL(url.URL, req.RequestURI), url.token, req.Header)
+			go fetchSingletonFromOneEndpoint(withRoute(ctx, url), retchan, combineURL(url.URL, req.RequestURI), url.token, req.Header)
 		}
 
 		ret := getOneResponse(retchan, len(cds))
+		noteFanOutDeadline(ctx, req)
 
 		if ret == nil {
 			w.WriteHeader(http.StatusNotFound)
@@ -399,13 +569,18 @@ func (*srv) fetchMaps(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
 	retchan := make(chan mapFetchResult)
-	cds := clouddriverManager.getHealthyClouddriverURLs()
+	cds := fanOutTargets(req)
+	ctx, cancel := fanOutContext(req)
+	defer cancel()
 
 	for _, url := range cds {
-		go fetchMapFromOneEndpoint(req.Context(), retchan, combineURL(url.URL, req.RequestURI), url.token, req.Header)
+		go fetchMapFromOneEndpoint(withRoute(ctx, url), retchan, mergeSource(url), combineURL(url.URL, req.RequestURI), url.token, req.Header)
 	}
 
-	ret := combineMaps(retchan, len(cds))
+	stats := mergeCounts{}
+	ret := combineMaps(retchan, len(cds), stats)
+	noteFanOutDeadline(ctx, req)
+	mergeStatistics.record(routeTemplate(req), stats)
 
 	outjson, err := json.Marshal(ret)
 	if err != nil {
@@ -420,7 +595,7 @@ func (s *srv) fetchMapsHandler() http.HandlerFunc {
 	return s.fetchMaps
 }
 
-func fetchMapFromOneEndpoint(ctx context.Context, c chan mapFetchResult, url string, token string, headers http.Header) {
+func fetchMapFromOneEndpoint(ctx context.Context, c chan mapFetchResult, source string, url string, token string, headers http.Header) {
 	bytes, statusCode, _, err := fetchGet(ctx, url, token, headers)
 
 	if err != nil {
@@ -430,7 +605,7 @@ func fetchMapFromOneEndpoint(ctx context.Context, c chan mapFetchResult, url str
 	}
 
 	if statusCode == http.StatusNotFound {
-		c <- mapFetchResult{fetchResult{nil}, map[string]interface{}{}}
+		c <- mapFetchResult{source: source, data: map[string]interface{}{}}
 		return
 	}
 
@@ -452,11 +627,12 @@ func fetchMapFromOneEndpoint(ctx context.Context, c chan mapFetchResult, url str
 
 	c <- mapFetchResult{
 		result: fetchResult{err: nil},
+		source: source,
 		data:   data,
 	}
 }
 
-func fetchFeatureListFromOneEndpoint(ctx context.Context, c chan featureFetchResult, url string, token string, headers http.Header) {
+func fetchFeatureListFromOneEndpoint(ctx context.Context, c chan featureFetchResult, source string, url string, token string, headers http.Header) {
 	bytes, statusCode, _, err := fetchGet(ctx, url, token, headers)
 
 	if err != nil {
@@ -471,7 +647,7 @@ func fetchFeatureListFromOneEndpoint(ctx context.Context, c chan featureFetchRes
 		return
 	}
 
-	result := featureFetchResult{result: fetchResult{err: nil}}
+	result := featureFetchResult{result: fetchResult{err: nil}, source: source}
 	err = json.Unmarshal(bytes, &result.data)
 	if err != nil {
 		ret := featureFetchResult{result: fetchResult{err: fmt.Errorf("%s returned junk: %v, %s", url, err, string(bytes))}}
@@ -487,12 +663,17 @@ func (*srv) fetchFeatureList(w http.ResponseWriter, req *http.Request) {
 
 	retchan := make(chan featureFetchResult)
 	cds := clouddriverManager.getHealthyClouddriverURLs()
+	ctx, cancel := fanOutContext(req)
+	defer cancel()
 
 	for _, url := range cds {
-		go fetchFeatureListFromOneEndpoint(req.Context(), retchan, combineURL(url.URL, req.RequestURI), url.token, req.Header)
+		go fetchFeatureListFromOneEndpoint(withRoute(ctx, url), retchan, mergeSource(url), combineURL(url.URL, req.RequestURI), url.token, req.Header)
 	}
 
-	ret := combineFeatureLists(retchan, len(cds))
+	stats := mergeCounts{}
+	ret := combineFeatureLists(retchan, len(cds), featureFlags, stats)
+	noteFanOutDeadline(ctx, req)
+	mergeStatistics.record(routeTemplate(req), stats)
 
 	outjson, err := json.Marshal(ret)
 	if err != nil {
@@ -19,9 +19,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func thing(v string) map[string]interface{} {
@@ -88,7 +92,7 @@ func Test_combineLists(t *testing.T) {
 			for _, item := range tt.items {
 				c <- listFetchResult{data: item}
 			}
-			ret := combineUniqueLists(c, len(tt.items), tt.key)
+			ret := combineUniqueLists(c, len(tt.items), tt.key, nil)
 			assert.Equal(t, tt.want, ret)
 		})
 	}
@@ -216,6 +220,38 @@ func Test_combineMaps(t *testing.T) {
 			},
 			map[string]interface{}{"this": 1},
 		},
+		{
+			"lists for the same key are merged",
+			[]mapFetchResult{
+				{
+					data: map[string]interface{}{"prod": []interface{}{"app-main", "app-canary"}},
+				},
+				{
+					data: map[string]interface{}{"prod": []interface{}{"app-main", "app-worker"}},
+				},
+			},
+			map[string]interface{}{"prod": []interface{}{"app-main", "app-canary", "app-worker"}},
+		},
+		{
+			"security groups are merged by account, provider, and region",
+			[]mapFetchResult{
+				{
+					data: map[string]interface{}{"prod": map[string]interface{}{"aws": map[string]interface{}{
+						"us-east-1": []interface{}{map[string]interface{}{"id": "sg-1", "name": "web"}},
+					}}},
+				},
+				{
+					data: map[string]interface{}{"prod": map[string]interface{}{"aws": map[string]interface{}{
+						"us-east-1": []interface{}{map[string]interface{}{"id": "sg-2", "name": "db"}},
+						"us-west-2": []interface{}{map[string]interface{}{"id": "sg-3", "name": "web"}},
+					}}},
+				},
+			},
+			map[string]interface{}{"prod": map[string]interface{}{"aws": map[string]interface{}{
+				"us-east-1": []interface{}{map[string]interface{}{"id": "sg-1", "name": "web"}, map[string]interface{}{"id": "sg-2", "name": "db"}},
+				"us-west-2": []interface{}{map[string]interface{}{"id": "sg-3", "name": "web"}},
+			}}},
+		},
 		{
 			"no valid responses returns empty map",
 			[]mapFetchResult{
@@ -238,7 +274,7 @@ func Test_combineMaps(t *testing.T) {
 			for i := 0; i < len(tt.list); i++ {
 				c <- tt.list[i]
 			}
-			ret := combineMaps(c, len(tt.list))
+			ret := combineMaps(c, len(tt.list), nil)
 			assert.Equal(t, tt.want, ret)
 		})
 	}
@@ -343,7 +379,7 @@ func Test_combineFeatureLists(t *testing.T) {
 			for i := 0; i < len(tt.list); i++ {
 				c <- tt.list[i]
 			}
-			ret := combineFeatureLists(c, len(tt.list))
+			ret := combineFeatureLists(c, len(tt.list), featureFlagsConfig{}, nil)
 			assert.ElementsMatch(t, tt.want, ret)
 		})
 	}
@@ -376,3 +412,71 @@ func Test_getKeyValue(t *testing.T) {
 		})
 	}
 }
+
+func Test_singleItemByOptionalQueryID(t *testing.T) {
+	a := hedgeTestServer(t, 0, http.StatusOK, `[{"functionName":"fa"}]`)
+	b := hedgeTestServer(t, 0, http.StatusOK, `[{"functionName":"fb"}]`)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a": {URL: a.URL},
+			"b": {URL: b.URL},
+		},
+	}
+
+	s := &srv{}
+	r := mux.NewRouter()
+	r.HandleFunc("/functions", s.singleItemByOptionalQueryID("account"))
+
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{"routed by account", "/functions?account=b&functionName=fb&region=us-east-1", `[{"functionName":"fb"}]`},
+		{"merged without an account", "/functions", `[{"functionName":"fa"},{"functionName":"fb"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.uri, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			var got []map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			var want []map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(tt.want), &want))
+			assert.ElementsMatch(t, want, got)
+		})
+	}
+}
+
+func Test_fetchList_roles(t *testing.T) {
+	a := hedgeTestServer(t, 0, http.StatusOK, `[{"name":"deployer","id":"arn:a"},{"name":"web","id":"arn:web"}]`)
+	b := hedgeTestServer(t, 0, http.StatusOK, `[{"name":"deployer","id":"arn:b"},{"name":"batch","id":"arn:batch"}]`)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a": {URL: a.URL},
+			"b": {URL: b.URL},
+		},
+	}
+
+	s := &srv{}
+	r := mux.NewRouter()
+	r.HandleFunc("/roles/{cloudProvider}", s.fetchList("name"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/roles/aws", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var got []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	names := []string{}
+	for _, role := range got {
+		names = append(names, role["name"].(string))
+	}
+	assert.ElementsMatch(t, []string{"deployer", "web", "batch"}, names)
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultFiatURL             = "http://spin-fiat:7003"
+	defaultFiatCacheTTLSeconds = 60
+	fiatAnonymousUser          = "anonymous"
+)
+
+var fiatRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "fiat_requests_total",
+	Help:      "The number of permission lookups sent to Fiat, by result.",
+}, []string{"result"})
+
+// fiatConfig enables filtering merged accounts to those Fiat says the
+// X-SPINNAKER-USER may read.  Each user's permissions are cached for
+// CacheTTLSeconds.
+type fiatConfig struct {
+	Enabled         bool   `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	URL             string `yaml:"url,omitempty" json:"url,omitempty"`
+	CacheTTLSeconds int    `yaml:"cacheTTLSeconds,omitempty" json:"cacheTTLSeconds,omitempty"`
+}
+
+func (c *fiatConfig) applyDefaults() {
+	if !c.Enabled {
+		return
+	}
+	if c.URL == "" {
+		c.URL = defaultFiatURL
+	}
+	if c.CacheTTLSeconds == 0 {
+		c.CacheTTLSeconds = defaultFiatCacheTTLSeconds
+	}
+}
+
+func (c fiatConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return fmt.Errorf("malformed url")
+	}
+	if c.CacheTTLSeconds < 0 {
+		return fmt.Errorf("cacheTTLSeconds cannot be negative")
+	}
+	return nil
+}
+
+// fiatUserPermission is the part of Fiat's /authorize/{user} response
+// Stormdriver uses.
+type fiatUserPermission struct {
+	Admin    bool `json:"admin"`
+	Accounts []struct {
+		Name           string   `json:"name"`
+		Authorizations []string `json:"authorizations"`
+	} `json:"accounts"`
+}
+
+// fiatPermissions holds the authorizations a user has on each account.
+type fiatPermissions struct {
+	admin    bool
+	accounts map[string]map[string]bool
+}
+
+func makeFiatPermissions(p fiatUserPermission) fiatPermissions {
+	ret := fiatPermissions{admin: p.Admin, accounts: map[string]map[string]bool{}}
+	for _, account := range p.Accounts {
+		authorizations := map[string]bool{}
+		for _, authorization := range account.Authorizations {
+			authorizations[strings.ToUpper(authorization)] = true
+		}
+		ret.accounts[account.Name] = authorizations
+	}
+	return ret
+}
+
+func (p fiatPermissions) allows(account string, authorization string) bool {
+	return p.admin || p.accounts[account][authorization]
+}
+
+type fiatCacheEntry struct {
+	permissions fiatPermissions
+	expires     time.Time
+}
+
+// fiatClient fetches and caches users' permissions from Fiat.
+type fiatClient struct {
+	sync.Mutex
+	url   string
+	ttl   time.Duration
+	cache map[string]fiatCacheEntry
+	now   func() time.Time
+}
+
+// makeFiatClient returns nil unless Fiat is enabled.
+func makeFiatClient(conf fiatConfig) *fiatClient {
+	if !conf.Enabled {
+		return nil
+	}
+	return &fiatClient{
+		url:   conf.URL,
+		ttl:   time.Duration(conf.CacheTTLSeconds) * time.Second,
+		cache: map[string]fiatCacheEntry{},
+		now:   time.Now,
+	}
+}
+
+// permissions returns the user's permissions.  If Fiat cannot be
+// reached, expired cached permissions are used; with none, the user
+// has no permissions.
+func (f *fiatClient) permissions(ctx context.Context, user string) fiatPermissions {
+	if user == "" {
+		user = fiatAnonymousUser
+	}
+	f.Lock()
+	cached, found := f.cache[user]
+	f.Unlock()
+	if found && f.now().Before(cached.expires) {
+		return cached.permissions
+	}
+
+	perms, err := f.fetch(ctx, user)
+	if err != nil {
+		fiatRequests.WithLabelValues("error").Inc()
+		zap.S().Warnw("fiat", "user", user, "usingCached", found, "error", err)
+		if found {
+			return cached.permissions
+		}
+		return fiatPermissions{}
+	}
+	fiatRequests.WithLabelValues("success").Inc()
+
+	f.Lock()
+	defer f.Unlock()
+	now := f.now()
+	for key, entry := range f.cache {
+		if now.After(entry.expires) {
+			delete(f.cache, key)
+		}
+	}
+	f.cache[user] = fiatCacheEntry{permissions: perms, expires: now.Add(f.ttl)}
+	return perms
+}
+
+func (f *fiatClient) fetch(ctx context.Context, user string) (fiatPermissions, error) {
+	headers := http.Header{}
+	headers.Set("accept", "application/json")
+	data, code, _, err := fetchGet(ctx, combineURL(f.url, "/authorize/"+url.PathEscape(user)), "", headers)
+	if err != nil {
+		return fiatPermissions{}, err
+	}
+	if !httputil.StatusCodeOK(code) {
+		return fiatPermissions{}, fmt.Errorf("status %d", code)
+	}
+	var p fiatUserPermission
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fiatPermissions{}, err
+	}
+	return makeFiatPermissions(p), nil
+}
+
+// filterApplications removes the clusters in accounts Fiat does not
+// let the request read from each application, and the applications
+// left with none.  Aliased accounts are checked by their aliases.
+func (c *permissionChecker) filterApplications(req *http.Request, items []interface{}) []interface{} {
+	if c == nil || c.fiat == nil {
+		return items
+	}
+	perms := c.fiat.permissions(req.Context(), req.Header.Get("x-spinnaker-user"))
+	ret := []interface{}{}
+	for _, item := range items {
+		doc, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		clusterNames, ok := doc["clusterNames"].(map[string]interface{})
+		if !ok || len(clusterNames) == 0 {
+			ret = append(ret, item)
+			continue
+		}
+		for account := range clusterNames {
+			if !perms.allows(aliases.alias(account), authorizationRead) {
+				delete(clusterNames, account)
+			}
+		}
+		if len(clusterNames) > 0 {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fiatTestServer(t *testing.T, calls *int32, failing *int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if atomic.LoadInt32(failing) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/authorize/alice":
+			_, _ = w.Write([]byte(`{"name":"alice","admin":false,"accounts":[
+				{"name":"dev","authorizations":["READ","WRITE"]},
+				{"name":"prod","authorizations":["READ"]}]}`))
+		case "/authorize/anonymous":
+			_, _ = w.Write([]byte(`{"name":"anonymous","accounts":[]}`))
+		case "/authorize/root":
+			_, _ = w.Write([]byte(`{"name":"root","admin":true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_fiatConfig_applyDefaults(t *testing.T) {
+	c := fiatConfig{}
+	c.applyDefaults()
+	assert.Equal(t, fiatConfig{}, c, "disabled config is left alone")
+
+	c = fiatConfig{Enabled: true}
+	c.applyDefaults()
+	assert.Equal(t, fiatConfig{Enabled: true, URL: defaultFiatURL, CacheTTLSeconds: defaultFiatCacheTTLSeconds}, c)
+	assert.NoError(t, c.validate())
+
+	c.CacheTTLSeconds = -1
+	assert.Error(t, c.validate())
+}
+
+func Test_fiatClient_permissions(t *testing.T) {
+	var calls, failing int32
+	s := fiatTestServer(t, &calls, &failing)
+	f := makeFiatClient(fiatConfig{Enabled: true, URL: s.URL, CacheTTLSeconds: 60})
+	now := time.Unix(1000, 0)
+	f.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	perms := f.permissions(ctx, "alice")
+	assert.True(t, perms.allows("dev", authorizationWrite))
+	assert.True(t, perms.allows("prod", authorizationRead))
+	assert.False(t, perms.allows("prod", authorizationWrite))
+	assert.False(t, perms.allows("other", authorizationRead))
+
+	f.permissions(ctx, "alice")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "cached")
+
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt32(&failing, 1)
+	perms = f.permissions(ctx, "alice")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.True(t, perms.allows("dev", authorizationRead), "expired permissions are used when Fiat fails")
+
+	perms = f.permissions(ctx, "bob")
+	assert.False(t, perms.allows("dev", authorizationRead), "no permissions without Fiat")
+
+	atomic.StoreInt32(&failing, 0)
+	assert.True(t, f.permissions(ctx, "root").allows("anything", authorizationWrite))
+	assert.False(t, f.permissions(ctx, "").allows("dev", authorizationRead))
+}
+
+func Test_permissionChecker_fiatFilters(t *testing.T) {
+	var calls, failing int32
+	s := fiatTestServer(t, &calls, &failing)
+	c := makePermissionChecker(permissionsConfig{Fiat: fiatConfig{Enabled: true, URL: s.URL, CacheTTLSeconds: 60}})
+
+	req := httptest.NewRequest(http.MethodGet, "/credentials", nil)
+	req.Header.Set("x-spinnaker-user", "alice")
+
+	var accounts []interface{}
+	require.NoError(t, json.Unmarshal([]byte(`[{"name":"dev"},{"name":"prod"},{"name":"secret"}]`), &accounts))
+	got, err := json.Marshal(c.filterAccounts(req, accounts))
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"name":"dev"},{"name":"prod"}]`, string(got))
+
+	var apps []interface{}
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"name":"app1","clusterNames":{"dev":["app1-dev"],"secret":["app1-secret"]}},
+		{"name":"app2","clusterNames":{"secret":["app2"]}},
+		{"name":"app3","clusterNames":{}}]`), &apps))
+	got, err = json.Marshal(c.filterApplications(req, apps))
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"name":"app1","clusterNames":{"dev":["app1-dev"]}},
+		{"name":"app3","clusterNames":{}}]`, string(got))
+
+	// Fiat knows aliased accounts by their aliases
+	saved := aliases
+	defer func() { aliases = saved }()
+	aliases = makeAccountAliases(map[string]string{"prod": "prod-k8s", "hidden": "dev"})
+	require.NoError(t, json.Unmarshal([]byte(`[{"name":"dev"},{"name":"prod-k8s"}]`), &accounts))
+	got, err = json.Marshal(c.filterAccounts(req, accounts))
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"name":"prod-k8s"}]`, string(got))
+	assert.True(t, c.checkRead(req, "prod-k8s"))
+	assert.False(t, c.checkRead(req, "dev"))
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthcheckIntervalSeconds = 15
+	defaultHealthcheckTimeoutSeconds  = 10
+	defaultHealthcheckPath            = "/health"
+
+	// healthcheckTickSeconds is how often the health checker visits
+	// every check.  A clouddriver's check runs only once its interval
+	// has passed, so intervals may be shorter or longer than the
+	// global one.
+	healthcheckTickSeconds = 1
+)
+
+// healthcheckConfig controls how clouddrivers are health checked.
+// IntervalSeconds is how often each clouddriver is checked.  Path is
+// appended to the clouddriver's URL unless healthcheckUrl is set.
+// Unset fields take the global value, then the default.
+type healthcheckConfig struct {
+	IntervalSeconds int    `yaml:"intervalSeconds,omitempty" json:"intervalSeconds,omitempty"`
+	TimeoutSeconds  int    `yaml:"timeoutSeconds,omitempty" json:"timeoutSeconds,omitempty"`
+	Path            string `yaml:"path,omitempty" json:"path,omitempty"`
+}
+
+func (c *healthcheckConfig) validate() error {
+	if c.IntervalSeconds < 0 {
+		return fmt.Errorf("intervalSeconds cannot be negative")
+	}
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeoutSeconds cannot be negative")
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	return nil
+}
+
+// merge returns c with the fields set in override replaced.
+func (c healthcheckConfig) merge(override *healthcheckConfig) healthcheckConfig {
+	if override == nil {
+		return c
+	}
+	if override.IntervalSeconds != 0 {
+		c.IntervalSeconds = override.IntervalSeconds
+	}
+	if override.TimeoutSeconds != 0 {
+		c.TimeoutSeconds = override.TimeoutSeconds
+	}
+	if override.Path != "" {
+		c.Path = override.Path
+	}
+	return c
+}
+
+func (c healthcheckConfig) intervalSeconds() int {
+	if c.IntervalSeconds == 0 {
+		return defaultHealthcheckIntervalSeconds
+	}
+	return c.IntervalSeconds
+}
+
+func (c healthcheckConfig) timeout() time.Duration {
+	if c.TimeoutSeconds == 0 {
+		return defaultHealthcheckTimeoutSeconds * time.Second
+	}
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+func (c healthcheckConfig) path() string {
+	if c.Path == "" {
+		return defaultHealthcheckPath
+	}
+	return c.Path
+}
+
+// healthchecks is the global health check configuration, replaced
+// when the configuration is reloaded.
+var healthchecks struct {
+	sync.Mutex
+	conf healthcheckConfig
+}
+
+func setHealthchecks(c healthcheckConfig) {
+	healthchecks.Lock()
+	defer healthchecks.Unlock()
+	healthchecks.conf = c
+}
+
+func getHealthchecks() healthcheckConfig {
+	healthchecks.Lock()
+	defer healthchecks.Unlock()
+	return healthchecks.conf
+}
+
+// healthcheckSettings returns the URL and timeout of a configured or
+// discovered clouddriver's health checks.
+func healthcheckSettings(cd clouddriverConfig) (string, time.Duration) {
+	checks := getHealthchecks().merge(cd.Healthcheck)
+	url := cd.HealthcheckURL
+	if url == "" {
+		url = cd.URL + checks.path()
+	}
+	return url, checks.timeout()
+}
+
+// periodicCheck runs a check at most once per interval, returning the
+// last result in between.  Without an interval of its own, it follows
+// the global interval, including after a reload.  A nil periodicCheck
+// always runs the check.
+type periodicCheck struct {
+	sync.Mutex
+	interval time.Duration
+	last     time.Time
+	err      error
+}
+
+// makePeriodicCheck returns a check at the clouddriver's own interval,
+// if it has one, or otherwise at the global interval.
+func makePeriodicCheck(override *healthcheckConfig) *periodicCheck {
+	if override == nil || override.IntervalSeconds == 0 {
+		return &periodicCheck{}
+	}
+	return &periodicCheck{interval: time.Duration(override.IntervalSeconds) * time.Second}
+}
+
+func (p *periodicCheck) currentInterval() time.Duration {
+	if p.interval > 0 {
+		return p.interval
+	}
+	return time.Duration(getHealthchecks().intervalSeconds()) * time.Second
+}
+
+func (p *periodicCheck) run(now time.Time, check func() error) error {
+	if p == nil {
+		return check()
+	}
+	p.Lock()
+	defer p.Unlock()
+	if !p.last.IsZero() && now.Sub(p.last) < p.currentInterval() {
+		return p.err
+	}
+	p.err = check()
+	p.last = now
+	return p.err
+}
+
+// urlChecker reports whether a clouddriver's health check URL returns
+// a 2xx or 3xx status within the timeout.  During a maintenance window
+// the check always passes.
+type urlChecker struct {
+	url         string
+	timeout     time.Duration
+	periodic    *periodicCheck
+	maintenance []maintenanceSchedule
+}
+
+// makeURLChecker returns the checker reported under the clouddriver's
+// name in /health.
+func makeURLChecker(cd clouddriverConfig) *urlChecker {
+	c := getHealthchecks().merge(cd.Healthcheck)
+	// already checked by configuration.validate()
+	maintenance, _ := parseMaintenanceWindows(cd.MaintenanceWindows)
+	return &urlChecker{
+		url:         cd.HealthcheckURL,
+		timeout:     c.timeout(),
+		periodic:    makePeriodicCheck(cd.Healthcheck),
+		maintenance: maintenance,
+	}
+}
+
+func (u *urlChecker) Check() error {
+	now := time.Now()
+	if inMaintenance(u.maintenance, now) {
+		return nil
+	}
+	return u.periodic.run(now, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := downstreamClients.clientFor(u.url).Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("HTTP status code %d returned", resp.StatusCode)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_healthcheckConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  healthcheckConfig
+		wantErr bool
+	}{
+		{"empty", healthcheckConfig{}, false},
+		{"all set", healthcheckConfig{IntervalSeconds: 30, TimeoutSeconds: 2, Path: "/actuator/health"}, false},
+		{"negative interval", healthcheckConfig{IntervalSeconds: -1}, true},
+		{"negative timeout", healthcheckConfig{TimeoutSeconds: -1}, true},
+		{"relative path", healthcheckConfig{Path: "health"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_healthcheckConfig_merge(t *testing.T) {
+	var empty healthcheckConfig
+	assert.Equal(t, defaultHealthcheckIntervalSeconds, empty.intervalSeconds())
+	assert.Equal(t, defaultHealthcheckTimeoutSeconds*time.Second, empty.timeout())
+	assert.Equal(t, defaultHealthcheckPath, empty.path())
+
+	global := healthcheckConfig{IntervalSeconds: 30, Path: "/ready"}
+	assert.Equal(t, global, global.merge(nil))
+	merged := global.merge(&healthcheckConfig{TimeoutSeconds: 3, Path: "/actuator/health"})
+	assert.Equal(t, healthcheckConfig{IntervalSeconds: 30, TimeoutSeconds: 3, Path: "/actuator/health"}, merged)
+}
+
+func Test_loadConfiguration_healthcheckPath(t *testing.T) {
+	c, err := loadConfiguration([]byte(`healthcheck:
+  path: /ready
+clouddrivers:
+  - url: http://a
+  - url: http://b
+    healthcheck:
+      path: /actuator/health
+  - url: http://c
+    healthcheckUrl: http://c/custom`))
+	require.NoError(t, err)
+	assert.Equal(t, "http://a/ready", c.Clouddrivers[0].HealthcheckURL)
+	assert.Equal(t, "http://b/actuator/health", c.Clouddrivers[1].HealthcheckURL)
+	assert.Equal(t, "http://c/custom", c.Clouddrivers[2].HealthcheckURL)
+}
+
+func Test_periodicCheck(t *testing.T) {
+	p := makePeriodicCheck(&healthcheckConfig{IntervalSeconds: 60})
+	require.NotNil(t, p)
+	calls := 0
+	check := func() error {
+		calls++
+		return errors.New("down")
+	}
+	now := time.Now()
+	assert.Error(t, p.run(now, check))
+	assert.Error(t, p.run(now.Add(30*time.Second), check), "last result is returned")
+	assert.Equal(t, 1, calls)
+	assert.Error(t, p.run(now.Add(60*time.Second), check))
+	assert.Equal(t, 2, calls)
+
+	var always *periodicCheck
+	assert.NoError(t, always.run(now, func() error { return nil }))
+}
+
+func Test_periodicCheck_interval(t *testing.T) {
+	defer setHealthchecks(getHealthchecks())
+	setHealthchecks(healthcheckConfig{IntervalSeconds: 30})
+
+	assert.Equal(t, 30*time.Second, makePeriodicCheck(nil).currentInterval(), "the global interval")
+	assert.Equal(t, 5*time.Second, makePeriodicCheck(&healthcheckConfig{IntervalSeconds: 5}).currentInterval(), "more often than the global interval")
+	assert.Equal(t, 60*time.Second, makePeriodicCheck(&healthcheckConfig{IntervalSeconds: 60}).currentInterval(), "less often than the global interval")
+
+	p := makePeriodicCheck(&healthcheckConfig{TimeoutSeconds: 3})
+	setHealthchecks(healthcheckConfig{IntervalSeconds: 10})
+	assert.Equal(t, 10*time.Second, p.currentInterval(), "a reloaded global interval applies")
+}
+
+func Test_urlChecker(t *testing.T) {
+	healthy := hedgeTestServer(t, 0, http.StatusOK, `{}`)
+	slow := hedgeTestServer(t, 200*time.Millisecond, http.StatusOK, `{}`)
+	broken := hedgeTestServer(t, 0, http.StatusInternalServerError, `{}`)
+
+	assert.NoError(t, makeURLChecker(clouddriverConfig{HealthcheckURL: healthy.URL}).Check())
+	assert.Error(t, makeURLChecker(clouddriverConfig{HealthcheckURL: broken.URL}).Check())
+
+	c := makeURLChecker(clouddriverConfig{HealthcheckURL: slow.URL, Healthcheck: &healthcheckConfig{TimeoutSeconds: 1}})
+	assert.Equal(t, time.Second, c.timeout)
+	c.timeout = 20 * time.Millisecond
+	assert.Error(t, c.Check(), "times out")
+}
+
+func Test_urlChecker_maintenance(t *testing.T) {
+	broken := hedgeTestServer(t, 0, http.StatusInternalServerError, `{}`)
+	start := time.Now().UTC().Add(-time.Minute).Format("15:04")
+	c := makeURLChecker(clouddriverConfig{
+		HealthcheckURL:     broken.URL,
+		MaintenanceWindows: []maintenanceWindow{{Start: start, Duration: "1h"}},
+	})
+	assert.NoError(t, c.Check(), "passes during maintenance")
+}
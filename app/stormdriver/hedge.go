@@ -0,0 +1,194 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// hedgeConfig enables hedged requests for lookups routed by account.
+// When another clouddriver also has the account, and the routed one
+// has not answered within DelayMillis, the same request is sent to the
+// other, and the first successful response is used.  0 disables hedging.
+type hedgeConfig struct {
+	DelayMillis int `yaml:"delayMillis,omitempty" json:"delayMillis,omitempty"`
+}
+
+func (c hedgeConfig) validate() error {
+	if c.DelayMillis < 0 {
+		return fmt.Errorf("delayMillis cannot be negative")
+	}
+	return nil
+}
+
+var hedging hedgeConfig
+
+var hedgedRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "hedged_requests_total",
+	Help:      "Account-routed lookups which sent a hedged request, by which response was used: primary, hedge, or none.",
+}, []string{"winner"})
+
+// findCloudRouteCandidates returns the route for an account, followed by
+// the other clouddrivers which returned the account on the last sync,
+// highest priority first.  Clouddrivers in maintenance or swapped out
+// are skipped, and an account pinned by an account override or routing
+// rule has only its route.
+func (m *ClouddriverManager) findCloudRouteCandidates(name string) ([]URLAndPriority, bool) {
+	primary, found := m.findCloudRoute(name)
+	if !found {
+		return nil, false
+	}
+	m.Lock()
+	defer m.Unlock()
+	return m.routeCandidates(primary, name, m.syncedCloudAccounts), true
+}
+
+// findArtifactRouteCandidates is findCloudRouteCandidates for artifact
+// accounts.
+func (m *ClouddriverManager) findArtifactRouteCandidates(name string) ([]URLAndPriority, bool) {
+	primary, found := m.findArtifactRoute(name)
+	if !found {
+		return nil, false
+	}
+	m.Lock()
+	defer m.Unlock()
+	return m.routeCandidates(primary, name, m.syncedArtifactAccounts), true
+}
+
+// routeCandidates returns primary, followed by the other clouddrivers
+// whose synced accounts include name, unless name is pinned to primary.
+// Must be called with the lock held.
+func (m *ClouddriverManager) routeCandidates(primary URLAndPriority, name string, synced map[string][]trackedSpinnakerAccount) []URLAndPriority {
+	ret := []URLAndPriority{primary}
+	if m.routePinned(name) {
+		return ret
+	}
+	others := []URLAndPriority{}
+	for _, cd := range m.state {
+		key := cd.routeKey()
+		if key == primary.key() || cd.inMaintenance || cd.quarantined {
+			continue
+		}
+		if _, swapped := m.swaps[cd.Name]; swapped {
+			continue
+		}
+		for _, account := range synced[key] {
+			if account.Name == name {
+				others = append(others, URLAndPriority{URL: cd.URL, Priority: cd.Priority, token: cd.token})
+				break
+			}
+		}
+	}
+	sort.SliceStable(others, func(i, j int) bool { return others[i].Priority > others[j].Priority })
+	return append(ret, others...)
+}
+
+// routePinned returns true if an account override or routing rule
+// decides which clouddriver account goes to, so its requests must not
+// be sent to any other.  Must be called with the lock held.
+func (m *ClouddriverManager) routePinned(account string) bool {
+	if name, found := m.accountOverrides[account]; found {
+		if _, err := m.findClouddriverByName(name); err == nil {
+			return true
+		}
+	}
+	_, found := m.ruleRoute(account)
+	return found
+}
+
+type hedgeResult struct {
+	index      int
+	target     string
+	token      string
+	data       []byte
+	statusCode int
+	headers    http.Header
+	err        error
+}
+
+func (r hedgeResult) ok() bool {
+	return r.err == nil && httputil.StatusCodeOK(r.statusCode)
+}
+
+// hedgedFetch sends a GET for requestURI to the first route, and to the
+// second if the first has not succeeded within delay, or fails sooner.
+// The first successful result is returned, or if neither succeeds, the
+// first route's result.
+func hedgedFetch(ctx context.Context, routes []URLAndPriority, requestURI string, headers http.Header, delay time.Duration) hedgeResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if len(routes) > 2 {
+		routes = routes[:2]
+	}
+
+	results := make(chan hedgeResult, len(routes))
+	launched := 0
+	launch := func() {
+		index := launched
+		route := routes[index]
+		launched++
+		go func() {
+			target := combineURL(route.URL, requestURI)
+			data, code, respHeaders, err := fetchGet(withRoute(ctx, route), target, route.token, headers)
+			results <- hedgeResult{index: index, target: target, token: route.token, data: data, statusCode: code, headers: respHeaders, err: err}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var primary *hedgeResult
+	for received := 0; received < launched; {
+		select {
+		case <-timer.C:
+			if launched < len(routes) {
+				launch()
+			}
+		case r := <-results:
+			received++
+			if r.ok() {
+				if launched > 1 {
+					winner := "primary"
+					if r.index > 0 {
+						winner = "hedge"
+					}
+					hedgedRequests.WithLabelValues(winner).Inc()
+				}
+				return r
+			}
+			if r.index == 0 {
+				primary = &r
+			}
+			if launched < len(routes) {
+				launch()
+			}
+		}
+	}
+	if launched > 1 {
+		hedgedRequests.WithLabelValues("none").Inc()
+	}
+	return *primary
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hedgeTestServer(t *testing.T, delay time.Duration, status int, body string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_hedgedFetch(t *testing.T) {
+	tests := []struct {
+		name         string
+		primaryDelay time.Duration
+		primaryCode  int
+		hedgeDelay   time.Duration
+		hedgeCode    int
+		want         string
+		wantCode     int
+	}{
+		{"primary answers before the hedge", 0, http.StatusOK, 0, http.StatusOK, "primary", http.StatusOK},
+		{"slow primary", 5 * time.Second, http.StatusOK, 0, http.StatusOK, "hedge", http.StatusOK},
+		{"primary fails", 0, http.StatusServiceUnavailable, 0, http.StatusOK, "hedge", http.StatusOK},
+		{"both fail", 0, http.StatusNotFound, 0, http.StatusServiceUnavailable, "primary", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := hedgeTestServer(t, tt.primaryDelay, tt.primaryCode, "primary")
+			hedge := hedgeTestServer(t, tt.hedgeDelay, tt.hedgeCode, "hedge")
+			routes := []URLAndPriority{{URL: primary.URL}, {URL: hedge.URL}}
+
+			start := time.Now()
+			got := hedgedFetch(context.Background(), routes, "/credentials/a", http.Header{}, 50*time.Millisecond)
+			assert.Less(t, time.Since(start), 2*time.Second)
+			assert.NoError(t, got.err)
+			assert.Equal(t, tt.wantCode, got.statusCode)
+			assert.Equal(t, tt.want, string(got.data))
+		})
+	}
+}
+
+func Test_findCloudRouteCandidates(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"a": {Name: "a", URL: "http://a", Priority: 10},
+			"b": {Name: "b", URL: "http://b", Priority: 1},
+			"c": {Name: "c", URL: "http://c", Priority: 5},
+			"d": {Name: "d", URL: "http://d", Priority: 20, inMaintenance: true},
+			"e": {Name: "e", URL: "http://e"},
+		},
+		swaps: map[string]string{},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"prod": {URL: "http://a", Priority: 10},
+		},
+	}
+	m.syncedCloudAccounts = map[string][]trackedSpinnakerAccount{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		m.syncedCloudAccounts[m.state[name].routeKey()] = []trackedSpinnakerAccount{{Name: "prod"}}
+	}
+
+	got, found := m.findCloudRouteCandidates("prod")
+	assert.True(t, found)
+	urls := []string{}
+	for _, route := range got {
+		urls = append(urls, route.URL)
+	}
+	assert.Equal(t, []string{"http://a", "http://c", "http://b"}, urls)
+
+	_, found = m.findCloudRouteCandidates("missing")
+	assert.False(t, found)
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
+)
+
+// These match the defaults used by httputil.NewHTTPClient().
+var defaultHTTPClientConfig = httputil.ClientConfig{
+	DialTimeout:           15,
+	ClientTimeout:         60,
+	TLSHandshakeTimeout:   15,
+	ResponseHeaderTimeout: 60,
+	MaxIdleConnections:    5,
+}
+
+func withClientDefaults(c httputil.ClientConfig) httputil.ClientConfig {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultHTTPClientConfig.DialTimeout
+	}
+	if c.ClientTimeout == 0 {
+		c.ClientTimeout = defaultHTTPClientConfig.ClientTimeout
+	}
+	if c.TLSHandshakeTimeout == 0 {
+		c.TLSHandshakeTimeout = defaultHTTPClientConfig.TLSHandshakeTimeout
+	}
+	if c.ResponseHeaderTimeout == 0 {
+		c.ResponseHeaderTimeout = defaultHTTPClientConfig.ResponseHeaderTimeout
+	}
+	if c.MaxIdleConnections == 0 {
+		c.MaxIdleConnections = defaultHTTPClientConfig.MaxIdleConnections
+	}
+	return c
+}
+
+// proxyConfig routes requests to a clouddriver through an HTTP proxy.
+// NoProxy uses the same syntax as the NO_PROXY environment variable,
+// one entry per list item.
+type proxyConfig struct {
+	URL     string   `yaml:"url,omitempty" json:"url,omitempty"`
+	NoProxy []string `yaml:"noProxy,omitempty" json:"noProxy,omitempty"`
+}
+
+func (p *proxyConfig) validate() error {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("proxy url scheme must be http or https")
+	}
+	return nil
+}
+
+func (p *proxyConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	cfg := httpproxy.Config{
+		HTTPProxy:  p.URL,
+		HTTPSProxy: p.URL,
+		NoProxy:    strings.Join(p.NoProxy, ","),
+	}
+	f := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return f(req.URL)
+	}
+}
+
+// socks5Config routes connections to a clouddriver through a SOCKS5
+// proxy, such as an SSH bastion.  Username and Password are optional.
+type socks5Config struct {
+	Address  string `yaml:"address,omitempty" json:"address,omitempty"`
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+}
+
+func (s *socks5Config) validate() error {
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		return fmt.Errorf("address: %v", err)
+	}
+	return nil
+}
+
+func (s *socks5Config) dialContext(forward *net.Dialer) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	var auth *proxy.Auth
+	if s.Username != "" {
+		auth = &proxy.Auth{User: s.Username, Password: s.Password}
+	}
+	d, err := proxy.SOCKS5("tcp", s.Address, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("socks5 dialer does not support contexts")
+	}
+	return cd.DialContext, nil
+}
+
+// clientTLSConfig sets the TLS client certificate and CA bundle used to
+// talk to a clouddriver behind mutual TLS.  The CA bundle is added to
+// the system roots.  The certificate and key are re-read when they
+// change.
+type clientTLSConfig struct {
+	CertificatePath string `yaml:"certificatePath,omitempty" json:"certificatePath,omitempty"`
+	KeyPath         string `yaml:"keyPath,omitempty" json:"keyPath,omitempty"`
+	CAPath          string `yaml:"caPath,omitempty" json:"caPath,omitempty"`
+}
+
+func (c *clientTLSConfig) validate() error {
+	if (c.CertificatePath == "") != (c.KeyPath == "") {
+		return fmt.Errorf("certificatePath and keyPath must be set together")
+	}
+	if c.CertificatePath == "" && c.CAPath == "" {
+		return fmt.Errorf("certificatePath or caPath is required")
+	}
+	return nil
+}
+
+// tlsConfig returns a copy of base, which may be nil, with the client
+// certificate and CA bundle applied.
+func (c *clientTLSConfig) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	ret := &tls.Config{}
+	if base != nil {
+		ret = base.Clone()
+	}
+	if c.CAPath != "" {
+		caCert, err := os.ReadFile(c.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		caConfig, err := makeTLSConfigWithCA(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.CAPath, err)
+		}
+		ret.RootCAs = caConfig.RootCAs
+	}
+	if c.CertificatePath != "" {
+		reloader := &certificateReloader{certPath: c.CertificatePath, keyPath: c.KeyPath}
+		if _, err := reloader.load(); err != nil {
+			return nil, err
+		}
+		ret.GetClientCertificate = reloader.getClientCertificate
+	}
+	return ret, nil
+}
+
+// clientOptions holds per-destination settings which require a
+// dedicated client.
+type clientOptions struct {
+	proxy     *proxyConfig
+	socks5    *socks5Config
+	dialer    *dialerConfig
+	rateLimit *rateLimitConfig
+	tls       *clientTLSConfig
+	retry     *retryConfig
+	oauth2    *oauth2Config
+	tokenFile string
+}
+
+func (o clientOptions) isDefault() bool {
+	return o.proxy == nil && o.socks5 == nil && o.dialer == nil && o.rateLimit == nil && o.tls == nil && o.retry == nil &&
+		o.oauth2 == nil && o.tokenFile == ""
+}
+
+// destinationClient is a dedicated client for one destination.  The
+// limiter and token source, if any, are kept when the client is rebuilt.
+type destinationClient struct {
+	options clientOptions
+	limiter *rate.Limiter
+	tokens  *oauth2TokenSource
+	client  *http.Client
+}
+
+// clientRegistry holds the HTTP clients used to talk to clouddrivers.
+// Clients may be replaced at runtime, for instance when the controller's
+// CA bundle changes, so callers should fetch a client for each request
+// rather than holding on to one.
+//
+// Clouddrivers with specific needs, such as a proxy, register a dedicated
+// client for their base URL.  All others use the default client.
+type clientRegistry struct {
+	sync.RWMutex
+	config        httputil.ClientConfig
+	dialer        dialerConfig
+	resolver      *cachingResolver
+	tlsConfig     *tls.Config
+	defaultClient *http.Client
+	retry         *retryConfig
+	concurrency   *downstreamLimiter
+	maxResponse   int64
+	destinations  map[string]*destinationClient
+}
+
+var downstreamClients = &clientRegistry{
+	config:        defaultHTTPClientConfig,
+	defaultClient: http.DefaultClient,
+	destinations:  map[string]*destinationClient{},
+}
+
+// matchBaseURL returns true if target is base, or below it: the scheme
+// and host must be equal, and base's path must be a prefix of target's
+// ending at a path separator.  The length of base's path is returned so
+// the longest match can be found.
+func matchBaseURL(target string, base string) (int, bool) {
+	t, err := url.Parse(target)
+	if err != nil {
+		return 0, false
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return 0, false
+	}
+	if !strings.EqualFold(t.Scheme, b.Scheme) || !strings.EqualFold(t.Host, b.Host) {
+		return 0, false
+	}
+	basePath := strings.TrimSuffix(b.Path, "/")
+	if t.Path != basePath && !strings.HasPrefix(t.Path, basePath+"/") {
+		return 0, false
+	}
+	return len(basePath), true
+}
+
+// clientFor returns the client to use for a request to the given URL,
+// which is the client registered for the longest matching base URL,
+// or the default client.
+func (r *clientRegistry) clientFor(target string) *http.Client {
+	r.RLock()
+	defer r.RUnlock()
+	best := -1
+	client := r.defaultClient
+	for base, dest := range r.destinations {
+		if n, found := matchBaseURL(target, base); found && n > best {
+			best = n
+			client = dest.client
+		}
+	}
+	return client
+}
+
+// tokenClient returns the client used to fetch OAuth2 tokens.  It is
+// always the default client, so a token server sharing a base URL with
+// a clouddriver is not itself sent a token.
+func (r *clientRegistry) tokenClient() *http.Client {
+	r.RLock()
+	defer r.RUnlock()
+	return r.defaultClient
+}
+
+// retryFor returns the GET retry policy for the given URL: the one set
+// for the longest matching base URL, or the default policy, which may be
+// nil.
+func (r *clientRegistry) retryFor(target string) *retryConfig {
+	r.RLock()
+	defer r.RUnlock()
+	best := -1
+	ret := r.retry
+	for base, dest := range r.destinations {
+		if n, found := matchBaseURL(target, base); found && n > best {
+			best = n
+			ret = r.retry
+			if dest.options.retry != nil {
+				ret = dest.options.retry
+			}
+		}
+	}
+	return ret
+}
+
+// setRetry sets the default GET retry policy.  nil disables retries
+// except for destinations with their own policy.
+func (r *clientRegistry) setRetry(c *retryConfig) {
+	r.Lock()
+	defer r.Unlock()
+	r.retry = c
+}
+
+// setConcurrency replaces the limits on concurrent requests to the
+// clouddrivers, and rebuilds all clients to use them.
+func (r *clientRegistry) setConcurrency(c downstreamConcurrencyConfig) {
+	r.Lock()
+	defer r.Unlock()
+	r.concurrency = makeDownstreamLimiter(c)
+	r.rebuild()
+}
+
+// setMaxResponseBytes limits the size of response bodies from the
+// clouddrivers, and rebuilds all clients to use it.  0 is unlimited.
+func (r *clientRegistry) setMaxResponseBytes(n int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.maxResponse = n
+	r.rebuild()
+}
+
+// register sets up a dedicated client for requests to baseURL.  If opts
+// holds no special settings, any dedicated client is removed.  If the
+// client cannot be built, an error is returned and requests to baseURL
+// fail rather than being sent without the settings.
+func (r *clientRegistry) register(baseURL string, opts clientOptions) error {
+	r.Lock()
+	defer r.Unlock()
+	if opts.isDefault() {
+		delete(r.destinations, baseURL)
+		return nil
+	}
+	dest := &destinationClient{options: opts}
+	if opts.rateLimit != nil {
+		dest.limiter = opts.rateLimit.makeLimiter()
+	}
+	if opts.oauth2 != nil {
+		dest.tokens = makeOAuth2TokenSource(opts.oauth2)
+	}
+	client, err := r.makeClient(opts, dest.limiter, dest.tokens)
+	if err != nil {
+		client = failingClient(err)
+	}
+	dest.client = client
+	r.destinations[baseURL] = dest
+	return err
+}
+
+// setTLSConfig replaces the default TLS configuration, and rebuilds
+// all clients to use it.
+func (r *clientRegistry) setTLSConfig(cfg *tls.Config) {
+	r.Lock()
+	defer r.Unlock()
+	httputil.SetTLSConfig(cfg)
+	r.tlsConfig = cfg
+	r.rebuild()
+}
+
+// configure sets the timeouts, limits, dialer preferences, and resolver
+// for all clients, and rebuilds them.  resolver may be nil to use the
+// system resolver.
+func (r *clientRegistry) configure(c httputil.ClientConfig, d dialerConfig, resolver *cachingResolver) {
+	r.Lock()
+	defer r.Unlock()
+	r.config = withClientDefaults(c)
+	r.dialer = d
+	r.resolver = resolver
+	r.rebuild()
+}
+
+// Must be called with the lock held.
+func (r *clientRegistry) rebuild() {
+	client, err := r.makeClient(clientOptions{}, nil, nil)
+	if err != nil {
+		zap.S().Errorw("cannot build default client", "error", err)
+		client = failingClient(err)
+	}
+	r.defaultClient = client
+	for base, dest := range r.destinations {
+		client, err := r.makeClient(dest.options, dest.limiter, dest.tokens)
+		if err != nil {
+			zap.S().Errorw("cannot build client", "url", base, "error", err)
+			client = failingClient(err)
+		}
+		dest.client = client
+	}
+}
+
+// failingTransport fails every request with err.  It stands in for a
+// client which could not be built, so requests are never sent without
+// the proxy or TLS settings they were configured with.
+type failingTransport struct {
+	err error
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
+
+func failingClient(err error) *http.Client {
+	return &http.Client{Transport: &failingTransport{err: err}}
+}
+
+// makeClient builds a client the same way httputil.NewHTTPClient() does,
+// with the per-destination options applied.  If limiter is not nil,
+// requests are rate limited.  If tokens is not nil, requests get an
+// OAuth2 access token; if opts has a token file, they get the token in
+// it.  Concurrent requests are
+// limited by the registry's limiter, if any.  An error is returned if a
+// proxy or TLS setting cannot be applied.  Must be called with the
+// lock held.
+func (r *clientRegistry) makeClient(opts clientOptions, limiter *rate.Limiter, tokens *oauth2TokenSource) (*http.Client, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(r.config.DialTimeout) * time.Second}
+	transport := &http.Transport{
+		DialContext:           r.dialer.merge(opts.dialer).dialContext(dialer, r.resolver),
+		TLSHandshakeTimeout:   time.Duration(r.config.TLSHandshakeTimeout) * time.Second,
+		TLSClientConfig:       r.tlsConfig,
+		ResponseHeaderTimeout: time.Duration(r.config.ResponseHeaderTimeout) * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          r.config.MaxIdleConnections,
+	}
+	if opts.proxy != nil {
+		transport.Proxy = opts.proxy.proxyFunc()
+	}
+	if opts.socks5 != nil {
+		dial, err := opts.socks5.dialContext(dialer)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy %s: %w", opts.socks5.Address, err)
+		}
+		transport.DialContext = dial
+	}
+	if opts.tls != nil {
+		tlsConfig, err := opts.tls.tlsConfig(r.tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("client TLS: %w", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	transport.DialContext = countConnections(transport.DialContext)
+	var roundTripper http.RoundTripper = &clouddriverSpanTransport{next: &tlsObservingTransport{next: transport}}
+	if r.maxResponse > 0 {
+		roundTripper = &responseSizeLimitedTransport{limit: r.maxResponse, next: roundTripper}
+	}
+	if r.concurrency != nil {
+		roundTripper = &concurrencyLimitedTransport{limiter: r.concurrency, next: roundTripper}
+	}
+	if limiter != nil {
+		roundTripper = &rateLimitedTransport{
+			limiter: limiter,
+			maxWait: time.Duration(opts.rateLimit.MaxWaitSeconds) * time.Second,
+			next:    roundTripper,
+		}
+	}
+	if tokens != nil {
+		roundTripper = &oauth2Transport{tokens: tokens, next: roundTripper}
+	}
+	if opts.tokenFile != "" {
+		roundTripper = &tokenFileTransport{tokens: &tokenFileReloader{path: opts.tokenFile}, next: roundTripper}
+	}
+	return &http.Client{
+		Timeout:   time.Duration(r.config.ClientTimeout) * time.Second,
+		Transport: otelhttp.NewTransport(roundTripper, otelhttp.WithSpanNameFormatter(downstreamSpanName)),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// isCertificateError returns true if err was caused by a failure to
+// verify the remote's certificate.
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid)
+}
+
+// noteDownstreamError is called with any error from a downstream request,
+// so certificate failures can trigger an early CA refresh.
+func noteDownstreamError(err error) {
+	if controller != nil && isCertificateError(err) {
+		controller.requestCARefresh()
+	}
+}
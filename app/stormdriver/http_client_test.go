@@ -0,0 +1,261 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isCertificateError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"plain error", errors.New("connection refused"), false},
+		{"unknown authority", x509.UnknownAuthorityError{}, true},
+		{"wrapped unknown authority", &url.Error{Op: "Get", URL: "https://x", Err: x509.UnknownAuthorityError{}}, true},
+		{"invalid certificate", x509.CertificateInvalidError{Reason: x509.Expired}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isCertificateError(tt.err))
+		})
+	}
+}
+
+func Test_clientRegistry_clientFor(t *testing.T) {
+	r := &clientRegistry{
+		config:        defaultHTTPClientConfig,
+		defaultClient: http.DefaultClient,
+		destinations:  map[string]*destinationClient{},
+	}
+	proxied := clientOptions{proxy: &proxyConfig{URL: "http://proxy:3128"}}
+	r.register("http://cd1:7002", proxied)
+	r.register("http://cd1:7002/nested", proxied)
+	r.register("http://cd2:7002", clientOptions{})
+
+	assert.Same(t, r.destinations["http://cd1:7002"].client, r.clientFor("http://cd1:7002/credentials"))
+	assert.Same(t, r.destinations["http://cd1:7002/nested"].client, r.clientFor("http://cd1:7002/nested/credentials"))
+	assert.Same(t, http.DefaultClient, r.clientFor("http://cd2:7002/credentials"), "no options uses the default")
+	assert.Same(t, http.DefaultClient, r.clientFor("http://cd3:7002/credentials"))
+	assert.Same(t, http.DefaultClient, r.clientFor("http://cd1:70021/credentials"), "host must match exactly")
+	assert.Same(t, r.destinations["http://cd1:7002"].client, r.clientFor("http://cd1:7002/nestedother"), "path must match at a separator")
+}
+
+func Test_clientRegistry_retryFor(t *testing.T) {
+	defaultRetry := &retryConfig{Attempts: 2}
+	cd1Retry := &retryConfig{Attempts: 5}
+	r := &clientRegistry{
+		config:        defaultHTTPClientConfig,
+		defaultClient: http.DefaultClient,
+		destinations:  map[string]*destinationClient{},
+		retry:         defaultRetry,
+	}
+	r.register("http://cd1:7002", clientOptions{retry: cd1Retry})
+
+	assert.Same(t, cd1Retry, r.retryFor("http://cd1:7002/credentials"))
+	assert.Same(t, defaultRetry, r.retryFor("http://cd1:70021/credentials"), "host must match exactly")
+	assert.Same(t, defaultRetry, r.retryFor("http://cd2:7002/credentials"))
+}
+
+func Test_matchBaseURL(t *testing.T) {
+	tests := []struct {
+		target string
+		base   string
+		want   bool
+	}{
+		{"http://cd1/credentials", "http://cd1", true},
+		{"http://cd1", "http://cd1", true},
+		{"http://cd10/credentials", "http://cd1", false},
+		{"https://cd1/credentials", "http://cd1", false},
+		{"http://cd1/api/credentials", "http://cd1/api/", true},
+		{"http://cd1/apiv2/credentials", "http://cd1/api", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.base, func(t *testing.T) {
+			_, got := matchBaseURL(tt.target, tt.base)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_proxyConfig_proxyFunc(t *testing.T) {
+	p := &proxyConfig{URL: "http://proxy:3128", NoProxy: []string{".internal", "10.0.0.0/8"}}
+	f := p.proxyFunc()
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"http://clouddriver.example.com/credentials", "http://proxy:3128"},
+		{"https://clouddriver.example.com/credentials", "http://proxy:3128"},
+		{"http://clouddriver.internal/credentials", ""},
+		{"http://10.1.2.3:7002/credentials", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.target, nil)
+			require.NoError(t, err)
+			got, err := f(req)
+			require.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, got)
+			} else {
+				assert.Equal(t, tt.want, got.String())
+			}
+		})
+	}
+}
+
+// runSOCKS5Server accepts a single unauthenticated SOCKS5 CONNECT and
+// relays it, returning the address to listen on and a channel which
+// receives the requested destination.
+func runSOCKS5Server(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	dest := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 262)
+		// greeting: version, method count, methods
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{5, 0})
+		// request: version, connect, reserved, IPv4 address type, address, port
+		if _, err := io.ReadFull(conn, buf[:10]); err != nil || buf[3] != 1 {
+			return
+		}
+		addr := net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(buf[8])<<8|int(buf[9])))
+		dest <- addr
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	}()
+	return l.Addr().String(), dest
+}
+
+func Test_clientRegistry_socks5(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	socksAddr, dest := runSOCKS5Server(t)
+
+	r := &clientRegistry{
+		config:        defaultHTTPClientConfig,
+		defaultClient: http.DefaultClient,
+		destinations:  map[string]*destinationClient{},
+	}
+	r.register(backend.URL, clientOptions{socks5: &socks5Config{Address: socksAddr}})
+
+	resp, err := r.clientFor(backend.URL).Get(backend.URL + "/health")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, strings.TrimPrefix(backend.URL, "http://"), <-dest)
+}
+
+func Test_clientTLSConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       clientTLSConfig
+		wantErr bool
+	}{
+		{"empty", clientTLSConfig{}, true},
+		{"ca only", clientTLSConfig{CAPath: "ca"}, false},
+		{"cert and key", clientTLSConfig{CertificatePath: "c", KeyPath: "k"}, false},
+		{"cert without key", clientTLSConfig{CertificatePath: "c", CAPath: "ca"}, true},
+		{"key without cert", clientTLSConfig{KeyPath: "k"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_clientRegistry_mutualTLS(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.Organization[0]))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	// the httptest certificate is self-signed, so it serves as the CA,
+	// the server certificate, and the client certificate.
+	certPath, keyPath := writeTestKeyPair(t, t.TempDir())
+	r := &clientRegistry{
+		config:        defaultHTTPClientConfig,
+		defaultClient: http.DefaultClient,
+		destinations:  map[string]*destinationClient{},
+	}
+
+	r.register(backend.URL, clientOptions{tls: &clientTLSConfig{CAPath: certPath}})
+	_, err := r.clientFor(backend.URL).Get(backend.URL + "/health")
+	assert.Error(t, err, "no client certificate")
+
+	r.register(backend.URL, clientOptions{tls: &clientTLSConfig{CertificatePath: certPath, KeyPath: keyPath, CAPath: certPath}})
+	resp, err := r.clientFor(backend.URL).Get(backend.URL + "/health")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Acme Co", string(body))
+
+	// a TLS configuration which cannot be loaded fails requests rather
+	// than sending them with the default TLS settings
+	err = r.register(backend.URL, clientOptions{tls: &clientTLSConfig{CAPath: t.TempDir() + "/missing.pem"}})
+	require.Error(t, err)
+	_, err = r.clientFor(backend.URL).Get(backend.URL + "/health")
+	assert.ErrorContains(t, err, "client TLS")
+}
@@ -19,12 +19,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"time"
 
 	"github.com/OpsMx/go-app-base/httputil"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/skandragon/gohealthcheck/health"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
@@ -32,34 +32,52 @@ import (
 )
 
 type srv struct {
-	listenPort uint16
-	Insecure   bool
+	listenPort     uint16
+	adminToken     string
+	permissions    *permissionChecker
+	search         *PaginatedCache
+	streamingPaths []string
+	Insecure       bool
 }
 
 func (*srv) accountRoutesRequest() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Set("content-type", "application/json")
 		ret := struct {
-			Accounts         map[string]URLAndPriority `json:"accounts,omitempty"`
-			ArtifactAccounts map[string]URLAndPriority `json:"artifactAccounts,omitempty"`
+			Accounts         map[string]URLAndPriority `json:"accounts,omitempty" yaml:"accounts,omitempty"`
+			ArtifactAccounts map[string]URLAndPriority `json:"artifactAccounts,omitempty" yaml:"artifactAccounts,omitempty"`
 		}{clouddriverManager.getCloudAccountRoutes(), clouddriverManager.getArtifactAccountRoutes()}
-		json, err := json.Marshal(ret)
-		if err != nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		httputil.CheckedWrite(w, json)
+		writeFormatted(w, req, ret, func() [][]string {
+			return routeRows(ret.Accounts, ret.ArtifactAccounts)
+		})
 	}
 }
 
 func (*srv) accountsRequest() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Set("content-type", "application/json")
 		ret := struct {
-			Accounts         []trackedSpinnakerAccount `json:"accounts,omitempty"`
-			ArtifactAccounts []trackedSpinnakerAccount `json:"artifactAccounts,omitempty"`
+			Accounts         []trackedSpinnakerAccount `json:"accounts,omitempty" yaml:"accounts,omitempty"`
+			ArtifactAccounts []trackedSpinnakerAccount `json:"artifactAccounts,omitempty" yaml:"artifactAccounts,omitempty"`
 		}{clouddriverManager.getCloudAccounts(), clouddriverManager.getArtifactAccounts()}
+		writeFormatted(w, req, ret, func() [][]string {
+			return accountRows(ret.Accounts, ret.ArtifactAccounts)
+		})
+	}
+}
+
+func (*srv) clouddriverAccountsRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := mux.Vars(req)["name"]
+		cloud, artifact, found := clouddriverManager.getAccountsForClouddriver(name)
+		if !found {
+			httputil.SetError(w, http.StatusNotFound, "unknown clouddriver")
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		ret := struct {
+			Name             string                    `json:"name"`
+			Accounts         []trackedSpinnakerAccount `json:"accounts"`
+			ArtifactAccounts []trackedSpinnakerAccount `json:"artifactAccounts"`
+		}{name, cloud, artifact}
 		json, err := json.Marshal(ret)
 		if err != nil {
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -75,6 +93,7 @@ type tracerHTTP struct {
 	Headers    map[string][]string `json:"headers,omitempty"`
 	Body       string              `json:"body,omitempty"`
 	StatusCode int                 `json:"status_code,omitempty"`
+	Truncated  bool                `json:"truncated,omitempty"`
 }
 
 type tracerContents struct {
@@ -83,72 +102,193 @@ type tracerContents struct {
 	Response tracerHTTP `json:"response,omitempty"`
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return handlers.LoggingHandler(os.Stdout, next)
+// manifestPaths are the shapes of Clouddriver's manifest endpoints.  The
+// location is "_" for cluster-scoped manifests.
+var manifestPaths = []string{
+	"/manifests/{account}/{name}",
+	"/manifests/{account}/{location}/{name}",
+	"/manifests/{account}/{location}/{kind}/cluster/{app}/{cluster}/dynamic/{criteria}",
+}
+
+// accountWritePrefixes are the route families whose paths name the
+// account, on which DELETE and PATCH requests, such as deleting a
+// cluster's resources or patching a manifest, go to its owner.
+var accountWritePrefixes = []string{
+	"/applications/{name}/clusters/{account}",
+	"/applications/{name}/loadBalancers/{account}",
+	"/applications/{name}/serverGroups/{account}",
+	"/firewalls/{account}",
+	"/instances/{account}",
+	"/manifests/{account}",
+	"/securityGroups/{account}",
+	"/serverGroups/{account}",
 }
 
 func (s *srv) routes(r *mux.Router) {
-	r.HandleFunc("/applications", s.fetchList("")).Methods(http.MethodGet)
+	r.HandleFunc("/applications", s.fetchFilteredList("", s.permissions.filterApplications)).Methods(http.MethodGet)
+	r.HandleFunc("/search", s.search.searchHandler).Methods(http.MethodGet)
 	r.HandleFunc("/applications/{name}/clusters", s.fetchMapsHandler()).Methods(http.MethodGet)
+	r.HandleFunc("/applications/{name}/functions", s.fetchList("")).Methods(http.MethodGet)
 	r.HandleFunc("/applications/{name}/loadBalancers", s.fetchList("")).Methods(http.MethodGet)
 	r.HandleFunc("/applications/{name}/serverGroupManagers", s.fetchList("")).Methods(http.MethodGet)
 	r.HandleFunc("/applications/{name}/serverGroups", s.fetchList("")).Methods(http.MethodGet)
-	r.HandleFunc("/artifacts/credentials", s.fetchList("name")).Methods(http.MethodGet)
-	r.HandleFunc("/artifacts/fetch", s.artifactsPut).Methods(http.MethodPut)
-	r.HandleFunc("/artifacts/fetch/", s.artifactsPut).Methods(http.MethodPut) // lame!
+	r.HandleFunc("/artifacts/credentials", shedder.cacheUnderPressure(s.fetchFilteredList("name", s.filterArtifactCredentials))).Methods(http.MethodGet)
+	r.HandleFunc("/artifacts/fetch", audit.audited(auditKindArtifactFetch, s.artifactsPut)).Methods(http.MethodPut)
+	r.HandleFunc("/artifacts/fetch/", audit.audited(auditKindArtifactFetch, s.artifactsPut)).Methods(http.MethodPut) // lame!
 	r.HandleFunc("/artifacts/account/{account}/names", s.singleArtifactItemByIDPath("account")).Methods(http.MethodGet)
 	r.HandleFunc("/artifacts/account/{account}/versions", s.singleArtifactItemByIDPath("account")).Methods(http.MethodGet)
 
 	r.HandleFunc("/aws/images/find", s.fetchList("")).Methods(http.MethodGet)
-	r.HandleFunc("/aws/ops", s.cloudOpsPost()).Methods(http.MethodPost)
-	r.HandleFunc("/azure/ops", s.cloudOpsPost()).Methods(http.MethodPost)
-	r.HandleFunc("/kubernetes/ops", s.cloudOpsPost()).Methods(http.MethodPost)
-	r.HandleFunc("/gcp/ops", s.cloudOpsPost()).Methods(http.MethodPost)
-
-	r.PathPrefix("/cache").HandlerFunc(handleCachePost).Methods("POST")
-	r.HandleFunc("/credentials", s.fetchList("name")).Methods(http.MethodGet)
-	r.HandleFunc("/credentials/{account}", s.singleItemByIDPath("account")).Methods(http.MethodGet)
+	r.HandleFunc("/aws/ops", audit.audited(auditKindOperation, s.cloudOpsPost())).Methods(http.MethodPost)
+	r.HandleFunc("/azure/ops", audit.audited(auditKindOperation, s.cloudOpsPost())).Methods(http.MethodPost)
+	r.HandleFunc("/kubernetes/ops", audit.audited(auditKindOperation, s.cloudOpsPost())).Methods(http.MethodPost)
+	r.HandleFunc("/gcp/ops", audit.audited(auditKindOperation, s.cloudOpsPost())).Methods(http.MethodPost)
+
+	r.PathPrefix("/cache").HandlerFunc(audit.audited(auditKindCacheRefresh, handleCachePost)).Methods("POST")
+	r.HandleFunc("/credentials", shedder.cacheUnderPressure(s.credentialsList())).Methods(http.MethodGet)
+	r.HandleFunc("/credentials/{account}", s.credentialsByAccount()).Methods(http.MethodGet)
+	r.HandleFunc("/credentials/type/{accountType}", s.fetchFilteredList("name", s.filterCredentials)).Methods(http.MethodGet)
+	r.HandleFunc("/credentials", audit.audited(auditKindAccountChange, syncAccountsAfter(s.accountDefinitionWrite(true)))).Methods(http.MethodPost)
+	r.HandleFunc("/credentials", audit.audited(auditKindAccountChange, syncAccountsAfter(s.accountDefinitionWrite(false)))).Methods(http.MethodPut)
+	r.HandleFunc("/credentials/{account}", audit.audited(auditKindAccountChange, syncAccountsAfter(s.accountRoutedWrite("account")))).Methods(http.MethodDelete)
 	r.HandleFunc("/dockerRegistry/images/find", s.singleItemByOptionalQueryID("account")).Methods(http.MethodGet)
+	r.HandleFunc("/ecs/cloudMetrics/alarms", s.fetchList("")).Methods(http.MethodGet)
+	r.HandleFunc("/ecs/ecsClusters", s.fetchList("")).Methods(http.MethodGet)
+	r.HandleFunc("/ecs/secrets", s.fetchList("")).Methods(http.MethodGet)
+	r.HandleFunc("/ecs/serviceDiscoveryRegistries", s.fetchList("")).Methods(http.MethodGet)
+	r.HandleFunc("/elasticIps", s.fetchList("")).Methods(http.MethodGet)
 	r.HandleFunc("/features/stages", s.fetchFeatureList).Methods(http.MethodGet)
+	r.HandleFunc("/firewalls", s.fetchMapsHandler()).Methods(http.MethodGet)
+	r.HandleFunc("/functions", s.singleItemByOptionalQueryID("account")).Methods(http.MethodGet)
 	r.HandleFunc("/instanceTypes", s.fetchList("")).Methods(http.MethodGet)
 	r.HandleFunc("/keyPairs", s.fetchList("")).Methods(http.MethodGet)
+	r.HandleFunc("/roles/{cloudProvider}", s.fetchList("name")).Methods(http.MethodGet)
 	r.HandleFunc("/securityGroups", s.fetchMapsHandler()).Methods(http.MethodGet)
 	r.HandleFunc("/subnets/aws", s.fetchList("")).Methods(http.MethodGet)
+	r.HandleFunc("/vpcs", s.fetchList("")).Methods(http.MethodGet)
 	r.PathPrefix("/applications/{name}/clusters/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
 	r.PathPrefix("/applications/{name}/loadBalancers/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
 	r.PathPrefix("/applications/{name}/serverGroups/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
+	r.PathPrefix("/cloudMetrics/{cloudProvider}/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
+	r.PathPrefix("/ecs/ecsClusterDescriptions/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
+	r.PathPrefix("/elasticIps/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
+	r.PathPrefix("/firewalls/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
 	r.PathPrefix("/instances/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
+	for _, path := range manifestPaths {
+		r.HandleFunc(path, s.singleItemByIDPath("account")).Methods(http.MethodGet, http.MethodHead)
+		r.HandleFunc(path, audit.audited(auditKindManifest, s.accountRoutedWrite("account"))).Methods(http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
 	r.PathPrefix("/manifests/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
 	r.HandleFunc("/networks/aws", s.fetchList("")).Methods(http.MethodGet)
 	r.PathPrefix("/securityGroups/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
 	r.PathPrefix("/serverGroups/{account}").HandlerFunc(s.singleItemByIDPath("account")).Methods(http.MethodGet)
-	r.PathPrefix("/task").HandlerFunc(s.broadcast()).Methods(http.MethodGet)
+	for _, prefix := range accountWritePrefixes {
+		r.PathPrefix(prefix).HandlerFunc(audit.audited(auditKindWrite, s.accountRoutedWrite("account"))).Methods(http.MethodDelete, http.MethodPatch)
+	}
+	r.PathPrefix("/task").HandlerFunc(splitTaskHandler(journal.taskHandler(taskOwners.handler(s.broadcast())))).Methods(http.MethodGet)
 
 	// internal handlers
 	r.HandleFunc("/_internal/accountRoutes", s.accountRoutesRequest()).Methods(http.MethodGet)
 	r.HandleFunc("/_internal/accounts", s.accountsRequest()).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/clouddrivers", s.clouddriversRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/clouddrivers", audit.audited(auditKindAdmin, s.requireAdmin(s.registerClouddriverRequest))).Methods(http.MethodPost)
+	r.HandleFunc("/_internal/clouddrivers/{name}/accounts", s.clouddriverAccountsRequest()).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/tasks/stats", s.taskStatsRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/mergeStats", s.mergeStatsRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/tls", s.tlsRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/config", s.configRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/clouddrivers/swaps", s.listSwapsRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/clouddrivers/swaps", audit.audited(auditKindAdmin, s.requireAdmin(s.swapClouddriverRequest))).Methods(http.MethodPost)
+	r.HandleFunc("/_internal/clouddrivers/swaps/{from}", audit.audited(auditKindAdmin, s.requireAdmin(s.removeSwapRequest))).Methods(http.MethodDelete)
+	r.HandleFunc("/_internal/clouddrivers/{name}", audit.audited(auditKindAdmin, s.requireAdmin(s.deregisterClouddriverRequest))).Methods(http.MethodDelete)
+	r.HandleFunc("/_internal/routes/diffs", s.routeDiffsRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/conflicts", s.conflictsRequest).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/refresh", audit.audited(auditKindAdmin, s.requireAdmin(s.refreshRequest))).Methods(http.MethodPost)
+	r.HandleFunc("/_internal/routes/export", s.requireAdmin(s.exportRoutesRequest)).Methods(http.MethodGet)
+	r.HandleFunc("/_internal/routes/import", audit.audited(auditKindAdmin, s.requireAdmin(s.importRoutesRequest))).Methods(http.MethodPost)
+	r.HandleFunc("/_internal/routes/import", audit.audited(auditKindAdmin, s.requireAdmin(s.clearImportedRoutesRequest))).Methods(http.MethodDelete)
+	r.HandleFunc("/_internal/controller/reconnect", audit.audited(auditKindAdmin, s.requireAdmin(s.controllerReconnectRequest))).Methods(http.MethodPost)
+
+	// WebSocket and server-sent event GETs on the configured streaming
+	// paths are tunneled to one clouddriver, as they cannot be buffered.
+	for _, prefix := range s.streamingPaths {
+		r.PathPrefix(prefix).MatcherFunc(streamingRequestMatcher).HandlerFunc(s.streamProxy()).Methods(http.MethodGet).Name(streamRouteName)
+	}
 
 	// Catch-all for all other actions.  These endpoints will need to be added...
 	r.PathPrefix("/").HandlerFunc(s.redirect()).Methods(http.MethodGet)
-	r.PathPrefix("/").HandlerFunc(s.failAndLog()).Methods(http.MethodPost, http.MethodConnect, http.MethodDelete, http.MethodOptions, http.MethodPatch, http.MethodPut, http.MethodTrace)
+	r.PathPrefix("/").HandlerFunc(audit.audited(auditKindWrite, s.forwardByAccount())).Methods(http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	r.PathPrefix("/").HandlerFunc(s.failAndLog()).Methods(http.MethodConnect, http.MethodOptions, http.MethodTrace)
 }
 
-func runHTTPServer(ctx context.Context, conf *configuration, healthchecker *health.Health) {
-	s := &srv{
-		listenPort: conf.HTTPListenPort,
+func makeSrv(conf *configuration) *srv {
+	return &srv{
+		listenPort:     conf.HTTPListenPort,
+		adminToken:     conf.Admin.Token,
+		permissions:    makePermissionChecker(conf.Permissions),
+		search:         MakePaginatedCache(conf.Search, makeSharedCache(conf.Cache, "search")),
+		streamingPaths: conf.StreamingPaths,
 	}
+}
 
+// makeRouter returns the handler for every route, with the middleware
+// added in the order it must run.
+func (s *srv) makeRouter(conf *configuration, healthchecker *health.Health) *mux.Router {
 	r := mux.NewRouter()
 	// added first because order matters.
 	r.HandleFunc("/health", healthchecker.HTTPHandler()).Methods(http.MethodGet)
+	r.Handle("/metrics", metricsHandler()).Methods(http.MethodGet)
 	s.routes(r)
 
-	r.Use(loggingMiddleware)
+	r.Use(requestIDMiddleware)
+	r.Use(makeAccessLogger(conf.AccessLog).middleware)
+	r.Use(makeUserLabeler(conf.Metrics).middleware)
+	r.Use(makeCallerRateLimiter(conf.CallerRateLimit).middleware)
+	r.Use(makeAdmissionController(conf.Admission).middleware)
+	r.Use(shedder.middleware)
+	r.Use(aliases.middleware)
+	r.Use(s.permissions.accountsHeaderMiddleware)
+	r.Use(makeResponseCache(conf.ResponseCache, conf.Cache).middleware)
 	r.Use(otelmux.Middleware(appName))
+	r.Use(requestIDSpanMiddleware)
+	return r
+}
+
+func runHTTPServer(ctx context.Context, conf *configuration, healthchecker *health.Health) {
+	s := makeSrv(conf)
+	go s.search.RunCache(ctx)
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", s.listenPort),
-		Handler: r,
+		Handler: s.makeRouter(conf, healthchecker),
+	}
+	serve := srv.ListenAndServe
+	if conf.TLS.enabled() {
+		tlsConfig, err := makeServerTLSConfig(conf.TLS)
+		if err != nil {
+			zap.S().Fatalw("unable to configure TLS listener", "error", err)
+		}
+		srv.TLSConfig = tlsConfig
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+	serveUntilDone(ctx, srv, time.Duration(conf.ShutdownDrainSeconds)*time.Second, serve)
+}
+
+// serveUntilDone runs serve until ctx is cancelled, then stops accepting
+// connections and waits up to drain for in-flight requests to finish.
+func serveUntilDone(ctx context.Context, srv *http.Server, drain time.Duration, serve func() error) {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			zap.S().Warnw("requests still in flight at end of drain timeout", "drain", drain, "error", err)
+		}
+	}()
+	if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+		zap.S().Fatal(err)
 	}
-	zap.S().Fatal(srv.ListenAndServe())
+	<-drained
 }
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_serveUntilDone(t *testing.T) {
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serveUntilDone(ctx, srv, 5*time.Second, func() error { return srv.Serve(l) })
+		close(done)
+	}()
+
+	result := make(chan int)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+	assert.Equal(t, http.StatusTeapot, <-result, "in-flight request completes")
+	<-done
+}
+
+func Test_srv_routes(t *testing.T) {
+	s := &srv{streamingPaths: []string{"/events"}}
+	r := mux.NewRouter()
+	s.routes(r)
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/securityGroups", "/securityGroups"},
+		{http.MethodGet, "/firewalls", "/firewalls"},
+		{http.MethodGet, "/firewalls/prod", "/firewalls/{account}"},
+		{http.MethodGet, "/firewalls/prod/aws/us-east-1/web", "/firewalls/{account}"},
+		{http.MethodGet, "/functions", "/functions"},
+		{http.MethodGet, "/applications/app/functions", "/applications/{name}/functions"},
+		{http.MethodGet, "/cloudMetrics/aws/prod/us-east-1", "/cloudMetrics/{cloudProvider}/{account}"},
+		{http.MethodGet, "/cloudMetrics/aws/prod/us-east-1/CPUUtilization/statistics", "/cloudMetrics/{cloudProvider}/{account}"},
+		{http.MethodGet, "/roles/aws", "/roles/{cloudProvider}"},
+		{http.MethodGet, "/vpcs", "/vpcs"},
+		{http.MethodGet, "/elasticIps", "/elasticIps"},
+		{http.MethodGet, "/elasticIps/prod", "/elasticIps/{account}"},
+		{http.MethodGet, "/elasticIps/prod/us-east-1", "/elasticIps/{account}"},
+		{http.MethodGet, "/ecs/ecsClusters", "/ecs/ecsClusters"},
+		{http.MethodGet, "/ecs/secrets", "/ecs/secrets"},
+		{http.MethodGet, "/ecs/serviceDiscoveryRegistries", "/ecs/serviceDiscoveryRegistries"},
+		{http.MethodGet, "/ecs/cloudMetrics/alarms", "/ecs/cloudMetrics/alarms"},
+		{http.MethodGet, "/ecs/ecsClusterDescriptions/prod/us-east-1", "/ecs/ecsClusterDescriptions/{account}"},
+		{http.MethodGet, "/manifests/prod/deployment%20web", "/manifests/{account}/{name}"},
+		{http.MethodGet, "/manifests/prod/_/clusterrole%20admin", "/manifests/{account}/{location}/{name}"},
+		{http.MethodHead, "/manifests/prod/default/deployment%20web", "/manifests/{account}/{location}/{name}"},
+		{http.MethodGet, "/manifests/prod/default/deployment/cluster/app/deployment%20web/dynamic/newest", "/manifests/{account}/{location}/{kind}/cluster/{app}/{cluster}/dynamic/{criteria}"},
+		{http.MethodGet, "/manifests/prod/default/deployment%20web/extra", "/manifests/{account}"},
+		{http.MethodPatch, "/manifests/prod/default/deployment%20web", "/manifests/{account}/{location}/{name}"},
+		{http.MethodDelete, "/manifests/prod/default/deployment%20web", "/manifests/{account}/{location}/{name}"},
+		{http.MethodDelete, "/manifests/prod/default/deployment%20web/extra", "/manifests/{account}"},
+		{http.MethodDelete, "/serverGroups/prod/us-east-1/web-v001", "/serverGroups/{account}"},
+		{http.MethodPatch, "/applications/app/clusters/prod/web", "/applications/{name}/clusters/{account}"},
+		{http.MethodDelete, "/securityGroups/prod/aws/us-east-1/web", "/securityGroups/{account}"},
+		{http.MethodDelete, "/unknown/path?account=prod", "/"},
+		{http.MethodGet, "/unknown/path", "/"},
+		{http.MethodGet, "/applications?stream", "/applications"},
+		{http.MethodGet, "/events/prod?stream", "/events"},
+		{http.MethodGet, "/events/prod", "/"},
+		{http.MethodPost, "/events/prod?stream", "/"},
+		{http.MethodGet, "/unknown/path?stream", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			var match mux.RouteMatch
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if strings.HasSuffix(tt.path, "?stream") {
+				req.Header.Set("Accept", "text/event-stream")
+			}
+			require.True(t, r.Match(req, &match))
+			template, err := match.Route.GetPathTemplate()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, template)
+		})
+	}
+}
+
+func Test_srv_routes_credentialsByType(t *testing.T) {
+	a := hedgeTestServer(t, 0, http.StatusOK, `[{"name":"open","type":"kubernetes"},{"name":"prod","type":"kubernetes","permissions":{"READ":["ops"]}}]`)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{"open": {URL: a.URL}},
+	}
+
+	s := &srv{permissions: makePermissionChecker(permissionsConfig{Enforce: true})}
+	r := mux.NewRouter()
+	s.routes(r)
+
+	tests := []struct {
+		roles string
+		want  []string
+	}{
+		{"ops", []string{"open", "prod"}},
+		{"dev", []string{"open"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.roles, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/credentials/type/kubernetes", nil)
+			req.Header.Set("x-spinnaker-roles", tt.roles)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			var got []map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			names := []string{}
+			for _, account := range got {
+				names = append(names, account["name"].(string))
+			}
+			assert.ElementsMatch(t, tt.want, names)
+		})
+	}
+}
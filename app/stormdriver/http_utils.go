@@ -17,20 +17,75 @@
 package main
 
 import (
+	"bytes"
+	"io"
+	"mime"
 	"net/http"
+	"strings"
 )
 
-var ignoredHeaders = map[string]bool{
+// defaultContentType is assumed when a clouddriver does not say, or
+// sends something unparseable; nearly everything it returns is JSON.
+const defaultContentType = "application/json"
+
+// hopByHopHeaders describe a single connection, and are never passed
+// on in either direction (RFC 7230, section 6.1).  Neither are any
+// headers named in the Connection header; see hopByHop().
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// managedRequestHeaders are set on requests to clouddrivers by
+// Stormdriver or the HTTP client, so the caller's are not copied.
+var managedRequestHeaders = map[string]bool{
+	"Accept-Encoding": true,
+	"Content-Length":  true,
+}
+
+// managedResponseHeaders are set on responses by Stormdriver, so the
+// clouddriver's are not copied.
+var managedResponseHeaders = map[string]bool{
 	"Accept-Encoding": true,
-	"Connection":      true,
 	"Content-Length":  true,
 	"Content-Type":    true,
 	"User-Agent":      true,
 }
 
+// hopByHop returns the canonical names of the hop-by-hop headers in h:
+// the standard ones, and any listed in its Connection header.
+func hopByHop(h http.Header) map[string]bool {
+	connection := h.Values("Connection")
+	if len(connection) == 0 {
+		return hopByHopHeaders
+	}
+	ret := map[string]bool{}
+	for k := range hopByHopHeaders {
+		ret[k] = true
+	}
+	for _, v := range connection {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				ret[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return ret
+}
+
+// copyHeaders copies the caller's request headers which are to be sent
+// on to a clouddriver, as chosen by requestHeaderPolicy.
 func copyHeaders(dst, src http.Header) {
+	skip := hopByHop(src)
 	for k, vv := range src {
-		if ignoredHeaders[k] {
+		if skip[k] || managedRequestHeaders[k] || !requestHeaderPolicy.allows(k) {
 			continue
 		}
 		for _, v := range vv {
@@ -52,3 +107,82 @@ func combineURL(base, uri string) string {
 	}
 	return base + uri
 }
+
+// textualContentType returns true for media types which are text, and
+// so need a charset to be read correctly.  JSON is always UTF-8.
+func textualContentType(mediaType string) bool {
+	switch mediaType {
+	case "application/x-yaml", "application/yaml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// normalizeContentType returns the content-type to send for an upstream
+// response with the given content-type.  The media type and charset are
+// lower cased, other parameters are dropped, and textual types without
+// a charset are marked as UTF-8, which is what clouddriver sends.
+func normalizeContentType(upstream string) string {
+	if strings.TrimSpace(upstream) == "" {
+		return defaultContentType
+	}
+	mediaType, params, err := mime.ParseMediaType(upstream)
+	if err != nil {
+		return defaultContentType
+	}
+	charset := strings.ToLower(params["charset"])
+	if charset == "" && textualContentType(mediaType) {
+		charset = "utf-8"
+	}
+	if charset == "" {
+		return mediaType
+	}
+	return mime.FormatMediaType(mediaType, map[string]string{"charset": charset})
+}
+
+// setContentType sets the response's content-type from the upstream one.
+func setContentType(w http.ResponseWriter, upstream string) {
+	w.Header().Set("content-type", normalizeContentType(upstream))
+}
+
+// flushWriter flushes after every write, so a streamed response
+// reaches the client as it arrives from upstream.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// streamBody copies body to w without holding all of it in memory,
+// flushing as it goes if w supports it.
+func streamBody(w http.ResponseWriter, body io.Reader) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	return io.Copy(flushWriter{w: w, flusher: flusher}, body)
+}
+
+// prefixBuffer keeps the first limit bytes written to it, discarding
+// the rest, for logging part of a streamed body.
+type prefixBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	room := b.limit - b.Len()
+	if room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
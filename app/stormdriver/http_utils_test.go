@@ -17,11 +17,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_copyHeaders(t *testing.T) {
@@ -69,6 +73,80 @@ func Test_copyHeaders(t *testing.T) {
 	}
 }
 
+func Test_copyHeaders_policy(t *testing.T) {
+	saved := requestHeaderPolicy
+	defer func() { requestHeaderPolicy = saved }()
+
+	src := http.Header{
+		"Connection":      {"keep-alive"},
+		"Content-Length":  {"10"},
+		"Content-Type":    {"application/x-yaml"},
+		"Te":              {"trailers"},
+		"User-Agent":      {"deck"},
+		"X-Spinnaker-App": {"app1"},
+		"X-Internal-Hop":  {"1"},
+	}
+	tests := []struct {
+		name   string
+		policy headerPolicy
+		want   http.Header
+	}{
+		{
+			"default",
+			defaultRequestHeaderPolicy,
+			http.Header{"Content-Type": {"application/x-yaml"}, "X-Spinnaker-App": {"app1"}, "X-Internal-Hop": {"1"}},
+		},
+		{
+			"deny",
+			headerPolicy{Deny: []string{"x-internal-*"}},
+			http.Header{"Content-Type": {"application/x-yaml"}, "User-Agent": {"deck"}, "X-Spinnaker-App": {"app1"}},
+		},
+		{
+			"allow",
+			headerPolicy{Allow: []string{"X-Spinnaker-*", "Connection"}},
+			http.Header{"X-Spinnaker-App": {"app1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestHeaderPolicy = tt.policy
+			got := http.Header{}
+			copyHeaders(got, src)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_hopByHop(t *testing.T) {
+	tests := []struct {
+		name string
+		src  http.Header
+		want http.Header
+	}{
+		{
+			"standard headers",
+			http.Header{"Keep-Alive": {"timeout=5"}, "Transfer-Encoding": {"chunked"}, "Upgrade": {"h2c"}, "X-Kept": {"1"}},
+			http.Header{"X-Kept": {"1"}},
+		},
+		{
+			"named in connection",
+			http.Header{"Connection": {"close, x-trace-hop", " X-Other "}, "X-Trace-Hop": {"1"}, "X-Other": {"2"}, "X-Kept": {"3"}},
+			http.Header{"X-Kept": {"3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := http.Header{}
+			copyHeaders(req, tt.src)
+			assert.Equal(t, tt.want, req)
+			resp := http.Header{}
+			copyResponseHeaders(routeClassProxy, resp, tt.src)
+			assert.Equal(t, tt.want, resp)
+		})
+	}
+	assert.Len(t, hopByHopHeaders, 9, "the standard set is not changed")
+}
+
 func Test_combineURL(t *testing.T) {
 	var tests = []struct {
 		a, b string
@@ -91,3 +169,74 @@ func Test_combineURL(t *testing.T) {
 		})
 	}
 }
+
+func Test_normalizeContentType(t *testing.T) {
+	var tests = []struct {
+		upstream string
+		want     string
+	}{
+		{"", "application/json"},
+		{"not a / type;", "application/json"},
+		{"application/json", "application/json"},
+		{"application/json;charset=UTF-8", "application/json; charset=utf-8"},
+		{"Application/JSON; charset=utf-8", "application/json; charset=utf-8"},
+		{"application/x-yaml", "application/x-yaml; charset=utf-8"},
+		{"application/yaml;charset=ISO-8859-1", "application/yaml; charset=iso-8859-1"},
+		{"text/plain", "text/plain; charset=utf-8"},
+		{"text/plain;charset=UTF-8", "text/plain; charset=utf-8"},
+		{"application/octet-stream", "application/octet-stream"},
+		{"application/json; boundary=x", "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			assert.Equal(t, tt.want, normalizeContentType(tt.upstream))
+		})
+	}
+}
+
+func Test_streamBody(t *testing.T) {
+	w := httptest.NewRecorder()
+	n, err := streamBody(w, strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.True(t, w.Flushed)
+}
+
+func Test_prefixBuffer(t *testing.T) {
+	b := &prefixBuffer{limit: 5}
+	n, err := b.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.False(t, b.truncated)
+	n, err = b.Write([]byte("defgh"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n, "all bytes are accepted")
+	assert.Equal(t, "abcde", b.String())
+	assert.True(t, b.truncated)
+}
+
+func Test_fetchFrom_streams(t *testing.T) {
+	large := strings.Repeat("x", 4*1024*1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(large))
+	}))
+	defer backend.Close()
+
+	w := httptest.NewRecorder()
+	fetchFrom(context.Background(), backend.URL+"/serverGroups", "", w, httptest.NewRequest(http.MethodGet, "/serverGroups", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("content-type"))
+	assert.Equal(t, len(large), w.Body.Len())
+
+	w = httptest.NewRecorder()
+	fetchFrom(context.Background(), backend.URL+"/missing", "", w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("content-type"))
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"gopkg.in/yaml.v3"
+)
+
+// writeFormatted writes obj to the response in the format requested by
+// the `format` query parameter: json (the default), yaml, or csv.
+// For csv, rows is called to flatten the object into records, the first
+// of which is the header.
+func writeFormatted(w http.ResponseWriter, req *http.Request, obj interface{}, rows func() [][]string) {
+	var data []byte
+	var err error
+	var contentType string
+
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "json":
+		contentType = "application/json"
+		data, err = json.Marshal(obj)
+	case "yaml":
+		contentType = "application/x-yaml"
+		data, err = yaml.Marshal(obj)
+	case "csv":
+		contentType = "text/csv"
+		data, err = renderCSV(rows())
+	default:
+		httputil.SetError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", contentType)
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, data)
+}
+
+func renderCSV(records [][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	escaped := make([][]string, len(records))
+	for idx, record := range records {
+		escaped[idx] = make([]string, len(record))
+		for col, cell := range record {
+			escaped[idx][col] = escapeCSVCell(cell)
+		}
+	}
+	if err := cw.WriteAll(escaped); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// escapeCSVCell prefixes cells which a spreadsheet would otherwise
+// evaluate as a formula with a single quote.
+func escapeCSVCell(cell string) string {
+	if cell == "" {
+		return cell
+	}
+	switch cell[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + cell
+	}
+	return cell
+}
+
+func accountRows(accounts []trackedSpinnakerAccount, artifactAccounts []trackedSpinnakerAccount) [][]string {
+	ret := [][]string{{"kind", "name", "type"}}
+	for _, a := range accounts {
+		ret = append(ret, []string{"account", a.Name, a.Type})
+	}
+	for _, a := range artifactAccounts {
+		ret = append(ret, []string{"artifactAccount", a.Name, a.Type})
+	}
+	return ret
+}
+
+func routeRows(routes map[string]URLAndPriority, artifactRoutes map[string]URLAndPriority) [][]string {
+	ret := [][]string{{"kind", "account", "url", "priority"}}
+	add := func(kind string, m map[string]URLAndPriority) {
+		names := keysForMap(m)
+		sort.Strings(names)
+		for _, name := range names {
+			ret = append(ret, []string{kind, name, m[name].URL, strconv.Itoa(m[name].Priority)})
+		}
+	}
+	add("account", routes)
+	add("artifactAccount", artifactRoutes)
+	return ret
+}
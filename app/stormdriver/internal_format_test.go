@@ -0,0 +1,65 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_writeFormatted(t *testing.T) {
+	routes := map[string]URLAndPriority{
+		"b": {URL: "url2", Priority: 1},
+		"a": {URL: "url1"},
+	}
+	obj := struct {
+		Accounts map[string]URLAndPriority `json:"accounts" yaml:"accounts"`
+	}{routes}
+	rows := func() [][]string { return routeRows(routes, nil) }
+
+	tests := []struct {
+		name            string
+		query           string
+		wantCode        int
+		wantContentType string
+		wantBody        string
+	}{
+		{"default is json", "", http.StatusOK, "application/json", `{"accounts":{"a":{"url":"url1"},"b":{"url":"url2","priority":1}}}`},
+		{"yaml", "?format=yaml", http.StatusOK, "application/x-yaml", "accounts:\n    a:\n        url: url1\n    b:\n        url: url2\n        priority: 1\n"},
+		{"csv", "?format=csv", http.StatusOK, "text/csv", "kind,account,url,priority\naccount,a,url1,0\naccount,b,url2,1\n"},
+		{"unknown", "?format=xml", http.StatusBadRequest, "application/json", `{"status":"error","code":400,"error":"unknown format \"xml\""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/_internal/accountRoutes"+tt.query, nil)
+			w := httptest.NewRecorder()
+			writeFormatted(w, req, obj, rows)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantContentType, w.Header().Get("content-type"))
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
+
+func Test_renderCSV_escapesFormulas(t *testing.T) {
+	data, err := renderCSV([][]string{{"name"}, {"=HYPERLINK(\"x\")"}, {"+1"}, {"-1"}, {"@SUM(A1)"}, {"plain"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "name\n\"'=HYPERLINK(\"\"x\"\")\"\n'+1\n'-1\n'@SUM(A1)\nplain\n", string(data))
+}
@@ -0,0 +1,536 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultJournalMaxQueueAgeSeconds    = 3600
+	defaultJournalReplayIntervalSeconds = 10
+	defaultJournalRetentionSeconds      = 86400
+
+	// journalPruneInterval is how often finished entries past their
+	// retention are dropped while running.
+	journalPruneInterval = time.Hour
+
+	journalTaskPrefix = "stormdriver-"
+)
+
+const (
+	journalAccepted  = "accepted"
+	journalForwarded = "forwarded"
+	journalQueued    = "queued"
+	journalReplayed  = "replayed"
+	journalFailed    = "failed"
+	journalExpired   = "expired"
+	journalUnknown   = "unknown"
+)
+
+// journalConfig enables a write-ahead journal of operations.  If Path is
+// empty, no journal is kept.  Operations on the QueueAccounts (or all
+// accounts, if "*" is listed) which cannot be forwarded because their
+// clouddriver is unavailable are queued, and replayed when a route
+// returns, for up to MaxQueueAgeSeconds.  Finished entries are kept
+// for RetentionSeconds, so their synthetic task ids can still be looked up.
+type journalConfig struct {
+	Path                  string   `yaml:"path,omitempty" json:"path,omitempty"`
+	QueueAccounts         []string `yaml:"queueAccounts,omitempty" json:"queueAccounts,omitempty"`
+	MaxQueueAgeSeconds    int      `yaml:"maxQueueAgeSeconds,omitempty" json:"maxQueueAgeSeconds,omitempty"`
+	ReplayIntervalSeconds int      `yaml:"replayIntervalSeconds,omitempty" json:"replayIntervalSeconds,omitempty"`
+	RetentionSeconds      int      `yaml:"retentionSeconds,omitempty" json:"retentionSeconds,omitempty"`
+}
+
+func (c *journalConfig) applyDefaults() {
+	if c.Path == "" {
+		return
+	}
+	if c.MaxQueueAgeSeconds == 0 {
+		c.MaxQueueAgeSeconds = defaultJournalMaxQueueAgeSeconds
+	}
+	if c.ReplayIntervalSeconds == 0 {
+		c.ReplayIntervalSeconds = defaultJournalReplayIntervalSeconds
+	}
+	if c.RetentionSeconds == 0 {
+		c.RetentionSeconds = defaultJournalRetentionSeconds
+	}
+}
+
+func (c *journalConfig) validate() error {
+	if c.Path == "" && len(c.QueueAccounts) > 0 {
+		return fmt.Errorf("queueAccounts requires a path")
+	}
+	if c.RetentionSeconds < 0 {
+		return fmt.Errorf("retentionSeconds cannot be negative")
+	}
+	return nil
+}
+
+// journalEntry is one line in the journal.  Each change of state appends
+// the whole entry again; on load, the last line for each ID wins.
+type journalEntry struct {
+	ID         string          `json:"id"`
+	Time       time.Time       `json:"time"`
+	Updated    time.Time       `json:"updated"`
+	Method     string          `json:"method"`
+	URI        string          `json:"uri"`
+	Headers    http.Header     `json:"headers,omitempty"`
+	Body       json.RawMessage `json:"body"`
+	Accounts   []string        `json:"accounts"`
+	State      string          `json:"state"`
+	StatusCode int             `json:"statusCode,omitempty"`
+	TaskID     string          `json:"taskId,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+func (e *journalEntry) finished() bool {
+	return e.State != journalAccepted && e.State != journalQueued
+}
+
+// opJournal records operations and their outcomes.  A nil opJournal
+// records nothing and queues nothing.
+type opJournal struct {
+	sync.Mutex
+	conf          journalConfig
+	file          *os.File
+	entries       map[string]*journalEntry
+	queueAll      bool
+	queueAccounts map[string]bool
+}
+
+var journal *opJournal
+
+// openJournal loads any existing journal, compacts it, and opens it for
+// appending.  Operations which were accepted but never finished may
+// have reached a clouddriver, so they are marked unknown rather than
+// replayed.
+func openJournal(conf journalConfig) (*opJournal, error) {
+	j := &opJournal{
+		conf:          conf,
+		entries:       map[string]*journalEntry{},
+		queueAccounts: map[string]bool{},
+	}
+	for _, account := range conf.QueueAccounts {
+		if account == "*" {
+			j.queueAll = true
+		}
+		j.queueAccounts[account] = true
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	for _, e := range j.entries {
+		if e.State == journalAccepted {
+			// we stopped before learning the outcome.
+			e.State = journalUnknown
+			e.Error = "stormdriver stopped before the outcome was known"
+		}
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *opJournal) open() error {
+	f, err := os.OpenFile(j.conf.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	j.file = f
+	return nil
+}
+
+func (j *opJournal) retention() time.Duration {
+	if j.conf.RetentionSeconds == 0 {
+		return defaultJournalRetentionSeconds * time.Second
+	}
+	return time.Duration(j.conf.RetentionSeconds) * time.Second
+}
+
+func (j *opJournal) expired(e *journalEntry, cutoff time.Time) bool {
+	return e.finished() && e.Updated.Before(cutoff)
+}
+
+// prune drops finished entries older than the retention period, and
+// rewrites the journal without them.
+func (j *opJournal) prune() {
+	j.Lock()
+	defer j.Unlock()
+	cutoff := time.Now().Add(-j.retention())
+	found := false
+	for _, e := range j.entries {
+		if j.expired(e, cutoff) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	j.file.Close()
+	j.file = nil
+	if err := j.compact(); err != nil {
+		zap.S().Errorw("unable to compact journal", "error", err)
+	}
+	if err := j.open(); err != nil {
+		zap.S().Errorw("unable to reopen journal", "path", j.conf.Path, "error", err)
+	}
+}
+
+func (j *opJournal) load() error {
+	f, err := os.Open(j.conf.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// most likely a partial final write; skip it.
+			zap.S().Warnw("skipping unreadable journal entry", "error", err)
+			continue
+		}
+		j.entries[e.ID] = &e
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with only the entries still worth
+// keeping.  Must be called while the journal is not open for appending,
+// and with the lock held once it is in use.
+func (j *opJournal) compact() error {
+	cutoff := time.Now().Add(-j.retention())
+	tmp := j.conf.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for id, e := range j.entries {
+		if j.expired(e, cutoff) {
+			delete(j.entries, id)
+			continue
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, _ = w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, j.conf.Path)
+}
+
+// write appends the entry's current state.  Must be called with the lock held.
+func (j *opJournal) write(e *journalEntry) {
+	e.Updated = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		zap.S().Errorw("json.Marshal", "error", err)
+		return
+	}
+	if j.file == nil {
+		zap.S().Errorw("unable to write journal, it is not open", "id", e.ID)
+		return
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		zap.S().Errorw("unable to write journal", "error", err)
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		zap.S().Errorw("unable to sync journal", "error", err)
+	}
+}
+
+func newJournalID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return journalTaskPrefix + hex.EncodeToString(b)
+}
+
+// spinnakerHeaders returns the x-spinnaker-* request headers, which
+// identify the user when replaying or polling on their behalf.
+func spinnakerHeaders(h http.Header) http.Header {
+	ret := http.Header{}
+	for k, vv := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-spinnaker-") {
+			ret[k] = vv
+		}
+	}
+	return ret
+}
+
+// accept records an operation before it is forwarded.
+func (j *opJournal) accept(req *http.Request, body []byte, accounts []string) *journalEntry {
+	if j == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	e := &journalEntry{
+		ID:       newJournalID(),
+		Time:     now,
+		Method:   req.Method,
+		URI:      req.RequestURI,
+		Headers:  spinnakerHeaders(req.Header),
+		Body:     append(json.RawMessage(nil), body...),
+		Accounts: accounts,
+		State:    journalAccepted,
+	}
+	j.Lock()
+	defer j.Unlock()
+	j.entries[e.ID] = e
+	j.write(e)
+	return e
+}
+
+// shouldQueue returns true if operations on all the accounts may be queued.
+func (j *opJournal) shouldQueue(accounts []string) bool {
+	if j == nil || len(accounts) == 0 {
+		return false
+	}
+	if j.queueAll {
+		return true
+	}
+	for _, account := range accounts {
+		if !j.queueAccounts[account] {
+			return false
+		}
+	}
+	return true
+}
+
+// finish records the outcome of forwarding an entry.
+func (j *opJournal) finish(e *journalEntry, state string, statusCode int, taskID string, err error) {
+	if j == nil || e == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	e.State = state
+	e.StatusCode = statusCode
+	e.TaskID = taskID
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.write(e)
+}
+
+func (j *opJournal) lookup(id string) (journalEntry, bool) {
+	j.Lock()
+	defer j.Unlock()
+	e, found := j.entries[id]
+	if !found {
+		return journalEntry{}, false
+	}
+	return *e, true
+}
+
+// replayQueued tries to forward each queued operation whose accounts
+// all have routes again.  Operations queued for too long are expired.
+func (j *opJournal) replayQueued(ctx context.Context) {
+	j.Lock()
+	queued := []*journalEntry{}
+	for _, e := range j.entries {
+		if e.State == journalQueued {
+			queued = append(queued, e)
+		}
+	}
+	j.Unlock()
+
+	maxAge := time.Duration(j.conf.MaxQueueAgeSeconds) * time.Second
+	for _, e := range queued {
+		if time.Since(e.Time) > maxAge {
+			zap.S().Warnw("queued operation expired", "id", e.ID, "accounts", e.Accounts)
+			j.finish(e, journalExpired, 0, "", fmt.Errorf("no route after %s", maxAge))
+			continue
+		}
+		route, found := findSingleCloudRoute(e.Accounts)
+		if !found {
+			continue
+		}
+		target := combineURL(route.URL, e.URI)
+		body, code, _, err := fetchWithBody(withRoute(ctx, route), e.Method, target, route.token, e.Headers, e.Body)
+		if err != nil {
+			// still unavailable; try again later.
+			continue
+		}
+		if !httputil.StatusCodeOK(code) {
+			zap.S().Warnw("replayed operation failed", "id", e.ID, "statusCode", code)
+			j.finish(e, journalFailed, code, "", nil)
+			continue
+		}
+		taskID := taskIDFromResponse(body)
+		zap.S().Infow("replayed queued operation", "id", e.ID, "taskId", taskID)
+		j.finish(e, journalReplayed, code, taskID, nil)
+		taskOwners.record(taskID, route)
+		clouddriver := clouddriverManager.clouddriverNameForRoute(route)
+		now := time.Now().UTC()
+		events.emit(opEvent{
+			Time:        now,
+			Method:      e.Method,
+			Path:        strings.SplitN(e.URI, "?", 2)[0],
+			User:        e.Headers.Get("x-spinnaker-user"),
+			Accounts:    e.Accounts,
+			Clouddriver: clouddriver,
+			TaskID:      taskID,
+			StatusCode:  code,
+		})
+		tasks.track(trackedTask{
+			id:          taskID,
+			route:       route,
+			clouddriver: clouddriver,
+			accounts:    e.Accounts,
+			headers:     e.Headers,
+			started:     now,
+		})
+	}
+}
+
+// findSingleCloudRoute returns the route for the first of the accounts,
+// if all of them have routes.
+func findSingleCloudRoute(accounts []string) (URLAndPriority, bool) {
+	var ret URLAndPriority
+	for idx, account := range accounts {
+		route, found := clouddriverManager.findCloudRoute(account)
+		if !found {
+			return URLAndPriority{}, false
+		}
+		if idx == 0 {
+			ret = route
+		}
+	}
+	return ret, len(accounts) > 0
+}
+
+func (j *opJournal) replayLoop(ctx context.Context) {
+	t := time.NewTicker(time.Duration(j.conf.ReplayIntervalSeconds) * time.Second)
+	defer t.Stop()
+	prune := time.NewTicker(journalPruneInterval)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			j.replayQueued(ctx)
+		case <-prune.C:
+			j.prune()
+		}
+	}
+}
+
+// writeQueuedResponse responds as clouddriver would to an accepted
+// operation, using the journal entry's ID as the task id.
+func writeQueuedResponse(w http.ResponseWriter, e *journalEntry) {
+	ret, _ := json.Marshal(map[string]string{
+		"id":          e.ID,
+		"resourceUri": "/task/" + e.ID,
+	})
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, ret)
+}
+
+// syntheticTask returns a clouddriver-style task document for an
+// operation which has not been forwarded, or failed to be.
+func syntheticTask(e journalEntry) map[string]interface{} {
+	status := map[string]interface{}{
+		"phase":     "STORMDRIVER",
+		"status":    "Queued until a clouddriver is available for " + strings.Join(e.Accounts, ", "),
+		"completed": false,
+		"failed":    false,
+		"retryable": false,
+	}
+	if e.finished() {
+		status["status"] = fmt.Sprintf("Operation was not forwarded: %s %s", e.State, e.Error)
+		if e.State == journalUnknown {
+			status["status"] = "The outcome of this operation is not known: " + e.Error
+		}
+		status["completed"] = true
+		status["failed"] = true
+	}
+	return map[string]interface{}{
+		"id":            e.ID,
+		"status":        status,
+		"history":       []interface{}{status},
+		"resultObjects": []interface{}{},
+	}
+}
+
+// taskHandler answers /task/{id} for synthetic task ids, either with a
+// synthetic task or by looking up the real task once the operation has
+// been replayed.  Other requests are passed to next.
+func (j *opJournal) taskHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/task/")
+		if j == nil || !strings.HasPrefix(id, journalTaskPrefix) {
+			next(w, req)
+			return
+		}
+		e, found := j.lookup(id)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if e.State == journalReplayed && e.TaskID != "" {
+			r := req.Clone(req.Context())
+			r.URL.Path = "/task/" + e.TaskID
+			r.RequestURI = r.URL.RequestURI()
+			next(w, r)
+			return
+		}
+		ret, err := json.Marshal(syntheticTask(e))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		httputil.CheckedWrite(w, ret)
+	}
+}
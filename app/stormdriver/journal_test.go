@@ -0,0 +1,186 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_openJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := openJournal(journalConfig{Path: path})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/kubernetes/ops", nil)
+	req.Header.Set("x-spinnaker-user", "alice")
+	req.Header.Set("authorization", "Bearer secret")
+
+	queued := j.accept(req, []byte(`[{}]`), []string{"a1"})
+	j.finish(queued, journalQueued, 0, "", nil)
+	forwarded := j.accept(req, []byte(`[{}]`), []string{"a1"})
+	j.finish(forwarded, journalForwarded, 200, "task-1", nil)
+	interrupted := j.accept(req, []byte(`[{}]`), []string{"a1"})
+	j.file.Close()
+
+	j, err = openJournal(journalConfig{Path: path})
+	require.NoError(t, err)
+	defer j.file.Close()
+
+	e, found := j.lookup(queued.ID)
+	require.True(t, found)
+	assert.Equal(t, journalQueued, e.State)
+	assert.Equal(t, "alice", e.Headers.Get("x-spinnaker-user"))
+	assert.Empty(t, e.Headers.Get("authorization"), "only spinnaker headers are kept")
+
+	e, found = j.lookup(forwarded.ID)
+	require.True(t, found)
+	assert.Equal(t, "task-1", e.TaskID)
+
+	e, found = j.lookup(interrupted.ID)
+	require.True(t, found)
+	assert.Equal(t, journalUnknown, e.State, "entries with no outcome may have been forwarded, so are not replayed")
+}
+
+func Test_opJournal_prune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := openJournal(journalConfig{Path: path, RetentionSeconds: 60})
+	require.NoError(t, err)
+	defer func() { j.file.Close() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/ops", nil)
+	old := j.accept(req, []byte(`[{}]`), []string{"a1"})
+	j.finish(old, journalForwarded, 200, "task-1", nil)
+	queued := j.accept(req, []byte(`[{}]`), []string{"a1"})
+	j.finish(queued, journalQueued, 0, "", nil)
+	recent := j.accept(req, []byte(`[{}]`), []string{"a1"})
+	j.finish(recent, journalForwarded, 200, "task-2", nil)
+
+	j.Lock()
+	old.Updated = time.Now().Add(-time.Hour)
+	queued.Updated = time.Now().Add(-time.Hour)
+	j.Unlock()
+	j.prune()
+
+	_, found := j.lookup(old.ID)
+	assert.False(t, found, "finished entries past retention are dropped")
+	_, found = j.lookup(queued.ID)
+	assert.True(t, found, "unfinished entries are kept")
+	_, found = j.lookup(recent.ID)
+	assert.True(t, found)
+
+	j.finish(recent, journalForwarded, 200, "task-2", nil)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), old.ID, "the file is rewritten")
+	assert.Contains(t, string(data), recent.ID, "and still appended to")
+}
+
+func Test_opJournal_compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	old := journalEntry{ID: "old", State: journalForwarded, Updated: time.Now().Add(-48 * time.Hour)}
+	waiting := journalEntry{ID: "waiting", State: journalQueued, Updated: time.Now().Add(-48 * time.Hour)}
+	data := []byte{}
+	for _, e := range []journalEntry{old, waiting} {
+		line, err := json.Marshal(e)
+		require.NoError(t, err)
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	data = append(data, []byte("{\"id\": \"trunc")...)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	j, err := openJournal(journalConfig{Path: path})
+	require.NoError(t, err)
+	defer j.file.Close()
+	assert.Equal(t, []string{"waiting"}, keysForMap(j.entries))
+}
+
+func Test_opJournal_shouldQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		queue    []string
+		accounts []string
+		want     bool
+	}{
+		{"no accounts", []string{"*"}, []string{}, false},
+		{"wildcard", []string{"*"}, []string{"a1", "a2"}, true},
+		{"listed", []string{"a1", "a2"}, []string{"a1", "a2"}, true},
+		{"partly listed", []string{"a1"}, []string{"a1", "a2"}, false},
+		{"not listed", []string{}, []string{"a1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, err := openJournal(journalConfig{Path: filepath.Join(t.TempDir(), "journal"), QueueAccounts: tt.queue})
+			require.NoError(t, err)
+			defer j.file.Close()
+			assert.Equal(t, tt.want, j.shouldQueue(tt.accounts))
+		})
+	}
+
+	var j *opJournal
+	assert.False(t, j.shouldQueue([]string{"a1"}), "nil journal never queues")
+}
+
+func Test_opJournal_taskHandler(t *testing.T) {
+	j := &opJournal{entries: map[string]*journalEntry{
+		"stormdriver-queued":   {ID: "stormdriver-queued", State: journalQueued, Accounts: []string{"a1"}},
+		"stormdriver-expired":  {ID: "stormdriver-expired", State: journalExpired, Accounts: []string{"a1"}},
+		"stormdriver-replayed": {ID: "stormdriver-replayed", State: journalReplayed, TaskID: "real"},
+	}}
+	var nextPath string
+	handler := j.taskHandler(func(w http.ResponseWriter, req *http.Request) {
+		nextPath = req.URL.Path
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		path       string
+		wantCode   int
+		wantNext   string
+		wantFailed interface{}
+	}{
+		{"/task/12345", http.StatusOK, "/task/12345", nil},
+		{"/task/stormdriver-replayed", http.StatusOK, "/task/real", nil},
+		{"/task/stormdriver-queued", http.StatusOK, "", false},
+		{"/task/stormdriver-expired", http.StatusOK, "", true},
+		{"/task/stormdriver-unknown", http.StatusNotFound, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			nextPath = ""
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantNext, nextPath)
+			if tt.wantFailed != nil {
+				var task map[string]interface{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &task))
+				status := task["status"].(map[string]interface{})
+				assert.Equal(t, tt.wantFailed, status["failed"])
+			}
+		})
+	}
+}
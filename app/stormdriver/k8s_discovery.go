@@ -0,0 +1,217 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesSource = "kubernetes"
+
+	// kubernetesAnnotationPrefix is the prefix for Service annotations
+	// read by Stormdriver, such as stormdriver.opsmx.io/priority.
+	kubernetesAnnotationPrefix = "stormdriver.opsmx.io/"
+
+	defaultKubernetesPortName  = "http"
+	defaultKubernetesScheme    = "http"
+	defaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultKubernetesCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubernetesNamespacePath    = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// kubernetesDiscoveryConfig finds clouddrivers as the Services in a
+// namespace matching a label selector.  The API server and credentials
+// default to those of the pod Stormdriver runs in.
+type kubernetesDiscoveryConfig struct {
+	Namespace       string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	LabelSelector   string `yaml:"labelSelector,omitempty" json:"labelSelector,omitempty"`
+	PortName        string `yaml:"portName,omitempty" json:"portName,omitempty"`
+	Scheme          string `yaml:"scheme,omitempty" json:"scheme,omitempty"`
+	IntervalSeconds int    `yaml:"intervalSeconds,omitempty" json:"intervalSeconds,omitempty"`
+	APIServer       string `yaml:"apiServer,omitempty" json:"apiServer,omitempty"`
+	TokenPath       string `yaml:"tokenPath,omitempty" json:"tokenPath,omitempty"`
+	CAPath          string `yaml:"caPath,omitempty" json:"caPath,omitempty"`
+}
+
+func (c *kubernetesDiscoveryConfig) applyDefaults() {
+	if c.PortName == "" {
+		c.PortName = defaultKubernetesPortName
+	}
+	if c.Scheme == "" {
+		c.Scheme = defaultKubernetesScheme
+	}
+	if c.IntervalSeconds == 0 {
+		c.IntervalSeconds = defaultDiscoveryIntervalSeconds
+	}
+	if c.TokenPath == "" {
+		c.TokenPath = defaultKubernetesTokenPath
+	}
+	if c.CAPath == "" {
+		c.CAPath = defaultKubernetesCAPath
+	}
+}
+
+func (c kubernetesDiscoveryConfig) validate() error {
+	if c.LabelSelector == "" {
+		return errors.New("labelSelector is required")
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, not %q", c.Scheme)
+	}
+	if c.IntervalSeconds < 0 {
+		return errors.New("intervalSeconds cannot be negative")
+	}
+	if c.APIServer != "" {
+		if _, err := url.Parse(c.APIServer); err != nil {
+			return fmt.Errorf("apiServer: %v", err)
+		}
+	}
+	return nil
+}
+
+// kubernetesService is the part of a Service which discovery uses.
+type kubernetesService struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubernetesServiceList struct {
+	Items []kubernetesService `json:"items"`
+}
+
+type kubernetesDiscoverer struct {
+	conf      kubernetesDiscoveryConfig
+	apiServer string
+	namespace string
+	client    *http.Client
+}
+
+// makeKubernetesDiscoverer resolves the API server and namespace, using
+// the in-cluster environment for any not configured.
+func makeKubernetesDiscoverer(c kubernetesDiscoveryConfig) (*kubernetesDiscoverer, error) {
+	d := &kubernetesDiscoverer{
+		conf:      c,
+		apiServer: strings.TrimSuffix(c.APIServer, "/"),
+		namespace: c.Namespace,
+	}
+	if d.apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("apiServer is not set and not running in a cluster")
+		}
+		d.apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if d.namespace == "" {
+		ns, err := os.ReadFile(kubernetesNamespacePath)
+		if err != nil {
+			return nil, fmt.Errorf("namespace is not set: %v", err)
+		}
+		d.namespace = strings.TrimSpace(string(ns))
+	}
+
+	var tlsConfig *tls.Config
+	if ca, err := os.ReadFile(c.CAPath); err == nil {
+		if tlsConfig, err = makeTLSConfigWithCA(ca); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.CAPath, err)
+		}
+	}
+	d.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}
+	return d, nil
+}
+
+// discover lists the matching Services.  The token is re-read each time,
+// as projected service account tokens are rotated.
+func (d *kubernetesDiscoverer) discover(ctx context.Context) ([]clouddriverConfig, error) {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/services?labelSelector=%s",
+		d.apiServer, url.PathEscape(d.namespace), url.QueryEscape(d.conf.LabelSelector))
+	headers := map[string]string{}
+	if token, err := os.ReadFile(d.conf.TokenPath); err == nil {
+		headers["authorization"] = "Bearer " + strings.TrimSpace(string(token))
+	}
+	body, err := discoveryRequest(ctx, d.client, http.MethodGet, u, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	var list kubernetesServiceList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+
+	ret := []clouddriverConfig{}
+	for _, svc := range list.Items {
+		port, found := d.servicePort(svc)
+		if !found {
+			continue
+		}
+		annotations := svc.Metadata.Annotations
+		scheme := annotations[kubernetesAnnotationPrefix+"scheme"]
+		if scheme == "" {
+			scheme = d.conf.Scheme
+		}
+		host := svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc"
+		u := scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+		ret = append(ret, clouddriverFromMetadata(svc.Metadata.Name, u, annotations, kubernetesAnnotationPrefix))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+// servicePort picks the port named by the service's port annotation,
+// or the configured port name, or the only port if there is just one.
+func (d *kubernetesDiscoverer) servicePort(svc kubernetesService) (int, bool) {
+	name := d.conf.PortName
+	if annotated := svc.Metadata.Annotations[kubernetesAnnotationPrefix+"port"]; annotated != "" {
+		if port, err := strconv.Atoi(annotated); err == nil {
+			return port, true
+		}
+		name = annotated
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Name == name {
+			return p.Port, true
+		}
+	}
+	if len(svc.Spec.Ports) == 1 {
+		return svc.Spec.Ports[0].Port, true
+	}
+	return 0, false
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testServiceList = `{"items": [
+  {"metadata": {"name": "cd-b", "namespace": "spin", "annotations": {
+     "stormdriver.opsmx.io/priority": "5",
+     "stormdriver.opsmx.io/disableArtifactAccounts": "true",
+     "stormdriver.opsmx.io/scheme": "https"}},
+   "spec": {"ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 7002}]}},
+  {"metadata": {"name": "cd-a", "namespace": "spin"},
+   "spec": {"ports": [{"name": "web", "port": 8080}]}},
+  {"metadata": {"name": "no-port", "namespace": "spin"},
+   "spec": {"ports": [{"name": "a", "port": 1}, {"name": "b", "port": 2}]}}
+]}`
+
+func Test_kubernetesDiscoverer_discover(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("sekrit\n"), 0600))
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/namespaces/spin/services", r.URL.Path)
+		assert.Equal(t, "app=clouddriver", r.URL.Query().Get("labelSelector"))
+		assert.Equal(t, "Bearer sekrit", r.Header.Get("authorization"))
+		_, _ = w.Write([]byte(testServiceList))
+	}))
+	defer api.Close()
+
+	c := kubernetesDiscoveryConfig{Namespace: "spin", LabelSelector: "app=clouddriver", APIServer: api.URL, TokenPath: tokenPath, CAPath: "/nonexistent"}
+	c.applyDefaults()
+	d, err := makeKubernetesDiscoverer(c)
+	require.NoError(t, err)
+
+	got, err := d.discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []clouddriverConfig{
+		{Name: "cd-a", URL: "http://cd-a.spin.svc:8080"},
+		{Name: "cd-b", URL: "https://cd-b.spin.svc:7002", Priority: 5, DisableArtifactAccounts: true},
+	}, got)
+}
+
+func Test_kubernetesDiscoverer_servicePort(t *testing.T) {
+	svc := func(annotation string, names ...string) kubernetesService {
+		s := kubernetesService{}
+		if annotation != "" {
+			s.Metadata.Annotations = map[string]string{"stormdriver.opsmx.io/port": annotation}
+		}
+		for i, name := range names {
+			s.Spec.Ports = append(s.Spec.Ports, struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			}{name, 1000 + i})
+		}
+		return s
+	}
+	d := &kubernetesDiscoverer{conf: kubernetesDiscoveryConfig{PortName: "http"}}
+	tests := []struct {
+		name      string
+		svc       kubernetesService
+		want      int
+		wantFound bool
+	}{
+		{"named port", svc("", "grpc", "http"), 1001, true},
+		{"only port", svc("", "web"), 1000, true},
+		{"ambiguous", svc("", "a", "b"), 0, false},
+		{"annotated name", svc("b", "a", "b", "http"), 1001, true},
+		{"annotated number", svc("7002", "a", "b"), 7002, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := d.servicePort(tt.svc)
+			assert.Equal(t, tt.wantFound, found)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_kubernetesDiscoverer_discover_error(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("services is forbidden"))
+	}))
+	defer api.Close()
+	c := kubernetesDiscoveryConfig{Namespace: "spin", LabelSelector: "app=clouddriver", APIServer: api.URL}
+	c.applyDefaults()
+	d, err := makeKubernetesDiscoverer(c)
+	require.NoError(t, err)
+	_, err = d.discover(context.Background())
+	assert.EqualError(t, err, "GET /api/v1/namespaces/spin/services: status 403: services is forbidden")
+}
+
+type fakeDiscoverer struct {
+	clouddrivers []clouddriverConfig
+	err          error
+}
+
+func (f *fakeDiscoverer) discover(ctx context.Context) ([]clouddriverConfig, error) {
+	return f.clouddrivers, f.err
+}
+
+func Test_pollDiscovery(t *testing.T) {
+	m := &ClouddriverManager{state: map[string]*trackedClouddriver{
+		"config:static": {Name: "static", Source: configSource},
+	}}
+	d := &fakeDiscoverer{clouddrivers: []clouddriverConfig{{Name: "cd-a", URL: "http://cd-a:7002"}}}
+	pollDiscovery(context.Background(), m, kubernetesSource, d)
+	require.Contains(t, m.state, "kubernetes:cd-a")
+	assert.Equal(t, "http://cd-a:7002/health", m.state["kubernetes:cd-a"].healthcheckURL)
+
+	// a failed poll keeps what was found before.
+	d.clouddrivers, d.err = nil, errors.New("boom")
+	pollDiscovery(context.Background(), m, kubernetesSource, d)
+	assert.Contains(t, m.state, "kubernetes:cd-a")
+
+	d.clouddrivers, d.err = []clouddriverConfig{}, nil
+	pollDiscovery(context.Background(), m, kubernetesSource, d)
+	assert.NotContains(t, m.state, "kubernetes:cd-a")
+	assert.Contains(t, m.state, "config:static")
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// listKeySeparator joins the fields of a composite list key, as in
+// "account,region,name".
+const listKeySeparator = ","
+
+// listKeysConfig sets the fields used to drop duplicates when merging
+// the lists returned for a route template, replacing the route's
+// built-in key.  Items are duplicates when every field matches.  An
+// empty list of fields keeps every item.
+type listKeysConfig map[string][]string
+
+func (c listKeysConfig) validate() error {
+	for route, fields := range c {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("route %q must start with /", route)
+		}
+		for _, field := range fields {
+			if field == "" || strings.Contains(field, listKeySeparator) {
+				return fmt.Errorf("route %q: invalid field %q", route, field)
+			}
+		}
+	}
+	return nil
+}
+
+var listKeys listKeysConfig
+
+// keyFor returns the key to merge the lists for route by, which is key
+// unless the route is configured.
+func (c listKeysConfig) keyFor(route string, key string) string {
+	if fields, found := c[route]; found {
+		return strings.Join(fields, listKeySeparator)
+	}
+	return key
+}
+
+// getListKey returns the item's value for key, which may name several
+// fields separated by commas.  A single field must be a string, or ""
+// is returned.  In a composite key, a missing field is an empty part,
+// and one which is not a string is JSON encoded, so only items which
+// are not objects return "".
+func getListKey(item interface{}, key string) string {
+	if !strings.Contains(key, listKeySeparator) {
+		return getKeyValue(item, key)
+	}
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	fields := strings.Split(key, listKeySeparator)
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i] = listKeyPart(m[field])
+	}
+	// NUL cannot appear in the field values Clouddriver returns, so
+	// ("a b", "c") and ("a", "b c") stay distinct.
+	return strings.Join(values, "\x00")
+}
+
+func listKeyPart(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_listKeysConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       listKeysConfig
+		wantErr bool
+	}{
+		{"empty", listKeysConfig{}, false},
+		{"composite", listKeysConfig{"/vpcs": {"account", "region", "name"}}, false},
+		{"no fields keeps everything", listKeysConfig{"/vpcs": {}}, false},
+		{"route without slash", listKeysConfig{"vpcs": {"name"}}, true},
+		{"empty field", listKeysConfig{"/vpcs": {"name", ""}}, true},
+		{"field with a comma", listKeysConfig{"/vpcs": {"name,type"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_listKeysConfig_keyFor(t *testing.T) {
+	c := listKeysConfig{
+		"/vpcs":     {"account", "region", "name"},
+		"/keyPairs": {},
+	}
+	assert.Equal(t, "account,region,name", c.keyFor("/vpcs", ""))
+	assert.Equal(t, "", c.keyFor("/keyPairs", "keyName"))
+	assert.Equal(t, "name", c.keyFor("/credentials", "name"))
+}
+
+func Test_getListKey(t *testing.T) {
+	item := map[string]interface{}{"account": "a", "region": "r", "name": "n", "count": 3}
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"single field", "name", "n"},
+		{"composite", "account,region,name", "a\x00r\x00n"},
+		{"missing field", "account,zone", "a\x00"},
+		{"non-string field", "name,count", "n\x003"},
+		{"every field missing", "zone,cluster", "\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, getListKey(item, tt.key))
+		})
+	}
+}
+
+func Test_combineUniqueLists_compositeKey(t *testing.T) {
+	vpc := func(account string, region string, name string) map[string]interface{} {
+		return map[string]interface{}{"account": account, "region": region, "name": name}
+	}
+	regionless := map[string]interface{}{"account": "a", "name": "default"}
+	c := make(chan listFetchResult, 2)
+	c <- listFetchResult{data: []interface{}{vpc("a", "us-east-1", "default"), vpc("a", "us-west-2", "default"), regionless}}
+	c <- listFetchResult{data: []interface{}{vpc("a", "us-east-1", "default"), vpc("b", "us-east-1", "default"), regionless}}
+	ret := combineUniqueLists(c, 2, "account,region,name", nil)
+	assert.Equal(t, []interface{}{
+		vpc("a", "us-east-1", "default"),
+		vpc("a", "us-west-2", "default"),
+		regionless,
+		vpc("b", "us-east-1", "default"),
+	}, ret, "items missing a field are kept, once")
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// listSortingConfig makes the order of merged lists independent of
+// which clouddriver answered first.  With Enabled, every merged list is
+// sorted by its dedupe key, if it has one, or else by each item's JSON
+// encoding.  Fields chooses the field to sort by for particular route
+// templates, such as "/applications", and sorts those lists even if
+// Enabled is not set.
+type listSortingConfig struct {
+	Enabled bool              `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	Fields  map[string]string `yaml:"fields,omitempty" json:"fields,omitempty"`
+}
+
+func (c listSortingConfig) validate() error {
+	for route, field := range c.Fields {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("fields: route %q must start with /", route)
+		}
+		if field == "" {
+			return fmt.Errorf("fields: route %q has no field", route)
+		}
+	}
+	return nil
+}
+
+var listSorting listSortingConfig
+
+// sortField returns the field to sort the merged list for route by,
+// and whether it should be sorted at all.
+func (c listSortingConfig) sortField(route string, key string) (string, bool) {
+	if field, found := c.Fields[route]; found {
+		return field, true
+	}
+	return key, c.Enabled
+}
+
+// sortMerged sorts a merged list in place, if configured for route.
+// Items are ordered by the sort field, then by their JSON encoding, so
+// the order is the same whichever clouddriver answered first.
+func (c listSortingConfig) sortMerged(route string, key string, items []interface{}) {
+	field, enabled := c.sortField(route, key)
+	if !enabled {
+		return
+	}
+	type sortable struct {
+		primary   string
+		secondary string
+		item      interface{}
+	}
+	sorted := make([]sortable, len(items))
+	for i, item := range items {
+		encoded, _ := json.Marshal(item)
+		sorted[i] = sortable{secondary: string(encoded), item: item}
+		if field != "" {
+			sorted[i].primary = getListKey(item, field)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].primary != sorted[j].primary {
+			return sorted[i].primary < sorted[j].primary
+		}
+		return sorted[i].secondary < sorted[j].secondary
+	})
+	for i := range sorted {
+		items[i] = sorted[i].item
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_listSortingConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       listSortingConfig
+		wantErr bool
+	}{
+		{"empty", listSortingConfig{}, false},
+		{"enabled", listSortingConfig{Enabled: true}, false},
+		{"field", listSortingConfig{Fields: map[string]string{"/applications": "name"}}, false},
+		{"route without slash", listSortingConfig{Fields: map[string]string{"applications": "name"}}, true},
+		{"empty field", listSortingConfig{Fields: map[string]string{"/applications": ""}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_listSortingConfig_sortMerged(t *testing.T) {
+	item := func(name string, owner string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "owner": owner}
+	}
+	tests := []struct {
+		name  string
+		c     listSortingConfig
+		route string
+		key   string
+		items []interface{}
+		want  []interface{}
+	}{
+		{
+			"disabled leaves the order alone",
+			listSortingConfig{},
+			"/applications",
+			"name",
+			[]interface{}{item("b", "x"), item("a", "y")},
+			[]interface{}{item("b", "x"), item("a", "y")},
+		},
+		{
+			"enabled sorts by the dedupe key",
+			listSortingConfig{Enabled: true},
+			"/applications",
+			"name",
+			[]interface{}{item("b", "x"), item("c", "z"), item("a", "y")},
+			[]interface{}{item("a", "y"), item("b", "x"), item("c", "z")},
+		},
+		{
+			"configured field wins over the dedupe key",
+			listSortingConfig{Fields: map[string]string{"/applications": "owner"}},
+			"/applications",
+			"name",
+			[]interface{}{item("a", "z"), item("b", "x"), item("c", "y")},
+			[]interface{}{item("b", "x"), item("c", "y"), item("a", "z")},
+		},
+		{
+			"configured field only applies to its route",
+			listSortingConfig{Fields: map[string]string{"/applications": "owner"}},
+			"/vpcs",
+			"",
+			[]interface{}{item("b", "x"), item("a", "y")},
+			[]interface{}{item("b", "x"), item("a", "y")},
+		},
+		{
+			"ties and missing keys are ordered by content",
+			listSortingConfig{Enabled: true},
+			"/vpcs",
+			"",
+			[]interface{}{item("b", "x"), item("a", "y"), "plain"},
+			[]interface{}{"plain", item("a", "y"), item("b", "x")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.sortMerged(tt.route, tt.key, tt.items)
+			assert.Equal(t, tt.want, tt.items)
+		})
+	}
+}
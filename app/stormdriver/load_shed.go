@@ -0,0 +1,292 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLoadSheddingCheckIntervalSeconds = 5
+	defaultLoadSheddingMaxCachedResponses   = 1000
+	defaultLoadSheddingCacheTTLSeconds      = 600
+)
+
+// defaultExpensiveRoutes are the fan-out routes which return the most
+// data, and are rejected first under pressure.
+var defaultExpensiveRoutes = []string{
+	"/applications/{name}/clusters",
+	"/applications/{name}/loadBalancers",
+	"/applications/{name}/serverGroups",
+	"/securityGroups",
+	"/firewalls",
+}
+
+// loadSheddingConfig sets the resource thresholds past which Stormdriver
+// degrades: cached credentials are served, optional clouddrivers are
+// left out of fan-out requests, and the ExpensiveRoutes are rejected.
+// At most MaxCachedResponses are kept, each for CacheTTLSeconds.
+// If neither MaxHeapMB nor MaxGoroutines is set, load shedding is disabled.
+type loadSheddingConfig struct {
+	MaxHeapMB            int      `yaml:"maxHeapMB,omitempty" json:"maxHeapMB,omitempty"`
+	MaxGoroutines        int      `yaml:"maxGoroutines,omitempty" json:"maxGoroutines,omitempty"`
+	CheckIntervalSeconds int      `yaml:"checkIntervalSeconds,omitempty" json:"checkIntervalSeconds,omitempty"`
+	ExpensiveRoutes      []string `yaml:"expensiveRoutes,omitempty" json:"expensiveRoutes,omitempty"`
+	MaxCachedResponses   int      `yaml:"maxCachedResponses,omitempty" json:"maxCachedResponses,omitempty"`
+	CacheTTLSeconds      int      `yaml:"cacheTTLSeconds,omitempty" json:"cacheTTLSeconds,omitempty"`
+}
+
+func (c *loadSheddingConfig) enabled() bool {
+	return c.MaxHeapMB > 0 || c.MaxGoroutines > 0
+}
+
+func (c *loadSheddingConfig) applyDefaults() {
+	if !c.enabled() {
+		return
+	}
+	if c.CheckIntervalSeconds == 0 {
+		c.CheckIntervalSeconds = defaultLoadSheddingCheckIntervalSeconds
+	}
+	if c.ExpensiveRoutes == nil {
+		c.ExpensiveRoutes = defaultExpensiveRoutes
+	}
+	if c.MaxCachedResponses == 0 {
+		c.MaxCachedResponses = defaultLoadSheddingMaxCachedResponses
+	}
+	if c.CacheTTLSeconds == 0 {
+		c.CacheTTLSeconds = defaultLoadSheddingCacheTTLSeconds
+	}
+}
+
+var loadSheddingActive = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+	Namespace: "stormdriver",
+	Name:      "load_shedding_active",
+	Help:      "1 if resource thresholds have been exceeded and requests are being degraded.",
+})
+
+type cachedResponse struct {
+	contentType string
+	body        []byte
+	stored      time.Time
+}
+
+// loadShedder tracks whether resource usage is past the configured
+// thresholds.  A nil loadShedder is never active.
+type loadShedder struct {
+	sync.Mutex
+	conf      loadSheddingConfig
+	expensive map[string]bool
+	state     int32
+	cache     map[string]cachedResponse
+	now       func() time.Time
+}
+
+var shedder *loadShedder
+
+func makeLoadShedder(conf loadSheddingConfig) *loadShedder {
+	l := &loadShedder{
+		conf:      conf,
+		expensive: map[string]bool{},
+		cache:     map[string]cachedResponse{},
+		now:       time.Now,
+	}
+	for _, route := range conf.ExpensiveRoutes {
+		l.expensive[route] = true
+	}
+	return l
+}
+
+func (l *loadShedder) active() bool {
+	return l != nil && atomic.LoadInt32(&l.state) == 1
+}
+
+// update sets the shedding state from the current resource usage.
+// Once active, usage must fall below 90% of the thresholds to recover.
+func (l *loadShedder) update(heapBytes uint64, goroutines int) {
+	over := func(limit float64) bool {
+		heapOver := l.conf.MaxHeapMB > 0 && float64(heapBytes) > limit*float64(l.conf.MaxHeapMB)*1024*1024
+		goroutinesOver := l.conf.MaxGoroutines > 0 && float64(goroutines) > limit*float64(l.conf.MaxGoroutines)
+		return heapOver || goroutinesOver
+	}
+	wasActive := l.active()
+	nowActive := over(1.0) || (wasActive && over(0.9))
+	if nowActive == wasActive {
+		return
+	}
+	if nowActive {
+		atomic.StoreInt32(&l.state, 1)
+		loadSheddingActive.Set(1)
+		zap.S().Warnw("resource thresholds exceeded, shedding load", "heapMB", heapBytes/1024/1024, "goroutines", goroutines)
+	} else {
+		atomic.StoreInt32(&l.state, 0)
+		loadSheddingActive.Set(0)
+		zap.S().Infow("resource usage recovered, no longer shedding load", "heapMB", heapBytes/1024/1024, "goroutines", goroutines)
+	}
+}
+
+// monitor samples resource usage until ctx is done.
+func (l *loadShedder) monitor(ctx context.Context) {
+	t := time.NewTicker(time.Duration(l.conf.CheckIntervalSeconds) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			l.update(stats.HeapInuse, runtime.NumGoroutine())
+		}
+	}
+}
+
+// middleware rejects expensive routes while shedding load.
+func (l *loadShedder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l.active() && l.expensive[routeTemplate(req)] {
+			requestLogger(req.Context()).Warnw("request rejected while shedding load", "method", req.Method, "uri", req.RequestURI)
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// responseCapture records a copy of the response written by a handler.
+type responseCapture struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseCapture) WriteHeader(code int) {
+	if r.statusCode == 0 {
+		r.statusCode = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseCapture) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// responseCacheKey identifies a response by the request path and query
+// and the x-spinnaker-* headers naming the user, roles, and accounts,
+// so one caller is never served another's cached response.  The request
+// id differs on every request and is left out.
+func responseCacheKey(req *http.Request) string {
+	parts := []string{req.URL.Path, req.URL.RawQuery}
+	headers := spinnakerHeaders(req.Header)
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		if strings.EqualFold(k, "x-spinnaker-request-id") {
+			continue
+		}
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		parts = append(parts, k+"="+strings.Join(req.Header.Values(k), ","))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// cacheUnderPressure remembers the last successful response for each
+// request path, query, and caller, and serves it instead of calling next
+// while shedding load.
+func (l *loadShedder) cacheUnderPressure(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if l == nil {
+			next(w, req)
+			return
+		}
+		key := responseCacheKey(req)
+		if l.active() {
+			cached, found := l.cached(key)
+			if found {
+				w.Header().Set("content-type", cached.contentType)
+				w.Header().Set("x-stormdriver-degraded", "cached")
+				w.WriteHeader(http.StatusOK)
+				httputil.CheckedWrite(w, cached.body)
+				return
+			}
+		}
+		rec := &responseCapture{ResponseWriter: w}
+		next(rec, req)
+		if rec.statusCode == http.StatusOK {
+			l.store(key, cachedResponse{contentType: w.Header().Get("content-type"), body: rec.body.Bytes()})
+		}
+	}
+}
+
+func (l *loadShedder) cacheTTL() time.Duration {
+	return time.Duration(l.conf.CacheTTLSeconds) * time.Second
+}
+
+func (l *loadShedder) cached(key string) (cachedResponse, bool) {
+	l.Lock()
+	defer l.Unlock()
+	cached, found := l.cache[key]
+	if !found || l.now().Sub(cached.stored) >= l.cacheTTL() {
+		return cachedResponse{}, false
+	}
+	return cached, true
+}
+
+// store keeps a response.  When the cache is full, expired entries are
+// dropped, and if it is still full, the oldest entry is.
+func (l *loadShedder) store(key string, response cachedResponse) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	response.stored = now
+	if _, found := l.cache[key]; !found && len(l.cache) >= l.conf.MaxCachedResponses {
+		oldestKey := ""
+		var oldest time.Time
+		for k, e := range l.cache {
+			if now.Sub(e.stored) >= l.cacheTTL() {
+				delete(l.cache, k)
+				continue
+			}
+			if oldestKey == "" || e.stored.Before(oldest) {
+				oldestKey, oldest = k, e.stored
+			}
+		}
+		if len(l.cache) >= l.conf.MaxCachedResponses {
+			delete(l.cache, oldestKey)
+		}
+	}
+	l.cache[key] = response
+}
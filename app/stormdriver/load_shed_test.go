@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadShedder_update(t *testing.T) {
+	l := makeLoadShedder(loadSheddingConfig{MaxHeapMB: 100, MaxGoroutines: 1000})
+	const mb = 1024 * 1024
+
+	l.update(50*mb, 100)
+	assert.False(t, l.active())
+	l.update(101*mb, 100)
+	assert.True(t, l.active(), "heap over limit")
+	l.update(95*mb, 100)
+	assert.True(t, l.active(), "still above 90% of the limit")
+	l.update(80*mb, 100)
+	assert.False(t, l.active())
+	l.update(10*mb, 1001)
+	assert.True(t, l.active(), "goroutines over limit")
+
+	var nilShedder *loadShedder
+	assert.False(t, nilShedder.active())
+}
+
+func Test_loadShedder_cacheUnderPressure(t *testing.T) {
+	conf := loadSheddingConfig{MaxGoroutines: 10}
+	conf.applyDefaults()
+	l := makeLoadShedder(conf)
+	calls := 0
+	handler := l.cacheUnderPressure(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`["fresh"]`))
+	})
+	get := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/credentials", nil)
+		req.Header.Set("x-spinnaker-user", user)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	get("alice")
+	assert.Equal(t, 1, calls)
+
+	l.update(0, 11)
+	w := get("alice")
+	assert.Equal(t, 1, calls, "served from cache")
+	assert.Equal(t, `["fresh"]`, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("content-type"))
+	assert.Equal(t, "cached", w.Header().Get("x-stormdriver-degraded"))
+
+	get("bob")
+	assert.Equal(t, 2, calls, "nothing cached for another user")
+}
+
+func Test_responseCacheKey(t *testing.T) {
+	key := func(headers map[string]string) string {
+		req := httptest.NewRequest(http.MethodGet, "/credentials?expand=true", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return responseCacheKey(req)
+	}
+	base := key(map[string]string{"x-spinnaker-user": "alice", "x-spinnaker-accounts": "dev"})
+	assert.Equal(t, base, key(map[string]string{"X-Spinnaker-Accounts": "dev", "X-Spinnaker-User": "alice", "X-Spinnaker-Request-Id": "1"}))
+	assert.NotEqual(t, base, key(map[string]string{"x-spinnaker-user": "alice", "x-spinnaker-accounts": "dev,prod"}))
+	assert.NotEqual(t, base, key(map[string]string{"x-spinnaker-user": "alice"}))
+	assert.NotEqual(t, base, key(map[string]string{"x-spinnaker-user": "alice", "x-spinnaker-accounts": "dev", "x-spinnaker-roles": "admin"}))
+}
+
+func Test_loadShedder_cacheBounded(t *testing.T) {
+	l := makeLoadShedder(loadSheddingConfig{MaxGoroutines: 10, MaxCachedResponses: 2, CacheTTLSeconds: 60})
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	l.store("a", cachedResponse{body: []byte("a")})
+	now = now.Add(time.Second)
+	l.store("b", cachedResponse{body: []byte("b")})
+	now = now.Add(time.Second)
+	l.store("c", cachedResponse{body: []byte("c")})
+	assert.Len(t, l.cache, 2)
+	_, found := l.cached("a")
+	assert.False(t, found, "oldest entry evicted")
+
+	now = now.Add(time.Minute)
+	_, found = l.cached("c")
+	assert.False(t, found, "expired")
+}
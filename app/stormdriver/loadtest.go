@@ -0,0 +1,319 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/OpsMx/go-app-base/tracer"
+	"github.com/OpsMx/go-app-base/version"
+)
+
+const (
+	loadtestCredentials = "credentials"
+	loadtestList        = "list"
+	loadtestOp          = "op"
+)
+
+// loadtestOptions describe the mix of requests to send, and where.  If
+// target is empty, the requests are sent to an embedded Stormdriver
+// using the clouddrivers in configFile.
+type loadtestOptions struct {
+	target      string
+	configFile  string
+	user        string
+	duration    time.Duration
+	concurrency int
+	weights     map[string]int
+	listPaths   []string
+	opPath      string
+	opBody      []byte
+}
+
+// loadtestRequest is one request in the mix.
+type loadtestRequest struct {
+	kind   string
+	method string
+	path   string
+	body   []byte
+}
+
+// loadtestResult is the outcome of one request.
+type loadtestResult struct {
+	kind    string
+	elapsed time.Duration
+	failed  bool
+}
+
+// loadtestSummary is the latency distribution for one kind of request.
+type loadtestSummary struct {
+	kind     string
+	requests int
+	failures int
+	p50      time.Duration
+	p90      time.Duration
+	p99      time.Duration
+	max      time.Duration
+}
+
+// runLoadtest implements the "loadtest" subcommand, returning the exit code.
+func runLoadtest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	target := fs.String("target", "", "base URL of a running Stormdriver; if empty, an embedded one is started from -configFile")
+	configFile := fs.String("configFile", "/app/config/stormdriver.yaml", "configuration for the embedded Stormdriver")
+	user := fs.String("user", "loadtest", "x-spinnaker-user to send")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send requests")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent clients")
+	credentialsWeight := fs.Int("credentials", 5, "relative weight of /credentials polls")
+	listWeight := fs.Int("lists", 4, "relative weight of list fan-outs")
+	opWeight := fs.Int("ops", 0, "relative weight of operation posts; requires -opBody")
+	listPaths := fs.String("listPaths", "/applications", "comma separated paths to use for list fan-outs")
+	opPath := fs.String("opPath", "/kubernetes/ops", "path to post operations to")
+	opBodyFile := fs.String("opBody", "", "file holding the operation to post; it will really be run")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := loadtestOptions{
+		target:      strings.TrimSuffix(*target, "/"),
+		configFile:  *configFile,
+		user:        *user,
+		duration:    *duration,
+		concurrency: *concurrency,
+		weights: map[string]int{
+			loadtestCredentials: *credentialsWeight,
+			loadtestList:        *listWeight,
+			loadtestOp:          *opWeight,
+		},
+		listPaths: strings.Split(*listPaths, ","),
+		opPath:    *opPath,
+	}
+	if *opWeight > 0 {
+		if *opBodyFile == "" {
+			fmt.Fprintln(os.Stderr, "loadtest: -ops requires -opBody")
+			return 2
+		}
+		body, err := os.ReadFile(*opBodyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+			return 1
+		}
+		opts.opBody = body
+	}
+	if opts.concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "loadtest: -concurrency must be at least 1")
+		return 2
+	}
+
+	if opts.target == "" {
+		target, err := startEmbeddedStormdriver(opts.configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+			return 1
+		}
+		opts.target = target
+	}
+
+	mix := opts.requestMix()
+	if len(mix) == 0 {
+		fmt.Fprintln(os.Stderr, "loadtest: no requests to send")
+		return 2
+	}
+
+	fmt.Printf("sending requests to %s for %s with %d clients\n", opts.target, opts.duration, opts.concurrency)
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: opts.concurrency},
+	}
+	results := runLoad(context.Background(), client, opts, mix)
+	printLoadtestSummaries(os.Stdout, summarizeLoadtest(results))
+	return 0
+}
+
+// requestMix expands the weights into a list to pick from at random.
+func (o loadtestOptions) requestMix() []loadtestRequest {
+	ret := []loadtestRequest{}
+	for i := 0; i < o.weights[loadtestCredentials]; i++ {
+		ret = append(ret, loadtestRequest{kind: loadtestCredentials, method: http.MethodGet, path: "/credentials"})
+	}
+	for i := 0; i < o.weights[loadtestList]; i++ {
+		for _, path := range o.listPaths {
+			ret = append(ret, loadtestRequest{kind: loadtestList, method: http.MethodGet, path: path})
+		}
+	}
+	for i := 0; i < o.weights[loadtestOp]; i++ {
+		ret = append(ret, loadtestRequest{kind: loadtestOp, method: http.MethodPost, path: o.opPath, body: o.opBody})
+	}
+	return ret
+}
+
+// runLoad sends requests from the mix until the duration passes.
+func runLoad(ctx context.Context, client *http.Client, opts loadtestOptions, mix []loadtestRequest) []loadtestResult {
+	ctx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+
+	var lock sync.Mutex
+	results := []loadtestResult{}
+	var wg sync.WaitGroup
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for ctx.Err() == nil {
+				result := sendLoadtestRequest(ctx, client, opts, mix[r.Intn(len(mix))])
+				if ctx.Err() != nil {
+					// cut short by the deadline; not a real result.
+					return
+				}
+				lock.Lock()
+				results = append(results, result)
+				lock.Unlock()
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	return results
+}
+
+func sendLoadtestRequest(ctx context.Context, client *http.Client, opts loadtestOptions, lr loadtestRequest) loadtestResult {
+	start := time.Now()
+	result := loadtestResult{kind: lr.kind}
+	req, err := http.NewRequestWithContext(ctx, lr.method, opts.target+lr.path, bytes.NewReader(lr.body))
+	if err != nil {
+		result.failed = true
+		return result
+	}
+	req.Header.Set("x-spinnaker-user", opts.user)
+	if lr.body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.failed = true
+		result.elapsed = time.Since(start)
+		return result
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result.elapsed = time.Since(start)
+	result.failed = !httputil.StatusCodeOK(resp.StatusCode)
+	return result
+}
+
+// percentile returns the p'th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func summarizeLoadtest(results []loadtestResult) []loadtestSummary {
+	byKind := map[string][]time.Duration{}
+	failures := map[string]int{}
+	for _, r := range results {
+		byKind[r.kind] = append(byKind[r.kind], r.elapsed)
+		if r.failed {
+			failures[r.kind]++
+		}
+	}
+	ret := []loadtestSummary{}
+	for _, kind := range []string{loadtestCredentials, loadtestList, loadtestOp} {
+		durations, found := byKind[kind]
+		if !found {
+			continue
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		ret = append(ret, loadtestSummary{
+			kind:     kind,
+			requests: len(durations),
+			failures: failures[kind],
+			p50:      percentile(durations, 0.50),
+			p90:      percentile(durations, 0.90),
+			p99:      percentile(durations, 0.99),
+			max:      durations[len(durations)-1],
+		})
+	}
+	return ret
+}
+
+func printLoadtestSummaries(w io.Writer, summaries []loadtestSummary) {
+	fmt.Fprintf(w, "%-12s %9s %9s %10s %10s %10s %10s\n", "kind", "requests", "failures", "p50", "p90", "p99", "max")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%-12s %9d %9d %10s %10s %10s %10s\n", s.kind, s.requests, s.failures,
+			s.p50.Round(time.Microsecond), s.p90.Round(time.Microsecond),
+			s.p99.Round(time.Microsecond), s.max.Round(time.Microsecond))
+	}
+}
+
+// startEmbeddedStormdriver serves the Clouddriver API on a loopback port,
+// routing to the statically configured clouddrivers, and returns its
+// base URL once the first account sync has finished.  The controller,
+// if configured, is not used.
+func startEmbeddedStormdriver(configFile string) (string, error) {
+	buf, err := os.ReadFile(configFile)
+	if err != nil {
+		return "", err
+	}
+	if conf, err = loadConfiguration(buf); err != nil {
+		return "", err
+	}
+	if len(conf.Clouddrivers) == 0 {
+		return "", fmt.Errorf("%s: no clouddrivers configured", configFile)
+	}
+	if tracerProvider, err = tracer.NewTracerProvider("", false, version.GitHash(), appName, 0); err != nil {
+		return "", err
+	}
+	applySettings(conf)
+	clouddriverManager = makeConfiguredClouddriverManager(conf)
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	clouddriverManager.updateAllAccounts(t)
+
+	s := makeSrv(conf)
+	go s.search.RunCache(context.Background())
+	r := s.makeRouter(conf, healthchecker)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		_ = http.Serve(l, r)
+	}()
+	return "http://" + l.Addr().String(), nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_percentile(t *testing.T) {
+	sorted := []time.Duration{}
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	var tests = []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0.50, 50 * time.Millisecond},
+		{0.90, 90 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1.00, 100 * time.Millisecond},
+		{0.00, 1 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, percentile(sorted, tt.p))
+	}
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
+
+func Test_loadtestOptions_requestMix(t *testing.T) {
+	opts := loadtestOptions{
+		weights:   map[string]int{loadtestCredentials: 2, loadtestList: 1, loadtestOp: 0},
+		listPaths: []string{"/applications", "/securityGroups"},
+	}
+	mix := opts.requestMix()
+	kinds := map[string]int{}
+	for _, r := range mix {
+		kinds[r.kind]++
+	}
+	assert.Equal(t, map[string]int{loadtestCredentials: 2, loadtestList: 2}, kinds)
+}
+
+func Test_runLoad(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "tester", r.Header.Get("x-spinnaker-user"))
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	opts := loadtestOptions{
+		target:      server.URL,
+		user:        "tester",
+		duration:    100 * time.Millisecond,
+		concurrency: 2,
+		weights:     map[string]int{loadtestCredentials: 1, loadtestOp: 1},
+		opPath:      "/kubernetes/ops",
+		opBody:      []byte(`[]`),
+	}
+	results := runLoad(context.Background(), server.Client(), opts, opts.requestMix())
+	summaries := summarizeLoadtest(results)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, loadtestCredentials, summaries[0].kind)
+	assert.Equal(t, 0, summaries[0].failures)
+	assert.Equal(t, loadtestOp, summaries[1].kind)
+	assert.Equal(t, summaries[1].requests, summaries[1].failures)
+}
@@ -28,6 +28,7 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/OpsMx/go-app-base/birger"
 	"github.com/OpsMx/go-app-base/httputil"
@@ -50,21 +51,34 @@ var (
 	traceToStdout  = flag.Bool("traceToStdout", false, "log traces to stdout")
 	traceRatio     = flag.Float64("traceRatio", 0.01, "ratio of traces to create, if incoming request is not traced")
 	showversion    = flag.Bool("version", false, "show the version and exit")
+	preflight      = flag.Bool("preflight", false, "sync credentials once, print the routing table, and exit non-zero on failure")
+	preflightWait  = flag.Duration("preflightWait", 10*time.Second, "with -preflight, how long to wait for clouddrivers from the controller")
+	enablePprof    = flag.Bool("pprof", false, "serve net/http/pprof on the admin listener, as admin.pprof does")
+	validateOnly   = flag.Bool("validate", false, "load and check the configuration file, print any problems, and exit non-zero if there are any")
+	validateLive   = flag.Bool("validateLive", false, "with -validate, also check that referenced files exist and clouddrivers accept connections")
 
 	conf               *configuration
 	healthchecker      = health.MakeHealth()
 	tracerProvider     *tracer.TracerProvider
 	clouddriverManager *ClouddriverManager
+	controller         *controllerSession
 	logger             *zap.Logger
 	sl                 *zap.SugaredLogger
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(runLoadtest(os.Args[2:]))
+	}
+
 	log.Printf("%s", version.VersionString())
 	flag.Parse()
 	if *showversion {
 		os.Exit(0)
 	}
+	if *validateOnly {
+		os.Exit(runValidate(os.Stdout, *configFile, *validateLive))
+	}
 
 	var err error
 	if logger, err = zap.NewProduction(); err != nil {
@@ -98,47 +112,154 @@ func main() {
 
 	tracerProvider, err = tracer.NewTracerProvider(*jaegerEndpoint, *traceToStdout, version.GitHash(), appName, *traceRatio)
 	util.Check(err)
-	defer tracerProvider.Shutdown(ctx)
+	defer tracerProvider.Shutdown(context.Background())
 
 	conf = loadConfigurationFile(*configFile)
+	setRunningConfig(conf)
 
-	if len(conf.Clouddrivers) == 0 && conf.Controller.URL == "" {
-		sl.Errorf("no clouddrivers defined in config, and controller not configured")
+	// Secrets from Vault must be in place before anything reads them.
+	vault, err := makeVaultSync(conf.Vault)
+	util.Check(err)
+	if vault != nil {
+		if err := vault.sync(ctx); err != nil {
+			sl.Fatalw("unable to read secrets from vault", "error", err)
+		}
+		go vault.run(ctx)
+	}
+	if err := checkTokenFiles(conf.Clouddrivers); err != nil {
+		sl.Fatalw("unable to read token file", "error", err)
 	}
+	util.Check(addTraceExporters(ctx, tracerProvider.Provider, conf.Tracing))
 
-	clouddriverManager = MakeClouddriverManager(conf.Clouddrivers, conf.SpinnakerUser)
+	if len(conf.Clouddrivers) == 0 && conf.Controller.URL == "" && !conf.Discovery.enabled() {
+		sl.Errorf("no clouddrivers defined in config, and neither controller nor discovery configured")
+	}
+
+	http.DefaultClient = httputil.NewHTTPClient(nil)
+	applySettings(conf)
+	clouddriverManager = makeConfiguredClouddriverManager(conf)
 
-	var controllerManager *birger.ControllerManager
 	updateChan := make(chan birger.ServiceUpdate)
 	if conf.Controller.URL != "" {
-		controllerManager = birger.MakeControllerManager(conf.Controller, []string{"clouddriver"})
+		controller = makeControllerSession(conf.Controller, []string{"clouddriver"})
+		util.Check(controller.loadCA())
+		updateChan = controller.updates
 
-		caCert, err := controllerManager.GetCACertPEM()
-		util.Check(err)
-		cfg, err := makeTLSConfigWithCA(caCert)
-		util.Check(err)
-		httputil.SetTLSConfig(cfg)
-		updateChan = controllerManager.UpdateChan
+		healthchecker.AddCheck("controllerManager", false, controller)
+		go controller.watchCredentials(ctx, time.Duration(conf.ControllerCredentialCheckSeconds)*time.Second)
+		go controller.watchCA(ctx, time.Duration(conf.ControllerCARefreshSeconds)*time.Second)
+	}
 
-		healthchecker.AddCheck("controllerManager", false, controllerManager)
+	if *preflight {
+		os.Exit(runPreflight(ctx, conf.Discovery, updateChan, *preflightWait))
 	}
 
-	http.DefaultClient = httputil.NewHTTPClient(nil)
+	if conf.LoadShedding.enabled() {
+		shedder = makeLoadShedder(conf.LoadShedding)
+		go shedder.monitor(ctx)
+	}
+
+	if events = makeEventPublisher(conf.Events); events != nil {
+		go events.run(ctx)
+	}
+
+	audit, err = makeAuditLog(conf.Audit)
+	util.Check(err)
+	if audit != nil {
+		go audit.run()
+	}
+
+	tasks = makeTaskTracker(conf.TaskTracking)
+
+	if conf.Journal.Path != "" {
+		j, err := openJournal(conf.Journal)
+		if err != nil {
+			sl.Fatalw("unable to open journal", "path", conf.Journal.Path, "error", err)
+		}
+		journal = j
+		go journal.replayLoop(ctx)
+	}
+
+	owners, err := openTaskOwnerMap(conf.TaskOwners, conf.Cache)
+	if err != nil {
+		sl.Fatalw("unable to open task owners", "path", conf.TaskOwners.Path, "error", err)
+	}
+	taskOwners = owners
 
 	go clouddriverManager.accountTracker(updateChan)
+	if err := startDiscovery(ctx, conf.Discovery, clouddriverManager, conf.HTTPListenPort); err != nil {
+		sl.Fatalw("unable to start discovery", "error", err)
+	}
 
 	for _, cd := range conf.Clouddrivers {
-		healthchecker.AddCheck(cd.Name, true, healthchecker.HTTPChecker(cd.HealthcheckURL))
+		healthchecker.AddCheck(cd.Name, true, makeURLChecker(cd))
 	}
 
-	go healthchecker.RunCheckers(15)
+	go healthchecker.RunCheckers(healthcheckTickSeconds)
+
+	hupchan := make(chan os.Signal, 1)
+	signal.Notify(hupchan, syscall.SIGHUP)
+	go watchReloadSignal(ctx, hupchan, *configFile)
+
+	if conf.Admin.Pprof || *enablePprof {
+		go runAdminServer(ctx, conf.Admin)
+	}
 
-	go runHTTPServer(ctx, conf, healthchecker)
+	serverDone := make(chan struct{})
+	go func() {
+		runHTTPServer(ctx, conf, healthchecker)
+		close(serverDone)
+	}()
 
 	sig := <-sigchan
+	sl.Infow("shutting down", "signal", sig, "drainSeconds", conf.ShutdownDrainSeconds)
+	cancel()
+	<-serverDone
+	audit.close(auditDrainTimeout)
 	sl.Infow("clean exit", "signal", sig)
 }
 
+// applySettings configures the downstream clients, and sets the
+// package-level settings read while handling requests.  It is shared by
+// the server and the loadtest subcommand's embedded Stormdriver.
+func applySettings(conf *configuration) {
+	setHealthchecks(conf.Healthcheck)
+	downstreamClients.configure(conf.HTTPClientConfig, conf.Dialer, makeCachingResolver(conf.DNS))
+	downstreamClients.setRetry(conf.Retry)
+	downstreamClients.setConcurrency(conf.DownstreamConcurrency)
+	downstreamClients.setMaxResponseBytes(conf.MaxResponseBytes)
+	if conf.ResponseHeaders != nil {
+		responseHeaderPolicies = conf.ResponseHeaders
+	}
+	if conf.RequestHeaders != nil {
+		requestHeaderPolicy = *conf.RequestHeaders
+	}
+	fanOutDeadlines = conf.FanOut
+	hedging = conf.Hedging
+	failover = conf.Failover
+	featureFlags = conf.FeatureFlags
+	accountManagement = conf.AccountManagement
+	artifactFallback = conf.ArtifactFallback
+	listKeys = conf.ListKeys
+	listSorting = conf.ListSorting
+	compression = conf.Compression
+	aliases = makeAccountAliases(conf.AccountAliases)
+}
+
+// makeConfiguredClouddriverManager tracks the configured clouddrivers,
+// with the routing settings applied.
+func makeConfiguredClouddriverManager(conf *configuration) *ClouddriverManager {
+	m := MakeClouddriverManager(conf.Clouddrivers, conf.SpinnakerUser)
+	m.setAccountOverrides(conf.AccountOverrides)
+	m.setQuarantine(conf.Quarantine)
+	if conf.ControllerGraceSeconds != nil {
+		m.setControllerGrace(time.Duration(*conf.ControllerGraceSeconds) * time.Second)
+	}
+	rules, _ := compileRoutingRules(conf.RoutingRules) // checked by validate()
+	m.setRoutingRules(rules)
+	return m
+}
+
 func makeTLSConfigWithCA(caCert []byte) (*tls.Config, error) {
 	caCertPool, _ := x509.SystemCertPool()
 	if caCertPool == nil {
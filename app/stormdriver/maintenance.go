@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Embed the timezone database, as the container image does not have one.
+	_ "time/tzdata"
+)
+
+// maintenanceWindow is a recurring period during which a clouddriver is
+// excluded from routing and its health check always passes.  Start is
+// the local time of day the window opens, as HH:MM, in Timezone (default
+// UTC).  Days limits the window to the named days of the week, by the day
+// it opens; if empty, the window occurs every day.  Duration may be no
+// longer than a day.
+type maintenanceWindow struct {
+	Days     []string `yaml:"days,omitempty" json:"days,omitempty"`
+	Start    string   `yaml:"start,omitempty" json:"start,omitempty"`
+	Duration string   `yaml:"duration,omitempty" json:"duration,omitempty"`
+	Timezone string   `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+}
+
+type maintenanceSchedule struct {
+	days     map[time.Weekday]bool
+	hour     int
+	minute   int
+	duration time.Duration
+	location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseMaintenanceWindow(w maintenanceWindow) (maintenanceSchedule, error) {
+	ret := maintenanceSchedule{days: map[time.Weekday]bool{}, location: time.UTC}
+	for _, day := range w.Days {
+		key := strings.ToLower(day)
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		weekday, found := weekdays[key]
+		if !found {
+			return ret, fmt.Errorf("unknown day %q", day)
+		}
+		ret.days[weekday] = true
+	}
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return ret, fmt.Errorf("start must be HH:MM: %v", err)
+	}
+	ret.hour, ret.minute = start.Hour(), start.Minute()
+	ret.duration, err = time.ParseDuration(w.Duration)
+	if err != nil {
+		return ret, fmt.Errorf("duration: %v", err)
+	}
+	if ret.duration <= 0 || ret.duration > 24*time.Hour {
+		return ret, fmt.Errorf("duration must be positive and no more than 24h")
+	}
+	if w.Timezone != "" {
+		ret.location, err = time.LoadLocation(w.Timezone)
+		if err != nil {
+			return ret, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	return ret, nil
+}
+
+func parseMaintenanceWindows(windows []maintenanceWindow) ([]maintenanceSchedule, error) {
+	ret := []maintenanceSchedule{}
+	for idx, w := range windows {
+		s, err := parseMaintenanceWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %d: %v", idx+1, err)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// active returns true if now falls within a window which opened today
+// or yesterday, in the schedule's timezone.
+func (s maintenanceSchedule) active(now time.Time) bool {
+	local := now.In(s.location)
+	for _, daysAgo := range []int{0, 1} {
+		day := local.AddDate(0, 0, -daysAgo)
+		if len(s.days) > 0 && !s.days[day.Weekday()] {
+			continue
+		}
+		opens := time.Date(day.Year(), day.Month(), day.Day(), s.hour, s.minute, 0, 0, s.location)
+		if !local.Before(opens) && local.Before(opens.Add(s.duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+func inMaintenance(schedules []maintenanceSchedule, now time.Time) bool {
+	for _, s := range schedules {
+		if s.active(now) {
+			return true
+		}
+	}
+	return false
+}
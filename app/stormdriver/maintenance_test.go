@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_maintenanceSchedule_active(t *testing.T) {
+	nightly, err := parseMaintenanceWindow(maintenanceWindow{Start: "23:30", Duration: "1h"})
+	require.NoError(t, err)
+	weekends, err := parseMaintenanceWindow(maintenanceWindow{Days: []string{"Saturday", "sun"}, Start: "02:00", Duration: "2h", Timezone: "America/Los_Angeles"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		schedule maintenanceSchedule
+		now      string
+		want     bool
+	}{
+		{"before nightly", nightly, "2022-06-01T23:29:00Z", false},
+		{"start of nightly", nightly, "2022-06-01T23:30:00Z", true},
+		{"nightly after midnight", nightly, "2022-06-02T00:15:00Z", true},
+		{"end of nightly", nightly, "2022-06-02T00:30:00Z", false},
+		// 2022-06-04 is a Saturday; 02:00 PDT is 09:00 UTC
+		{"saturday window", weekends, "2022-06-04T09:30:00Z", true},
+		{"saturday in UTC but not local window", weekends, "2022-06-04T02:30:00Z", false},
+		{"weekday", weekends, "2022-06-06T09:30:00Z", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tt.now)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tt.schedule.active(now))
+		})
+	}
+}
+
+func Test_parseMaintenanceWindow_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		w    maintenanceWindow
+	}{
+		{"bad day", maintenanceWindow{Days: []string{"funday"}, Start: "01:00", Duration: "1h"}},
+		{"bad start", maintenanceWindow{Start: "1am", Duration: "1h"}},
+		{"missing duration", maintenanceWindow{Start: "01:00"}},
+		{"too long", maintenanceWindow{Start: "01:00", Duration: "25h"}},
+		{"bad timezone", maintenanceWindow{Start: "01:00", Duration: "1h", Timezone: "Mars/Olympus"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMaintenanceWindow(tt.w)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_ClouddriverManager_getClouddriverURLs_maintenance(t *testing.T) {
+	always, err := parseMaintenanceWindows([]maintenanceWindow{{Start: "00:00", Duration: "24h"}})
+	require.NoError(t, err)
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:rebooting": {Name: "rebooting", URL: "url1", maintenance: always},
+			"config:up":        {Name: "up", URL: "url2", Priority: -1},
+		},
+	}
+	assert.Equal(t, []URLAndPriority{{URL: "url2", Priority: -1}}, m.getClouddriverURLs(false))
+	assert.True(t, m.state["config:rebooting"].inMaintenance)
+	assert.NoError(t, m.state["config:rebooting"].Check(), "health check passes during maintenance")
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+)
+
+// mergeMapValues combines the values two clouddrivers returned for the
+// same key of a map response, such as the cluster names for an account
+// from /applications/{name}/clusters, or the account, provider, and
+// region maps of /securityGroups.  Maps are merged key by key, to any
+// depth, and lists are concatenated, dropping items already present;
+// anything else is replaced by the later value.  It returns the merged
+// value and how many items were duplicates.
+func mergeMapValues(existing interface{}, value interface{}) (interface{}, int) {
+	existingList, ok1 := existing.([]interface{})
+	valueList, ok2 := value.([]interface{})
+	if ok1 && ok2 {
+		return mergeLists(existingList, valueList)
+	}
+	existingMap, ok1 := existing.(map[string]interface{})
+	valueMap, ok2 := value.(map[string]interface{})
+	if ok1 && ok2 {
+		return mergeMaps(existingMap, valueMap)
+	}
+	return value, 1
+}
+
+// mergeMaps adds the keys of b to a, merging the values of keys in both.
+func mergeMaps(a map[string]interface{}, b map[string]interface{}) (map[string]interface{}, int) {
+	duplicates := 0
+	for k, v := range b {
+		existing, seen := a[k]
+		if !seen {
+			a[k] = v
+			continue
+		}
+		merged, d := mergeMapValues(existing, v)
+		duplicates += d
+		a[k] = merged
+	}
+	return a, duplicates
+}
+
+// mergeLists appends the items of b not already in a.  Items are
+// compared by their JSON encoding, so objects with the same fields and
+// values are duplicates whatever their key order.
+func mergeLists(a []interface{}, b []interface{}) ([]interface{}, int) {
+	seen := map[string]bool{}
+	ret := make([]interface{}, 0, len(a)+len(b))
+	duplicates := 0
+	for _, list := range [][]interface{}{a, b} {
+		for _, item := range list {
+			key, err := json.Marshal(item)
+			if err == nil {
+				if seen[string(key)] {
+					duplicates++
+					continue
+				}
+				seen[string(key)] = true
+			}
+			ret = append(ret, item)
+		}
+	}
+	return ret, duplicates
+}
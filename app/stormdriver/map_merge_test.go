@@ -0,0 +1,83 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_mergeMapValues(t *testing.T) {
+	tests := []struct {
+		name           string
+		existing       interface{}
+		value          interface{}
+		want           interface{}
+		wantDuplicates int
+	}{
+		{
+			"lists are concatenated",
+			[]interface{}{"a"},
+			[]interface{}{"b"},
+			[]interface{}{"a", "b"},
+			0,
+		},
+		{
+			"duplicate strings are dropped",
+			[]interface{}{"a", "b"},
+			[]interface{}{"b", "c"},
+			[]interface{}{"a", "b", "c"},
+			1,
+		},
+		{
+			"duplicate objects are dropped",
+			[]interface{}{map[string]interface{}{"name": "a", "region": "us-east-1"}},
+			[]interface{}{map[string]interface{}{"region": "us-east-1", "name": "a"}, map[string]interface{}{"name": "b"}},
+			[]interface{}{map[string]interface{}{"name": "a", "region": "us-east-1"}, map[string]interface{}{"name": "b"}},
+			1,
+		},
+		{
+			"nested maps are merged",
+			map[string]interface{}{"aws": map[string]interface{}{"us-east-1": []interface{}{"sg-1"}}},
+			map[string]interface{}{"aws": map[string]interface{}{"us-east-1": []interface{}{"sg-1", "sg-2"}, "us-west-2": []interface{}{"sg-3"}}},
+			map[string]interface{}{"aws": map[string]interface{}{"us-east-1": []interface{}{"sg-1", "sg-2"}, "us-west-2": []interface{}{"sg-3"}}},
+			1,
+		},
+		{
+			"other values are replaced",
+			"old",
+			"new",
+			"new",
+			1,
+		},
+		{
+			"a list does not merge with a non-list",
+			[]interface{}{"a"},
+			"new",
+			"new",
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, duplicates := mergeMapValues(tt.existing, tt.value)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantDuplicates, duplicates)
+		})
+	}
+}
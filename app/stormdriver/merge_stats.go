@@ -0,0 +1,150 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	mergeItems = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stormdriver",
+		Name:      "merge_items_total",
+		Help:      "Items returned by each clouddriver for aggregated requests, by route and clouddriver.",
+	}, []string{"route", "clouddriver"})
+
+	mergeDuplicates = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stormdriver",
+		Name:      "merge_duplicates_total",
+		Help:      "Items discarded as duplicates of another clouddriver's when aggregating, by route and clouddriver.",
+	}, []string{"route", "clouddriver"})
+)
+
+// mergeCount is what one source contributed to one aggregated response.
+type mergeCount struct {
+	items      int
+	duplicates int
+}
+
+// mergeCounts tallies each source's contribution while merging.  A nil
+// mergeCounts counts nothing.
+type mergeCounts map[string]*mergeCount
+
+func (m mergeCounts) add(source string, items int, duplicates int) {
+	if m == nil {
+		return
+	}
+	c, found := m[source]
+	if !found {
+		c = &mergeCount{}
+		m[source] = c
+	}
+	c.items += items
+	c.duplicates += duplicates
+}
+
+// mergeSource names the clouddriver behind a route, for statistics.
+// Routes which match no known clouddriver, such as imported ones, are
+// named by URL.
+func mergeSource(route URLAndPriority) string {
+	if name := clouddriverManager.clouddriverNameForRoute(route); name != "" {
+		return name
+	}
+	return route.URL
+}
+
+// mergeStat is the running total for one route and clouddriver.
+type mergeStat struct {
+	Route         string  `json:"route"`
+	Clouddriver   string  `json:"clouddriver"`
+	Requests      int     `json:"requests"`
+	Items         int     `json:"items"`
+	Duplicates    int     `json:"duplicates"`
+	DuplicateRate float64 `json:"duplicateRate"`
+}
+
+type mergeStatKey struct {
+	route       string
+	clouddriver string
+}
+
+// mergeStats keeps running totals of how much each clouddriver
+// contributes to aggregated responses, to spot clouddrivers which
+// serve overlapping caches.
+type mergeStats struct {
+	sync.Mutex
+	stats map[mergeStatKey]*mergeStat
+}
+
+var mergeStatistics = &mergeStats{stats: map[mergeStatKey]*mergeStat{}}
+
+func (s *mergeStats) record(route string, counts mergeCounts) {
+	s.Lock()
+	defer s.Unlock()
+	for source, c := range counts {
+		mergeItems.WithLabelValues(route, source).Add(float64(c.items))
+		mergeDuplicates.WithLabelValues(route, source).Add(float64(c.duplicates))
+
+		key := mergeStatKey{route: route, clouddriver: source}
+		stat, found := s.stats[key]
+		if !found {
+			stat = &mergeStat{Route: route, Clouddriver: source}
+			s.stats[key] = stat
+		}
+		stat.Requests++
+		stat.Items += c.items
+		stat.Duplicates += c.duplicates
+		if stat.Items > 0 {
+			stat.DuplicateRate = float64(stat.Duplicates) / float64(stat.Items)
+		}
+	}
+}
+
+// getStats returns the running totals, sorted by route then clouddriver.
+func (s *mergeStats) getStats() []mergeStat {
+	s.Lock()
+	defer s.Unlock()
+	ret := make([]mergeStat, 0, len(s.stats))
+	for _, stat := range s.stats {
+		ret = append(ret, *stat)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Route != ret[j].Route {
+			return ret[i].Route < ret[j].Route
+		}
+		return ret[i].Clouddriver < ret[j].Clouddriver
+	})
+	return ret
+}
+
+func (*srv) mergeStatsRequest(w http.ResponseWriter, req *http.Request) {
+	json, err := json.Marshal(mergeStatistics.getStats())
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_combineUniqueLists_stats(t *testing.T) {
+	item := func(name string) interface{} { return map[string]interface{}{"name": name} }
+
+	c := make(chan listFetchResult, 2)
+	c <- listFetchResult{source: "cd1", data: []interface{}{item("a"), item("b")}}
+	c <- listFetchResult{source: "cd2", data: []interface{}{item("b"), item("c"), item("a")}}
+	stats := mergeCounts{}
+	ret := combineUniqueLists(c, 2, "name", stats)
+
+	assert.Len(t, ret, 3)
+	assert.Equal(t, mergeCounts{
+		"cd1": {items: 2, duplicates: 0},
+		"cd2": {items: 3, duplicates: 2},
+	}, stats)
+}
+
+func Test_combineMaps_stats(t *testing.T) {
+	c := make(chan mapFetchResult, 2)
+	c <- mapFetchResult{source: "cd1", data: map[string]interface{}{"a": 1}}
+	c <- mapFetchResult{source: "cd1", data: map[string]interface{}{"a": 2, "b": 3}}
+	stats := mergeCounts{}
+	combineMaps(c, 2, stats)
+
+	assert.Equal(t, mergeCounts{"cd1": {items: 3, duplicates: 1}}, stats)
+}
+
+func Test_mergeStats_record(t *testing.T) {
+	s := &mergeStats{stats: map[mergeStatKey]*mergeStat{}}
+	s.record("/credentials", mergeCounts{"cd2": {items: 4, duplicates: 1}, "cd1": {items: 4}})
+	s.record("/credentials", mergeCounts{"cd2": {items: 4, duplicates: 3}})
+	s.record("/applications", mergeCounts{"cd1": {items: 0}})
+
+	want := []mergeStat{
+		{Route: "/applications", Clouddriver: "cd1", Requests: 1},
+		{Route: "/credentials", Clouddriver: "cd1", Requests: 1, Items: 4},
+		{Route: "/credentials", Clouddriver: "cd2", Requests: 2, Items: 8, Duplicates: 4, DuplicateRate: 0.5},
+	}
+	assert.Equal(t, want, s.getStats())
+}
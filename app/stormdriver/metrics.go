@@ -0,0 +1,280 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	userLabelHash      = "hash"
+	userLabelAllowlist = "allowlist"
+	userLabelNone      = "none"
+
+	defaultMaxUserLabels = 100
+)
+
+// metricsConfig controls how the x-spinnaker-user header is used as a
+// metric label.  UserLabel is one of "hash" (the default), "allowlist",
+// or "none".  Users in UserAllowlist are always labeled by name; others
+// are hashed, or grouped as "other" in allowlist mode.  In hash mode at
+// most MaxUserLabels distinct hashes are used; later users are "other".
+type metricsConfig struct {
+	UserLabel     string   `yaml:"userLabel,omitempty" json:"userLabel,omitempty"`
+	UserAllowlist []string `yaml:"userAllowlist,omitempty" json:"userAllowlist,omitempty"`
+	MaxUserLabels int      `yaml:"maxUserLabels,omitempty" json:"maxUserLabels,omitempty"`
+}
+
+func (c metricsConfig) validate() error {
+	switch c.UserLabel {
+	case "", userLabelHash, userLabelAllowlist, userLabelNone:
+		return nil
+	}
+	return fmt.Errorf("metrics: unknown userLabel %q", c.UserLabel)
+}
+
+// metricMethods are the request methods used as labels as-is.  Any
+// other method is labeled "other".
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+func methodLabel(method string) string {
+	if metricMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+var (
+	metricsRegistry = newMetricsRegistry()
+
+	requestsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stormdriver",
+		Name:      "requests_total",
+		Help:      "Requests handled, by route, method, status code, and Spinnaker user.",
+	}, []string{"route", "method", "code", "user"})
+
+	requestDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "stormdriver",
+		Name:      "request_duration_seconds",
+		Help:      "Request latency, by route, method, and Spinnaker user.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "user"})
+)
+
+// newMetricsRegistry returns a registry which already holds the Go
+// runtime metrics (goroutines, heap, and GC pauses) and the process
+// metrics (CPU, memory, and file descriptors).
+func newMetricsRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return r
+}
+
+var (
+	downstreamConnectionsOpen = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "stormdriver",
+		Name:      "downstream_connections_open",
+		Help:      "Open connections to clouddrivers, by address.",
+	}, []string{"address"})
+	downstreamConnectionsOpened = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stormdriver",
+		Name:      "downstream_connections_opened_total",
+		Help:      "Connections opened to clouddrivers, by address.",
+	}, []string{"address"})
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// countConnections wraps dial so the connections it makes are counted
+// while they are open.
+func countConnections(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+		downstreamConnectionsOpen.WithLabelValues(addr).Inc()
+		downstreamConnectionsOpened.WithLabelValues(addr).Inc()
+		return &countedConn{Conn: conn, address: addr}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	address string
+	closed  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() { downstreamConnectionsOpen.WithLabelValues(c.address).Dec() })
+	return c.Conn.Close()
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+type userLabeler struct {
+	sync.Mutex
+	mode      string
+	allowlist map[string]bool
+	maxHashes int
+	hashes    map[string]bool
+}
+
+func makeUserLabeler(conf metricsConfig) *userLabeler {
+	l := &userLabeler{
+		mode:      conf.UserLabel,
+		allowlist: map[string]bool{},
+		maxHashes: conf.MaxUserLabels,
+		hashes:    map[string]bool{},
+	}
+	if l.maxHashes <= 0 {
+		l.maxHashes = defaultMaxUserLabels
+	}
+	for _, user := range conf.UserAllowlist {
+		l.allowlist[user] = true
+	}
+	return l
+}
+
+// label returns the metric label to use for the named user.
+func (l *userLabeler) label(user string) string {
+	if l.mode == userLabelNone {
+		return ""
+	}
+	if user == "" {
+		return "unknown"
+	}
+	if l.allowlist[user] {
+		return user
+	}
+	if l.mode == userLabelAllowlist {
+		return "other"
+	}
+	sum := sha256.Sum256([]byte(user))
+	hash := "sha256:" + hex.EncodeToString(sum[:6])
+
+	// keep the number of label values bounded, however many users there are.
+	l.Lock()
+	defer l.Unlock()
+	if !l.hashes[hash] {
+		if len(l.hashes) >= l.maxHashes {
+			return "other"
+		}
+		l.hashes[hash] = true
+	}
+	return hash
+}
+
+// statusRecorder captures the status code written by a handler, and
+// counts the bytes of the body.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.statusCode == 0 {
+		r.statusCode = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets upgraded connections, such as WebSockets, take over the
+// connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func routeTemplate(req *http.Request) string {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return "unknown"
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return tmpl
+}
+
+func (l *userLabeler) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		if rec.statusCode == 0 {
+			rec.statusCode = http.StatusOK
+		}
+
+		route := routeTemplate(req)
+		user := l.label(req.Header.Get("x-spinnaker-user"))
+		method := methodLabel(req.Method)
+		requestsTotal.WithLabelValues(route, method, strconv.Itoa(rec.statusCode), user).Inc()
+		requestDuration.WithLabelValues(route, method, user).Observe(time.Since(start).Seconds())
+	})
+}
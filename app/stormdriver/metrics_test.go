@@ -0,0 +1,97 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_userLabeler_label(t *testing.T) {
+	tests := []struct {
+		name string
+		conf metricsConfig
+		user string
+		want string
+	}{
+		{"hash by default", metricsConfig{}, "alice", "sha256:2bd806c97f0e"},
+		{"allowlisted user in hash mode", metricsConfig{UserAllowlist: []string{"alice"}}, "alice", "alice"},
+		{"allowlisted user", metricsConfig{UserLabel: "allowlist", UserAllowlist: []string{"alice"}}, "alice", "alice"},
+		{"other user in allowlist mode", metricsConfig{UserLabel: "allowlist", UserAllowlist: []string{"alice"}}, "bob", "other"},
+		{"missing user", metricsConfig{}, "", "unknown"},
+		{"labels disabled", metricsConfig{UserLabel: "none"}, "alice", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, makeUserLabeler(tt.conf).label(tt.user))
+		})
+	}
+}
+
+func Test_userLabeler_boundedHashes(t *testing.T) {
+	l := makeUserLabeler(metricsConfig{MaxUserLabels: 2})
+	alice := l.label("alice")
+	bob := l.label("bob")
+	assert.NotEqual(t, "other", alice)
+	assert.NotEqual(t, "other", bob)
+	assert.Equal(t, "other", l.label("carol"))
+	assert.Equal(t, alice, l.label("alice"), "users already seen keep their label")
+}
+
+func Test_methodLabel(t *testing.T) {
+	assert.Equal(t, http.MethodGet, methodLabel(http.MethodGet))
+	assert.Equal(t, "other", methodLabel("PROPFIND"))
+}
+
+func Test_metricsHandler_runtimeMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	for _, name := range []string{"go_goroutines", "go_memstats_heap_alloc_bytes", "go_gc_duration_seconds", "process_open_fds"} {
+		if name == "process_open_fds" && runtime.GOOS != "linux" {
+			continue
+		}
+		assert.Contains(t, body, "\n"+name, name)
+	}
+}
+
+func Test_countConnections(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	d := &net.Dialer{}
+	dial := countConnections(d.DialContext)
+	before := testutil.ToFloat64(downstreamConnectionsOpened.WithLabelValues(addr))
+
+	conn, err := dial(context.Background(), "tcp", addr)
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(downstreamConnectionsOpen.WithLabelValues(addr)))
+	require.NoError(t, conn.Close())
+	_ = conn.Close() // counted once
+	assert.Equal(t, float64(0), testutil.ToFloat64(downstreamConnectionsOpen.WithLabelValues(addr)))
+	assert.Equal(t, before+1, testutil.ToFloat64(downstreamConnectionsOpened.WithLabelValues(addr)))
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.uber.org/zap"
+)
+
+// oauth2ExpiryMargin is how long before a token expires it is replaced,
+// so a request never goes out with a token about to lapse.
+const oauth2ExpiryMargin = 30 * time.Second
+
+// oauth2FetchTimeout bounds a token fetch.  The fetch is shared by every
+// request waiting for a token, so it does not use any one request's
+// context.
+const oauth2FetchTimeout = 30 * time.Second
+
+// oauth2Config holds the OAuth2 client credentials used to get access
+// tokens for a clouddriver.
+type oauth2Config struct {
+	TokenURL     string   `yaml:"tokenUrl,omitempty" json:"tokenUrl,omitempty"`
+	ClientID     string   `yaml:"clientId,omitempty" json:"clientId,omitempty"`
+	ClientSecret string   `yaml:"clientSecret,omitempty" json:"clientSecret,omitempty"`
+	Scopes       []string `yaml:"scopes,omitempty" json:"scopes,omitempty"`
+}
+
+func (c *oauth2Config) validate() error {
+	if c.TokenURL == "" {
+		return fmt.Errorf("tokenUrl must be set")
+	}
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tokenUrl must be an http or https URL")
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("clientId must be set")
+	}
+	return nil
+}
+
+// oauth2TokenSource fetches access tokens using the client credentials
+// grant, and hands out the current one until it is about to expire.
+type oauth2TokenSource struct {
+	sync.Mutex
+	config   oauth2Config
+	token    string
+	expires  time.Time // zero if the token server did not say
+	fetching *oauth2Fetch
+	now      func() time.Time
+}
+
+// oauth2Fetch is a token fetch in flight.  done is closed once token
+// and err are set.
+type oauth2Fetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func makeOAuth2TokenSource(c *oauth2Config) *oauth2TokenSource {
+	return &oauth2TokenSource{config: *c, now: time.Now}
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// get returns a current access token, fetching a new one if needed.
+// Concurrent callers wait for a single fetch, which is not held up or
+// cancelled by any one of them; a caller whose ctx ends stops waiting.
+func (s *oauth2TokenSource) get(ctx context.Context) (string, error) {
+	s.Lock()
+	if s.token != "" && (s.expires.IsZero() || s.now().Before(s.expires.Add(-oauth2ExpiryMargin))) {
+		token := s.token
+		s.Unlock()
+		return token, nil
+	}
+	f := s.fetching
+	if f == nil {
+		f = &oauth2Fetch{done: make(chan struct{})}
+		s.fetching = f
+		go s.refresh(f)
+	}
+	s.Unlock()
+
+	select {
+	case <-f.done:
+		return f.token, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// refresh fetches a new token for f, and makes it the current one.
+func (s *oauth2TokenSource) refresh(f *oauth2Fetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), oauth2FetchTimeout)
+	defer cancel()
+	token, expiresIn, err := s.fetch(ctx)
+
+	s.Lock()
+	if err == nil {
+		s.token = token
+		s.expires = time.Time{}
+		if expiresIn > 0 {
+			s.expires = s.now().Add(time.Duration(expiresIn) * time.Second)
+		}
+	}
+	s.fetching = nil
+	s.Unlock()
+
+	f.token, f.err = token, err
+	close(f.done)
+}
+
+// invalidate drops token if it is still the current one, so the next
+// request fetches a new one.  It is called when a clouddriver rejects
+// a token before it was expected to expire.
+func (s *oauth2TokenSource) invalidate(token string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+func (s *oauth2TokenSource) fetch(ctx context.Context) (string, int64, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.Header.Set("accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+
+	resp, err := downstreamClients.tokenClient().Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token request: %w", err)
+	}
+	if !httputil.StatusCodeOK(resp.StatusCode) {
+		return "", 0, fmt.Errorf("oauth2 token request: %s returned status %d", s.config.TokenURL, resp.StatusCode)
+	}
+	var tr oauth2TokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("oauth2 token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, fmt.Errorf("oauth2 token response: no access_token")
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("oauth2 token response: unsupported token_type %q", tr.TokenType)
+	}
+	return tr.AccessToken, tr.ExpiresIn, nil
+}
+
+// oauth2Transport adds an access token to every request, replacing any
+// credentials the request carried, so a caller cannot reach the
+// clouddriver with credentials of its own.
+type oauth2Transport struct {
+	tokens *oauth2TokenSource
+	next   http.RoundTripper
+}
+
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.get(req.Context())
+	if err != nil {
+		closeRequestBody(req)
+		zap.S().Warnw("cannot get oauth2 token", "tokenUrl", t.tokens.config.TokenURL, "error", err)
+		return nil, err
+	}
+	// A RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	req.Header.Set("authorization", "Bearer "+token)
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.tokens.invalidate(token)
+	}
+	return resp, err
+}
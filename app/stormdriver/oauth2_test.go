@@ -0,0 +1,197 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_oauth2Config_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  oauth2Config
+		wantErr bool
+	}{
+		{"valid", oauth2Config{TokenURL: "https://idp.example.com/token", ClientID: "stormdriver"}, false},
+		{"missing tokenUrl", oauth2Config{ClientID: "stormdriver"}, true},
+		{"relative tokenUrl", oauth2Config{TokenURL: "/token", ClientID: "stormdriver"}, true},
+		{"missing clientId", oauth2Config{TokenURL: "https://idp.example.com/token"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// oauth2TestServer hands out numbered tokens, counting the requests.
+func oauth2TestServer(t *testing.T, expiresIn int, fetches *int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "stormdriver" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "read write" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(fetches, 1)
+		w.Header().Set("content-type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, n, expiresIn)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_oauth2TokenSource_get(t *testing.T) {
+	var fetches int32
+	server := oauth2TestServer(t, 3600, &fetches)
+	s := makeOAuth2TokenSource(&oauth2Config{
+		TokenURL:     server.URL,
+		ClientID:     "stormdriver",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"read", "write"},
+	})
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	token, err := s.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// reused until close to expiry
+	now = now.Add(time.Hour - time.Minute)
+	token, err = s.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	now = now.Add(45 * time.Second)
+	token, err = s.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	s.invalidate("token-1") // stale; ignored
+	token, err = s.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	s.invalidate("token-2")
+	token, err = s.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+}
+
+func Test_oauth2TokenSource_get_rejected(t *testing.T) {
+	var fetches int32
+	server := oauth2TestServer(t, 3600, &fetches)
+	s := makeOAuth2TokenSource(&oauth2Config{TokenURL: server.URL, ClientID: "stormdriver", ClientSecret: "wrong"})
+	_, err := s.get(context.Background())
+	assert.ErrorContains(t, err, "returned status 401")
+}
+
+func Test_oauth2TokenSource_get_shared(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		n := atomic.AddInt32(&fetches, 1)
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, n)
+	}))
+	defer server.Close()
+	s := makeOAuth2TokenSource(&oauth2Config{TokenURL: server.URL, ClientID: "stormdriver"})
+
+	// A caller giving up does not cancel the fetch others wait for.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.get(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	results := make(chan string, 5)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			token, err := s.get(context.Background())
+			assert.NoError(t, err)
+			results <- token
+		}()
+	}
+	close(release)
+	for i := 0; i < cap(results); i++ {
+		assert.Equal(t, "token-1", <-results)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func Test_oauth2Transport(t *testing.T) {
+	var fetches int32
+	server := oauth2TestServer(t, 3600, &fetches)
+	var seen atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("authorization")
+		seen.Store(auth)
+		if auth == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized) // revoked
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	client := &http.Client{Transport: &oauth2Transport{
+		tokens: makeOAuth2TokenSource(&oauth2Config{
+			TokenURL:     server.URL,
+			ClientID:     "stormdriver",
+			ClientSecret: "s3cret",
+			Scopes:       []string{"read", "write"},
+		}),
+		next: http.DefaultTransport,
+	}}
+	send := func(auth string) int {
+		req, err := http.NewRequest(http.MethodGet, backend.URL+"/credentials", nil)
+		require.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("authorization", auth)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send(""))
+	assert.Equal(t, "Bearer token-1", seen.Load())
+	assert.Equal(t, http.StatusOK, send(""))
+	assert.Equal(t, "Bearer token-2", seen.Load())
+	assert.Equal(t, http.StatusOK, send("Bearer caller"))
+	assert.Equal(t, "Bearer token-2", seen.Load(), "the caller's credentials are replaced")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
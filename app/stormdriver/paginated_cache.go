@@ -16,7 +16,63 @@
 
 package main
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSearchCacheTTLSeconds = 30
+	defaultSearchMaxResults      = 5000
+	defaultSearchPageSize        = 10
+	defaultSearchTimeoutSeconds  = 60
+)
+
+// searchConfig controls the cache used to answer paginated /search
+// queries.  Each clouddriver is asked once for up to MaxResults
+// matches, and the merged results are kept for CacheTTLSeconds, per user
+// and query, while Deck pages through them.  A fetch which takes longer
+// than TimeoutSeconds is answered with the results received so far.
+type searchConfig struct {
+	CacheTTLSeconds int `yaml:"cacheTTLSeconds,omitempty" json:"cacheTTLSeconds,omitempty"`
+	MaxResults      int `yaml:"maxResults,omitempty" json:"maxResults,omitempty"`
+	TimeoutSeconds  int `yaml:"timeoutSeconds,omitempty" json:"timeoutSeconds,omitempty"`
+}
+
+func (c *searchConfig) applyDefaults() {
+	if c.CacheTTLSeconds == 0 {
+		c.CacheTTLSeconds = defaultSearchCacheTTLSeconds
+	}
+	if c.MaxResults == 0 {
+		c.MaxResults = defaultSearchMaxResults
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = defaultSearchTimeoutSeconds
+	}
+}
+
+func (c searchConfig) validate() error {
+	if c.CacheTTLSeconds < 0 {
+		return fmt.Errorf("cacheTTLSeconds cannot be negative")
+	}
+	if c.MaxResults < 0 {
+		return fmt.Errorf("maxResults cannot be negative")
+	}
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeoutSeconds cannot be negative")
+	}
+	return nil
+}
 
 // PaginatedCache holds the state and data for a cache that uses a specific format
 // of pagination.  Specifically, one that follows a model of a list of
@@ -26,48 +82,59 @@ type PaginatedCache struct {
 	cache       map[string]*cacheEntry
 	updateChan  chan cacheUpdateResponse
 	requestChan chan CacheRequest
+	ttl         time.Duration
+	timeout     time.Duration
+	maxResults  int
+
+	// shared, if not nil, holds results for other replicas to use.
+	shared Cache
 }
 
 // CacheResponse is a reply to a CacheRequest.
 type CacheResponse struct {
-	TotalMatches int           `json:"totalMatches,omitempty"`
+	TotalMatches int           `json:"totalMatches"`
 	PageNumber   int           `json:"pageNumber,omitempty"`
 	PageSize     int           `json:"pageSize,omitempty"`
 	Platform     string        `json:"platform,omitempty"`
 	Query        string        `json:"query,omitempty"`
-	Results      []interface{} `json:"results,omitempty"`
+	Results      []interface{} `json:"results"`
 }
 
 // CacheRequest is a request to receive info from the cache.  After this is
 // sent to the cache, the sender should listen on its replyChannel.
-// Exactly one reply will be sent per CacheRequest.  The channel will be
-// closed by the cache to ensure this.
+// Exactly one reply will be sent per CacheRequest, so the channel should
+// be buffered if the sender may stop listening.
 //
 // Typically, this is in response to a HTTP request, and the format of the query
-// generally maps into this structure's shape.
+// generally maps into this structure's shape.  PageNumber starts at 1.
 type CacheRequest struct {
 	Username     string
 	QueryURL     string
 	PageNumber   int
 	PageSize     int
+	Headers      http.Header
+	Targets      []URLAndPriority // the clouddrivers to ask
 	ReplyChannel chan CacheResponse
 }
 
 // cacheUpdateResponse contains the new data to store in the cache.
 // This is a complete update, with full data.
 type cacheUpdateResponse struct {
-	username string        // copied from the request
-	queryURL string        // copied from the request
-	query    string        // from clouddriver
-	platform string        // from clouddriver
-	results  []interface{} // from clouddriver
+	username string           // copied from the request
+	queryURL string           // copied from the request
+	targets  []URLAndPriority // copied from the request
+	query    string           // from clouddriver
+	platform string           // from clouddriver
+	results  []interface{}    // from clouddriver
+	failed   bool             // true if no clouddriver answered
 }
 
 // cacheEntry holds the data for a single query, scoped to the user by design.
 // States:
-// *  If waitingClients is not empty, we have a fetch running.
-// *  If waitingClients is empty, results is valid (even if empty), and
-//    we have no fetches running.
+//   - If waitingClients is not empty, we have a fetch running.
+//   - If waitingClients is empty, results is valid (even if empty), and
+//     we have no fetches running.  Once expiry passes, the next request
+//     starts a new fetch.
 type cacheEntry struct {
 	results        []interface{} // set from update
 	platform       string        // set from update
@@ -77,81 +144,332 @@ type cacheEntry struct {
 }
 
 // MakePaginatedCache returns a new cache.
-func MakePaginatedCache() *PaginatedCache {
+func MakePaginatedCache(conf searchConfig, shared Cache) *PaginatedCache {
 	return &PaginatedCache{
+		shared:      shared,
 		cache:       map[string]*cacheEntry{},
 		updateChan:  make(chan cacheUpdateResponse),
 		requestChan: make(chan CacheRequest),
+		ttl:         time.Duration(conf.CacheTTLSeconds) * time.Second,
+		timeout:     time.Duration(conf.TimeoutSeconds) * time.Second,
+		maxResults:  conf.MaxResults,
 	}
 }
 
-// RunCache runs the cache, forever.  Use a goroutine.
-func (c *PaginatedCache) RunCache() {
+// cacheKey identifies a query by the user, the query, and the
+// clouddrivers asked, as requests scoped to different accounts are
+// sent to different clouddrivers.
+func cacheKey(username string, queryURL string, targets []URLAndPriority) string {
+	urls := make([]string, len(targets))
+	for i, target := range targets {
+		urls[i] = target.URL
+	}
+	sort.Strings(urls)
+	return fmt.Sprintf("%s::%s::%s", username, queryURL, strings.Join(urls, ","))
+}
+
+// RunCache runs the cache until ctx is done.  Use a goroutine.  Fetches
+// still running when ctx is done are cancelled.
+func (c *PaginatedCache) RunCache(ctx context.Context) {
+	sweepInterval := c.ttl
+	if sweepInterval < time.Second {
+		sweepInterval = time.Second
+	}
+	sweep := time.NewTicker(sweepInterval)
+	defer sweep.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case request := <-c.requestChan:
-			key := fmt.Sprintf("%s::%s", request.Username, request.QueryURL)
+			key := cacheKey(request.Username, request.QueryURL, request.Targets)
 			entry, found := c.cache[key]
 			if !found {
-				go c.update(request.Username, request.QueryURL)
+				go c.update(ctx, request.Username, request.QueryURL, request.Targets, request.Headers)
 				c.cache[key] = &cacheEntry{
 					expiry:         0,
 					waitingClients: []*CacheRequest{&request},
 				}
 				continue
 			}
+			if len(entry.waitingClients) == 0 && entry.expiry <= time.Now().UnixNano() {
+				go c.update(ctx, request.Username, request.QueryURL, request.Targets, request.Headers)
+				entry.waitingClients = []*CacheRequest{&request}
+				continue
+			}
 			if len(entry.waitingClients) == 0 {
 				c.reply(entry, &request)
 			} else {
 				entry.waitingClients = append(entry.waitingClients, &request)
 			}
 		case update := <-c.updateChan:
-			key := fmt.Sprintf("%s::%s", update.username, update.queryURL)
-			c.cache[key].results = update.results
-			c.cache[key].platform = update.platform
-			c.cache[key].query = update.query
-			for _, request := range c.cache[key].waitingClients {
-				c.reply(c.cache[key], request)
+			key := cacheKey(update.username, update.queryURL, update.targets)
+			entry := c.cache[key]
+			entry.results = update.results
+			entry.platform = update.platform
+			entry.query = update.query
+			entry.expiry = time.Now().Add(c.ttl).UnixNano()
+			if update.failed {
+				// answer those waiting, but try again next time.
+				entry.expiry = 0
+			}
+			for _, request := range entry.waitingClients {
+				c.reply(entry, request)
+			}
+			entry.waitingClients = []*CacheRequest{}
+		case now := <-sweep.C:
+			for key, entry := range c.cache {
+				if len(entry.waitingClients) == 0 && entry.expiry <= now.UnixNano() {
+					delete(c.cache, key)
+				}
 			}
-			c.cache[key].waitingClients = []*CacheRequest{}
 		}
 	}
 }
 
-func (c *PaginatedCache) update(username string, queryURL string) {
-	// fire off parallel queries, combine them, and send a reply to the
-	// cache runner.
-
-	c.updateChan <- cacheUpdateResponse{
+// update asks the target clouddrivers for all the matches for
+// queryURL, in parallel, combines them, and sends the result to the
+// cache runner.  Clouddrivers which have not answered within the
+// timeout are left out.
+func (c *PaginatedCache) update(runCtx context.Context, username string, queryURL string, cds []URLAndPriority, headers http.Header) {
+	ret := cacheUpdateResponse{
 		username: username,
 		queryURL: queryURL,
-		query:    "TODO",
-		platform: "TODO",
+		targets:  cds,
 		results:  []interface{}{},
 	}
+	defer func() {
+		select {
+		case c.updateChan <- ret:
+		case <-runCtx.Done():
+		}
+	}()
+
+	ctx := runCtx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(runCtx, c.timeout)
+		defer cancel()
+	}
+
+	key := cacheKey(username, queryURL, cds)
+	if c.loadShared(ctx, key, &ret) {
+		return
+	}
+	defer func() {
+		if !ret.failed {
+			c.storeShared(ctx, key, ret)
+		}
+	}()
+
+	u, err := url.Parse(queryURL)
+	if err != nil {
+		zap.S().Errorw("search query", "queryURL", queryURL, "error", err)
+		ret.failed = true
+		return
+	}
+	query := u.Query()
+	query.Set("pageNumber", "1")
+	query.Set("pageSize", strconv.Itoa(c.maxResults))
+	u.RawQuery = query.Encode()
+
+	retchan := make(chan listFetchResult)
+	for _, cd := range cds {
+		go fetchListFromOneEndpoint(withRoute(ctx, cd), retchan, mergeSource(cd), combineURL(cd.URL, u.String()), cd.token, headers)
+	}
+
+	failures := 0
+	seen := map[string]bool{}
+	stats := mergeCounts{}
+	defer func() {
+		mergeStatistics.record(u.Path, stats)
+	}()
+	for i := 0; i < len(cds); i++ {
+		j := <-retchan
+		if j.result.err != nil {
+			zap.S().Errorw("failed to fetch", "error", j.result.err)
+			failures++
+			continue
+		}
+		for _, page := range j.data {
+			p, ok := page.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if results, ok := p["results"].([]interface{}); ok {
+				duplicates := 0
+				for _, result := range results {
+					key := searchResultKey(result)
+					if seen[key] {
+						duplicates++
+						continue
+					}
+					seen[key] = true
+					ret.results = append(ret.results, result)
+				}
+				stats.add(j.source, len(results), duplicates)
+			}
+			if query, ok := p["query"].(string); ok && ret.query == "" {
+				ret.query = query
+			}
+			if platform, ok := p["platform"].(string); ok && ret.platform == "" {
+				ret.platform = platform
+			}
+		}
+	}
+	ret.failed = failures == len(cds)
+}
+
+// searchResultKey identifies a search result, so the same resource
+// returned by more than one clouddriver is listed once.  Results are
+// identified by their type and url if they have both, and otherwise
+// by their whole contents.
+func searchResultKey(result interface{}) string {
+	if r, ok := result.(map[string]interface{}); ok {
+		resultType, _ := r["type"].(string)
+		resultURL, _ := r["url"].(string)
+		if resultType != "" && resultURL != "" {
+			return resultType + "\x00" + resultURL
+		}
+	}
+	data, _ := json.Marshal(result)
+	return string(data)
 }
 
+// sharedSearch is a search result, as kept in the shared cache.
+type sharedSearch struct {
+	Query    string        `json:"query"`
+	Platform string        `json:"platform"`
+	Results  []interface{} `json:"results"`
+}
+
+// loadShared fills in update from the shared cache, returning false if
+// it is not there.
+func (c *PaginatedCache) loadShared(ctx context.Context, key string, update *cacheUpdateResponse) bool {
+	if c.shared == nil {
+		return false
+	}
+	data, found, err := c.shared.Get(ctx, key)
+	if err != nil {
+		zap.S().Warnw("shared search cache unavailable", "error", err)
+		return false
+	}
+	var stored sharedSearch
+	if !found || json.Unmarshal(data, &stored) != nil {
+		return false
+	}
+	update.query = stored.Query
+	update.platform = stored.Platform
+	update.results = stored.Results
+	return true
+}
+
+func (c *PaginatedCache) storeShared(ctx context.Context, key string, update cacheUpdateResponse) {
+	if c.shared == nil {
+		return
+	}
+	data, err := json.Marshal(sharedSearch{Query: update.query, Platform: update.platform, Results: update.results})
+	if err != nil {
+		return
+	}
+	if err := c.shared.Set(ctx, key, data, c.ttl); err != nil {
+		zap.S().Warnw("shared search cache unavailable", "error", err)
+	}
+}
+
+// reply sends the requested page of entry.  Pages are no larger than
+// the cache's result limit, and the page is found without multiplying
+// the caller's numbers, so no page number or size can overflow.
 func (c *PaginatedCache) reply(entry *cacheEntry, request *CacheRequest) {
-	startOffset := request.PageNumber * request.PageSize
-	endOffset := startOffset + request.PageSize
+	pageNumber := request.PageNumber
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+	pageSize := c.pageSize(request.PageSize)
 
 	totalMatches := len(entry.results)
+	pages := totalMatches / pageSize
+	if totalMatches%pageSize != 0 {
+		pages++
+	}
 
 	reply := CacheResponse{
 		TotalMatches: totalMatches,
-		PageNumber:   request.PageNumber,
-		PageSize:     request.PageSize,
+		PageNumber:   pageNumber,
+		PageSize:     pageSize,
 		Platform:     entry.platform,
 		Query:        entry.query,
 	}
 
-	if startOffset >= totalMatches {
+	if pageNumber-1 >= pages {
 		reply.Results = []interface{}{}
 	} else {
-		if endOffset > totalMatches {
-			endOffset = totalMatches
+		startOffset := (pageNumber - 1) * pageSize
+		endOffset := totalMatches
+		if totalMatches-startOffset > pageSize {
+			endOffset = startOffset + pageSize
 		}
 		reply.Results = entry.results[startOffset:endOffset]
 	}
 	request.ReplyChannel <- reply
 }
+
+// pageSize returns size, at least 1 and at most the cache's result limit.
+func (c *PaginatedCache) pageSize(size int) int {
+	if size < 1 {
+		return 1
+	}
+	if c.maxResults > 0 && size > c.maxResults {
+		return c.maxResults
+	}
+	return size
+}
+
+func positiveIntParam(query url.Values, name string, defaultValue int) int {
+	v, err := strconv.Atoi(query.Get(name))
+	if err != nil || v < 1 {
+		return defaultValue
+	}
+	return v
+}
+
+// searchHandler answers Deck's paginated /search queries from the cache.
+// Every page of a query is served from one fetch.
+func (c *PaginatedCache) searchHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	pageNumber := positiveIntParam(query, "pageNumber", 1)
+	pageSize := c.pageSize(positiveIntParam(query, "pageSize", defaultSearchPageSize))
+	query.Del("pageNumber")
+	query.Del("pageSize")
+
+	reply := make(chan CacheResponse, 1)
+	request := CacheRequest{
+		Username:     req.Header.Get("x-spinnaker-user"),
+		QueryURL:     req.URL.Path + "?" + query.Encode(),
+		PageNumber:   pageNumber,
+		PageSize:     pageSize,
+		Headers:      req.Header.Clone(),
+		Targets:      fanOutTargets(req),
+		ReplyChannel: reply,
+	}
+	select {
+	case <-req.Context().Done():
+		return
+	case c.requestChan <- request:
+	}
+
+	select {
+	case <-req.Context().Done():
+		return
+	case response := <-reply:
+		outjson, err := json.Marshal([]CacheResponse{response})
+		if err != nil {
+			requestLogger(req.Context()).Errorw("json.Marshal", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		httputil.CheckedWrite(w, outjson)
+	}
+}
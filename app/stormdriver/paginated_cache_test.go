@@ -0,0 +1,319 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PaginatedCache_reply(t *testing.T) {
+	entry := &cacheEntry{results: []interface{}{"a", "b", "c", "d", "e"}, platform: "aws", query: "q"}
+	tests := []struct {
+		name       string
+		pageNumber int
+		pageSize   int
+		want       []interface{}
+	}{
+		{"first page", 1, 2, []interface{}{"a", "b"}},
+		{"second page", 2, 2, []interface{}{"c", "d"}},
+		{"partial last page", 3, 2, []interface{}{"e"}},
+		{"past the end", 4, 2, []interface{}{}},
+		{"page 0 is the first page", 0, 2, []interface{}{"a", "b"}},
+		{"page size over the limit", 1, 100, []interface{}{"a", "b", "c"}},
+		{"huge page number", math.MaxInt64 / 2, 4, []interface{}{}},
+		{"overflowing page number and size", math.MaxInt64, math.MaxInt64, []interface{}{}},
+		{"huge page size", 1, math.MaxInt64, []interface{}{"a", "b", "c"}},
+	}
+	c := &PaginatedCache{maxResults: 3}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := make(chan CacheResponse, 1)
+			c.reply(entry, &CacheRequest{PageNumber: tt.pageNumber, PageSize: tt.pageSize, ReplyChannel: reply})
+			got := <-reply
+			assert.Equal(t, tt.want, got.Results)
+			assert.Equal(t, 5, got.TotalMatches)
+			assert.Equal(t, "aws", got.Platform)
+		})
+	}
+}
+
+func searchTestServer(t *testing.T, calls *int32, results ...string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		assert.Equal(t, "1", r.URL.Query().Get("pageNumber"))
+		assert.Equal(t, "100", r.URL.Query().Get("pageSize"))
+		assert.Equal(t, "alice", r.Header.Get("x-spinnaker-user"))
+		items := []interface{}{}
+		for _, result := range results {
+			items = append(items, map[string]interface{}{"name": result})
+		}
+		page := []map[string]interface{}{{
+			"pageNumber":   1,
+			"pageSize":     100,
+			"platform":     "aws",
+			"query":        r.URL.Query().Get("q"),
+			"results":      items,
+			"totalMatches": len(items),
+		}}
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_PaginatedCache_searchHandler(t *testing.T) {
+	var calls int32
+	cd1 := searchTestServer(t, &calls, "a", "b", "c")
+	cd2 := searchTestServer(t, &calls, "d", "e")
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"one": {URL: cd1.URL},
+			"two": {URL: cd2.URL},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := MakePaginatedCache(searchConfig{CacheTTLSeconds: 60, MaxResults: 100}, nil)
+	go c.RunCache(ctx)
+
+	search := func(query string) CacheResponse {
+		req := httptest.NewRequest(http.MethodGet, "/search?"+query, nil)
+		req.Header.Set("x-spinnaker-user", "alice")
+		w := httptest.NewRecorder()
+		c.searchHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var got []CacheResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		require.Len(t, got, 1)
+		return got[0]
+	}
+
+	page1 := search("q=web&pageSize=4")
+	assert.Equal(t, 5, page1.TotalMatches)
+	assert.Len(t, page1.Results, 4)
+	assert.Equal(t, "web", page1.Query)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	page2 := search("q=web&pageSize=4&pageNumber=2")
+	assert.Equal(t, 2, page2.PageNumber)
+	assert.Len(t, page2.Results, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "later pages come from the cache")
+
+	huge := search("q=web&pageNumber=4611686018427387904&pageSize=4")
+	assert.Empty(t, huge.Results, "huge page numbers do not overflow")
+	huge = search("q=web&pageNumber=2&pageSize=9223372036854775807")
+	assert.Equal(t, 100, huge.PageSize, "page sizes are capped at maxResults")
+	assert.Empty(t, huge.Results)
+
+	search("q=db")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "each query is fetched")
+}
+
+func Test_PaginatedCache_scopedToAccounts(t *testing.T) {
+	var calls int32
+	cd1 := searchTestServer(t, &calls, "a", "b")
+	cd2 := searchTestServer(t, &calls, "c")
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"one": {URL: cd1.URL},
+			"two": {URL: cd2.URL},
+		},
+	}
+	oldDeadlines := fanOutDeadlines
+	defer func() { fanOutDeadlines = oldDeadlines }()
+	fanOutDeadlines = fanOutConfig{ScopeToAccounts: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := MakePaginatedCache(searchConfig{CacheTTLSeconds: 60, MaxResults: 100}, nil)
+	go c.RunCache(ctx)
+
+	search := func(accounts string) int {
+		req := httptest.NewRequest(http.MethodGet, "/search?q=web", nil)
+		req.Header.Set("x-spinnaker-user", "alice")
+		req.Header.Set("x-spinnaker-accounts", accounts)
+		w := httptest.NewRecorder()
+		c.searchHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var got []CacheResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		require.Len(t, got, 1)
+		return got[0].TotalMatches
+	}
+
+	assert.Equal(t, 2, search("one"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "only the owner is asked")
+	assert.Equal(t, 1, search("two"), "other accounts are not served from the first fetch")
+	assert.Equal(t, 3, search("one,two"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	assert.Equal(t, 2, search("one"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "the same targets are served from the cache")
+}
+
+func Test_searchResultKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a    interface{}
+		b    interface{}
+		same bool
+	}{
+		{
+			"same type and url",
+			map[string]interface{}{"type": "serverGroups", "url": "/x", "provider": "aws"},
+			map[string]interface{}{"type": "serverGroups", "url": "/x", "provider": "titus"},
+			true,
+		},
+		{
+			"different types",
+			map[string]interface{}{"type": "serverGroups", "url": "/x"},
+			map[string]interface{}{"type": "clusters", "url": "/x"},
+			false,
+		},
+		{
+			"no url, same contents",
+			map[string]interface{}{"name": "a", "account": "prod"},
+			map[string]interface{}{"account": "prod", "name": "a"},
+			true,
+		},
+		{
+			"no url, different contents",
+			map[string]interface{}{"name": "a"},
+			map[string]interface{}{"name": "b"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.same, searchResultKey(tt.a) == searchResultKey(tt.b))
+		})
+	}
+}
+
+func Test_PaginatedCache_dedupe(t *testing.T) {
+	var calls int32
+	cd1 := searchTestServer(t, &calls, "a", "b", "c")
+	cd2 := searchTestServer(t, &calls, "b", "c", "d")
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"one": {URL: cd1.URL},
+			"two": {URL: cd2.URL},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := MakePaginatedCache(searchConfig{CacheTTLSeconds: 60, MaxResults: 100}, nil)
+	go c.RunCache(ctx)
+
+	req := httptest.NewRequest(http.MethodGet, "/search?q=web&pageSize=3&pageNumber=2", nil)
+	req.Header.Set("x-spinnaker-user", "alice")
+	w := httptest.NewRecorder()
+	c.searchHandler(w, req)
+	var got []CacheResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, 4, got[0].TotalMatches)
+	assert.Len(t, got[0].Results, 1)
+}
+
+func Test_PaginatedCache_timeout(t *testing.T) {
+	var calls int32
+	cd1 := searchTestServer(t, &calls, "a", "b")
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"one": {URL: cd1.URL},
+			"two": {URL: slow.URL},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := MakePaginatedCache(searchConfig{CacheTTLSeconds: 60, MaxResults: 100}, nil)
+	c.timeout = 50 * time.Millisecond
+	go c.RunCache(ctx)
+
+	req := httptest.NewRequest(http.MethodGet, "/search?q=web", nil)
+	req.Header.Set("x-spinnaker-user", "alice")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	c.searchHandler(w, req)
+	assert.Less(t, time.Since(start), 2*time.Second, "the slow clouddriver is not waited for")
+	var got []CacheResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, 2, got[0].TotalMatches)
+}
+
+func Test_PaginatedCache_shared(t *testing.T) {
+	var calls int32
+	cd := searchTestServer(t, &calls, "a", "b")
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{"one": {URL: cd.URL}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shared := makeMemoryCache(10)
+	replica1 := MakePaginatedCache(searchConfig{CacheTTLSeconds: 60, MaxResults: 100}, shared)
+	replica2 := MakePaginatedCache(searchConfig{CacheTTLSeconds: 60, MaxResults: 100}, shared)
+	go replica1.RunCache(ctx)
+	go replica2.RunCache(ctx)
+
+	for _, c := range []*PaginatedCache{replica1, replica2} {
+		req := httptest.NewRequest(http.MethodGet, "/search?q=web", nil)
+		req.Header.Set("x-spinnaker-user", "alice")
+		w := httptest.NewRecorder()
+		c.searchHandler(w, req)
+		var got []CacheResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		assert.Equal(t, 2, got[0].TotalMatches)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "the second replica used the shared results")
+}
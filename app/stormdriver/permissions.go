@@ -0,0 +1,252 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	authorizationRead  = "READ"
+	authorizationWrite = "WRITE"
+)
+
+// permissionsConfig enables checking the permissions in clouddriver's
+// account documents against the X-SPINNAKER-ROLES header, for installs
+// without Fiat.  Users with any of the AdminRoles may use every account.
+// If PopulateAccountsHeader is set, requests without X-SPINNAKER-ACCOUNTS
+// have it set to the accounts the roles may write to, as Gate would.
+type permissionsConfig struct {
+	Enforce                bool       `yaml:"enforce,omitempty" json:"enforce,omitempty"`
+	AdminRoles             []string   `yaml:"adminRoles,omitempty" json:"adminRoles,omitempty"`
+	PopulateAccountsHeader bool       `yaml:"populateAccountsHeader,omitempty" json:"populateAccountsHeader,omitempty"`
+	Fiat                   fiatConfig `yaml:"fiat,omitempty" json:"fiat,omitempty"`
+}
+
+// accountPermissions maps an authorization, such as READ or WRITE,
+// to the roles which have it.
+type accountPermissions map[string][]string
+
+// permissionsFromDocument extracts the permissions from an account
+// document.  The older requiredGroupMembership list is used for both
+// READ and WRITE if no permissions are set.
+func permissionsFromDocument(doc map[string]interface{}) accountPermissions {
+	ret := accountPermissions{}
+	if perms, ok := doc["permissions"].(map[string]interface{}); ok {
+		for authorization, roles := range perms {
+			ret[strings.ToUpper(authorization)] = stringList(roles)
+		}
+	}
+	if !ret.restricted() {
+		if groups := stringList(doc["requiredGroupMembership"]); len(groups) > 0 {
+			ret[authorizationRead] = groups
+			ret[authorizationWrite] = groups
+		}
+	}
+	return ret
+}
+
+func stringList(v interface{}) []string {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	ret := []string{}
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// restricted returns true if any roles are listed.  As with Fiat,
+// unrestricted accounts may be used by everyone.
+func (p accountPermissions) restricted() bool {
+	for _, roles := range p {
+		if len(roles) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p accountPermissions) allows(authorization string, roles map[string]bool) bool {
+	if !p.restricted() {
+		return true
+	}
+	for _, role := range p[authorization] {
+		if roles[strings.ToLower(role)] {
+			return true
+		}
+	}
+	return false
+}
+
+// requestRoles returns the roles in the X-SPINNAKER-ROLES header.
+func requestRoles(req *http.Request) map[string]bool {
+	ret := map[string]bool{}
+	for _, header := range req.Header.Values("x-spinnaker-roles") {
+		for _, role := range strings.Split(header, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				ret[strings.ToLower(role)] = true
+			}
+		}
+	}
+	return ret
+}
+
+type permissionChecker struct {
+	enforce                bool
+	adminRoles             []string
+	populateAccountsHeader bool
+	fiat                   *fiatClient
+}
+
+func makePermissionChecker(conf permissionsConfig) *permissionChecker {
+	return &permissionChecker{
+		enforce:                conf.Enforce,
+		adminRoles:             conf.AdminRoles,
+		populateAccountsHeader: conf.PopulateAccountsHeader,
+		fiat:                   makeFiatClient(conf.Fiat),
+	}
+}
+
+// allowed returns true if the request's roles grant the authorization.
+// A nil checker allows everything.
+func (c *permissionChecker) allowed(req *http.Request, perms accountPermissions, authorization string) bool {
+	if c == nil || !c.enforce {
+		return true
+	}
+	return c.grants(requestRoles(req), perms, authorization)
+}
+
+// grants returns true if any of roles has the authorization, whether
+// or not enforcement is enabled.
+func (c *permissionChecker) grants(roles map[string]bool, perms accountPermissions, authorization string) bool {
+	return c.isAdmin(roles) || perms.allows(authorization, roles)
+}
+
+func (c *permissionChecker) isAdmin(roles map[string]bool) bool {
+	for _, role := range c.adminRoles {
+		if roles[strings.ToLower(role)] {
+			return true
+		}
+	}
+	return false
+}
+
+// accountsHeaderMiddleware sets X-SPINNAKER-ACCOUNTS, if it is not
+// already present, to the accounts the request's roles may write to.
+func (c *permissionChecker) accountsHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if c != nil && c.populateAccountsHeader && !admissionExempt(req) && req.Header.Get("x-spinnaker-accounts") == "" {
+			roles := requestRoles(req)
+			accounts := clouddriverManager.filterCloudAccountNames(func(perms accountPermissions) bool {
+				return c.grants(roles, perms, authorizationWrite)
+			})
+			req.Header.Set("x-spinnaker-accounts", strings.Join(accounts, ","))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// filterAccounts removes the account documents the request may not
+// read, checking the documents' permissions if enforcing and asking
+// Fiat if it is enabled.  Fiat learns accounts from /credentials, so
+// it knows aliased accounts by their aliases, and is asked about those.
+func (c *permissionChecker) filterAccounts(req *http.Request, items []interface{}) []interface{} {
+	if c == nil || (!c.enforce && c.fiat == nil) {
+		return items
+	}
+	var fiatPerms fiatPermissions
+	if c.fiat != nil {
+		fiatPerms = c.fiat.permissions(req.Context(), req.Header.Get("x-spinnaker-user"))
+	}
+	ret := []interface{}{}
+	for _, item := range items {
+		doc, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if !c.allowed(req, permissionsFromDocument(doc), authorizationRead) {
+			continue
+		}
+		if c.fiat != nil {
+			name, _ := doc["name"].(string)
+			if !fiatPerms.allows(aliases.alias(name), authorizationRead) {
+				continue
+			}
+		}
+		ret = append(ret, item)
+	}
+	return ret
+}
+
+// checkRead returns true if the request may read the named account,
+// checked as filterAccounts checks account documents.  While
+// enforcing, accounts whose permissions are not known may only be read
+// by admins.
+func (c *permissionChecker) checkRead(req *http.Request, accountName string) bool {
+	if c == nil || (!c.enforce && c.fiat == nil) {
+		return true
+	}
+	user := req.Header.Get("x-spinnaker-user")
+	if c.enforce {
+		perms, found := clouddriverManager.findCloudAccountPermissions(accountName)
+		if !found && !c.isAdmin(requestRoles(req)) {
+			zap.S().Warnw("read denied, account permissions unknown", "accountName", accountName, "user", user)
+			return false
+		}
+		if !c.allowed(req, perms, authorizationRead) {
+			zap.S().Warnw("read denied", "accountName", accountName, "user", user)
+			return false
+		}
+	}
+	if c.fiat != nil && !c.fiat.permissions(req.Context(), user).allows(aliases.alias(accountName), authorizationRead) {
+		zap.S().Warnw("read denied by fiat", "accountName", accountName, "user", user)
+		return false
+	}
+	return true
+}
+
+// checkWrite returns the first of the named accounts which the request
+// may not write to, or "" if all are allowed.  Accounts whose
+// permissions are not known may only be written to by admins.
+func (c *permissionChecker) checkWrite(req *http.Request, accountNames []string) string {
+	if c == nil || !c.enforce {
+		return ""
+	}
+	for _, name := range accountNames {
+		perms, found := clouddriverManager.findCloudAccountPermissions(name)
+		if !found {
+			if c.isAdmin(requestRoles(req)) {
+				continue
+			}
+			zap.S().Warnw("write denied, account permissions unknown", "accountName", name, "user", req.Header.Get("x-spinnaker-user"))
+			return name
+		}
+		if !c.allowed(req, perms, authorizationWrite) {
+			zap.S().Warnw("write denied", "accountName", name, "user", req.Header.Get("x-spinnaker-user"))
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_permissionsFromDocument(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want accountPermissions
+	}{
+		{"none", `{"name":"a"}`, accountPermissions{}},
+		{"permissions", `{"permissions":{"READ":["dev","ops"],"WRITE":["ops"]}}`, accountPermissions{"READ": {"dev", "ops"}, "WRITE": {"ops"}}},
+		{"requiredGroupMembership", `{"requiredGroupMembership":["ops"]}`, accountPermissions{"READ": {"ops"}, "WRITE": {"ops"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(tt.doc), &doc))
+			assert.Equal(t, tt.want, permissionsFromDocument(doc))
+		})
+	}
+}
+
+func Test_permissionChecker_allowed(t *testing.T) {
+	c := makePermissionChecker(permissionsConfig{Enforce: true, AdminRoles: []string{"Admins"}})
+	perms := accountPermissions{"READ": {"dev", "ops"}, "WRITE": {"ops"}}
+
+	tests := []struct {
+		name          string
+		roles         string
+		authorization string
+		want          bool
+	}{
+		{"no roles", "", authorizationRead, false},
+		{"read role", "dev", authorizationRead, true},
+		{"read role cannot write", "dev", authorizationWrite, false},
+		{"write role, mixed case and spaces", "other, OPS", authorizationWrite, true},
+		{"admin", "admins", authorizationWrite, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/credentials", nil)
+			if tt.roles != "" {
+				req.Header.Set("x-spinnaker-roles", tt.roles)
+			}
+			assert.Equal(t, tt.want, c.allowed(req, perms, tt.authorization))
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/credentials", nil)
+	assert.True(t, c.allowed(req, accountPermissions{}, authorizationWrite), "unrestricted accounts allow everyone")
+	var disabled *permissionChecker
+	assert.True(t, disabled.allowed(req, perms, authorizationWrite))
+}
+
+func Test_permissionChecker_filterAccounts(t *testing.T) {
+	c := makePermissionChecker(permissionsConfig{Enforce: true})
+	var items []interface{}
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"name":"open"},
+		{"name":"devs","permissions":{"READ":["dev"]}},
+		{"name":"ops","permissions":{"READ":["ops"]}}
+	]`), &items))
+
+	req := httptest.NewRequest(http.MethodGet, "/credentials", nil)
+	req.Header.Set("x-spinnaker-roles", "dev")
+	got := c.filterAccounts(req, items)
+	names := []string{}
+	for _, item := range got {
+		names = append(names, getKeyValue(item, "name"))
+	}
+	assert.Equal(t, []string{"open", "devs"}, names)
+}
+
+func Test_permissionChecker_accountsHeaderMiddleware(t *testing.T) {
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccounts: []trackedSpinnakerAccount{
+			{Name: "prod", permissions: accountPermissions{"WRITE": {"ops"}}},
+			{Name: "dev", permissions: accountPermissions{"WRITE": {"dev", "ops"}}},
+			{Name: "open"},
+		},
+	}
+	c := makePermissionChecker(permissionsConfig{PopulateAccountsHeader: true})
+	var got string
+	handler := c.accountsHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get("x-spinnaker-accounts")
+	}))
+
+	tests := []struct {
+		name     string
+		roles    string
+		accounts string
+		want     string
+	}{
+		{"no roles", "", "", "open"},
+		{"dev", "dev", "", "dev,open"},
+		{"ops", "ops", "", "dev,open,prod"},
+		{"already set", "ops", "prod", "prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/applications", nil)
+			req.Header.Set("x-spinnaker-roles", tt.roles)
+			if tt.accounts != "" {
+				req.Header.Set("x-spinnaker-accounts", tt.accounts)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_permissionChecker_checkRead(t *testing.T) {
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccounts: []trackedSpinnakerAccount{
+			{Name: "prod", permissions: accountPermissions{"READ": {"ops"}}},
+			{Name: "open"},
+		},
+	}
+	c := makePermissionChecker(permissionsConfig{Enforce: true, AdminRoles: []string{"admin"}})
+
+	tests := []struct {
+		name    string
+		roles   string
+		account string
+		want    bool
+	}{
+		{"open account", "", "open", true},
+		{"allowed", "ops", "prod", true},
+		{"denied", "dev", "prod", false},
+		{"unknown account", "ops", "missing", false},
+		{"unknown account as admin", "admin", "missing", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/credentials/"+tt.account, nil)
+			req.Header.Set("x-spinnaker-roles", tt.roles)
+			assert.Equal(t, tt.want, c.checkRead(req, tt.account))
+		})
+	}
+	var disabled *permissionChecker
+	assert.True(t, disabled.checkRead(httptest.NewRequest(http.MethodGet, "/credentials/prod", nil), "prod"))
+}
+
+func Test_permissionChecker_checkWrite(t *testing.T) {
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccounts: []trackedSpinnakerAccount{
+			{Name: "prod", permissions: accountPermissions{"WRITE": {"ops"}}},
+			{Name: "open"},
+		},
+	}
+	c := makePermissionChecker(permissionsConfig{Enforce: true, AdminRoles: []string{"admin"}})
+
+	tests := []struct {
+		name     string
+		roles    string
+		accounts []string
+		want     string
+	}{
+		{"open account", "", []string{"open"}, ""},
+		{"allowed", "ops", []string{"prod", "open"}, ""},
+		{"denied", "dev", []string{"open", "prod"}, "prod"},
+		{"unknown account", "ops", []string{"missing"}, "missing"},
+		{"unknown account as admin", "admin", []string{"missing"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/ops", nil)
+			req.Header.Set("x-spinnaker-roles", tt.roles)
+			assert.Equal(t, tt.want, c.checkWrite(req, tt.accounts))
+		})
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/OpsMx/go-app-base/birger"
+	"go.uber.org/zap"
+)
+
+// preflightClouddriver is the result of one clouddriver's first sync.
+type preflightClouddriver struct {
+	name             string
+	source           string
+	url              string
+	accounts         int
+	artifactAccounts int
+	maintenance      bool
+	err              string
+}
+
+// preflightReport is the result of a single credential sync.
+type preflightReport struct {
+	clouddrivers   []preflightClouddriver
+	routes         map[string]URLAndPriority
+	artifactRoutes map[string]URLAndPriority
+}
+
+// failed is true if any clouddriver failed to sync, or none were synced
+// at all because none were found or all were in maintenance.
+func (r preflightReport) failed() bool {
+	for _, cd := range r.clouddrivers {
+		if cd.err != "" {
+			return true
+		}
+	}
+	return r.synced() == 0
+}
+
+// synced returns the number of clouddrivers not skipped for maintenance.
+func (r preflightReport) synced() int {
+	ret := 0
+	for _, cd := range r.clouddrivers {
+		if !cd.maintenance {
+			ret++
+		}
+	}
+	return ret
+}
+
+// preflightReport describes the outcome of the last sync for each
+// clouddriver.  A clouddriver which did not return its credentials
+// on the last sync has failed, unless it is in a maintenance window
+// and so was not synced.
+func (m *ClouddriverManager) preflightReport() preflightReport {
+	m.Lock()
+	defer m.Unlock()
+	ret := preflightReport{
+		clouddrivers:   []preflightClouddriver{},
+		routes:         copyRoutes(m.cloudAccountRoutes),
+		artifactRoutes: copyRoutes(m.artifactAccountRoutes),
+	}
+	for _, cd := range m.state {
+		item := preflightClouddriver{name: cd.Name, source: cd.Source, url: cd.URL, maintenance: cd.inMaintenance}
+		problems := []string{}
+		accounts, found := m.syncedCloudAccounts[cd.routeKey()]
+		if !found {
+			problems = append(problems, "credentials sync failed")
+		}
+		item.accounts = len(accounts)
+		if !cd.DisableArtifactAccounts {
+			artifacts, found := m.syncedArtifactAccounts[cd.routeKey()]
+			if !found {
+				problems = append(problems, "artifact credentials sync failed")
+			}
+			item.artifactAccounts = len(artifacts)
+		}
+		if !cd.inMaintenance {
+			item.err = strings.Join(problems, ", ")
+		}
+		ret.clouddrivers = append(ret.clouddrivers, item)
+	}
+	sort.Slice(ret.clouddrivers, func(i, j int) bool {
+		if ret.clouddrivers[i].name != ret.clouddrivers[j].name {
+			return ret.clouddrivers[i].name < ret.clouddrivers[j].name
+		}
+		return ret.clouddrivers[i].source < ret.clouddrivers[j].source
+	})
+	return ret
+}
+
+func (r preflightReport) write(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLOUDDRIVER\tSOURCE\tURL\tACCOUNTS\tARTIFACT ACCOUNTS\tSTATUS")
+	for _, cd := range r.clouddrivers {
+		status := "ok"
+		if cd.maintenance {
+			status = "skipped: in maintenance window"
+		}
+		if cd.err != "" {
+			status = "FAILED: " + cd.err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", cd.name, cd.source, cd.url, cd.accounts, cd.artifactAccounts, status)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, row := range routeRows(r.routes, r.artifactRoutes) {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+
+	if len(r.clouddrivers) == 0 {
+		fmt.Fprintln(w, "\nno clouddrivers found")
+	} else if r.synced() == 0 {
+		fmt.Fprintln(w, "\nno clouddrivers synced")
+	}
+}
+
+// runPreflight performs a single credential sync and prints the result,
+// returning the exit code.  Clouddrivers announced by the controller
+// within wait, and those each discovery source returns when polled
+// once, are included.
+func runPreflight(ctx context.Context, discovery discoveryConfig, updateChan chan birger.ServiceUpdate, wait time.Duration) int {
+	if err := discoverOnce(ctx, discovery, clouddriverManager); err != nil {
+		zap.S().Errorw("unable to configure discovery", "error", err)
+		return 1
+	}
+	if controller != nil {
+		zap.S().Infow("waiting for clouddrivers from the controller", "wait", wait)
+		deadline := time.After(wait)
+	collect:
+		for {
+			select {
+			case update := <-updateChan:
+				clouddriverManager.handleUpdate(update)
+			case <-deadline:
+				break collect
+			}
+		}
+	}
+
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	clouddriverManager.updateAllAccounts(t)
+
+	report := clouddriverManager.preflightReport()
+	report.write(os.Stdout)
+	if report.failed() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClouddriverManager_preflightReport(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:cd1": {Name: "cd1", Source: "config", URL: "url1"},
+			"config:cd2": {Name: "cd2", Source: "config", URL: "url2", DisableArtifactAccounts: true},
+			"config:cd3": {Name: "cd3", Source: "config", URL: "url3", inMaintenance: true},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a1": {URL: "url1"},
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{},
+		syncedCloudAccounts: map[string][]trackedSpinnakerAccount{
+			"url1:": {{Name: "a1"}},
+		},
+		syncedArtifactAccounts: map[string][]trackedSpinnakerAccount{
+			"url1:": {},
+		},
+	}
+
+	report := m.preflightReport()
+	assert.Equal(t, []preflightClouddriver{
+		{name: "cd1", source: "config", url: "url1", accounts: 1},
+		{name: "cd2", source: "config", url: "url2", err: "credentials sync failed"},
+		{name: "cd3", source: "config", url: "url3", maintenance: true},
+	}, report.clouddrivers)
+	assert.True(t, report.failed())
+
+	var buf bytes.Buffer
+	report.write(&buf)
+	assert.Contains(t, buf.String(), "FAILED: credentials sync failed")
+	assert.Contains(t, buf.String(), "skipped: in maintenance window")
+	assert.Contains(t, buf.String(), "account  a1")
+
+	delete(m.state, "config:cd2")
+	assert.False(t, m.preflightReport().failed())
+
+	assert.True(t, (&ClouddriverManager{}).preflightReport().failed(), "no clouddrivers is a failure")
+
+	delete(m.state, "config:cd1")
+	report = m.preflightReport()
+	assert.True(t, report.failed(), "all clouddrivers skipped is a failure")
+	buf.Reset()
+	report.write(&buf)
+	assert.Contains(t, buf.String(), "no clouddrivers synced")
+}
+
+func Test_ClouddriverManager_preflightReport_sameName(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"srv:cd1":    {Name: "cd1", Source: "srv", URL: "url2"},
+			"config:cd1": {Name: "cd1", Source: "config", URL: "url1"},
+		},
+		syncedCloudAccounts:    map[string][]trackedSpinnakerAccount{},
+		syncedArtifactAccounts: map[string][]trackedSpinnakerAccount{},
+	}
+	report := m.preflightReport()
+	assert.Equal(t, "config", report.clouddrivers[0].source)
+	assert.Equal(t, "srv", report.clouddrivers[1].source)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// quarantineConfig removes a clouddriver's routes once its credential
+// syncs or health checks have failed FailureThreshold times in a row,
+// until it recovers.  A FailureThreshold of 0 disables quarantine.
+type quarantineConfig struct {
+	FailureThreshold int `yaml:"failureThreshold,omitempty" json:"failureThreshold,omitempty"`
+}
+
+func (c *quarantineConfig) validate() error {
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("failureThreshold cannot be negative")
+	}
+	return nil
+}
+
+var quarantinedClouddrivers = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+	Namespace: "stormdriver",
+	Name:      "clouddrivers_quarantined",
+	Help:      "The number of clouddrivers whose routes are removed after repeated failures.",
+})
+
+func (m *ClouddriverManager) setQuarantine(c quarantineConfig) {
+	m.Lock()
+	defer m.Unlock()
+	m.quarantineThreshold = c.FailureThreshold
+}
+
+// noteHealthcheck counts consecutive health check failures.  It is
+// called from the health checker, without the manager's lock.
+func (a *trackedClouddriver) noteHealthcheck(err error) {
+	if err != nil {
+		atomic.AddInt32(&a.healthFailures, 1)
+	} else {
+		atomic.StoreInt32(&a.healthFailures, 0)
+	}
+}
+
+// updateQuarantine decides which clouddrivers are quarantined, logging
+// any changes, and returns their route keys.  Must be called with the
+// lock held.
+func (m *ClouddriverManager) updateQuarantine() map[string]bool {
+	ret := map[string]bool{}
+	for _, cd := range m.state {
+		quarantined := m.quarantineThreshold > 0 && !cd.inMaintenance &&
+			(cd.syncFailures >= m.quarantineThreshold || int(atomic.LoadInt32(&cd.healthFailures)) >= m.quarantineThreshold)
+		if quarantined != cd.quarantined {
+			if quarantined {
+				zap.S().Warnw("clouddriver quarantined", "clouddriver", cd.Name, "url", cd.URL,
+					"syncFailures", cd.syncFailures, "healthFailures", atomic.LoadInt32(&cd.healthFailures))
+			} else {
+				zap.S().Infow("clouddriver recovered from quarantine", "clouddriver", cd.Name, "url", cd.URL)
+			}
+			cd.quarantined = quarantined
+		}
+		if quarantined {
+			ret[cd.routeKey()] = true
+		}
+	}
+	quarantinedClouddrivers.Set(float64(len(ret)))
+	return ret
+}
+
+// mergeWithoutQuarantined merges the accounts each clouddriver returned
+// on this sync, leaving out quarantined clouddrivers so their accounts
+// fall back to others which have them.
+func mergeWithoutQuarantined(cds []URLAndPriority, synced map[string][]trackedSpinnakerAccount, quarantined map[string]bool) (map[string]URLAndPriority, []trackedSpinnakerAccount) {
+	routes := map[string]URLAndPriority{}
+	accounts := []trackedSpinnakerAccount{}
+	for _, cd := range cds {
+		if quarantined[cd.key()] {
+			continue
+		}
+		accounts = mergeIfUnique(cd, synced[cd.key()], routes, accounts)
+	}
+	return routes, accounts
+}
+
+// dropQuarantinedRoutes removes the routes to quarantined clouddrivers
+// added by swaps, routing rules, or overrides.
+func dropQuarantinedRoutes(routes map[string]URLAndPriority, quarantined map[string]bool) {
+	for name, route := range routes {
+		if quarantined[route.key()] {
+			delete(routes, name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/OpsMx/go-app-base/tracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_quarantineConfig_validate(t *testing.T) {
+	assert.NoError(t, (&quarantineConfig{}).validate())
+	assert.NoError(t, (&quarantineConfig{FailureThreshold: 3}).validate())
+	assert.Error(t, (&quarantineConfig{FailureThreshold: -1}).validate())
+}
+
+func Test_trackedClouddriver_noteHealthcheck(t *testing.T) {
+	cd := &trackedClouddriver{}
+	cd.noteHealthcheck(errors.New("down"))
+	cd.noteHealthcheck(errors.New("down"))
+	assert.Equal(t, int32(2), cd.healthFailures)
+	cd.noteHealthcheck(nil)
+	assert.Equal(t, int32(0), cd.healthFailures)
+}
+
+func Test_ClouddriverManager_quarantine(t *testing.T) {
+	oldProvider := tracerProvider
+	defer func() { tracerProvider = oldProvider }()
+	var err error
+	tracerProvider, err = tracer.NewTracerProvider("", false, "test", appName, 0)
+	require.NoError(t, err)
+
+	var eastDown int32
+	east := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&eastDown) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name":"shared","type":"kubernetes"},{"name":"east-only","type":"kubernetes"}]`))
+	}))
+	defer east.Close()
+	west := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`[{"name":"shared","type":"kubernetes"}]`))
+	}))
+	defer west.Close()
+
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:east": {Name: "east", URL: east.URL, Priority: 10},
+			"config:west": {Name: "west", URL: west.URL},
+		},
+		cloudAccountRoutes:    map[string]URLAndPriority{},
+		artifactAccountRoutes: map[string]URLAndPriority{},
+		accountOverrides:      map[string]string{"pinned": "east"},
+		warnedOverrides:       map[string]bool{},
+	}
+	m.setQuarantine(quarantineConfig{FailureThreshold: 2})
+	ctx := context.Background()
+	routeFor := func(name string) string {
+		route, found := m.findCloudRoute(name)
+		if !found {
+			return ""
+		}
+		return route.URL
+	}
+
+	m.syncAccounts(ctx)
+	assert.Equal(t, east.URL, routeFor("shared"))
+	assert.Equal(t, east.URL, routeFor("pinned"))
+
+	// failing health checks quarantine east, so its accounts fall back to west.
+	m.state["config:east"].noteHealthcheck(errors.New("down"))
+	m.state["config:east"].noteHealthcheck(errors.New("down"))
+	m.syncAccounts(ctx)
+	assert.True(t, m.state["config:east"].quarantined)
+	assert.Equal(t, west.URL, routeFor("shared"))
+	assert.Empty(t, routeFor("east-only"))
+	assert.Empty(t, routeFor("pinned"), "overrides do not route to a quarantined clouddriver")
+	for _, u := range m.getHealthyClouddriverURLs() {
+		assert.NotEqual(t, east.URL, u.URL)
+	}
+
+	m.state["config:east"].noteHealthcheck(nil)
+	m.syncAccounts(ctx)
+	assert.False(t, m.state["config:east"].quarantined)
+	assert.Equal(t, east.URL, routeFor("shared"))
+
+	// so do failing credential syncs, once there are enough in a row.
+	atomic.StoreInt32(&eastDown, 1)
+	m.syncAccounts(ctx)
+	assert.False(t, m.state["config:east"].quarantined)
+	m.syncAccounts(ctx)
+	assert.True(t, m.state["config:east"].quarantined)
+	assert.Empty(t, routeFor("pinned"))
+
+	atomic.StoreInt32(&eastDown, 0)
+	m.syncAccounts(ctx)
+	assert.False(t, m.state["config:east"].quarantined)
+	assert.Equal(t, east.URL, routeFor("east-only"))
+	assert.Equal(t, east.URL, routeFor("pinned"))
+}
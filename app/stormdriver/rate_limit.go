@@ -0,0 +1,104 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const defaultRateLimitMaxWaitSeconds = 10
+
+var errRateLimited = errors.New("clouddriver rate limit exceeded")
+
+// rateLimitConfig caps the rate of requests sent to a clouddriver.
+// Requests over the limit wait for up to MaxWaitSeconds, and are
+// failed immediately if they would need to wait longer.  Burst
+// defaults to RequestsPerSecond, rounded up.
+type rateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond,omitempty" json:"requestsPerSecond,omitempty"`
+	Burst             int     `yaml:"burst,omitempty" json:"burst,omitempty"`
+	MaxWaitSeconds    int     `yaml:"maxWaitSeconds,omitempty" json:"maxWaitSeconds,omitempty"`
+}
+
+func (c *rateLimitConfig) applyDefaults() {
+	if c.Burst == 0 {
+		c.Burst = int(math.Ceil(c.RequestsPerSecond))
+	}
+	if c.MaxWaitSeconds == 0 {
+		c.MaxWaitSeconds = defaultRateLimitMaxWaitSeconds
+	}
+}
+
+func (c *rateLimitConfig) validate() error {
+	if c.RequestsPerSecond <= 0 {
+		return fmt.Errorf("requestsPerSecond must be positive")
+	}
+	if c.Burst < 1 {
+		return fmt.Errorf("burst must be positive")
+	}
+	if c.MaxWaitSeconds < 0 {
+		return fmt.Errorf("maxWaitSeconds cannot be negative")
+	}
+	return nil
+}
+
+func (c *rateLimitConfig) makeLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(c.RequestsPerSecond), c.Burst)
+}
+
+// rateLimitedTransport delays requests to stay within a limiter's rate,
+// failing those which would have to wait longer than maxWait.
+type rateLimitedTransport struct {
+	limiter *rate.Limiter
+	maxWait time.Duration
+	next    http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reservation := t.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > t.maxWait {
+		reservation.Cancel()
+		closeRequestBody(req)
+		return nil, errRateLimited
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-req.Context().Done():
+			reservation.Cancel()
+			closeRequestBody(req)
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// A RoundTripper must always close the body, even on errors.
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
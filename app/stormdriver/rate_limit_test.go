@@ -0,0 +1,63 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+type countingTransport struct {
+	count int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count++
+	return httptest.NewRecorder().Result(), nil
+}
+
+func Test_rateLimitedTransport(t *testing.T) {
+	next := &countingTransport{}
+	transport := &rateLimitedTransport{
+		limiter: rate.NewLimiter(rate.Every(time.Hour), 2),
+		maxWait: time.Second,
+		next:    next,
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://clouddriver/credentials", nil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err, "within burst")
+		resp.Body.Close()
+	}
+	_, err := transport.RoundTrip(req)
+	assert.ErrorIs(t, err, errRateLimited)
+	assert.Equal(t, 2, next.count)
+}
+
+func Test_rateLimitConfig_applyDefaults(t *testing.T) {
+	c := &rateLimitConfig{RequestsPerSecond: 2.5}
+	c.applyDefaults()
+	assert.Equal(t, &rateLimitConfig{RequestsPerSecond: 2.5, Burst: 3, MaxWaitSeconds: defaultRateLimitMaxWaitSeconds}, c)
+	assert.NoError(t, c.validate())
+}
@@ -25,10 +25,12 @@ import (
 	"io"
 	"net/http"
 
-	"github.com/OpsMx/go-app-base/httputil"
-	"go.uber.org/zap"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// maxTracedBodyBytes is how much of a proxied response body is logged.
+const maxTracedBodyBytes = 64 * 1024
+
 func wantedHeader(k string) bool {
 	return k[0:1] == "X-" || k == "Content-Encoding" || k == "Content-Type"
 }
@@ -45,13 +47,14 @@ func simplifyHeadersForLogging(h http.Header) http.Header {
 
 func (s *srv) redirect() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		ctx, cancel := context.WithCancel(context.Background())
+		// not cancelled with the request, but traced as part of it.
+		ctx, cancel := context.WithCancel(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(req.Context())))
 		defer cancel()
 
 		reqBody, err := io.ReadAll(req.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			zap.S().Errorw("io.ReadAll", "error", err)
+			requestLogger(req.Context()).Errorw("io.ReadAll", "error", err)
 			return
 		}
 		req.Body.Close()
@@ -62,36 +65,40 @@ func (s *srv) redirect() http.HandlerFunc {
 			return
 		}
 
-		url := possibleURLs[0]
+		url := catchAllSelector.pick(possibleURLs, clouddriverManager.weightForRoute)
 		target := combineURL(url.URL, req.RequestURI)
-		httpRequest, err := http.NewRequestWithContext(ctx, req.Method, target, reqBodyReader)
+		httpRequest, err := http.NewRequestWithContext(withPassthrough(withRoute(ctx, url)), req.Method, target, reqBodyReader)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			zap.S().Errorw("http.NewRequestWithContext", "method", req.Method, "target", target, "hasToken", url.token != "", "error", err)
+			requestLogger(req.Context()).Errorw("http.NewRequestWithContext", "method", req.Method, "target", target, "hasToken", url.token != "", "error", err)
 			return
 		}
 
 		copyHeaders(httpRequest.Header, req.Header)
+		passAcceptEncoding(httpRequest.Header, req.Header)
+		noteClouddriver(req.Context(), target)
 		if url.token != "" {
 			httpRequest.Header.Set("authorization", fmt.Sprintf("Bearer %s", url.token))
 		}
 
-		resp, err := http.DefaultClient.Do(httpRequest)
+		resp, err := downstreamClients.clientFor(target).Do(httpRequest)
 		if err != nil {
+			noteDownstreamError(err)
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			zap.S().Errorw("http.DefaultClient.Do", req.Method, "target", target, "hasToken", url.token != "", "error", err)
+			requestLogger(req.Context()).Errorw("client.Do", "method", req.Method, "target", target, "hasToken", url.token != "", "error", err)
 			return
 		}
 
 		defer resp.Body.Close()
-		copyHeaders(w.Header(), resp.Header)
+		copyResponseHeaders(routeClassProxy, w.Header(), resp.Header)
+		copyContentEncoding(w.Header(), resp.Header)
+		setContentType(w, resp.Header.Get("content-type"))
 		w.WriteHeader(resp.StatusCode)
 
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			zap.S().Errorw("io.ReadAll", "error", err)
-			return
+		// stream the body, keeping only the start of it for the log.
+		respBody := &prefixBuffer{limit: maxTracedBodyBytes}
+		if _, err := streamBody(w, io.TeeReader(resp.Body, respBody)); err != nil {
+			requestLogger(req.Context()).Errorw("streaming response", "target", target, "error", err)
 		}
 
 		t := tracerContents{
@@ -102,15 +109,15 @@ func (s *srv) redirect() http.HandlerFunc {
 				URI:     req.RequestURI,
 			},
 			Response: tracerHTTP{
-				Body:       base64.StdEncoding.EncodeToString(respBody),
+				Body:       base64.StdEncoding.EncodeToString(respBody.Bytes()),
 				Headers:    simplifyHeadersForLogging(resp.Header),
 				StatusCode: resp.StatusCode,
 				URI:        target,
+				Truncated:  respBody.truncated,
 			},
 		}
 		json, _ := json.Marshal(t)
 
-		zap.S().Infof("%s", json)
-		httputil.CheckedWrite(w, respBody)
+		requestLogger(req.Context()).Infof("%s", json)
 	}
 }
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// requestIDHeader identifies one request from Gate in the logs and
+// traces of Stormdriver and of every clouddriver it asks.
+const requestIDHeader = "X-Spinnaker-Request-Id"
+
+// maxRequestIDLength limits the request IDs accepted from callers, so
+// log lines stay a reasonable size.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// validRequestID returns true if id is short, printable ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDMiddleware gives each request an ID, using the caller's if it
+// sent a valid one.  The ID is set on the request, so it is sent to
+// every clouddriver along with the other headers, and returned to the
+// caller.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			req.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDSpanMiddleware adds the request ID to the request's span.  It
+// must run inside the tracing middleware.
+func requestIDSpanMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if id := requestIDFrom(req.Context()); id != "" {
+			trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("spinnaker.request_id", id))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// requestIDFrom returns the request ID for ctx, or "" if it has none.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger to use while handling a request,
+// which adds the request ID to each line.
+func requestLogger(ctx context.Context) *zap.SugaredLogger {
+	if id := requestIDFrom(ctx); id != "" {
+		return zap.S().With("requestID", id)
+	}
+	return zap.S()
+}
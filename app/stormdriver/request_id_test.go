@@ -0,0 +1,102 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_requestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     string
+		wantSame bool
+	}{
+		{"generated when absent", "", false},
+		{"caller's kept", "gate-1234", true},
+		{"too long replaced", strings.Repeat("x", maxRequestIDLength+1), false},
+		{"unprintable replaced", "bad id", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seenHeader, seenContext string
+			h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				seenHeader = req.Header.Get(requestIDHeader)
+				seenContext = requestIDFrom(req.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/applications", nil)
+			if tt.sent != "" {
+				req.Header.Set(requestIDHeader, tt.sent)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			got := w.Header().Get(requestIDHeader)
+			assert.True(t, validRequestID(got))
+			assert.Equal(t, got, seenHeader)
+			assert.Equal(t, got, seenContext)
+			if tt.wantSame {
+				assert.Equal(t, tt.sent, got)
+			} else {
+				assert.NotEqual(t, tt.sent, got)
+			}
+		})
+	}
+}
+
+func Test_requestID_sentToEveryClouddriver(t *testing.T) {
+	seen := make(chan string, 2)
+	backend := func() string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen <- r.Header.Get(requestIDHeader)
+			// a clouddriver echoing the ID must not add a second value.
+			w.Header().Set(requestIDHeader, r.Header.Get(requestIDHeader))
+			_, _ = w.Write([]byte(`[]`))
+		}))
+		t.Cleanup(s.Close)
+		return s.URL
+	}
+	first, second := backend(), backend()
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"a": {URL: first},
+			"b": {URL: second},
+		},
+	}
+
+	s := &srv{}
+	r := mux.NewRouter()
+	r.HandleFunc("/applications/{name}/serverGroups", s.fetchList(""))
+	r.Use(requestIDMiddleware)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/applications/app/serverGroups", nil))
+
+	id := w.Header().Get(requestIDHeader)
+	assert.NotEmpty(t, id)
+	assert.Len(t, w.Header().Values(requestIDHeader), 1)
+	assert.Equal(t, id, <-seen)
+	assert.Equal(t, id, <-seen)
+}
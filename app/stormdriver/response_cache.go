@@ -0,0 +1,211 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const defaultResponseCacheMaxEntries = 1000
+
+// defaultCachedRoutes are the merged routes which Gate and Deck ask for
+// most often.
+var defaultCachedRoutes = []string{
+	"/applications",
+	"/credentials",
+	"/securityGroups",
+	"/firewalls",
+}
+
+// responseCacheConfig enables caching successful responses to GETs of
+// the listed routes (path templates) for TTLSeconds, per path, query,
+// and user.  If TTLSeconds is 0, responses are not cached.
+type responseCacheConfig struct {
+	TTLSeconds int      `yaml:"ttlSeconds,omitempty" json:"ttlSeconds,omitempty"`
+	Routes     []string `yaml:"routes,omitempty" json:"routes,omitempty"`
+	MaxEntries int      `yaml:"maxEntries,omitempty" json:"maxEntries,omitempty"`
+}
+
+func (c *responseCacheConfig) applyDefaults() {
+	if c.TTLSeconds == 0 {
+		return
+	}
+	if c.Routes == nil {
+		c.Routes = defaultCachedRoutes
+	}
+	if c.MaxEntries == 0 {
+		c.MaxEntries = defaultResponseCacheMaxEntries
+	}
+}
+
+func (c responseCacheConfig) validate() error {
+	if c.TTLSeconds < 0 {
+		return fmt.Errorf("ttlSeconds cannot be negative")
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("maxEntries cannot be negative")
+	}
+	return nil
+}
+
+var responseCacheRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "response_cache_requests_total",
+	Help:      "Requests to cached routes, by result: hit or miss.",
+}, []string{"result"})
+
+// storedResponse is a cached response, as kept in a Cache.
+type storedResponse struct {
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+// responseCache serves recent responses to merged GETs from a Cache.
+// Concurrent misses for the same key wait for the first to finish, so
+// a burst of requests to one replica fans out to the clouddrivers once.
+// A nil responseCache caches nothing.
+type responseCache struct {
+	sync.Mutex
+	ttl      time.Duration
+	routes   map[string]bool
+	backend  Cache
+	inflight map[string]chan struct{}
+}
+
+func makeResponseCache(conf responseCacheConfig, backend cacheConfig) *responseCache {
+	if conf.TTLSeconds == 0 {
+		return nil
+	}
+	c := &responseCache{
+		ttl:      time.Duration(conf.TTLSeconds) * time.Second,
+		routes:   map[string]bool{},
+		backend:  makeCache(backend, "response", conf.MaxEntries),
+		inflight: map[string]chan struct{}{},
+	}
+	for _, route := range conf.Routes {
+		c.routes[route] = true
+	}
+	return c
+}
+
+func (c *responseCache) get(ctx context.Context, key string) (*storedResponse, bool) {
+	data, found, err := c.backend.Get(ctx, key)
+	if err != nil {
+		zap.S().Warnw("response cache unavailable", "error", err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	var ret storedResponse
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, false
+	}
+	return &ret, true
+}
+
+func (c *responseCache) set(ctx context.Context, key string, response storedResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	if err := c.backend.Set(ctx, key, data, c.ttl); err != nil {
+		zap.S().Warnw("response cache unavailable", "error", err)
+	}
+}
+
+// claim returns a channel to close when done fetching key, or if
+// another request is already fetching it, that request's channel to
+// wait on.
+func (c *responseCache) claim(key string) (done chan struct{}, wait chan struct{}) {
+	c.Lock()
+	defer c.Unlock()
+	if wait, busy := c.inflight[key]; busy {
+		return nil, wait
+	}
+	done = make(chan struct{})
+	c.inflight[key] = done
+	return done, nil
+}
+
+func (c *responseCache) release(key string, done chan struct{}) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.inflight, key)
+	close(done)
+}
+
+func writeCachedResponse(w http.ResponseWriter, response *storedResponse) {
+	responseCacheRequests.WithLabelValues("hit").Inc()
+	w.Header().Set("content-type", response.ContentType)
+	w.Header().Set("x-stormdriver-cache", "hit")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, response.Body)
+}
+
+func (c *responseCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if c == nil || req.Method != http.MethodGet || !c.routes[routeTemplate(req)] {
+			next.ServeHTTP(w, req)
+			return
+		}
+		key := responseCacheKey(req)
+		for {
+			if cached, found := c.get(req.Context(), key); found {
+				writeCachedResponse(w, cached)
+				return
+			}
+			done, wait := c.claim(key)
+			if wait != nil {
+				select {
+				case <-wait:
+					continue
+				case <-req.Context().Done():
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+			defer c.release(key, done)
+			// the request which held the claim may have just finished.
+			if cached, found := c.get(req.Context(), key); found {
+				writeCachedResponse(w, cached)
+				return
+			}
+
+			responseCacheRequests.WithLabelValues("miss").Inc()
+			w.Header().Set("x-stormdriver-cache", "miss")
+			rec := &responseCapture{ResponseWriter: w}
+			next.ServeHTTP(rec, req)
+			// compressed bodies are not cached, as the next client may
+			// not accept the encoding.
+			if rec.statusCode == http.StatusOK && w.Header().Get("content-encoding") == "" {
+				c.set(req.Context(), key, storedResponse{ContentType: w.Header().Get("content-type"), Body: rec.body.Bytes()})
+			}
+			return
+		}
+	})
+}
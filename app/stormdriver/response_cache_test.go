@@ -0,0 +1,105 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_responseCache_middleware(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusOK)
+	c := makeResponseCache(responseCacheConfig{TTLSeconds: 60, Routes: []string{"/credentials"}, MaxEntries: 10}, cacheConfig{Type: cacheTypeMemory})
+	r := mux.NewRouter()
+	r.Use(c.middleware)
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		_, _ = w.Write([]byte(`[]`))
+	}
+	r.HandleFunc("/credentials", handler)
+	r.HandleFunc("/applications", handler)
+
+	get := func(path string, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("x-spinnaker-user", user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/credentials", "alice")
+	assert.Equal(t, "miss", w.Header().Get("x-stormdriver-cache"))
+	w = get("/credentials", "alice")
+	assert.Equal(t, "hit", w.Header().Get("x-stormdriver-cache"))
+	assert.Equal(t, "application/json", w.Header().Get("content-type"))
+	assert.Equal(t, "[]", w.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	get("/credentials", "bob")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "cached per user")
+
+	get("/applications", "alice")
+	get("/applications", "alice")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "route not cached")
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	get("/credentials?expand=true", "alice")
+	get("/credentials?expand=true", "alice")
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls), "failures not cached")
+}
+
+func Test_responseCache_coalesces(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	c := makeResponseCache(responseCacheConfig{TTLSeconds: 60, Routes: []string{"/credentials"}, MaxEntries: 10}, cacheConfig{Type: cacheTypeMemory})
+	r := mux.NewRouter()
+	r.Use(c.middleware)
+	r.HandleFunc("/credentials", func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		_, _ = w.Write([]byte(`[]`))
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/credentials", nil))
+			assert.Equal(t, "[]", w.Body.String())
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func Test_makeResponseCache_disabled(t *testing.T) {
+	assert.Nil(t, makeResponseCache(responseCacheConfig{}, cacheConfig{}))
+}
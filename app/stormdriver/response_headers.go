@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Route classes which return a single clouddriver's response headers.
+const (
+	// routeClassAccount is used for requests routed by account name.
+	routeClassAccount = "account"
+	// routeClassProxy is used for requests passed through to any clouddriver.
+	routeClassProxy = "proxy"
+	// routeClassDefault applies to classes with no policy of their own.
+	routeClassDefault = "default"
+)
+
+// headerPolicy selects which upstream response headers are returned to
+// the caller.  If Allow is not empty, only the headers it matches are
+// returned; headers matched by Deny never are.  Each entry is a header
+// name, or a prefix ending in "*", and is not case sensitive.
+type headerPolicy struct {
+	Allow []string `yaml:"allow,omitempty" json:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty" json:"deny,omitempty"`
+}
+
+func headerPatternMatches(pattern string, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == name
+}
+
+func headerMatchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if headerPatternMatches(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p headerPolicy) allows(name string) bool {
+	if len(p.Allow) > 0 && !headerMatchesAny(p.Allow, name) {
+		return false
+	}
+	return !headerMatchesAny(p.Deny, name)
+}
+
+// responseHeadersConfig holds a headerPolicy for each route class.
+type responseHeadersConfig map[string]headerPolicy
+
+func (p headerPolicy) validate() error {
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if pattern == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+			return fmt.Errorf("invalid header pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (c responseHeadersConfig) validate() error {
+	for class, policy := range c {
+		switch class {
+		case routeClassAccount, routeClassProxy, routeClassDefault:
+		default:
+			return fmt.Errorf("unknown route class %q", class)
+		}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("%s: %v", class, err)
+		}
+	}
+	return nil
+}
+
+// policyFor returns the policy for the route class, falling back to the
+// default class, and then to allowing everything.
+func (c responseHeadersConfig) policyFor(class string) headerPolicy {
+	if p, found := c[class]; found {
+		return p
+	}
+	return c[routeClassDefault]
+}
+
+var responseHeaderPolicies = responseHeadersConfig{}
+
+// defaultRequestHeaderPolicy is used when requestHeaders is not set.
+// Stormdriver identifies itself to clouddrivers, rather than passing
+// on the caller's user agent.
+var defaultRequestHeaderPolicy = headerPolicy{Deny: []string{"User-Agent"}}
+
+// requestHeaderPolicy selects which of the caller's request headers are
+// sent on to clouddrivers.
+var requestHeaderPolicy = defaultRequestHeaderPolicy
+
+// copyResponseHeaders copies the upstream response headers which the
+// route class's policy allows.  Hop-by-hop headers and those Stormdriver
+// sets itself, such as the request ID, are never copied.
+func copyResponseHeaders(class string, dst, src http.Header) {
+	policy := responseHeaderPolicies.policyFor(class)
+	skip := hopByHop(src)
+	for k, vv := range src {
+		if skip[k] || managedResponseHeaders[k] || k == requestIDHeader || !policy.allows(k) {
+			continue
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_headerPolicy_allows(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy headerPolicy
+		header string
+		want   bool
+	}{
+		{"empty policy", headerPolicy{}, "X-Anything", true},
+		{"denied exactly", headerPolicy{Deny: []string{"x-gateway-id"}}, "X-Gateway-Id", false},
+		{"denied by prefix", headerPolicy{Deny: []string{"X-Gateway-*"}}, "X-Gateway-Id", false},
+		{"not denied", headerPolicy{Deny: []string{"X-Gateway-*"}}, "X-Ratelimit-Remaining", true},
+		{"allowed by prefix", headerPolicy{Allow: []string{"X-RateLimit-*"}}, "X-Ratelimit-Remaining", true},
+		{"not allowed", headerPolicy{Allow: []string{"X-RateLimit-*"}}, "X-Gateway-Id", false},
+		{"deny wins", headerPolicy{Allow: []string{"X-*"}, Deny: []string{"X-Gateway-*"}}, "X-Gateway-Id", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.allows(tt.header))
+		})
+	}
+}
+
+func Test_responseHeadersConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    responseHeadersConfig
+		wantErr bool
+	}{
+		{"empty", responseHeadersConfig{}, false},
+		{"known classes", responseHeadersConfig{"account": {}, "proxy": {}, "default": {}}, false},
+		{"unknown class", responseHeadersConfig{"aggregate": {}}, true},
+		{"empty pattern", responseHeadersConfig{"proxy": {Deny: []string{""}}}, true},
+		{"inner wildcard", responseHeadersConfig{"proxy": {Allow: []string{"X-*-Id"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_copyResponseHeaders(t *testing.T) {
+	saved := responseHeaderPolicies
+	defer func() { responseHeaderPolicies = saved }()
+	responseHeaderPolicies = responseHeadersConfig{
+		"default": {Deny: []string{"X-Gateway-*"}},
+		"proxy":   {Allow: []string{"X-RateLimit-*"}},
+	}
+
+	src := http.Header{
+		"Content-Length":        {"10"},
+		"X-Gateway-Id":          {"gw"},
+		"X-Ratelimit-Remaining": {"5"},
+		"X-Request-Id":          {"r1"},
+	}
+
+	got := http.Header{}
+	copyResponseHeaders(routeClassAccount, got, src)
+	assert.Equal(t, http.Header{"X-Ratelimit-Remaining": {"5"}, "X-Request-Id": {"r1"}}, got)
+
+	got = http.Header{}
+	copyResponseHeaders(routeClassProxy, got, src)
+	assert.Equal(t, http.Header{"X-Ratelimit-Remaining": {"5"}}, got)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errResponseTooLarge = errors.New("clouddriver response too large")
+
+var downstreamResponsesTooLarge = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "downstream_responses_too_large_total",
+	Help:      "Responses from clouddrivers abandoned for exceeding maxResponseBytes.",
+})
+
+func validateMaxResponseBytes(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("cannot be negative")
+	}
+	return nil
+}
+
+type passthroughKey struct{}
+
+// withPassthrough marks requests made from ctx as having their
+// responses copied to the caller as they are read, rather than held in
+// memory.
+func withPassthrough(ctx context.Context) context.Context {
+	return context.WithValue(ctx, passthroughKey{}, true)
+}
+
+func isPassthrough(ctx context.Context) bool {
+	passthrough, _ := ctx.Value(passthroughKey{}).(bool)
+	return passthrough
+}
+
+// responseSizeLimitedTransport fails responses with bodies longer than
+// limit, so a misbehaving clouddriver cannot make Stormdriver run out
+// of memory.  Streaming responses are not limited, as they are never
+// held in memory and are expected to go on indefinitely.  Passed
+// through responses are only checked against their Content-Length, as
+// by the time the body is read the caller has been sent the status, and
+// cutting it short would leave a truncated body behind a 200.
+type responseSizeLimitedTransport struct {
+	limit int64
+	next  http.RoundTripper
+}
+
+func (t *responseSizeLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || isStreaming(req.Context()) {
+		return resp, err
+	}
+	if resp.ContentLength > t.limit {
+		resp.Body.Close()
+		downstreamResponsesTooLarge.Inc()
+		return nil, fmt.Errorf("%w: content-length %d exceeds %d", errResponseTooLarge, resp.ContentLength, t.limit)
+	}
+	if !isPassthrough(req.Context()) {
+		resp.Body = &limitedBody{body: resp.Body, remaining: t.limit}
+	}
+	return resp, nil
+}
+
+// limitedBody returns errResponseTooLarge once more than its limit has
+// been read.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// read one byte past the limit, to tell a body of exactly the limit
+	// from a longer one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		downstreamResponsesTooLarge.Inc()
+		return n + int(b.remaining), errResponseTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// downstreamErrorStatus is the status returned to the caller when a
+// request to a clouddriver fails with err.
+func downstreamErrorStatus(err error) int {
+	if errors.Is(err, errResponseTooLarge) {
+		return http.StatusBadGateway
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_responseSizeLimitedTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("content-length", "100")
+		}
+		_, _ = io.WriteString(w, body)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name        string
+		limit       int64
+		query       string
+		stream      bool
+		passthrough bool
+		wantErr     bool
+	}{
+		{"exactly the limit", 100, "", false, false, false},
+		{"content-length over the limit", 99, "", false, false, true},
+		{"chunked over the limit", 99, "?chunked=1", false, false, true},
+		{"chunked within the limit", 1000, "?chunked=1", false, false, false},
+		{"streaming is not limited", 10, "?chunked=1", true, false, false},
+		{"passthrough content-length over the limit", 99, "", false, true, true},
+		{"passthrough body is not cut short", 10, "?chunked=1", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &clientRegistry{destinations: map[string]*destinationClient{}}
+			r.configure(httputil.ClientConfig{}, dialerConfig{}, nil)
+			r.setMaxResponseBytes(tt.limit)
+
+			req, err := http.NewRequest(http.MethodGet, backend.URL+"/applications"+tt.query, nil)
+			require.NoError(t, err)
+			if tt.stream {
+				req = req.WithContext(withStreaming(req.Context()))
+			}
+			if tt.passthrough {
+				req = req.WithContext(withPassthrough(req.Context()))
+			}
+			resp, err := r.clientFor(req.URL.String()).Do(req)
+			var body []byte
+			if err == nil {
+				body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errResponseTooLarge)
+				assert.Equal(t, http.StatusBadGateway, downstreamErrorStatus(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, body, 100)
+		})
+	}
+}
+
+func Test_retryConfig_shouldRetry_responseTooLarge(t *testing.T) {
+	c := &retryConfig{Attempts: 3}
+	assert.False(t, c.shouldRetry(1, 0, errResponseTooLarge))
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultRetryAttempts             = 1
+	defaultRetryInitialBackoffMillis = 100
+	defaultRetryMaxBackoffMillis     = 2000
+)
+
+var defaultRetryStatusCodes = []int{
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// retryConfig retries GET requests to clouddrivers which fail with a
+// connection error or one of StatusCodes.  Attempts includes the first
+// request, so 1, the default, disables retries.  The wait between
+// attempts doubles from InitialBackoffMillis up to MaxBackoffMillis,
+// with jitter.
+type retryConfig struct {
+	Attempts             int   `yaml:"attempts,omitempty" json:"attempts,omitempty"`
+	InitialBackoffMillis int   `yaml:"initialBackoffMillis,omitempty" json:"initialBackoffMillis,omitempty"`
+	MaxBackoffMillis     int   `yaml:"maxBackoffMillis,omitempty" json:"maxBackoffMillis,omitempty"`
+	StatusCodes          []int `yaml:"statusCodes,omitempty" json:"statusCodes,omitempty"`
+}
+
+func (c *retryConfig) applyDefaults() {
+	if c.Attempts == 0 {
+		c.Attempts = defaultRetryAttempts
+	}
+	if c.InitialBackoffMillis == 0 {
+		c.InitialBackoffMillis = defaultRetryInitialBackoffMillis
+	}
+	if c.MaxBackoffMillis == 0 {
+		c.MaxBackoffMillis = defaultRetryMaxBackoffMillis
+	}
+	if c.StatusCodes == nil {
+		c.StatusCodes = defaultRetryStatusCodes
+	}
+}
+
+func (c *retryConfig) validate() error {
+	if c.Attempts < 1 {
+		return fmt.Errorf("attempts must be positive")
+	}
+	if c.InitialBackoffMillis < 0 || c.MaxBackoffMillis < 0 {
+		return fmt.Errorf("backoff cannot be negative")
+	}
+	if c.MaxBackoffMillis < c.InitialBackoffMillis {
+		return fmt.Errorf("maxBackoffMillis cannot be less than initialBackoffMillis")
+	}
+	for _, code := range c.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+	}
+	return nil
+}
+
+var getRetries = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "get_retries_total",
+	Help:      "GET requests to clouddrivers which were retried, by the failed attempt's status code, or \"error\".",
+}, []string{"reason"})
+
+// shouldRetry returns true if a GET which has been tried attempt times
+// and returned statusCode or err should be tried again.  A nil policy
+// never retries.
+func (c *retryConfig) shouldRetry(attempt int, statusCode int, err error) bool {
+	if c == nil || attempt >= c.Attempts {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled) &&
+			!errors.Is(err, context.DeadlineExceeded) &&
+			!errors.Is(err, errRateLimited) &&
+			!errors.Is(err, errConcurrencyLimited) &&
+			!errors.Is(err, errResponseTooLarge)
+	}
+	for _, code := range c.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait after the given failed attempt.
+func (c *retryConfig) backoff(attempt int) time.Duration {
+	d := time.Duration(c.InitialBackoffMillis) * time.Millisecond
+	limit := time.Duration(c.MaxBackoffMillis) * time.Millisecond
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	if d <= 0 {
+		return 0
+	}
+	// wait between half and all of d, so retries from many requests
+	// do not arrive together.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func retryReason(statusCode int, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return strconv.Itoa(statusCode)
+}
+
+// sleepContext waits for d, returning false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_retryConfig_shouldRetry(t *testing.T) {
+	c := &retryConfig{Attempts: 3}
+	c.applyDefaults()
+
+	tests := []struct {
+		name       string
+		policy     *retryConfig
+		attempt    int
+		statusCode int
+		err        error
+		want       bool
+	}{
+		{"nil policy", nil, 1, http.StatusServiceUnavailable, nil, false},
+		{"retryable status", c, 1, http.StatusServiceUnavailable, nil, true},
+		{"ok", c, 1, http.StatusOK, nil, false},
+		{"not found", c, 1, http.StatusNotFound, nil, false},
+		{"connection error", c, 2, -1, errors.New("connection refused"), true},
+		{"out of attempts", c, 3, http.StatusBadGateway, nil, false},
+		{"canceled", c, 1, -1, context.Canceled, false},
+		{"deadline", c, 1, -1, context.DeadlineExceeded, false},
+		{"rate limited", c, 1, -1, errRateLimited, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.shouldRetry(tt.attempt, tt.statusCode, tt.err))
+		})
+	}
+}
+
+func Test_retryConfig_backoff(t *testing.T) {
+	c := &retryConfig{InitialBackoffMillis: 100, MaxBackoffMillis: 300}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 300 * time.Millisecond},
+		{10, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := c.backoff(tt.attempt)
+		assert.GreaterOrEqual(t, got, tt.max/2)
+		assert.LessOrEqual(t, got, tt.max)
+	}
+}
+
+func Test_retryConfig_applyDefaults(t *testing.T) {
+	c := &retryConfig{}
+	c.applyDefaults()
+	assert.Equal(t, 1, c.Attempts)
+	assert.False(t, c.shouldRetry(1, http.StatusServiceUnavailable, nil), "retries are off unless attempts is set")
+}
+
+func Test_retryConfig_validate(t *testing.T) {
+	assert.Error(t, (&retryConfig{Attempts: 0}).validate())
+	assert.Error(t, (&retryConfig{Attempts: 2, InitialBackoffMillis: 10, MaxBackoffMillis: 5}).validate())
+	assert.Error(t, (&retryConfig{Attempts: 2, StatusCodes: []int{1000}}).validate())
+	c := &retryConfig{}
+	c.applyDefaults()
+	assert.NoError(t, c.validate())
+}
+
+func Test_fetchGet_retry(t *testing.T) {
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer backend.Close()
+
+	old := downstreamClients
+	defer func() { downstreamClients = old }()
+	downstreamClients = &clientRegistry{
+		config:        defaultHTTPClientConfig,
+		defaultClient: http.DefaultClient,
+		destinations:  map[string]*destinationClient{},
+	}
+
+	_, code, _, err := fetchGet(context.Background(), backend.URL, "", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "no retries by default")
+
+	atomic.StoreInt32(&calls, 0)
+	downstreamClients.setRetry(&retryConfig{Attempts: 2, InitialBackoffMillis: 1, MaxBackoffMillis: 1, StatusCodes: defaultRetryStatusCodes})
+	_, code, _, err = fetchGet(context.Background(), backend.URL, "", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "two attempts are not enough")
+
+	// the clouddriver's own policy replaces the default.
+	atomic.StoreInt32(&calls, 0)
+	downstreamClients.register(backend.URL, clientOptions{retry: &retryConfig{Attempts: 3, InitialBackoffMillis: 1, MaxBackoffMillis: 1, StatusCodes: defaultRetryStatusCodes}})
+	body, code, _, err := fetchGet(context.Background(), backend.URL, "", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]", string(body))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	// routeDiffHistory is how many non-empty diffs are kept.
+	routeDiffHistory = 20
+
+	// largeRouteChangeFraction is the fraction of the previous routes
+	// which, if removed or re-homed by one sync, is worth a warning.
+	largeRouteChangeFraction = 0.1
+
+	routeKindAccount         = "account"
+	routeKindArtifactAccount = "artifactAccount"
+)
+
+var (
+	routeChanges = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stormdriver",
+		Name:      "route_changes_total",
+		Help:      "Account routes changed by credential syncs, by kind and change (added, removed, or rehomed).",
+	}, []string{"kind", "change"})
+
+	routeCount = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "stormdriver",
+		Name:      "routes",
+		Help:      "Account routes after the last credential sync, by kind.",
+	}, []string{"kind"})
+)
+
+// rehomedAccount is an account which moved to another clouddriver.
+type rehomedAccount struct {
+	Account string `json:"account"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// routeDiff is the change in routes made by one credential sync.
+type routeDiff struct {
+	Kind     string           `json:"kind"`
+	Time     time.Time        `json:"time"`
+	Previous int              `json:"previous"`
+	Current  int              `json:"current"`
+	Added    []string         `json:"added,omitempty"`
+	Removed  []string         `json:"removed,omitempty"`
+	Rehomed  []rehomedAccount `json:"rehomed,omitempty"`
+}
+
+func (d routeDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Rehomed) == 0
+}
+
+// large returns true if the sync removed or re-homed a large part of
+// the previous routes, which usually means a clouddriver is broken.
+func (d routeDiff) large() bool {
+	if d.Previous == 0 {
+		return false
+	}
+	changed := len(d.Removed) + len(d.Rehomed)
+	return float64(changed)/float64(d.Previous) > largeRouteChangeFraction
+}
+
+// nameForRouteKey returns the name of the clouddriver with the given
+// route key, or "" if it is not known.  Must be called with the lock held.
+func (m *ClouddriverManager) nameForRouteKey(key string) string {
+	for _, cd := range m.state {
+		if cd.routeKey() == key {
+			return cd.Name
+		}
+	}
+	return ""
+}
+
+// routeTarget names a route's clouddriver, or its URL if the
+// clouddriver is not known.  Must be called with the lock held.
+func (m *ClouddriverManager) routeTarget(route URLAndPriority) string {
+	if name := m.nameForRouteKey(route.key()); name != "" {
+		return name
+	}
+	return route.URL
+}
+
+// diffRoutes compares two routing tables.  Must be called with the lock held.
+func (m *ClouddriverManager) diffRoutes(kind string, previous map[string]URLAndPriority, current map[string]URLAndPriority) routeDiff {
+	d := routeDiff{
+		Kind:     kind,
+		Time:     time.Now().UTC(),
+		Previous: len(previous),
+		Current:  len(current),
+	}
+	for name, route := range current {
+		old, found := previous[name]
+		if !found {
+			d.Added = append(d.Added, name)
+			continue
+		}
+		if old.key() != route.key() {
+			d.Rehomed = append(d.Rehomed, rehomedAccount{Account: name, From: m.routeTarget(old), To: m.routeTarget(route)})
+		}
+	}
+	for name := range previous {
+		if _, found := current[name]; !found {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Slice(d.Rehomed, func(i, j int) bool { return d.Rehomed[i].Account < d.Rehomed[j].Account })
+	return d
+}
+
+// recordRouteDiff updates metrics, logs, and keeps the diff if it is
+// not empty.  Must be called with the lock held.
+func (m *ClouddriverManager) recordRouteDiff(d routeDiff) {
+	routeCount.WithLabelValues(d.Kind).Set(float64(d.Current))
+	if d.empty() {
+		return
+	}
+	routeChanges.WithLabelValues(d.Kind, "added").Add(float64(len(d.Added)))
+	routeChanges.WithLabelValues(d.Kind, "removed").Add(float64(len(d.Removed)))
+	routeChanges.WithLabelValues(d.Kind, "rehomed").Add(float64(len(d.Rehomed)))
+
+	fields := []interface{}{
+		"kind", d.Kind,
+		"previous", d.Previous,
+		"current", d.Current,
+		"added", d.Added,
+		"removed", d.Removed,
+		"rehomed", d.Rehomed,
+	}
+	if d.large() {
+		zap.S().Warnw("large change in account routes", fields...)
+	} else {
+		zap.S().Infow("account routes changed", fields...)
+	}
+
+	m.routeDiffs = append(m.routeDiffs, d)
+	if len(m.routeDiffs) > routeDiffHistory {
+		m.routeDiffs = m.routeDiffs[len(m.routeDiffs)-routeDiffHistory:]
+	}
+}
+
+func (m *ClouddriverManager) getRouteDiffs() []routeDiff {
+	m.Lock()
+	defer m.Unlock()
+	return append([]routeDiff{}, m.routeDiffs...)
+}
+
+func (*srv) routeDiffsRequest(w http.ResponseWriter, req *http.Request) {
+	json, err := json.Marshal(clouddriverManager.getRouteDiffs())
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
+
+// refreshRequest syncs the credentials from every clouddriver now,
+// rather than waiting for the next scheduled sync, and returns what
+// changed.  The sync is not cancelled if the client goes away, as a
+// partial sync would drop routes.
+func (*srv) refreshRequest(w http.ResponseWriter, req *http.Request) {
+	ctx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(req.Context()))
+	accounts, artifactAccounts := clouddriverManager.syncAccounts(ctx)
+	ret := struct {
+		Accounts         routeDiff `json:"accounts"`
+		ArtifactAccounts routeDiff `json:"artifactAccounts"`
+	}{accounts, artifactAccounts}
+	json, err := json.Marshal(ret)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
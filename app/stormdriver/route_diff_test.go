@@ -0,0 +1,154 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/OpsMx/go-app-base/tracer"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClouddriverManager_diffRoutes(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:cd1": {Name: "cd1", URL: "url1"},
+			"config:cd2": {Name: "cd2", URL: "url2"},
+		},
+	}
+	previous := map[string]URLAndPriority{
+		"same":    {URL: "url1"},
+		"moved":   {URL: "url1"},
+		"gone":    {URL: "url2"},
+		"unknown": {URL: "url3"},
+	}
+	current := map[string]URLAndPriority{
+		"same":    {URL: "url1"},
+		"moved":   {URL: "url2"},
+		"new":     {URL: "url2"},
+		"unknown": {URL: "url1"},
+	}
+
+	d := m.diffRoutes(routeKindAccount, previous, current)
+	assert.Equal(t, []string{"new"}, d.Added)
+	assert.Equal(t, []string{"gone"}, d.Removed)
+	assert.Equal(t, []rehomedAccount{
+		{Account: "moved", From: "cd1", To: "cd2"},
+		{Account: "unknown", From: "url3", To: "cd1"},
+	}, d.Rehomed)
+	assert.True(t, d.large())
+	assert.False(t, d.empty())
+
+	assert.True(t, m.diffRoutes(routeKindAccount, current, current).empty())
+}
+
+func Test_routeDiff_large(t *testing.T) {
+	var tests = []struct {
+		name string
+		diff routeDiff
+		want bool
+	}{
+		{"first sync", routeDiff{Previous: 0, Added: []string{"a"}}, false},
+		{"only additions", routeDiff{Previous: 2, Added: []string{"a", "b", "c"}}, false},
+		{"small removal", routeDiff{Previous: 20, Removed: []string{"a", "b"}}, false},
+		{"large removal", routeDiff{Previous: 20, Removed: []string{"a", "b", "c"}}, true},
+		{"large rehome", routeDiff{Previous: 5, Rehomed: []rehomedAccount{{Account: "a"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.diff.large())
+		})
+	}
+}
+
+func Test_ClouddriverManager_recordRouteDiff(t *testing.T) {
+	m := &ClouddriverManager{}
+	m.recordRouteDiff(routeDiff{Kind: routeKindAccount})
+	assert.Empty(t, m.getRouteDiffs(), "empty diffs are not kept")
+
+	for i := 0; i < routeDiffHistory+5; i++ {
+		m.recordRouteDiff(routeDiff{Kind: routeKindAccount, Previous: i, Added: []string{"a"}})
+	}
+	diffs := m.getRouteDiffs()
+	assert.Len(t, diffs, routeDiffHistory)
+	assert.Equal(t, 5, diffs[0].Previous, "oldest diffs are dropped")
+}
+
+func Test_srv_refreshRequest(t *testing.T) {
+	oldProvider := tracerProvider
+	defer func() { tracerProvider = oldProvider }()
+	var err error
+	tracerProvider, err = tracer.NewTracerProvider("", false, "test", appName, 0)
+	require.NoError(t, err)
+
+	credentials := `[{"name":"a1","type":"kubernetes"}]`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		if req.URL.Path == "/credentials" {
+			_, _ = w.Write([]byte(credentials))
+			return
+		}
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer backend.Close()
+
+	// the clients name their spans from the manager, which must not be
+	// locked while credentials are fetched.
+	oldClients := downstreamClients
+	defer func() { downstreamClients = oldClients }()
+	downstreamClients = &clientRegistry{destinations: map[string]*destinationClient{}}
+	downstreamClients.configure(httputil.ClientConfig{}, dialerConfig{}, nil)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		state: map[string]*trackedClouddriver{"config:alice": {Name: "alice", URL: backend.URL}},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"gone": {URL: backend.URL},
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{},
+	}
+
+	s := &srv{adminToken: "secret"}
+	r := mux.NewRouter()
+	s.routes(r)
+	req := httptest.NewRequest(http.MethodPost, "/_internal/refresh", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.Header.Set("authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var got struct {
+		Accounts         routeDiff `json:"accounts"`
+		ArtifactAccounts routeDiff `json:"artifactAccounts"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, []string{"a1"}, got.Accounts.Added)
+	assert.Equal(t, []string{"gone"}, got.Accounts.Removed)
+	assert.True(t, got.ArtifactAccounts.empty())
+	_, found := clouddriverManager.findCloudRoute("a1")
+	assert.True(t, found)
+}
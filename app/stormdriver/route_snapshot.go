@@ -0,0 +1,176 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"go.uber.org/zap"
+)
+
+// routeSnapshot is an exported copy of the routing state.  Tokens are
+// never exported; on import, they are found by matching the URL against
+// the currently known clouddrivers.
+type routeSnapshot struct {
+	ExportedAt            time.Time                 `json:"exportedAt"`
+	Accounts              []trackedSpinnakerAccount `json:"accounts"`
+	AccountRoutes         map[string]URLAndPriority `json:"accountRoutes"`
+	ArtifactAccounts      []trackedSpinnakerAccount `json:"artifactAccounts"`
+	ArtifactAccountRoutes map[string]URLAndPriority `json:"artifactAccountRoutes"`
+}
+
+// exportRoutes returns a snapshot of the current, live routing state.
+func (m *ClouddriverManager) exportRoutes() routeSnapshot {
+	m.Lock()
+	defer m.Unlock()
+	return routeSnapshot{
+		ExportedAt:            time.Now().UTC(),
+		Accounts:              copyTrackedAccounts(m.cloudAccounts),
+		AccountRoutes:         copyRoutes(m.cloudAccountRoutes),
+		ArtifactAccounts:      copyTrackedAccounts(m.artifactAccounts),
+		ArtifactAccountRoutes: copyRoutes(m.artifactAccountRoutes),
+	}
+}
+
+// importRoutes installs a previously exported snapshot.  Imported routes
+// are advisory: they are only used for accounts which have no live route,
+// and each is discarded once a credential sync finds a live route for it.
+func (m *ClouddriverManager) importRoutes(snapshot routeSnapshot) {
+	m.Lock()
+	defer m.Unlock()
+	if snapshot.AccountRoutes == nil {
+		snapshot.AccountRoutes = map[string]URLAndPriority{}
+	}
+	if snapshot.ArtifactAccountRoutes == nil {
+		snapshot.ArtifactAccountRoutes = map[string]URLAndPriority{}
+	}
+	m.importedRoutes = &snapshot
+	m.pruneImportedRoutes()
+}
+
+func (m *ClouddriverManager) clearImportedRoutes() {
+	m.Lock()
+	defer m.Unlock()
+	m.importedRoutes = nil
+}
+
+// pruneImportedRoutes drops imported routes which now have a live route.
+// Must be called with the lock held.
+func (m *ClouddriverManager) pruneImportedRoutes() {
+	if m.importedRoutes == nil {
+		return
+	}
+	for name := range m.importedRoutes.AccountRoutes {
+		if _, found := m.cloudAccountRoutes[name]; found {
+			delete(m.importedRoutes.AccountRoutes, name)
+		}
+	}
+	for name := range m.importedRoutes.ArtifactAccountRoutes {
+		if _, found := m.artifactAccountRoutes[name]; found {
+			delete(m.importedRoutes.ArtifactAccountRoutes, name)
+		}
+	}
+	if len(m.importedRoutes.AccountRoutes) == 0 && len(m.importedRoutes.ArtifactAccountRoutes) == 0 {
+		zap.S().Infow("all imported routes replaced by live routes")
+		m.importedRoutes = nil
+	}
+}
+
+// findImportedRoute looks up a stale, imported route, and fills in
+// the token from any currently known clouddriver with the same URL.
+// Must be called with the lock held.
+func (m *ClouddriverManager) findImportedRoute(name string, artifact bool) (URLAndPriority, bool) {
+	if m.importedRoutes == nil {
+		return URLAndPriority{}, false
+	}
+	routes := m.importedRoutes.AccountRoutes
+	if artifact {
+		routes = m.importedRoutes.ArtifactAccountRoutes
+	}
+	route, found := routes[name]
+	if !found {
+		return URLAndPriority{}, false
+	}
+	route.token = m.tokenForURL(route.URL)
+	return route, true
+}
+
+// Must be called with the lock held.
+func (m *ClouddriverManager) tokenForURL(url string) string {
+	for _, cd := range m.state {
+		if cd.URL == url {
+			return cd.token
+		}
+	}
+	return ""
+}
+
+// importedRouteTargets returns the distinct targets of any imported routes.
+// Must be called with the lock held.
+func (m *ClouddriverManager) importedRouteTargets() []URLAndPriority {
+	if m.importedRoutes == nil {
+		return []URLAndPriority{}
+	}
+	ret := []URLAndPriority{}
+	for _, routes := range []map[string]URLAndPriority{m.importedRoutes.AccountRoutes, m.importedRoutes.ArtifactAccountRoutes} {
+		for _, route := range routes {
+			route.token = m.tokenForURL(route.URL)
+			ret = append(ret, route)
+		}
+	}
+	return ret
+}
+
+func (*srv) exportRoutesRequest(w http.ResponseWriter, req *http.Request) {
+	json, err := json.Marshal(clouddriverManager.exportRoutes())
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
+
+func (*srv) importRoutesRequest(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		zap.S().Errorw("io.ReadAll", "error", err)
+		return
+	}
+	var snapshot routeSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		httputil.SetError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	clouddriverManager.importRoutes(snapshot)
+	zap.S().Infow("imported route snapshot",
+		"exportedAt", snapshot.ExportedAt,
+		"accountRoutes", len(snapshot.AccountRoutes),
+		"artifactAccountRoutes", len(snapshot.ArtifactAccountRoutes))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (*srv) clearImportedRoutesRequest(w http.ResponseWriter, req *http.Request) {
+	clouddriverManager.clearImportedRoutes()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClouddriverManager_importRoutes(t *testing.T) {
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"controller:agent:cd": {Name: "cd", URL: "url1", token: "secret"},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{
+			"live": {URL: "url2"},
+		},
+		artifactAccountRoutes: map[string]URLAndPriority{},
+	}
+
+	m.importRoutes(routeSnapshot{
+		AccountRoutes: map[string]URLAndPriority{
+			"live":  {URL: "url1"},
+			"stale": {URL: "url1"},
+		},
+	})
+
+	route, found := m.findCloudRoute("stale")
+	assert.True(t, found)
+	assert.Equal(t, URLAndPriority{URL: "url1", token: "secret"}, route, "token is restored from state")
+
+	route, found = m.findCloudRoute("live")
+	assert.True(t, found)
+	assert.Equal(t, URLAndPriority{URL: "url2"}, route, "live routes win")
+
+	// a sync which finds a live route for the last imported account clears the import
+	m.cloudAccountRoutes["stale"] = URLAndPriority{URL: "url3"}
+	m.pruneImportedRoutes()
+	assert.Nil(t, m.importedRoutes)
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"go.uber.org/zap"
+)
+
+// routingRuleConfig routes accounts whose names match a regular
+// expression (Pattern) or a shell glob (Glob) to a named clouddriver.
+type routingRuleConfig struct {
+	Pattern     string `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	Glob        string `yaml:"glob,omitempty" json:"glob,omitempty"`
+	Clouddriver string `yaml:"clouddriver,omitempty" json:"clouddriver,omitempty"`
+}
+
+// routingRule is a compiled routingRuleConfig.
+type routingRule struct {
+	routingRuleConfig
+	re *regexp.Regexp
+}
+
+func (r routingRule) String() string {
+	if r.re != nil {
+		return r.Pattern
+	}
+	return r.Glob
+}
+
+func (r routingRule) matches(account string) bool {
+	if r.re != nil {
+		return r.re.MatchString(account)
+	}
+	matched, _ := path.Match(r.Glob, account)
+	return matched
+}
+
+// compileRoutingRules checks and compiles the rules, keeping their order.
+func compileRoutingRules(rules []routingRuleConfig) ([]routingRule, error) {
+	ret := make([]routingRule, 0, len(rules))
+	for idx, rule := range rules {
+		compiled := routingRule{routingRuleConfig: rule}
+		switch {
+		case rule.Clouddriver == "":
+			return nil, fmt.Errorf("rule %d: clouddriver is required", idx+1)
+		case rule.Pattern != "" && rule.Glob != "":
+			return nil, fmt.Errorf("rule %d: only one of pattern and glob may be set", idx+1)
+		case rule.Pattern != "":
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", idx+1, err)
+			}
+			compiled.re = re
+		case rule.Glob != "":
+			if _, err := path.Match(rule.Glob, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", idx+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("rule %d: one of pattern and glob is required", idx+1)
+		}
+		ret = append(ret, compiled)
+	}
+	return ret, nil
+}
+
+// setRoutingRules replaces the routing rules.  They take effect on the
+// next sync, and immediately for accounts not yet routed.
+func (m *ClouddriverManager) setRoutingRules(rules []routingRule) {
+	m.Lock()
+	defer m.Unlock()
+	m.routingRules = rules
+	m.warnedRules = map[string]bool{}
+}
+
+// ruleRoute returns the route given by the first rule matching account.
+// Must be called with the lock held.
+func (m *ClouddriverManager) ruleRoute(account string) (URLAndPriority, bool) {
+	for _, rule := range m.routingRules {
+		if !rule.matches(account) {
+			continue
+		}
+		cd, err := m.findClouddriverByName(rule.Clouddriver)
+		if err != nil {
+			if !m.warnedRules[rule.String()] {
+				m.warnedRules[rule.String()] = true
+				zap.S().Warnw("routing rule not applied", "rule", rule.String(), "clouddriver", rule.Clouddriver, "error", err)
+			}
+			return URLAndPriority{}, false
+		}
+		return URLAndPriority{URL: cd.URL, Priority: cd.Priority, token: cd.token}, true
+	}
+	return URLAndPriority{}, false
+}
+
+// applyRoutingRules reroutes each account matching a rule.  Must be
+// called with the lock held.
+func (m *ClouddriverManager) applyRoutingRules(routes map[string]URLAndPriority) {
+	if len(m.routingRules) == 0 {
+		return
+	}
+	for account := range routes {
+		if route, found := m.ruleRoute(account); found {
+			routes[account] = route
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_compileRoutingRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []routingRuleConfig
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"pattern and glob", []routingRuleConfig{{Pattern: "^aws-", Clouddriver: "a"}, {Glob: "gcp-*", Clouddriver: "b"}}, ""},
+		{"no clouddriver", []routingRuleConfig{{Pattern: "^aws-"}}, "rule 1: clouddriver is required"},
+		{"both", []routingRuleConfig{{Pattern: "^aws-", Glob: "aws-*", Clouddriver: "a"}}, "rule 1: only one of pattern and glob may be set"},
+		{"neither", []routingRuleConfig{{Clouddriver: "a"}}, "rule 1: one of pattern and glob is required"},
+		{"bad pattern", []routingRuleConfig{{Pattern: "(", Clouddriver: "a"}}, "rule 1: error parsing regexp: missing closing ): `(`"},
+		{"bad glob", []routingRuleConfig{{Glob: "[", Clouddriver: "a"}}, "rule 1: syntax error in pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileRoutingRules(tt.rules)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_ClouddriverManager_routingRules(t *testing.T) {
+	a := URLAndPriority{URL: "http://a"}
+	b := URLAndPriority{URL: "http://b"}
+	other := URLAndPriority{URL: "http://other"}
+	m := &ClouddriverManager{
+		state: map[string]*trackedClouddriver{
+			"config:a": {Name: "a", URL: "http://a"},
+			"config:b": {Name: "b", URL: "http://b"},
+		},
+		cloudAccountRoutes: map[string]URLAndPriority{},
+	}
+	rules, err := compileRoutingRules([]routingRuleConfig{
+		{Pattern: "^aws-prod-", Clouddriver: "a"},
+		{Glob: "aws-*", Clouddriver: "b"},
+		{Glob: "gcp-*", Clouddriver: "missing"},
+	})
+	require.NoError(t, err)
+	m.setRoutingRules(rules)
+
+	routes := map[string]URLAndPriority{
+		"aws-prod-1": other,
+		"aws-dev-1":  other,
+		"gcp-1":      other,
+		"k8s-1":      other,
+	}
+	m.applyRoutingRules(routes)
+	assert.Equal(t, map[string]URLAndPriority{
+		"aws-prod-1": a,
+		"aws-dev-1":  b,
+		"gcp-1":      other,
+		"k8s-1":      other,
+	}, routes)
+
+	// accounts not yet synced are routed by the rules.
+	route, found := m.findCloudRoute("aws-prod-new")
+	assert.True(t, found)
+	assert.Equal(t, a, route)
+	_, found = m.findCloudRoute("unmatched")
+	assert.False(t, found)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serverTLSConfig enables HTTPS on the listener.  If ClientCAPath is
+// set, client certificates signed by it are verified, and if
+// RequireClientCert is also set, clients must present one.
+type serverTLSConfig struct {
+	CertificatePath   string `yaml:"certificatePath,omitempty" json:"certificatePath,omitempty"`
+	KeyPath           string `yaml:"keyPath,omitempty" json:"keyPath,omitempty"`
+	ClientCAPath      string `yaml:"clientCAPath,omitempty" json:"clientCAPath,omitempty"`
+	RequireClientCert bool   `yaml:"requireClientCert,omitempty" json:"requireClientCert,omitempty"`
+}
+
+func (c serverTLSConfig) enabled() bool {
+	return c.CertificatePath != ""
+}
+
+func (c serverTLSConfig) validate() error {
+	if !c.enabled() {
+		if c.KeyPath != "" || c.ClientCAPath != "" || c.RequireClientCert {
+			return fmt.Errorf("certificatePath is required")
+		}
+		return nil
+	}
+	if c.KeyPath == "" {
+		return fmt.Errorf("keyPath is required")
+	}
+	if c.RequireClientCert && c.ClientCAPath == "" {
+		return fmt.Errorf("requireClientCert requires clientCAPath")
+	}
+	return nil
+}
+
+// certificateReloader serves the certificate in a pair of files,
+// re-reading them when either changes, so certificates can be rotated
+// without a restart.  It is used for both server and client
+// certificates.
+type certificateReloader struct {
+	sync.Mutex
+	certPath string
+	keyPath  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var ret time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(ret) {
+			ret = info.ModTime()
+		}
+	}
+	return ret, nil
+}
+
+func (r *certificateReloader) load() (*tls.Certificate, error) {
+	r.Lock()
+	defer r.Unlock()
+	modTime, err := latestModTime(r.certPath, r.keyPath)
+	if err != nil && r.cert != nil {
+		// keep serving the last good certificate while files are replaced.
+		return r.cert, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		if r.cert != nil {
+			zap.S().Warnw("unable to reload certificate, using previous one", "path", r.certPath, "error", err)
+			r.modTime = modTime
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil {
+		zap.S().Infow("reloaded certificate", "path", r.certPath)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}
+
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+func (r *certificateReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+// makeServerTLSConfig builds the listener's TLS configuration, and
+// checks the certificate can be loaded.
+func makeServerTLSConfig(c serverTLSConfig) (*tls.Config, error) {
+	reloader := &certificateReloader{certPath: c.CertificatePath, keyPath: c.KeyPath}
+	if _, err := reloader.load(); err != nil {
+		return nil, err
+	}
+	ret := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if c.ClientCAPath != "" {
+		pem, err := os.ReadFile(c.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.ClientCAPath)
+		}
+		ret.ClientCAs = pool
+		ret.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			ret.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return ret, nil
+}
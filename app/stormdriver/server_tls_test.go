@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_serverTLSConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       serverTLSConfig
+		wantErr bool
+	}{
+		{"disabled", serverTLSConfig{}, false},
+		{"cert and key", serverTLSConfig{CertificatePath: "c", KeyPath: "k"}, false},
+		{"missing key", serverTLSConfig{CertificatePath: "c"}, true},
+		{"key without cert", serverTLSConfig{KeyPath: "k"}, true},
+		{"client CA", serverTLSConfig{CertificatePath: "c", KeyPath: "k", ClientCAPath: "ca"}, false},
+		{"require without CA", serverTLSConfig{CertificatePath: "c", KeyPath: "k", RequireClientCert: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// writeTestKeyPair writes the certificate and key used by an httptest
+// TLS server to dir.
+func writeTestKeyPair(t *testing.T, dir string) (string, string) {
+	srv := httptest.NewTLSServer(nil)
+	srv.Close()
+	cert := srv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+	return certPath, keyPath
+}
+
+func Test_makeServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir)
+
+	cfg, err := makeServerTLSConfig(serverTLSConfig{CertificatePath: certPath, KeyPath: keyPath})
+	require.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, cfg.ClientAuth)
+	cert, err := cfg.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, cert)
+
+	cfg, err = makeServerTLSConfig(serverTLSConfig{CertificatePath: certPath, KeyPath: keyPath, ClientCAPath: certPath, RequireClientCert: true})
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	assert.NotNil(t, cfg.ClientCAs)
+
+	_, err = makeServerTLSConfig(serverTLSConfig{CertificatePath: certPath, KeyPath: keyPath, ClientCAPath: keyPath})
+	assert.Error(t, err)
+
+	_, err = makeServerTLSConfig(serverTLSConfig{CertificatePath: filepath.Join(dir, "missing"), KeyPath: keyPath})
+	assert.Error(t, err)
+}
+
+func Test_certificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeyPair(t, dir)
+	r := &certificateReloader{certPath: certPath, keyPath: keyPath}
+
+	first, err := r.getCertificate(nil)
+	require.NoError(t, err)
+	again, err := r.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, first, again)
+
+	// a broken replacement keeps the previous certificate.
+	require.NoError(t, os.WriteFile(certPath, []byte("garbage"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, later, later))
+	kept, err := r.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, first, kept)
+
+	// a valid replacement is loaded.
+	writeTestKeyPair(t, dir)
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, later, later))
+	reloaded, err := r.getCertificate(nil)
+	require.NoError(t, err)
+	assert.NotSame(t, first, reloaded)
+}
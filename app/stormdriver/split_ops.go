@@ -0,0 +1,324 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/OpsMx/go-app-base/httputil"
+)
+
+// A split operation's task id joins the ids of the tasks each
+// clouddriver started, such as "split-1234+5678", so any Stormdriver
+// replica can resolve it.  A part which a clouddriver did not start is
+// splitFailedPart followed by the status it answered with, as in
+// "split-1234+!502".
+const (
+	splitTaskPrefix    = "split-"
+	splitTaskSeparator = "+"
+	splitFailedPart    = "!"
+)
+
+// operationGroup is the part of an operation list sent to one clouddriver.
+type operationGroup struct {
+	route    URLAndPriority
+	accounts map[string]bool
+	items    []json.RawMessage
+}
+
+func (g *operationGroup) accountNames() []string {
+	ret := keysForMap(g.accounts)
+	sort.Strings(ret)
+	return ret
+}
+
+// splitOperations groups the operations by the clouddriver owning their
+// accounts, keeping their order.  itemRoutes holds the route key for
+// each operation, or "" if none of its accounts is routed; those go with
+// the first group.
+func splitOperations(items []json.RawMessage, itemRoutes []string, itemAccounts [][]string, routes map[string]URLAndPriority) []*operationGroup {
+	ret := []*operationGroup{}
+	groups := map[string]*operationGroup{}
+	for _, key := range itemRoutes {
+		if key == "" {
+			continue
+		}
+		if _, found := groups[key]; !found {
+			groups[key] = &operationGroup{route: routes[key], accounts: map[string]bool{}}
+			ret = append(ret, groups[key])
+		}
+	}
+	for idx, item := range items {
+		g := ret[0]
+		if key := itemRoutes[idx]; key != "" {
+			g = groups[key]
+		}
+		g.items = append(g.items, item)
+		for _, account := range itemAccounts[idx] {
+			g.accounts[account] = true
+		}
+	}
+	return ret
+}
+
+// forwardSplit sends each group of operations to its clouddriver, and
+// answers with one task id covering all of the tasks they start.  Once
+// any clouddriver has started its task, the operation cannot be taken
+// back, so the task id is returned even if other groups fail; those
+// parts are failed in the combined task.  Only if no group starts is
+// the failure returned.
+func forwardSplit(w http.ResponseWriter, req *http.Request, entry *journalEntry, groups []*operationGroup) {
+	parts := []string{}
+	started := 0
+	failedStatus := 0
+	var failure error
+	fail := func(status int, err error) {
+		parts = append(parts, splitFailedPart+strconv.Itoa(status))
+		failedStatus = status
+		if err != nil {
+			failure = err
+		}
+	}
+	for _, g := range groups {
+		data, err := json.Marshal(g.items)
+		if err != nil {
+			fail(http.StatusInternalServerError, err)
+			continue
+		}
+		responseBody, event, err := submitOperation(req, g.route, data, g.accountNames())
+		if err != nil {
+			event.StatusCode = downstreamErrorStatus(err)
+			event.Error = err.Error()
+			events.emit(event)
+			fail(event.StatusCode, err)
+			continue
+		}
+		events.emit(event)
+		if !httputil.StatusCodeOK(event.StatusCode) || event.TaskID == "" {
+			requestLogger(req.Context()).Errorw("split operation failed", "clouddriver", event.Clouddriver, "status", event.StatusCode, "body", string(responseBody))
+			status := event.StatusCode
+			if httputil.StatusCodeOK(status) {
+				status = http.StatusBadGateway
+			}
+			fail(status, nil)
+			continue
+		}
+		recordTask(req, g.route, event)
+		parts = append(parts, event.TaskID)
+		started++
+	}
+
+	if started == 0 {
+		journal.finish(entry, journalFailed, failedStatus, "", failure)
+		w.WriteHeader(failedStatus)
+		return
+	}
+
+	id := splitTaskPrefix + strings.Join(parts, splitTaskSeparator)
+	if failedStatus != 0 {
+		requestLogger(req.Context()).Errorw("split operation partly failed", "taskID", id, "status", failedStatus)
+	}
+	auditRecordFrom(req.Context()).setTaskID(id)
+	journal.finish(entry, journalForwarded, http.StatusOK, id, failure)
+	ret, _ := json.Marshal(map[string]string{
+		"id":          id,
+		"resourceUri": "/task/" + id,
+	})
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, ret)
+}
+
+// bufferedResponse collects a response so it can be combined with others.
+type bufferedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) WriteHeader(code int) {
+	if r.statusCode == 0 {
+		r.statusCode = code
+	}
+}
+
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+// failedPartTask is the task for a part of a split operation which was
+// not started, or whose task cannot be found.
+func failedPartTask(reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"status": map[string]interface{}{
+			"phase":     "STORMDRIVER",
+			"status":    reason,
+			"completed": true,
+			"failed":    true,
+			"retryable": false,
+		},
+	}
+}
+
+// unknownPartTask is the task for a part of a split operation which
+// could not be looked up this time.  It is still running, as far as
+// anyone knows.
+func unknownPartTask(reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"status": map[string]interface{}{
+			"phase":     "STORMDRIVER",
+			"status":    reason,
+			"completed": false,
+			"failed":    false,
+		},
+	}
+}
+
+// splitTaskHandler answers /task/{id} for split operations, looking up
+// each clouddriver's task through next and combining them into one.  A
+// part whose task is not found is failed, and one which cannot be
+// looked up is still running, so the other parts are still reported.
+// If no part can be looked up, the first error is returned.  Other
+// requests are passed to next.
+func splitTaskHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := taskIDFromPath(req.URL.Path)
+		if !strings.HasPrefix(id, splitTaskPrefix) || req.URL.Path != "/task/"+id {
+			next(w, req)
+			return
+		}
+		parts := []map[string]interface{}{}
+		var lookupFailure *bufferedResponse
+		found := 0
+		for _, taskID := range strings.Split(strings.TrimPrefix(id, splitTaskPrefix), splitTaskSeparator) {
+			if strings.HasPrefix(taskID, splitFailedPart) {
+				status := strings.TrimPrefix(taskID, splitFailedPart)
+				parts = append(parts, failedPartTask("clouddriver did not start this part of the operation: status "+status))
+				continue
+			}
+			r := req.Clone(req.Context())
+			r.URL.Path = "/task/" + taskID
+			r.URL.RawPath = ""
+			r.RequestURI = r.URL.RequestURI()
+			// the parts are decoded, so must not be compressed.
+			r.Header.Del("accept-encoding")
+			rec := &bufferedResponse{header: http.Header{}}
+			next(rec, r)
+			if !httputil.StatusCodeOK(rec.statusCode) {
+				if lookupFailure == nil {
+					lookupFailure = rec
+				}
+				if rec.statusCode == http.StatusNotFound {
+					parts = append(parts, failedPartTask(fmt.Sprintf("task %s not found", taskID)))
+				} else {
+					parts = append(parts, unknownPartTask(fmt.Sprintf("task %s lookup failed: status %d", taskID, rec.statusCode)))
+				}
+				continue
+			}
+			var task map[string]interface{}
+			if err := json.Unmarshal(rec.body.Bytes(), &task); err != nil {
+				requestLogger(req.Context()).Errorw("parse task", "taskID", taskID, "error", err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			parts = append(parts, task)
+			found++
+		}
+		if found == 0 && lookupFailure != nil {
+			setContentType(w, lookupFailure.header.Get("content-type"))
+			w.WriteHeader(lookupFailure.statusCode)
+			httputil.CheckedWrite(w, lookupFailure.body.Bytes())
+			return
+		}
+		ret, err := json.Marshal(combineTasks(id, parts))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		httputil.CheckedWrite(w, ret)
+	}
+}
+
+// combineTasks returns one clouddriver-style task for the parts of a
+// split operation.  It is completed once every part is, and failed if
+// any part failed.  Its status is that of the first failed part, else
+// the first part still running, else the last; the history and result
+// objects of every part are included.
+func combineTasks(id string, parts []map[string]interface{}) map[string]interface{} {
+	completed := true
+	failed := false
+	retryable := false
+	var status map[string]interface{}
+	statusRank := -1
+	history := []interface{}{}
+	resultObjects := []interface{}{}
+	for _, task := range parts {
+		s, _ := task["status"].(map[string]interface{})
+		partCompleted, _ := s["completed"].(bool)
+		partFailed, _ := s["failed"].(bool)
+		partRetryable, _ := s["retryable"].(bool)
+		completed = completed && partCompleted
+		failed = failed || partFailed
+		retryable = retryable || (partFailed && partRetryable)
+
+		rank := 0
+		if partFailed {
+			rank = 2
+		} else if !partCompleted {
+			rank = 1
+		}
+		if rank > statusRank || (rank == 0 && statusRank == 0) {
+			status = s
+			statusRank = rank
+		}
+
+		if h, ok := task["history"].([]interface{}); ok {
+			history = append(history, h...)
+		}
+		if r, ok := task["resultObjects"].([]interface{}); ok {
+			resultObjects = append(resultObjects, r...)
+		}
+	}
+
+	combined := map[string]interface{}{}
+	for k, v := range status {
+		combined[k] = v
+	}
+	combined["completed"] = completed
+	combined["failed"] = failed
+	combined["retryable"] = retryable
+	return map[string]interface{}{
+		"id":            id,
+		"status":        combined,
+		"history":       history,
+		"resultObjects": resultObjects,
+	}
+}
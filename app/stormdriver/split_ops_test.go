@@ -0,0 +1,196 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_splitOperations(t *testing.T) {
+	items := []json.RawMessage{
+		json.RawMessage(`{"op":{"account":"a1"}}`),
+		json.RawMessage(`{"op":{"account":"b1"}}`),
+		json.RawMessage(`{"op":{"account":"unknown"}}`),
+		json.RawMessage(`{"op":{"account":"a2"}}`),
+	}
+	routes := map[string]URLAndPriority{
+		"http://a:": {URL: "http://a"},
+		"http://b:": {URL: "http://b"},
+	}
+	groups := splitOperations(items,
+		[]string{"http://b:", "http://a:", "", "http://b:"},
+		[][]string{{"a1"}, {"b1"}, {"unknown"}, {"a2"}},
+		routes)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "http://b", groups[0].route.URL)
+	assert.Equal(t, []json.RawMessage{items[0], items[2], items[3]}, groups[0].items)
+	assert.Equal(t, []string{"a1", "a2", "unknown"}, groups[0].accountNames())
+	assert.Equal(t, "http://a", groups[1].route.URL)
+	assert.Equal(t, []json.RawMessage{items[1]}, groups[1].items)
+	assert.Equal(t, []string{"b1"}, groups[1].accountNames())
+}
+
+func Test_cloudOpsPost_split(t *testing.T) {
+	backend := func(name string, status int) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"id":"` + name + `","resourceUri":"/task/` + name + `","body":` + string(body) + `}`))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a := backend("task-a", http.StatusOK)
+	b := backend("task-b", http.StatusOK)
+	broken := backend("task-broken", http.StatusInternalServerError)
+	rejected := backend("task-rejected", http.StatusBadRequest)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantID   string
+	}{
+		{"one clouddriver", `[{"op":{"account":"a1"}},{"op":{"account":"a2"}}]`, http.StatusOK, "task-a"},
+		{"two clouddrivers", `[{"op":{"account":"a1"}},{"op":{"account":"b1"}}]`, http.StatusOK, "split-task-a+task-b"},
+		{"one part fails", `[{"op":{"account":"a1"}},{"op":{"account":"broken"}}]`, http.StatusOK, "split-task-a+!500"},
+		{"every part fails", `[{"op":{"account":"rejected"}},{"op":{"account":"broken"}}]`, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clouddriverManager = &ClouddriverManager{
+				cloudAccountRoutes: map[string]URLAndPriority{
+					"a1":       {URL: a.URL},
+					"a2":       {URL: a.URL},
+					"b1":       {URL: b.URL},
+					"broken":   {URL: broken.URL},
+					"rejected": {URL: rejected.URL},
+				},
+			}
+			s := &srv{}
+			r := mux.NewRouter()
+			r.HandleFunc("/kubernetes/ops", s.cloudOpsPost())
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/kubernetes/ops", strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantID != "" {
+				assert.Equal(t, tt.wantID, taskIDFromResponse(w.Body.Bytes()))
+			}
+		})
+	}
+}
+
+func Test_splitTaskHandler(t *testing.T) {
+	tasks := map[string]string{
+		"/task/a": `{"id":"a","status":{"phase":"DEPLOY","status":"done","completed":true,"failed":false},"history":[{"status":"a1"}],"resultObjects":[{"a":1}]}`,
+		"/task/b": `{"id":"b","status":{"phase":"DEPLOY","status":"running","completed":false,"failed":false},"history":[{"status":"b1"}],"resultObjects":[]}`,
+		"/task/c": `{"id":"c","status":{"phase":"DEPLOY","status":"boom","completed":true,"failed":true,"retryable":true},"history":[],"resultObjects":[]}`,
+	}
+	next := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/task/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		task, found := tasks[req.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assert.Empty(t, req.Header.Get("accept-encoding"))
+		_, _ = w.Write([]byte(task))
+	}
+	handler := splitTaskHandler(next)
+
+	tests := []struct {
+		name          string
+		path          string
+		wantCode      int
+		wantStatus    string
+		wantCompleted bool
+		wantFailed    bool
+	}{
+		{"not split", "/task/a", http.StatusOK, "done", true, false},
+		{"one running", "/task/split-a+b", http.StatusOK, "running", false, false},
+		{"one failed", "/task/split-a+b+c", http.StatusOK, "boom", false, true},
+		{"unknown part", "/task/split-a+z", http.StatusOK, "task z not found", true, true},
+		{"part not started", "/task/split-a+!502", http.StatusOK, "clouddriver did not start this part of the operation: status 502", true, true},
+		{"part lookup failed", "/task/split-a+down", http.StatusOK, "task down lookup failed: status 503", false, false},
+		{"no part found", "/task/split-y+z", http.StatusNotFound, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if strings.HasPrefix(tt.path, "/task/split-") {
+				req.Header.Set("accept-encoding", "gzip")
+			}
+			handler(w, req)
+			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var task struct {
+				ID     string `json:"id"`
+				Status struct {
+					Status    string `json:"status"`
+					Completed bool   `json:"completed"`
+					Failed    bool   `json:"failed"`
+				} `json:"status"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &task))
+			assert.Equal(t, strings.TrimPrefix(tt.path, "/task/"), task.ID)
+			assert.Equal(t, tt.wantStatus, task.Status.Status)
+			assert.Equal(t, tt.wantCompleted, task.Status.Completed)
+			assert.Equal(t, tt.wantFailed, task.Status.Failed)
+		})
+	}
+}
+
+func Test_combineTasks(t *testing.T) {
+	parts := []map[string]interface{}{
+		{
+			"status":        map[string]interface{}{"status": "one", "completed": true, "failed": false},
+			"history":       []interface{}{"h1"},
+			"resultObjects": []interface{}{"r1"},
+		},
+		{
+			"status":        map[string]interface{}{"status": "two", "completed": true, "failed": false},
+			"history":       []interface{}{"h2"},
+			"resultObjects": []interface{}{"r2"},
+		},
+	}
+	got := combineTasks("split-1+2", parts)
+	assert.Equal(t, map[string]interface{}{
+		"id":            "split-1+2",
+		"status":        map[string]interface{}{"status": "two", "completed": true, "failed": false, "retryable": false},
+		"history":       []interface{}{"h1", "h2"},
+		"resultObjects": []interface{}{"r1", "r2"},
+	}, got)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	srvSource = "srv"
+
+	// srvNotFoundPolls is how many polls in a row must find no such
+	// name before the clouddrivers discovered from it are removed, so
+	// a brief NXDOMAIN while records are republished is not an outage.
+	srvNotFoundPolls = 3
+)
+
+// srvDiscoveryConfig finds clouddrivers from the records of a DNS SRV
+// name, such as those ECS service discovery, Nomad, or Consul publish.
+// Servers, if set, are the DNS servers to ask, as host:port.
+type srvDiscoveryConfig struct {
+	Name            string   `yaml:"name,omitempty" json:"name,omitempty"`
+	Scheme          string   `yaml:"scheme,omitempty" json:"scheme,omitempty"`
+	Servers         []string `yaml:"servers,omitempty" json:"servers,omitempty"`
+	IntervalSeconds int      `yaml:"intervalSeconds,omitempty" json:"intervalSeconds,omitempty"`
+}
+
+func (c *srvDiscoveryConfig) applyDefaults() {
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	if c.IntervalSeconds == 0 {
+		c.IntervalSeconds = defaultDiscoveryIntervalSeconds
+	}
+}
+
+func (c srvDiscoveryConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, not %q", c.Scheme)
+	}
+	for _, server := range c.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("server %q: %v", server, err)
+		}
+	}
+	if c.IntervalSeconds < 0 {
+		return errors.New("intervalSeconds cannot be negative")
+	}
+	return nil
+}
+
+type srvDiscoverer struct {
+	conf   srvDiscoveryConfig
+	lookup func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+	// notFound counts the polls in a row which found no such name.
+	notFound int
+}
+
+func makeSRVDiscoverer(c srvDiscoveryConfig) *srvDiscoverer {
+	return &srvDiscoverer{
+		conf:   c,
+		lookup: makeNetResolver(c.Servers).LookupSRV,
+	}
+}
+
+// discover returns a clouddriver for each SRV record, named by its
+// target and port.  SRV prefers lower priorities and Stormdriver higher
+// ones, so the record's priority is negated.  A name which does not
+// exist is an error, so the clouddrivers found before are kept, until
+// srvNotFoundPolls polls in a row have not found it.
+func (d *srvDiscoverer) discover(ctx context.Context) ([]clouddriverConfig, error) {
+	_, records, err := d.lookup(ctx, "", "", d.conf.Name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		d.notFound++
+		if d.notFound < srvNotFoundPolls {
+			return nil, fmt.Errorf("%s not found, %d of %d times: %w", d.conf.Name, d.notFound, srvNotFoundPolls, err)
+		}
+		return []clouddriverConfig{}, nil
+	}
+	d.notFound = 0
+	ret := []clouddriverConfig{}
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		if host == "" {
+			// "." means the service is not available.
+			continue
+		}
+		hostport := net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+		ret = append(ret, clouddriverConfig{
+			Name:     hostport,
+			URL:      d.conf.Scheme + "://" + hostport,
+			Priority: -int(srv.Priority),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_srvDiscoverer_discover(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []*net.SRV
+		err     error
+		want    []clouddriverConfig
+		wantErr bool
+	}{
+		{
+			"records",
+			[]*net.SRV{
+				{Target: "cd-b.example.com.", Port: 7002, Priority: 10},
+				{Target: "cd-a.example.com.", Port: 8080, Priority: 0},
+				{Target: ".", Port: 0},
+			},
+			nil,
+			[]clouddriverConfig{
+				{Name: "cd-a.example.com:8080", URL: "http://cd-a.example.com:8080", Priority: 0},
+				{Name: "cd-b.example.com:7002", URL: "http://cd-b.example.com:7002", Priority: -10},
+			},
+			false,
+		},
+		{"no such name", nil, &net.DNSError{Err: "no such host", IsNotFound: true}, nil, true},
+		{"server failure", nil, errors.New("server misbehaving"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &srvDiscoverer{
+				conf: srvDiscoveryConfig{Name: "_clouddriver._tcp.example.com", Scheme: "http"},
+				lookup: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+					assert.Equal(t, "_clouddriver._tcp.example.com", name)
+					return name, tt.records, tt.err
+				},
+			}
+			got, err := d.discover(context.Background())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_srvDiscoverer_discover_notFound(t *testing.T) {
+	var err error
+	d := &srvDiscoverer{
+		conf: srvDiscoveryConfig{Name: "_clouddriver._tcp.example.com", Scheme: "http"},
+		lookup: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			if err != nil {
+				return "", nil, err
+			}
+			return name, []*net.SRV{{Target: "cd.example.com.", Port: 7002}}, nil
+		},
+	}
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+
+	for i := 1; i < srvNotFoundPolls; i++ {
+		err = notFound
+		_, discoverErr := d.discover(context.Background())
+		assert.Error(t, discoverErr, "poll %d keeps the previous clouddrivers", i)
+	}
+
+	// a successful poll starts the count again
+	err = nil
+	got, discoverErr := d.discover(context.Background())
+	require.NoError(t, discoverErr)
+	assert.Len(t, got, 1)
+
+	err = notFound
+	for i := 1; i < srvNotFoundPolls; i++ {
+		_, discoverErr = d.discover(context.Background())
+		assert.Error(t, discoverErr)
+	}
+	got, discoverErr = d.discover(context.Background())
+	require.NoError(t, discoverErr)
+	assert.Empty(t, got, "removed once not found every time")
+}
+
+func Test_srvDiscoveryConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       srvDiscoveryConfig
+		wantErr string
+	}{
+		{"minimal", srvDiscoveryConfig{Name: "_cd._tcp.example.com", Scheme: "http"}, ""},
+		{"no name", srvDiscoveryConfig{Scheme: "http"}, "name is required"},
+		{"bad scheme", srvDiscoveryConfig{Name: "x", Scheme: "ftp"}, `scheme must be http or https, not "ftp"`},
+		{"bad server", srvDiscoveryConfig{Name: "x", Scheme: "http", Servers: []string{"10.0.0.1"}}, `server "10.0.0.1": address 10.0.0.1: missing port in address`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
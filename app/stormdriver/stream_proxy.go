@@ -0,0 +1,175 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	stdhttputil "net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// isUpgradeRequest returns true if req asks to switch protocols, as
+// a WebSocket handshake does.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isEventStreamRequest returns true if req asks for server-sent events.
+func isEventStreamRequest(req *http.Request) bool {
+	for _, v := range req.Header.Values("Accept") {
+		if strings.Contains(strings.ToLower(v), "text/event-stream") {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreamingRequest returns true for requests whose responses do not
+// end on their own, and so must be tunneled rather than buffered.
+func isStreamingRequest(req *http.Request) bool {
+	return isUpgradeRequest(req) || isEventStreamRequest(req)
+}
+
+func streamingRequestMatcher(req *http.Request, _ *mux.RouteMatch) bool {
+	return isStreamingRequest(req)
+}
+
+// streamRouteName names the routes served by streamProxy.
+const streamRouteName = "stream"
+
+// validateStreamingPaths checks that each streaming path is a path
+// prefix.  "/" is refused, as it would tunnel every GET which asks to
+// stream past the routes which understand it.
+func validateStreamingPaths(paths []string) error {
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") || path == "/" {
+			return fmt.Errorf("%q must be a path prefix other than /", path)
+		}
+	}
+	return nil
+}
+
+// isStreamRoute returns true if req was routed to streamProxy.  The
+// route, not the request's headers, decides, as any caller can ask to
+// stream.
+func isStreamRoute(req *http.Request) bool {
+	route := mux.CurrentRoute(req)
+	return route != nil && route.GetName() == streamRouteName
+}
+
+type streamingKey struct{}
+
+// withStreaming marks requests made from ctx as streaming, so the
+// downstream transport does not hold a concurrency slot or limit the
+// size of their responses.
+func withStreaming(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingKey{}, true)
+}
+
+func isStreaming(ctx context.Context) bool {
+	streaming, _ := ctx.Value(streamingKey{}).(bool)
+	return streaming
+}
+
+// streamTarget picks the clouddriver for a streaming request: the one
+// owning the "account" query parameter if there is one, otherwise one
+// of the healthy clouddrivers, as for other unknown requests.
+func streamTarget(req *http.Request) (URLAndPriority, bool) {
+	if account := req.URL.Query().Get("account"); account != "" {
+		return clouddriverManager.findCloudRoute(account)
+	}
+	possibleURLs := clouddriverManager.getHealthyClouddriverURLs()
+	if len(possibleURLs) == 0 {
+		return URLAndPriority{}, false
+	}
+	return catchAllSelector.pick(possibleURLs, clouddriverManager.weightForRoute), true
+}
+
+// streamProxy tunnels WebSocket and server-sent event requests to a
+// clouddriver.  Responses are flushed as they arrive, and upgraded
+// connections are copied in both directions until either side closes.
+// The client's overall timeout does not apply, as these connections
+// are expected to last.
+func (*srv) streamProxy() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		route, found := streamTarget(req)
+		if !found {
+			requestLogger(req.Context()).Warnw("no clouddriver for streaming request", "method", req.Method, "uri", req.RequestURI)
+			http.Error(w, "no clouddrivers", http.StatusBadGateway)
+			return
+		}
+		target, err := url.Parse(combineURL(route.URL, req.RequestURI))
+		if err != nil {
+			requestLogger(req.Context()).Errorw("url.Parse", "uri", req.RequestURI, "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		proxy := &stdhttputil.ReverseProxy{
+			Director: func(out *http.Request) {
+				out.URL = target
+				noteClouddriver(out.Context(), target.String())
+				out.Host = target.Host
+				if !compression.Passthrough {
+					out.Header.Del("Accept-Encoding")
+				}
+				if route.token != "" {
+					out.Header.Set("authorization", "Bearer "+route.token)
+				}
+			},
+			Transport:     downstreamClients.clientFor(target.String()).Transport,
+			FlushInterval: -1,
+			ModifyResponse: func(resp *http.Response) error {
+				if resp.StatusCode == http.StatusSwitchingProtocols {
+					return nil
+				}
+				h := http.Header{}
+				copyResponseHeaders(routeClassProxy, h, resp.Header)
+				copyContentEncoding(h, resp.Header)
+				if ct := resp.Header.Get("content-type"); ct != "" {
+					h.Set("content-type", normalizeContentType(ct))
+				}
+				if cl := resp.Header.Get("content-length"); cl != "" {
+					h.Set("content-length", cl)
+				}
+				resp.Header = h
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, out *http.Request, err error) {
+				noteDownstreamError(err)
+				requestLogger(out.Context()).Errorw("streaming proxy", "method", out.Method, "target", target.String(), "hasToken", route.token != "", "error", err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		}
+		proxy.ServeHTTP(w, req.WithContext(withRoute(withStreaming(req.Context()), route)))
+	}
+}
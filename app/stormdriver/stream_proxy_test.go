@@ -0,0 +1,197 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isStreamingRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"plain GET", map[string]string{"Accept": "application/json"}, false},
+		{"event stream", map[string]string{"Accept": "text/event-stream"}, true},
+		{"websocket", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket"}, true},
+		{"upgrade without connection token", map[string]string{"Upgrade": "websocket"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, isStreamingRequest(req))
+		})
+	}
+}
+
+// streamProxyFrontend serves the routes, with the metrics middleware,
+// in front of a clouddriver owning the "prod" account.
+func streamProxyFrontend(t *testing.T, backend http.Handler) *httptest.Server {
+	b := httptest.NewServer(backend)
+	t.Cleanup(b.Close)
+
+	oldManager := clouddriverManager
+	t.Cleanup(func() { clouddriverManager = oldManager })
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{"prod": {URL: b.URL, token: "secret"}},
+	}
+
+	s := &srv{streamingPaths: []string{"/events", "/stream"}}
+	r := mux.NewRouter()
+	s.routes(r)
+	r.Use(makeUserLabeler(metricsConfig{}).middleware)
+	front := httptest.NewServer(r)
+	t.Cleanup(front.Close)
+	return front
+}
+
+func Test_streamProxy_eventStream(t *testing.T) {
+	release := make(chan struct{})
+	front := streamProxyFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("authorization"))
+		w.Header().Set("content-type", "text/event-stream")
+		_, _ = w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("data: second\n\n"))
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, front.URL+"/events?account=prod", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream; charset=utf-8", resp.Header.Get("content-type"))
+
+	// the first event arrives while the clouddriver is still sending.
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+
+	close(release)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: second\n\n", string(rest))
+}
+
+func Test_streamProxy_upgrade(t *testing.T) {
+	front := streamProxyFrontend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = buf.Flush()
+		line, _ := buf.ReadString('\n')
+		_, _ = buf.WriteString("echo " + line)
+		_ = buf.Flush()
+	}))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET /stream?account=prod HTTP/1.1\r\nHost: stormdriver\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\n", line)
+}
+
+func Test_streamProxy_noRoute(t *testing.T) {
+	front := streamProxyFrontend(t, http.NotFoundHandler())
+	req, err := http.NewRequest(http.MethodGet, front.URL+"/events?account=staging", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func Test_isStreamRoute(t *testing.T) {
+	s := &srv{streamingPaths: []string{"/events"}}
+	r := mux.NewRouter()
+	s.routes(r)
+	var got bool
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got = isStreamRoute(req)
+		})
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		accept string
+		want   bool
+	}{
+		{"streaming path", http.MethodGet, "/events", "text/event-stream", true},
+		{"not asking to stream", http.MethodGet, "/events", "", false},
+		{"other path", http.MethodGet, "/applications", "text/event-stream", false},
+		{"write", http.MethodPost, "/events", "text/event-stream", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			got = false
+			r.ServeHTTP(httptest.NewRecorder(), req)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_validateStreamingPaths(t *testing.T) {
+	assert.NoError(t, validateStreamingPaths(nil))
+	assert.NoError(t, validateStreamingPaths([]string{"/events", "/watch/"}))
+	assert.Error(t, validateStreamingPaths([]string{"/"}))
+	assert.Error(t, validateStreamingPaths([]string{"events"}))
+}
@@ -0,0 +1,330 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTaskOwnerTTLSeconds = 24 * 60 * 60
+	maxTaskOwners              = 10000
+
+	taskOwnerStoreMemory = "memory"
+	taskOwnerStoreFile   = "file"
+	taskOwnerStoreRedis  = "redis"
+
+	taskRouteOwner     = "owner"
+	taskRouteBroadcast = "broadcast"
+)
+
+var taskRoutes = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "task_routes_total",
+	Help:      "Task lookups, by whether they were sent to the clouddriver which created the task or to every clouddriver.",
+}, []string{"route"})
+
+// taskOwnersConfig chooses where the clouddriver which created each
+// task is remembered.  With "memory" (the default) it is forgotten on
+// restart; "file" keeps it in Path, and "redis" in the cache's Redis
+// server, shared by every replica.
+type taskOwnersConfig struct {
+	Store      string `yaml:"store,omitempty" json:"store,omitempty"`
+	Path       string `yaml:"path,omitempty" json:"path,omitempty"`
+	TTLSeconds int    `yaml:"ttlSeconds,omitempty" json:"ttlSeconds,omitempty"`
+}
+
+func (c taskOwnersConfig) validate(cache cacheConfig) error {
+	switch c.Store {
+	case "", taskOwnerStoreMemory:
+	case taskOwnerStoreFile:
+		if c.Path == "" {
+			return fmt.Errorf("path is required for the file store")
+		}
+	case taskOwnerStoreRedis:
+		if cache.Type != cacheTypeRedis {
+			return fmt.Errorf("the redis store requires cache.type: redis")
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store)
+	}
+	if c.TTLSeconds < 0 {
+		return fmt.Errorf("ttlSeconds cannot be negative")
+	}
+	return nil
+}
+
+// taskOwner is one remembered task, and also a line in the file store.
+type taskOwner struct {
+	ID      string    `json:"id"`
+	Route   string    `json:"route"`
+	Expires time.Time `json:"expires"`
+}
+
+// taskOwnerMap remembers the route to the clouddriver which created
+// each task, so task lookups can be sent to it rather than to every
+// clouddriver.  Clouddrivers may share a URL and differ only by token,
+// so routes are remembered by a hash of their key, which identifies
+// the route without storing the token.
+type taskOwnerMap struct {
+	sync.Mutex
+	ttl      time.Duration
+	owners   map[string]taskOwner
+	now      func() time.Time
+	path     string
+	file     *os.File
+	appended int
+	shared   Cache
+}
+
+var taskOwners = makeTaskOwnerMap(taskOwnersConfig{})
+
+func makeTaskOwnerMap(conf taskOwnersConfig) *taskOwnerMap {
+	ttl := conf.TTLSeconds
+	if ttl == 0 {
+		ttl = defaultTaskOwnerTTLSeconds
+	}
+	return &taskOwnerMap{
+		ttl:    time.Duration(ttl) * time.Second,
+		owners: map[string]taskOwner{},
+		now:    time.Now,
+	}
+}
+
+// openTaskOwnerMap returns the map for the configured store, loading
+// the owners saved in a file store.
+func openTaskOwnerMap(conf taskOwnersConfig, cache cacheConfig) (*taskOwnerMap, error) {
+	o := makeTaskOwnerMap(conf)
+	switch conf.Store {
+	case taskOwnerStoreFile:
+		if err := o.openFile(conf.Path); err != nil {
+			return nil, err
+		}
+	case taskOwnerStoreRedis:
+		o.shared = makeCache(cache, "taskOwners", 0)
+	}
+	return o, nil
+}
+
+// taskOwnerRoute identifies a route in the stores without its token.
+func taskOwnerRoute(route URLAndPriority) string {
+	sum := sha256.Sum256([]byte(route.key()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// openFile loads the unexpired owners from path, rewrites it with only
+// those, and opens it for appending.
+func (o *taskOwnerMap) openFile(path string) error {
+	if err := o.loadFile(path); err != nil {
+		return err
+	}
+	o.path = path
+	return o.rewriteFile()
+}
+
+// rewriteFile replaces the file with the owners now remembered, so
+// the lines for expired and replaced owners do not accumulate, and
+// reopens it for appending.  Must be called with the lock held, or
+// before the map is shared.
+func (o *taskOwnerMap) rewriteFile() error {
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+	path := o.path
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, owner := range o.owners {
+		line, _ := json.Marshal(owner)
+		_, _ = w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	o.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	o.appended = 0
+	return err
+}
+
+func (o *taskOwnerMap) loadFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := o.now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var owner taskOwner
+		if err := json.Unmarshal(scanner.Bytes(), &owner); err != nil {
+			// most likely a partial final write; skip it.
+			continue
+		}
+		if now.Before(owner.Expires) && owner.Route != "" {
+			o.owners[owner.ID] = owner
+		}
+	}
+	return scanner.Err()
+}
+
+// record remembers that the task was created by the clouddriver at route.
+func (o *taskOwnerMap) record(id string, route URLAndPriority) {
+	if id == "" {
+		return
+	}
+	o.Lock()
+	now := o.now()
+	if len(o.owners) >= maxTaskOwners {
+		o.prune(now)
+	}
+	owner := taskOwner{ID: id, Route: taskOwnerRoute(route), Expires: now.Add(o.ttl)}
+	o.owners[id] = owner
+	if o.file != nil {
+		o.appendToFile(owner)
+	}
+	o.Unlock()
+
+	if o.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := o.shared.Set(ctx, id, []byte(owner.Route), o.ttl); err != nil {
+			zap.S().Warnw("unable to save task owner", "taskId", id, "error", err)
+		}
+	}
+}
+
+// appendToFile saves an owner, and rewrites the file once it holds
+// more stale lines than remembered owners.  Must be called with the
+// lock held.
+func (o *taskOwnerMap) appendToFile(owner taskOwner) {
+	line, _ := json.Marshal(owner)
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		zap.S().Errorw("unable to save task owner", "taskId", owner.ID, "error", err)
+		return
+	}
+	o.appended++
+	if o.appended < maxTaskOwners || o.appended < 2*len(o.owners) {
+		return
+	}
+	if err := o.rewriteFile(); err != nil {
+		zap.S().Errorw("unable to rewrite task owners", "path", o.path, "error", err)
+	}
+}
+
+// prune removes expired owners, and if there are still too many, the
+// oldest.  Must be called with the lock held.
+func (o *taskOwnerMap) prune(now time.Time) {
+	oldestID := ""
+	var oldest time.Time
+	for id, owner := range o.owners {
+		if now.After(owner.Expires) {
+			delete(o.owners, id)
+			continue
+		}
+		if oldestID == "" || owner.Expires.Before(oldest) {
+			oldestID, oldest = id, owner.Expires
+		}
+	}
+	if len(o.owners) >= maxTaskOwners {
+		delete(o.owners, oldestID)
+	}
+}
+
+// lookup returns the route, as taskOwnerRoute identifies it, to the
+// clouddriver which created the task.
+func (o *taskOwnerMap) lookup(ctx context.Context, id string) (string, bool) {
+	o.Lock()
+	owner, found := o.owners[id]
+	o.Unlock()
+	if found && o.now().Before(owner.Expires) {
+		return owner.Route, true
+	}
+	if o.shared == nil || id == "" {
+		return "", false
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	ownerRoute, found, err := o.shared.Get(ctx, id)
+	if err != nil {
+		zap.S().Warnw("unable to look up task owner", "taskId", id, "error", err)
+	}
+	if !found {
+		return "", false
+	}
+	return string(ownerRoute), true
+}
+
+// taskIDFromPath returns the task ID from a /task/{id} path.
+func taskIDFromPath(path string) string {
+	id := strings.TrimPrefix(path, "/task/")
+	if id == path {
+		return ""
+	}
+	return strings.SplitN(id, "/", 2)[0]
+}
+
+// handler sends task lookups to the clouddriver which created the task,
+// if it is known and healthy, and otherwise to next.
+func (o *taskOwnerMap) handler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ownerRoute, found := o.lookup(req.Context(), taskIDFromPath(req.URL.Path))
+		if found {
+			if route, healthy := healthyTaskOwnerRoute(ownerRoute); healthy {
+				taskRoutes.WithLabelValues(taskRouteOwner).Inc()
+				fetchFrom(withRoute(req.Context(), route), combineURL(route.URL, req.RequestURI), route.token, w, req)
+				return
+			}
+		}
+		taskRoutes.WithLabelValues(taskRouteBroadcast).Inc()
+		next(w, req)
+	}
+}
+
+func healthyTaskOwnerRoute(ownerRoute string) (URLAndPriority, bool) {
+	for _, cd := range clouddriverManager.getHealthyClouddriverURLs() {
+		if taskOwnerRoute(cd) == ownerRoute {
+			return cd, true
+		}
+	}
+	return URLAndPriority{}, false
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_taskIDFromPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/task/abc", "abc"},
+		{"/task/abc/details", "abc"},
+		{"/tasks", ""},
+		{"/other/abc", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, taskIDFromPath(tt.path))
+		})
+	}
+}
+
+func Test_taskOwnerMap(t *testing.T) {
+	o := makeTaskOwnerMap(taskOwnersConfig{})
+	now := time.Unix(1000, 0)
+	o.now = func() time.Time { return now }
+
+	o.record("", URLAndPriority{URL: "http://ignored"})
+	assert.Empty(t, o.owners)
+
+	o.record("t1", URLAndPriority{URL: "http://a"})
+	o.record("t2", URLAndPriority{URL: "http://a", token: "other"})
+	route, found := o.lookup(context.Background(), "t1")
+	assert.True(t, found)
+	assert.Equal(t, taskOwnerRoute(URLAndPriority{URL: "http://a"}), route)
+	route, found = o.lookup(context.Background(), "t2")
+	assert.True(t, found)
+	assert.Equal(t, taskOwnerRoute(URLAndPriority{URL: "http://a", token: "other"}), route, "routes sharing a URL are told apart")
+	_, found = o.lookup(context.Background(), "t3")
+	assert.False(t, found)
+
+	now = now.Add(defaultTaskOwnerTTLSeconds*time.Second + time.Second)
+	_, found = o.lookup(context.Background(), "t1")
+	assert.False(t, found, "expired")
+}
+
+func Test_taskOwnerMap_prune(t *testing.T) {
+	o := makeTaskOwnerMap(taskOwnersConfig{})
+	now := time.Unix(1000, 0)
+	o.now = func() time.Time { return now }
+	for i := 0; i < maxTaskOwners; i++ {
+		o.record(fmt.Sprintf("t%d", i), URLAndPriority{URL: "http://a"})
+		now = now.Add(time.Millisecond)
+	}
+	o.record("newest", URLAndPriority{URL: "http://a"})
+	assert.Len(t, o.owners, maxTaskOwners)
+	_, found := o.lookup(context.Background(), "t0")
+	assert.False(t, found, "oldest is dropped")
+	_, found = o.lookup(context.Background(), "newest")
+	assert.True(t, found)
+}
+
+func Test_taskOwnerMap_handler(t *testing.T) {
+	owner := hedgeTestServer(t, 0, http.StatusOK, `{"id":"t1","from":"owner"}`)
+
+	oldManager := clouddriverManager
+	defer func() { clouddriverManager = oldManager }()
+	clouddriverManager = &ClouddriverManager{
+		cloudAccountRoutes: map[string]URLAndPriority{"a": {URL: owner.URL, token: "a"}},
+	}
+
+	o := makeTaskOwnerMap(taskOwnersConfig{})
+	o.record("t1", URLAndPriority{URL: owner.URL, token: "a"})
+	o.record("gone", URLAndPriority{URL: "http://removed"})
+	o.record("other token", URLAndPriority{URL: owner.URL, token: "removed"})
+	broadcast := func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("broadcast"))
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"known owner", "/task/t1", `{"id":"t1","from":"owner"}`},
+		{"unknown task", "/task/t2", "broadcast"},
+		{"owner no longer healthy", "/task/gone", "broadcast"},
+		{"another clouddriver at the URL", "/task/other%20token", "broadcast"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			o.handler(broadcast)(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func Test_taskOwnersConfig_validate(t *testing.T) {
+	redis := cacheConfig{Type: cacheTypeRedis, Address: "redis:6379"}
+	tests := []struct {
+		name    string
+		conf    taskOwnersConfig
+		cache   cacheConfig
+		wantErr bool
+	}{
+		{"default", taskOwnersConfig{}, cacheConfig{}, false},
+		{"file", taskOwnersConfig{Store: taskOwnerStoreFile, Path: "/tmp/owners"}, cacheConfig{}, false},
+		{"file without path", taskOwnersConfig{Store: taskOwnerStoreFile}, cacheConfig{}, true},
+		{"redis", taskOwnersConfig{Store: taskOwnerStoreRedis}, redis, false},
+		{"redis without a redis cache", taskOwnersConfig{Store: taskOwnerStoreRedis}, cacheConfig{Type: cacheTypeMemory}, true},
+		{"unknown store", taskOwnersConfig{Store: "bolt"}, cacheConfig{}, true},
+		{"negative ttl", taskOwnersConfig{TTLSeconds: -1}, cacheConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.validate(tt.cache)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_taskOwnerMap_file(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners")
+	conf := taskOwnersConfig{Store: taskOwnerStoreFile, Path: path, TTLSeconds: 60}
+
+	o, err := openTaskOwnerMap(conf, cacheConfig{})
+	require.NoError(t, err)
+	o.record("t1", URLAndPriority{URL: "http://a", token: "secret"})
+	o.record("t2", URLAndPriority{URL: "http://b"})
+	o.file.Close()
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(contents), "secret", "tokens are not saved")
+
+	reopened, err := openTaskOwnerMap(conf, cacheConfig{})
+	require.NoError(t, err)
+	defer reopened.file.Close()
+	route, found := reopened.lookup(context.Background(), "t2")
+	assert.True(t, found)
+	assert.Equal(t, taskOwnerRoute(URLAndPriority{URL: "http://b"}), route)
+
+	later := makeTaskOwnerMap(conf)
+	later.now = func() time.Time { return time.Now().Add(time.Hour) }
+	require.NoError(t, later.openFile(path))
+	defer later.file.Close()
+	assert.Empty(t, later.owners, "expired owners are dropped when loading")
+}
+
+func Test_taskOwnerMap_redis(t *testing.T) {
+	addr, _ := runFakeRedis(t)
+	cache := cacheConfig{Type: cacheTypeRedis, Address: addr, KeyPrefix: "sd:"}
+	conf := taskOwnersConfig{Store: taskOwnerStoreRedis}
+
+	o, err := openTaskOwnerMap(conf, cache)
+	require.NoError(t, err)
+	o.record("t1", URLAndPriority{URL: "http://a"})
+
+	replica, err := openTaskOwnerMap(conf, cache)
+	require.NoError(t, err)
+	route, found := replica.lookup(context.Background(), "t1")
+	assert.True(t, found)
+	assert.Equal(t, taskOwnerRoute(URLAndPriority{URL: "http://a"}), route)
+	_, found = replica.lookup(context.Background(), "t2")
+	assert.False(t, found)
+}
+
+func Test_taskOwnerMap_fileRewritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners")
+	o, err := openTaskOwnerMap(taskOwnersConfig{Store: taskOwnerStoreFile, Path: path}, cacheConfig{})
+	require.NoError(t, err)
+	defer func() { o.file.Close() }()
+	for i := 0; i < 2*maxTaskOwners; i++ {
+		o.record(fmt.Sprintf("t%d", i%10), URLAndPriority{URL: "http://a"})
+	}
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Less(t, strings.Count(string(contents), "\n"), maxTaskOwners, "replaced owners are dropped from the file")
+
+	_, found := o.lookup(context.Background(), "t9")
+	assert.True(t, found)
+}
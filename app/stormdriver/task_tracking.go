@@ -0,0 +1,270 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTaskTrackingPollIntervalSeconds = 10
+	defaultTaskTrackingTimeoutSeconds      = 3600
+	defaultTaskTrackingMaxTracked          = 1000
+
+	taskSucceeded = "succeeded"
+	taskFailed    = "failed"
+	taskTimedOut  = "timedOut"
+)
+
+// taskTrackingConfig enables polling the task returned by each forwarded
+// operation until it completes, to record how operations turn out.  At
+// most MaxTracked tasks are polled at once; tasks beyond that are not
+// tracked.
+type taskTrackingConfig struct {
+	Enabled             bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	PollIntervalSeconds int  `yaml:"pollIntervalSeconds,omitempty" json:"pollIntervalSeconds,omitempty"`
+	TimeoutSeconds      int  `yaml:"timeoutSeconds,omitempty" json:"timeoutSeconds,omitempty"`
+	MaxTracked          int  `yaml:"maxTracked,omitempty" json:"maxTracked,omitempty"`
+}
+
+func (c *taskTrackingConfig) applyDefaults() {
+	if !c.Enabled {
+		return
+	}
+	if c.PollIntervalSeconds == 0 {
+		c.PollIntervalSeconds = defaultTaskTrackingPollIntervalSeconds
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = defaultTaskTrackingTimeoutSeconds
+	}
+	if c.MaxTracked == 0 {
+		c.MaxTracked = defaultTaskTrackingMaxTracked
+	}
+}
+
+var (
+	taskOutcomes = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stormdriver",
+		Name:      "task_outcomes_total",
+		Help:      "Completed operation tasks, by account, clouddriver, and outcome.",
+	}, []string{"account", "clouddriver", "outcome"})
+
+	taskDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "stormdriver",
+		Name:      "task_duration_seconds",
+		Help:      "Time from forwarding an operation until its task completed, by account, clouddriver, and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"account", "clouddriver", "outcome"})
+
+	tasksTracked = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Namespace: "stormdriver",
+		Name:      "tasks_tracked",
+		Help:      "Operation tasks currently being polled.",
+	})
+)
+
+// taskStatus is the part of a clouddriver task needed to tell whether
+// it has finished.
+type taskStatus struct {
+	Status struct {
+		Completed bool `json:"completed"`
+		Failed    bool `json:"failed"`
+	} `json:"status"`
+}
+
+// taskStats summarizes the tasks for one account on one clouddriver.
+type taskStats struct {
+	Account                string  `json:"account"`
+	Clouddriver            string  `json:"clouddriver"`
+	Succeeded              int     `json:"succeeded"`
+	Failed                 int     `json:"failed"`
+	TimedOut               int     `json:"timedOut"`
+	SuccessRate            float64 `json:"successRate"`
+	AverageDurationSeconds float64 `json:"averageDurationSeconds"`
+
+	totalDuration time.Duration
+}
+
+type taskStatsKey struct {
+	account     string
+	clouddriver string
+}
+
+// trackedTask is a forwarded operation's task.
+type trackedTask struct {
+	id          string
+	route       URLAndPriority
+	clouddriver string
+	accounts    []string
+	headers     http.Header
+	started     time.Time
+}
+
+// taskTracker polls tasks in the background.  A nil taskTracker
+// tracks nothing.
+type taskTracker struct {
+	sync.Mutex
+	interval time.Duration
+	timeout  time.Duration
+	slots    chan struct{}
+	stats    map[taskStatsKey]*taskStats
+}
+
+var tasks *taskTracker
+
+func makeTaskTracker(conf taskTrackingConfig) *taskTracker {
+	if !conf.Enabled {
+		return nil
+	}
+	return &taskTracker{
+		interval: time.Duration(conf.PollIntervalSeconds) * time.Second,
+		timeout:  time.Duration(conf.TimeoutSeconds) * time.Second,
+		slots:    make(chan struct{}, conf.MaxTracked),
+		stats:    map[taskStatsKey]*taskStats{},
+	}
+}
+
+// track begins polling the task in the background, unless too many
+// tasks are already being tracked.
+func (t *taskTracker) track(task trackedTask) {
+	if t == nil || task.id == "" {
+		return
+	}
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		zap.S().Warnw("too many tasks tracked, not tracking task", "taskId", task.id)
+		return
+	}
+	tasksTracked.Inc()
+	go func() {
+		defer func() {
+			<-t.slots
+			tasksTracked.Dec()
+		}()
+		t.poll(context.Background(), task)
+	}()
+}
+
+// poll waits for the task to complete, and records its outcome.
+func (t *taskTracker) poll(ctx context.Context, task trackedTask) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	target := combineURL(task.route.URL, "/task/"+task.id)
+	for {
+		select {
+		case <-ctx.Done():
+			t.record(task, taskTimedOut, time.Since(task.started))
+			return
+		case <-ticker.C:
+		}
+		body, code, _, err := fetchGet(withRoute(ctx, task.route), target, task.route.token, task.headers)
+		if err != nil || !httputil.StatusCodeOK(code) {
+			continue
+		}
+		var status taskStatus
+		if err := json.Unmarshal(body, &status); err != nil {
+			zap.S().Warnw("unable to parse task", "taskId", task.id, "error", err)
+			continue
+		}
+		if !status.Status.Completed {
+			continue
+		}
+		outcome := taskSucceeded
+		if status.Status.Failed {
+			outcome = taskFailed
+		}
+		t.record(task, outcome, time.Since(task.started))
+		return
+	}
+}
+
+func (t *taskTracker) record(task trackedTask, outcome string, duration time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	for _, account := range task.accounts {
+		taskOutcomes.WithLabelValues(account, task.clouddriver, outcome).Inc()
+		taskDuration.WithLabelValues(account, task.clouddriver, outcome).Observe(duration.Seconds())
+
+		key := taskStatsKey{account: account, clouddriver: task.clouddriver}
+		s, found := t.stats[key]
+		if !found {
+			s = &taskStats{Account: account, Clouddriver: task.clouddriver}
+			t.stats[key] = s
+		}
+		switch outcome {
+		case taskSucceeded:
+			s.Succeeded++
+		case taskFailed:
+			s.Failed++
+		case taskTimedOut:
+			s.TimedOut++
+		}
+		s.totalDuration += duration
+		total := s.Succeeded + s.Failed + s.TimedOut
+		s.SuccessRate = float64(s.Succeeded) / float64(total)
+		s.AverageDurationSeconds = s.totalDuration.Seconds() / float64(total)
+	}
+}
+
+// getStats returns the statistics for each account and clouddriver,
+// sorted by account then clouddriver.
+func (t *taskTracker) getStats() []taskStats {
+	ret := []taskStats{}
+	if t == nil {
+		return ret
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.stats {
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Account != ret[j].Account {
+			return ret[i].Account < ret[j].Account
+		}
+		return ret[i].Clouddriver < ret[j].Clouddriver
+	})
+	return ret
+}
+
+func (*srv) taskStatsRequest(w http.ResponseWriter, req *http.Request) {
+	if tasks == nil {
+		httputil.SetError(w, http.StatusNotFound, "task tracking not enabled")
+		return
+	}
+	json, err := json.Marshal(tasks.getStats())
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_taskTracker_poll(t *testing.T) {
+	var polls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/task/t1", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("authorization"))
+		if atomic.AddInt32(&polls, 1) < 3 {
+			_, _ = w.Write([]byte(`{"id":"t1","status":{"completed":false,"failed":false}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"t1","status":{"completed":true,"failed":true}}`))
+	}))
+	defer server.Close()
+
+	tracker := makeTaskTracker(taskTrackingConfig{Enabled: true, MaxTracked: 1})
+	tracker.interval = time.Millisecond
+	tracker.timeout = 10 * time.Second
+	tracker.poll(context.Background(), trackedTask{
+		id:          "t1",
+		route:       URLAndPriority{URL: server.URL, token: "secret"},
+		clouddriver: "cd1",
+		accounts:    []string{"a1"},
+		started:     time.Now(),
+	})
+
+	stats := tracker.getStats()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, 1, stats[0].Failed)
+	assert.Equal(t, 0.0, stats[0].SuccessRate)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&polls))
+}
+
+func Test_taskTracker_record(t *testing.T) {
+	tracker := makeTaskTracker(taskTrackingConfig{Enabled: true, MaxTracked: 1})
+	tracker.record(trackedTask{clouddriver: "cd1", accounts: []string{"a2", "a1"}}, taskSucceeded, 2*time.Second)
+	tracker.record(trackedTask{clouddriver: "cd1", accounts: []string{"a1"}}, taskFailed, 4*time.Second)
+	tracker.record(trackedTask{clouddriver: "cd1", accounts: []string{"a1"}}, taskTimedOut, 6*time.Second)
+	tracker.record(trackedTask{clouddriver: "cd1", accounts: []string{"a1"}}, taskSucceeded, 8*time.Second)
+
+	stats := tracker.getStats()
+	want := []taskStats{
+		{Account: "a1", Clouddriver: "cd1", Succeeded: 2, Failed: 1, TimedOut: 1, SuccessRate: 0.5, AverageDurationSeconds: 5, totalDuration: 20 * time.Second},
+		{Account: "a2", Clouddriver: "cd1", Succeeded: 1, SuccessRate: 1, AverageDurationSeconds: 2, totalDuration: 2 * time.Second},
+	}
+	assert.Equal(t, want, stats)
+}
+
+func Test_taskTracker_track(t *testing.T) {
+	var tracker *taskTracker
+	tracker.track(trackedTask{id: "t1"}) // nil tracker does nothing
+	assert.Empty(t, tracker.getStats())
+
+	tracker = makeTaskTracker(taskTrackingConfig{Enabled: true, MaxTracked: 1})
+	tracker.slots <- struct{}{}
+	tracker.track(trackedTask{id: "t1"}) // no free slot, so dropped
+	assert.Len(t, tracker.slots, 1)
+}
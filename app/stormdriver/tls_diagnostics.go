@@ -0,0 +1,258 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	// tlsExpiryWarning is how far ahead of a certificate's expiry
+	// warnings are logged.
+	tlsExpiryWarning = 14 * 24 * time.Hour
+
+	// tlsWarningInterval limits how often each host is warned about.
+	tlsWarningInterval = 24 * time.Hour
+
+	controllerClientCertificate = "controller client certificate"
+)
+
+var tlsCertificateExpiry = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "stormdriver",
+	Name:      "tls_certificate_expiry_timestamp_seconds",
+	Help:      "When the first certificate in the chain last seen for each host expires, as a Unix time.",
+}, []string{"host"})
+
+// tlsCertificateInfo describes one certificate in a chain.
+type tlsCertificateInfo struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialNumber"`
+	DNSNames     []string  `json:"dnsNames,omitempty"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+// tlsObservation is the certificate chain last seen for a host.
+// NotAfter is the earliest expiry in the chain.
+type tlsObservation struct {
+	Host          string               `json:"host"`
+	ObservedAt    time.Time            `json:"observedAt"`
+	NotAfter      time.Time            `json:"notAfter,omitempty"`
+	ExpiresInDays int                  `json:"expiresInDays"`
+	Chain         []tlsCertificateInfo `json:"chain,omitempty"`
+	Error         string               `json:"error,omitempty"`
+
+	fingerprint string
+}
+
+// tlsObserver records the certificates presented on upstream TLS
+// connections, so expiring certificates are noticed before they cause
+// an outage.
+type tlsObserver struct {
+	sync.Mutex
+	observations map[string]*tlsObservation
+	warned       map[string]time.Time
+}
+
+var tlsObservations = makeTLSObserver()
+
+func makeTLSObserver() *tlsObserver {
+	return &tlsObserver{
+		observations: map[string]*tlsObservation{},
+		warned:       map[string]time.Time{},
+	}
+}
+
+// observeChain records the chain for host.  Only the first certificate
+// is compared with the last observation, so repeated calls are cheap.
+func (o *tlsObserver) observeChain(host string, chain []*x509.Certificate, now time.Time) {
+	if len(chain) == 0 {
+		return
+	}
+	sum := sha256.Sum256(chain[0].Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	o.Lock()
+	defer o.Unlock()
+	obs, found := o.observations[host]
+	if !found || obs.fingerprint != fingerprint || obs.Error != "" {
+		obs = &tlsObservation{Host: host, fingerprint: fingerprint}
+		for _, cert := range chain {
+			obs.Chain = append(obs.Chain, tlsCertificateInfo{
+				Subject:      cert.Subject.String(),
+				Issuer:       cert.Issuer.String(),
+				SerialNumber: cert.SerialNumber.String(),
+				DNSNames:     cert.DNSNames,
+				NotBefore:    cert.NotBefore.UTC(),
+				NotAfter:     cert.NotAfter.UTC(),
+			})
+			if obs.NotAfter.IsZero() || cert.NotAfter.Before(obs.NotAfter) {
+				obs.NotAfter = cert.NotAfter.UTC()
+			}
+		}
+		o.observations[host] = obs
+		// A replacement chain is warned about on its own merits.
+		delete(o.warned, host)
+		tlsCertificateExpiry.WithLabelValues(host).Set(float64(obs.NotAfter.Unix()))
+	}
+	obs.ObservedAt = now.UTC()
+
+	if obs.NotAfter.Sub(now) < tlsExpiryWarning && now.Sub(o.warned[host]) > tlsWarningInterval {
+		o.warned[host] = now
+		if !now.Before(obs.NotAfter) {
+			zap.S().Errorw("certificate has expired", "host", host, "notAfter", obs.NotAfter, "subject", obs.Chain[0].Subject)
+		} else {
+			zap.S().Warnw("certificate expires soon", "host", host, "notAfter", obs.NotAfter, "subject", obs.Chain[0].Subject)
+		}
+	}
+}
+
+// observeError records a failure to verify the certificate for host.
+// The last good chain, if any, is kept.
+func (o *tlsObserver) observeError(host string, err error, now time.Time) {
+	o.Lock()
+	defer o.Unlock()
+	obs, found := o.observations[host]
+	if !found {
+		obs = &tlsObservation{Host: host}
+		o.observations[host] = obs
+	}
+	obs.ObservedAt = now.UTC()
+	obs.Error = err.Error()
+}
+
+// getObservations returns the observations sorted by host.
+func (o *tlsObserver) getObservations(now time.Time) []tlsObservation {
+	o.Lock()
+	defer o.Unlock()
+	ret := make([]tlsObservation, 0, len(o.observations))
+	for _, obs := range o.observations {
+		item := *obs
+		if !item.NotAfter.IsZero() {
+			// Round down, so a certificate which expired an hour ago
+			// is -1 days from expiry rather than 0.
+			item.ExpiresInDays = int(math.Floor(item.NotAfter.Sub(now).Hours() / 24))
+		}
+		ret = append(ret, item)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Host < ret[j].Host })
+	return ret
+}
+
+// observeCertificateFile records the certificates in a PEM file, such as
+// the client certificate used to talk to the controller.
+func (o *tlsObserver) observeCertificateFile(name string, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	chain := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(bytes.TrimSpace(data))
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("%s: no certificates found", path)
+	}
+	o.observeChain(name, chain, time.Now())
+	return nil
+}
+
+// tlsObservingTransport records the certificates presented by each
+// upstream TLS connection.
+type tlsObservingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tlsObservingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		if isCertificateError(err) {
+			tlsObservations.observeError(tlsHost(req.URL), err, time.Now())
+		}
+		return resp, err
+	}
+	if resp.TLS != nil {
+		tlsObservations.observeChain(tlsHost(req.URL), resp.TLS.PeerCertificates, time.Now())
+	}
+	return resp, nil
+}
+
+// tlsHost returns the host and port connected to for u, so URLs which
+// do and do not spell out the default port share an observation.
+func tlsHost(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// observeTLS wraps the client's transport to record upstream certificates.
+func observeTLS(client *http.Client) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client.Transport = &tlsObservingTransport{next: next}
+	return client
+}
+
+func (*srv) tlsRequest(w http.ResponseWriter, req *http.Request) {
+	json, err := json.Marshal(tlsObservations.getObservations(time.Now()))
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httputil.CheckedWrite(w, json)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tlsObservingTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	saved := tlsObservations
+	defer func() { tlsObservations = saved }()
+	tlsObservations = makeTLSObserver()
+
+	client := observeTLS(server.Client())
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	u, _ := url.Parse(server.URL)
+	obs := tlsObservations.getObservations(time.Now())
+	require.Len(t, obs, 1)
+	assert.Equal(t, u.Host, obs[0].Host)
+	assert.Equal(t, server.Certificate().NotAfter.UTC(), obs[0].NotAfter)
+	assert.NotEmpty(t, obs[0].Chain)
+	assert.Empty(t, obs[0].Error)
+
+	// an untrusted certificate is recorded as an error
+	_, err = observeTLS(&http.Client{}).Get(server.URL)
+	require.Error(t, err)
+	obs = tlsObservations.getObservations(time.Now())
+	assert.NotEmpty(t, obs[0].Error)
+	assert.NotEmpty(t, obs[0].Chain, "last good chain is kept")
+}
+
+func Test_tlsObserver_observeChain(t *testing.T) {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{Raw: []byte("leaf"), NotAfter: now.Add(30 * 24 * time.Hour)}
+	intermediate := &x509.Certificate{Raw: []byte("intermediate"), NotAfter: now.Add(10 * 24 * time.Hour)}
+
+	o := makeTLSObserver()
+	o.observeChain("cd1:443", []*x509.Certificate{leaf, intermediate}, now)
+	obs := o.getObservations(now)
+	require.Len(t, obs, 1)
+	assert.Equal(t, intermediate.NotAfter, obs[0].NotAfter, "earliest expiry in the chain")
+	assert.Equal(t, 10, obs[0].ExpiresInDays)
+	assert.Equal(t, now, o.warned["cd1:443"], "warned about expiry within two weeks")
+
+	o.observeError("cd2:443", errors.New("x509: certificate has expired"), now)
+	obs = o.getObservations(now)
+	require.Len(t, obs, 2)
+	assert.Equal(t, "cd2:443", obs[1].Host)
+	assert.Equal(t, 0, obs[1].ExpiresInDays)
+
+	// an expired certificate is a negative number of days from expiry
+	expired := &x509.Certificate{Raw: []byte("expired"), NotAfter: now.Add(-time.Hour)}
+	o.observeChain("cd3:443", []*x509.Certificate{expired}, now)
+	obs = o.getObservations(now)
+	require.Len(t, obs, 3)
+	assert.Equal(t, -1, obs[2].ExpiresInDays)
+
+	// a replacement chain is warned about straight away
+	soon := &x509.Certificate{Raw: []byte("soon"), NotAfter: now.Add(5 * 24 * time.Hour)}
+	later := now.Add(time.Hour)
+	o.observeChain("cd1:443", []*x509.Certificate{soon}, later)
+	assert.Equal(t, later, o.warned["cd1:443"])
+}
+
+func Test_tlsHost(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://cd1.example.com/credentials", "cd1.example.com:443"},
+		{"https://cd1.example.com:443/credentials", "cd1.example.com:443"},
+		{"https://cd1.example.com:7002", "cd1.example.com:7002"},
+		{"http://cd1.example.com", "cd1.example.com:80"},
+		{"https://[::1]/credentials", "[::1]:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tlsHost(u))
+		})
+	}
+}
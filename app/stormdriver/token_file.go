@@ -0,0 +1,106 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tokenFileReloader serves the token in a file, re-reading it when the
+// file changes, so a rotated Kubernetes secret takes effect without a
+// restart.
+type tokenFileReloader struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	token   string
+}
+
+func (r *tokenFileReloader) load() (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	modTime, err := latestModTime(r.path)
+	if err != nil && r.token != "" {
+		// keep using the last good token while the file is replaced.
+		return r.token, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if r.token != "" && modTime.Equal(r.modTime) {
+		return r.token, nil
+	}
+	content, err := os.ReadFile(r.path)
+	if err == nil && strings.TrimSpace(string(content)) == "" {
+		err = fmt.Errorf("%s is empty", r.path)
+	}
+	if err != nil {
+		if r.token != "" {
+			zap.S().Warnw("unable to reload token, using previous one", "path", r.path, "error", err)
+			r.modTime = modTime
+			return r.token, nil
+		}
+		return "", err
+	}
+	if r.token != "" {
+		zap.S().Infow("reloaded token", "path", r.path)
+	}
+	r.token = strings.TrimSpace(string(content))
+	r.modTime = modTime
+	return r.token, nil
+}
+
+// checkTokenFiles reads the token file of each clouddriver which has
+// one, so a missing or empty file is found when the configuration is
+// loaded rather than on the first request.
+func checkTokenFiles(clouddrivers []clouddriverConfig) error {
+	for _, cd := range clouddrivers {
+		if cd.TokenFile == "" {
+			continue
+		}
+		if _, err := (&tokenFileReloader{path: cd.TokenFile}).load(); err != nil {
+			return fmt.Errorf("clouddriver %s: tokenFile: %w", cd.Name, err)
+		}
+	}
+	return nil
+}
+
+// tokenFileTransport adds the token from a file to every request,
+// replacing any credentials the request carried.
+type tokenFileTransport struct {
+	tokens *tokenFileReloader
+	next   http.RoundTripper
+}
+
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.load()
+	if err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+	// A RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	req.Header.Set("authorization", "Bearer "+token)
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tokenFileReloader_load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	r := &tokenFileReloader{path: path}
+
+	_, err := r.load()
+	assert.Error(t, err, "missing file with no previous token")
+
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0600))
+	token, err := r.load()
+	require.NoError(t, err)
+	assert.Equal(t, "first", token)
+
+	// rotated, as a Kubernetes secret update would
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	token, err = r.load()
+	require.NoError(t, err)
+	assert.Equal(t, "second", token)
+
+	// emptied or removed while being replaced
+	require.NoError(t, os.WriteFile(path, []byte(""), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	token, err = r.load()
+	require.NoError(t, err)
+	assert.Equal(t, "second", token)
+	require.NoError(t, os.Remove(path))
+	token, err = r.load()
+	require.NoError(t, err)
+	assert.Equal(t, "second", token)
+}
+
+func Test_tokenFileTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0600))
+	var seen string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("authorization")
+	}))
+	defer backend.Close()
+
+	r := &clientRegistry{destinations: map[string]*destinationClient{}}
+	r.register(backend.URL, clouddriverConfig{URL: backend.URL, TokenFile: path}.clientOptions())
+
+	tests := []struct {
+		name string
+		auth string
+		want string
+	}{
+		{"token added", "", "Bearer from-file"},
+		{"caller's credentials replaced", "Bearer caller", "Bearer from-file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, backend.URL+"/credentials", nil)
+			require.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("authorization", tt.auth)
+			}
+			resp, err := r.clientFor(req.URL.String()).Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.want, seen)
+		})
+	}
+}
+
+func Test_checkTokenFiles(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good")
+	require.NoError(t, os.WriteFile(good, []byte("token\n"), 0600))
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(empty, []byte("\n"), 0600))
+
+	assert.NoError(t, checkTokenFiles([]clouddriverConfig{{Name: "plain"}, {Name: "good", TokenFile: good}}))
+	assert.ErrorContains(t, checkTokenFiles([]clouddriverConfig{{Name: "empty", TokenFile: empty}}), "clouddriver empty: tokenFile")
+	assert.ErrorContains(t, checkTokenFiles([]clouddriverConfig{{Name: "missing", TokenFile: filepath.Join(dir, "missing")}}), "clouddriver missing: tokenFile")
+}
+
+func Test_clouddriverConfig_validate_tokenFile(t *testing.T) {
+	cd := clouddriverConfig{URL: "http://clouddriver:7002", TokenFile: "/app/secrets/token"}
+	assert.NoError(t, cd.validate())
+	cd.OAuth2 = &oauth2Config{TokenURL: "https://idp.example.com/token", ClientID: "stormdriver"}
+	assert.ErrorContains(t, cd.validate(), "only one of oauth2 and tokenFile")
+}
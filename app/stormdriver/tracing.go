@@ -0,0 +1,149 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http"
+)
+
+// tracingConfig adds trace exporters to those chosen on the command
+// line.
+type tracingConfig struct {
+	OTLP *otlpConfig `yaml:"otlp,omitempty" json:"otlp,omitempty"`
+}
+
+// otlpConfig sends traces to an OpenTelemetry collector, or any backend
+// accepting OTLP, over gRPC (the default) or HTTP.  Endpoint is a
+// host:port.  Headers are sent with every export, often to carry an
+// API key.  Unless Insecure is set, TLS is used, with the system roots
+// and optionally a CA bundle and client certificate.
+type otlpConfig struct {
+	Protocol string            `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	Endpoint string            `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	URLPath  string            `yaml:"urlPath,omitempty" json:"urlPath,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	Insecure bool              `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+	TLS      *clientTLSConfig  `yaml:"tls,omitempty" json:"tls,omitempty"`
+}
+
+func (c *tracingConfig) applyDefaults() {
+	if c.OTLP != nil {
+		c.OTLP.applyDefaults()
+	}
+}
+
+func (c tracingConfig) validate() error {
+	if c.OTLP == nil {
+		return nil
+	}
+	if err := c.OTLP.validate(); err != nil {
+		return fmt.Errorf("otlp: %v", err)
+	}
+	return nil
+}
+
+func (c *otlpConfig) applyDefaults() {
+	if c.Protocol == "" {
+		c.Protocol = otlpProtocolGRPC
+	}
+}
+
+func (c otlpConfig) validate() error {
+	switch c.Protocol {
+	case "", otlpProtocolGRPC, otlpProtocolHTTP:
+	default:
+		return fmt.Errorf("protocol must be grpc or http")
+	}
+	if c.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	if c.URLPath != "" && c.Protocol != otlpProtocolHTTP {
+		return fmt.Errorf("urlPath requires protocol http")
+	}
+	if c.TLS != nil {
+		if c.Insecure {
+			return fmt.Errorf("tls cannot be used with insecure")
+		}
+		if err := c.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+	return nil
+}
+
+// makeOTLPExporter returns an exporter sending spans as c describes.
+func makeOTLPExporter(ctx context.Context, c *otlpConfig) (tracesdk.SpanExporter, error) {
+	if c.Protocol == otlpProtocolHTTP {
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(c.Endpoint),
+			otlptracehttp.WithHeaders(c.Headers),
+		}
+		if c.URLPath != "" {
+			opts = append(opts, otlptracehttp.WithURLPath(c.URLPath))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else if c.TLS != nil {
+			tlsConfig, err := c.TLS.tlsConfig(nil)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	opts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(c.Endpoint),
+		otlptracegrpc.WithHeaders(c.Headers),
+	}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else if c.TLS != nil {
+		tlsConfig, err := c.TLS.tlsConfig(nil)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// addTraceExporters adds the configured exporters to the provider made
+// from the command line flags.
+func addTraceExporters(ctx context.Context, provider *tracesdk.TracerProvider, c tracingConfig) error {
+	if c.OTLP == nil {
+		return nil
+	}
+	exp, err := makeOTLPExporter(ctx, c.OTLP)
+	if err != nil {
+		return fmt.Errorf("otlp: %v", err)
+	}
+	provider.RegisterSpanProcessor(tracesdk.NewBatchSpanProcessor(exp))
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func Test_otlpConfig_validate(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       otlpConfig
+		wantProtocol string
+		wantErr      bool
+	}{
+		{"defaults to grpc", otlpConfig{Endpoint: "collector:4317"}, otlpProtocolGRPC, false},
+		{"grpc", otlpConfig{Protocol: "grpc", Endpoint: "collector:4317"}, otlpProtocolGRPC, false},
+		{"http", otlpConfig{Protocol: "http", Endpoint: "collector:4318", URLPath: "/v1/traces"}, otlpProtocolHTTP, false},
+		{"unknown protocol", otlpConfig{Protocol: "thrift", Endpoint: "collector:4317"}, "", true},
+		{"missing endpoint", otlpConfig{}, "", true},
+		{"urlPath with grpc", otlpConfig{Endpoint: "collector:4317", URLPath: "/v1/traces"}, "", true},
+		{"tls and insecure", otlpConfig{Endpoint: "collector:4317", Insecure: true, TLS: &clientTLSConfig{CAPath: "/ca.crt"}}, "", true},
+		{"tls without files", otlpConfig{Endpoint: "collector:4317", TLS: &clientTLSConfig{}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := tt.config
+			err := tt.config.validate()
+			assert.Equal(t, before, tt.config, "validate does not change the config")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			tt.config.applyDefaults()
+			assert.Equal(t, tt.wantProtocol, tt.config.Protocol)
+		})
+	}
+}
+
+func Test_addTraceExporters_http(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	provider := tracesdk.NewTracerProvider()
+	c := tracingConfig{OTLP: &otlpConfig{
+		Protocol: otlpProtocolHTTP,
+		Endpoint: strings.TrimPrefix(collector.URL, "http://"),
+		Headers:  map[string]string{"x-api-key": "secret"},
+		Insecure: true,
+	}}
+	c.applyDefaults()
+	require.NoError(t, c.validate())
+	require.NoError(t, addTraceExporters(context.Background(), provider, c))
+
+	_, span := provider.Tracer("test").Start(context.Background(), "request")
+	span.End()
+	require.NoError(t, provider.ForceFlush(context.Background()))
+
+	r := <-received
+	assert.Equal(t, "/v1/traces", r.URL.Path)
+	assert.Equal(t, "secret", r.Header.Get("x-api-key"))
+	require.NoError(t, provider.Shutdown(context.Background()))
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+const validateDialTimeout = 5 * time.Second
+
+// checkURL reports why a clouddriver or controller URL cannot be used,
+// or "" if it can.  validate() only checks that URLs parse, which
+// accepts hostnames without a scheme.
+func checkURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err.Error()
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Sprintf("%q must start with http:// or https://", s)
+	}
+	if u.Hostname() == "" {
+		return fmt.Sprintf("%q has no host", s)
+	}
+	return ""
+}
+
+// checkConfiguration returns the problems in a configuration which has
+// passed validate(), but would still not work once deployed.
+func checkConfiguration(c *configuration) []string {
+	ret := []string{}
+	if len(c.Clouddrivers) == 0 && c.Controller.URL == "" && !c.Discovery.enabled() {
+		ret = append(ret, "no clouddrivers defined, and neither controller nor discovery configured")
+	}
+	if c.Controller.URL != "" {
+		if problem := checkURL(c.Controller.URL); problem != "" {
+			ret = append(ret, "controller.url: "+problem)
+		}
+	}
+	names := map[string]bool{}
+	for _, cd := range c.Clouddrivers {
+		if names[cd.Name] {
+			ret = append(ret, fmt.Sprintf("clouddriver %s: name is used more than once", cd.Name))
+		}
+		names[cd.Name] = true
+		if problem := checkURL(cd.URL); problem != "" {
+			ret = append(ret, fmt.Sprintf("clouddriver %s: url: %s", cd.Name, problem))
+		}
+		if problem := checkURL(cd.HealthcheckURL); problem != "" {
+			ret = append(ret, fmt.Sprintf("clouddriver %s: healthcheckUrl: %s", cd.Name, problem))
+		}
+	}
+	return ret
+}
+
+// referencedFiles returns the files the configuration reads, keyed by
+// where they are configured.  Files written from Vault are left out, as
+// they do not exist until Stormdriver starts.
+func referencedFiles(c *configuration) map[string]string {
+	fromVault := map[string]bool{}
+	for _, s := range c.Vault.Secrets {
+		fromVault[s.File] = true
+	}
+	ret := map[string]string{}
+	add := func(where string, path string) {
+		if path != "" && !fromVault[path] {
+			ret[where] = path
+		}
+	}
+	if c.Controller.URL != "" {
+		add("controller.caPath", c.Controller.CAPath)
+		add("controller.certificatePath", c.Controller.CertificatePath)
+		add("controller.keyPath", c.Controller.KeyPath)
+	}
+	add("tls.certificatePath", c.TLS.CertificatePath)
+	add("tls.keyPath", c.TLS.KeyPath)
+	add("tls.clientCAPath", c.TLS.ClientCAPath)
+	for _, cd := range c.Clouddrivers {
+		prefix := "clouddriver " + cd.Name + ": "
+		add(prefix+"tokenFile", cd.TokenFile)
+		if cd.TLS != nil {
+			add(prefix+"tls.certificatePath", cd.TLS.CertificatePath)
+			add(prefix+"tls.keyPath", cd.TLS.KeyPath)
+			add(prefix+"tls.caPath", cd.TLS.CAPath)
+		}
+	}
+	return ret
+}
+
+// checkFiles returns the referenced files which cannot be read.
+func checkFiles(c *configuration) []string {
+	ret := []string{}
+	for where, path := range referencedFiles(c) {
+		f, err := os.Open(path)
+		if err != nil {
+			ret = append(ret, fmt.Sprintf("%s: %v", where, err))
+			continue
+		}
+		f.Close()
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// dialAddress returns the host:port to connect to for a URL.
+func dialAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// checkReachability opens, and immediately closes, a connection to the
+// controller and each clouddriver.  No requests are sent.  Clouddrivers
+// reached through a proxy are skipped.
+func checkReachability(ctx context.Context, c *configuration, dial dialFunc) []string {
+	targets := map[string]string{}
+	if c.Controller.URL != "" {
+		targets["controller"] = c.Controller.URL
+	}
+	for _, cd := range c.Clouddrivers {
+		if cd.Proxy == nil && cd.SOCKS5 == nil {
+			targets["clouddriver "+cd.Name] = cd.URL
+		}
+	}
+	ret := []string{}
+	for where, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil || checkURL(target) != "" {
+			continue // already reported
+		}
+		dctx, cancel := context.WithTimeout(ctx, validateDialTimeout)
+		conn, err := dial(dctx, "tcp", dialAddress(u))
+		cancel()
+		if err != nil {
+			ret = append(ret, fmt.Sprintf("%s: unreachable: %v", where, err))
+			continue
+		}
+		conn.Close()
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// runValidate loads and checks a configuration file, writing what it
+// finds to w, and returns the exit code.  With live set, referenced files
+// must be readable and clouddrivers must accept connections.
+func runValidate(w io.Writer, filename string, live bool) int {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		return 1
+	}
+	c, err := loadConfiguration(buf)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", filename, err)
+		return 1
+	}
+	problems := checkConfiguration(c)
+	if live {
+		problems = append(problems, checkFiles(c)...)
+		var d net.Dialer
+		problems = append(problems, checkReachability(context.Background(), c, d.DialContext)...)
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(w, "%s: %s\n", filename, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Fprintf(w, "%s: ok\n", filename)
+	return 0
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://clouddriver:7002", true},
+		{"https://clouddriver.example.com/base", true},
+		{"clouddriver:7002", false},
+		{"ftp://clouddriver", false},
+		{"http://", false},
+		{"http://%zz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			assert.Equal(t, tt.want, checkURL(tt.url) == "")
+		})
+	}
+}
+
+func Test_checkConfiguration(t *testing.T) {
+	c, err := loadConfiguration([]byte(`clouddrivers:
+  - name: one
+    url: http://one:7002
+  - name: one
+    url: two:7002
+    healthcheckUrl: http://two:7002/health`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"clouddriver one: name is used more than once",
+		`clouddriver one: url: "two:7002" must start with http:// or https://`,
+	}, checkConfiguration(c))
+
+	c, err = loadConfiguration([]byte(``))
+	require.NoError(t, err)
+	assert.Len(t, checkConfiguration(c), 1, "something must provide clouddrivers")
+}
+
+func Test_checkFiles(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(token, []byte("t"), 0600))
+	c := &configuration{
+		Clouddrivers: []clouddriverConfig{
+			{Name: "a", TokenFile: token, TLS: &clientTLSConfig{CAPath: filepath.Join(dir, "missing.crt")}},
+			{Name: "b", TokenFile: filepath.Join(dir, "from-vault")},
+		},
+		Vault: vaultConfig{Secrets: []vaultSecretConfig{{File: filepath.Join(dir, "from-vault")}}},
+	}
+	problems := checkFiles(c)
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "clouddriver a: tls.caPath")
+}
+
+func Test_checkReachability(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	c := &configuration{
+		Clouddrivers: []clouddriverConfig{
+			{Name: "up", URL: "http://" + l.Addr().String()},
+			{Name: "down", URL: "http://" + closedAddr},
+			{Name: "proxied", URL: "http://" + closedAddr, Proxy: &proxyConfig{}},
+		},
+	}
+	var d net.Dialer
+	problems := checkReachability(context.Background(), c, d.DialContext)
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "clouddriver down: unreachable")
+}
+
+func Test_runValidate(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.yaml")
+	require.NoError(t, os.WriteFile(good, []byte("clouddrivers:\n  - url: http://clouddriver:7002\n"), 0600))
+	bad := filepath.Join(dir, "bad.yaml")
+	require.NoError(t, os.WriteFile(bad, []byte("clouddrivers:\n  - name: x\n"), 0600))
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, runValidate(&out, good, false))
+	assert.Contains(t, out.String(), "good.yaml: ok")
+
+	out.Reset()
+	assert.Equal(t, 1, runValidate(&out, bad, false))
+	assert.Contains(t, out.String(), "missing url")
+
+	out.Reset()
+	assert.Equal(t, 1, runValidate(&out, filepath.Join(dir, "missing.yaml"), false))
+}
@@ -0,0 +1,402 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	vaultAuthToken      = "token"
+	vaultAuthKubernetes = "kubernetes"
+
+	defaultVaultRefreshSeconds      = 300
+	defaultVaultKubernetesMountPath = "kubernetes"
+	defaultVaultTokenPath           = "/vault/token"
+
+	vaultNamespaceHeader = "X-Vault-Namespace"
+	vaultTokenHeader     = "X-Vault-Token"
+	vaultRequestTimeout  = 30 * time.Second
+	vaultMaxResponseSize = 1 << 20
+
+	vaultSecretFileMode      = 0600
+	vaultSecretDirectoryMode = 0700
+)
+
+var errVaultPermissionDenied = errors.New("vault: permission denied")
+
+// vaultConfig writes secrets read from Vault to files, at startup and
+// every RefreshSeconds after, so anything Stormdriver reads from a file,
+// such as client certificates and the controller's credentials, can be
+// kept in Vault rather than in the configuration or environment.
+type vaultConfig struct {
+	Address        string              `yaml:"address,omitempty" json:"address,omitempty"`
+	Namespace      string              `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	CAPath         string              `yaml:"caPath,omitempty" json:"caPath,omitempty"`
+	Auth           vaultAuthConfig     `yaml:"auth,omitempty" json:"auth,omitempty"`
+	RefreshSeconds int                 `yaml:"refreshSeconds,omitempty" json:"refreshSeconds,omitempty"`
+	Secrets        []vaultSecretConfig `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+}
+
+// vaultAuthConfig says how to log in to Vault: with a token read from
+// TokenPath, such as one kept fresh by a Vault agent, or with the pod's
+// service account using Vault's Kubernetes auth method.
+type vaultAuthConfig struct {
+	Method    string `yaml:"method,omitempty" json:"method,omitempty"`
+	TokenPath string `yaml:"tokenPath,omitempty" json:"tokenPath,omitempty"`
+	Role      string `yaml:"role,omitempty" json:"role,omitempty"`
+	MountPath string `yaml:"mountPath,omitempty" json:"mountPath,omitempty"`
+	JWTPath   string `yaml:"jwtPath,omitempty" json:"jwtPath,omitempty"`
+}
+
+// vaultSecretConfig names one field of a secret at Path, and the file
+// it is written to.  KV version 1 and 2 secrets are both understood; for
+// version 2 the path includes "data/", as in the Vault API.
+type vaultSecretConfig struct {
+	Path  string `yaml:"path,omitempty" json:"path,omitempty"`
+	Field string `yaml:"field,omitempty" json:"field,omitempty"`
+	File  string `yaml:"file,omitempty" json:"file,omitempty"`
+}
+
+func (c *vaultConfig) enabled() bool {
+	return c.Address != ""
+}
+
+func (c *vaultConfig) applyDefaults() {
+	if !c.enabled() {
+		return
+	}
+	if c.RefreshSeconds == 0 {
+		c.RefreshSeconds = defaultVaultRefreshSeconds
+	}
+	if c.Auth.Method == "" {
+		c.Auth.Method = vaultAuthToken
+	}
+	switch c.Auth.Method {
+	case vaultAuthToken:
+		if c.Auth.TokenPath == "" {
+			c.Auth.TokenPath = defaultVaultTokenPath
+		}
+	case vaultAuthKubernetes:
+		if c.Auth.MountPath == "" {
+			c.Auth.MountPath = defaultVaultKubernetesMountPath
+		}
+		if c.Auth.JWTPath == "" {
+			c.Auth.JWTPath = defaultKubernetesTokenPath
+		}
+	}
+}
+
+func (c *vaultConfig) validate() error {
+	if !c.enabled() {
+		if len(c.Secrets) > 0 {
+			return errors.New("address is required")
+		}
+		return nil
+	}
+	u, err := url.Parse(c.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("address must be an http or https URL")
+	}
+	if c.RefreshSeconds < 0 {
+		return errors.New("refreshSeconds cannot be negative")
+	}
+	switch c.Auth.Method {
+	case vaultAuthToken:
+	case vaultAuthKubernetes:
+		if c.Auth.Role == "" {
+			return errors.New("auth.role is required for kubernetes auth")
+		}
+	default:
+		return fmt.Errorf("auth.method must be %s or %s, not %q", vaultAuthToken, vaultAuthKubernetes, c.Auth.Method)
+	}
+	files := map[string]bool{}
+	for idx, s := range c.Secrets {
+		if s.Path == "" || s.Field == "" || s.File == "" {
+			return fmt.Errorf("secrets index %d: path, field, and file are required", idx+1)
+		}
+		if files[s.File] {
+			return fmt.Errorf("secrets index %d: %s is written by more than one secret", idx+1, s.File)
+		}
+		files[s.File] = true
+	}
+	return nil
+}
+
+var vaultSyncErrors = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+	Namespace: "stormdriver",
+	Name:      "vault_sync_errors_total",
+	Help:      "The number of secrets which could not be read from Vault or written out.",
+})
+
+// vaultSync keeps the configured secret files up to date.
+type vaultSync struct {
+	sync.Mutex
+	conf   vaultConfig
+	client *http.Client
+	token  string
+}
+
+// makeVaultSync returns nil if Vault is not configured.
+func makeVaultSync(c vaultConfig) (*vaultSync, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	var tlsConfig *tls.Config
+	if c.CAPath != "" {
+		ca, err := os.ReadFile(c.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig, err = makeTLSConfigWithCA(ca); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.CAPath, err)
+		}
+	}
+	return &vaultSync{
+		conf: c,
+		client: &http.Client{
+			Timeout:   vaultRequestTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// run re-reads the secrets until ctx is done.  Failures are logged, and
+// the files from the last successful read are left in place.
+func (v *vaultSync) run(ctx context.Context) {
+	t := time.NewTicker(time.Duration(v.conf.RefreshSeconds) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := v.sync(ctx); err != nil {
+				zap.S().Warnw("unable to refresh secrets from vault", "error", err)
+			}
+		}
+	}
+}
+
+// sync reads each secret and writes any which changed to its file.  It
+// carries on past failures, returning the first.
+func (v *vaultSync) sync(ctx context.Context) error {
+	v.Lock()
+	defer v.Unlock()
+	secrets := map[string]map[string]interface{}{}
+	var firstErr error
+	fail := func(s vaultSecretConfig, err error) {
+		vaultSyncErrors.Inc()
+		zap.S().Warnw("vault secret", "path", s.Path, "field", s.Field, "file", s.File, "error", err)
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", s.Path, err)
+		}
+	}
+	for _, s := range v.conf.Secrets {
+		data, found := secrets[s.Path]
+		if !found {
+			var err error
+			if data, err = v.readSecret(ctx, s.Path); err != nil {
+				fail(s, err)
+				continue
+			}
+			secrets[s.Path] = data
+		}
+		value, found := data[s.Field]
+		if !found {
+			fail(s, fmt.Errorf("no field %q", s.Field))
+			continue
+		}
+		content, ok := value.(string)
+		if !ok {
+			fail(s, fmt.Errorf("field %q is not a string", s.Field))
+			continue
+		}
+		changed, err := writeFileIfChanged(s.File, []byte(content))
+		if err != nil {
+			fail(s, err)
+			continue
+		}
+		if changed {
+			zap.S().Infow("wrote secret from vault", "path", s.Path, "field", s.Field, "file", s.File)
+		}
+	}
+	return firstErr
+}
+
+// readSecret returns the fields of the secret at path, logging in first
+// if needed, and again if the token has expired.
+func (v *vaultSync) readSecret(ctx context.Context, path string) (map[string]interface{}, error) {
+	if v.token == "" {
+		if err := v.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+	body, err := v.request(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if errors.Is(err, errVaultPermissionDenied) {
+		if err := v.login(ctx); err != nil {
+			return nil, err
+		}
+		body, err = v.request(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	// KV version 2 wraps the fields, with the version's metadata.
+	if inner, ok := resp.Data["data"].(map[string]interface{}); ok {
+		if _, ok := resp.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return resp.Data, nil
+}
+
+// login gets a Vault token.  Credentials are re-read from their files
+// each time, as both agent-managed and service account tokens rotate.
+func (v *vaultSync) login(ctx context.Context) error {
+	if v.conf.Auth.Method == vaultAuthToken {
+		token, err := os.ReadFile(v.conf.Auth.TokenPath)
+		if err != nil {
+			return err
+		}
+		v.token = strings.TrimSpace(string(token))
+		return nil
+	}
+
+	jwt, err := os.ReadFile(v.conf.Auth.JWTPath)
+	if err != nil {
+		return err
+	}
+	request, err := json.Marshal(map[string]string{
+		"role": v.conf.Auth.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return err
+	}
+	v.token = ""
+	body, err := v.request(ctx, http.MethodPost, "/v1/auth/"+strings.Trim(v.conf.Auth.MountPath, "/")+"/login", request)
+	if err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return errors.New("login: no client_token in response")
+	}
+	v.token = resp.Auth.ClientToken
+	return nil
+}
+
+func (v *vaultSync) request(ctx context.Context, method string, path string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, vaultRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.conf.Address, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("accept", "application/json")
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	if v.token != "" {
+		req.Header.Set(vaultTokenHeader, v.token)
+	}
+	if v.conf.Namespace != "" {
+		req.Header.Set(vaultNamespaceHeader, v.conf.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, vaultMaxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, errVaultPermissionDenied
+	}
+	if !httputil.StatusCodeOK(resp.StatusCode) {
+		// Vault's errors do not include secret values, so are safe to log.
+		return nil, fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// writeFileIfChanged replaces the file with content, unless it already
+// holds it.  The new file is renamed into place, so readers never see a
+// partly written one.
+func writeFileIfChanged(path string, content []byte) (bool, error) {
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		return false, nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, vaultSecretDirectoryMode); err != nil {
+		return false, err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	if err := f.Chmod(vaultSecretFileMode); err != nil {
+		f.Close()
+		return false, err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_vaultConfig_validate(t *testing.T) {
+	secret := vaultSecretConfig{Path: "secret/data/stormdriver", Field: "tls.crt", File: "/app/secrets/tls.crt"}
+	tests := []struct {
+		name    string
+		config  vaultConfig
+		wantErr bool
+	}{
+		{"disabled", vaultConfig{}, false},
+		{"secrets without address", vaultConfig{Secrets: []vaultSecretConfig{secret}}, true},
+		{"token auth", vaultConfig{Address: "https://vault:8200", Secrets: []vaultSecretConfig{secret}}, false},
+		{"kubernetes auth", vaultConfig{Address: "https://vault:8200", Auth: vaultAuthConfig{Method: "kubernetes", Role: "stormdriver"}}, false},
+		{"kubernetes auth without role", vaultConfig{Address: "https://vault:8200", Auth: vaultAuthConfig{Method: "kubernetes"}}, true},
+		{"unknown auth", vaultConfig{Address: "https://vault:8200", Auth: vaultAuthConfig{Method: "ldap"}}, true},
+		{"bad address", vaultConfig{Address: "vault:8200"}, true},
+		{"incomplete secret", vaultConfig{Address: "https://vault:8200", Secrets: []vaultSecretConfig{{Path: "secret/x"}}}, true},
+		{"same file twice", vaultConfig{Address: "https://vault:8200", Secrets: []vaultSecretConfig{secret, secret}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.applyDefaults()
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// vaultTestServer serves a KV version 2 secret and a version 1 secret
+// to clients presenting a token issued by its Kubernetes login.  Only
+// the most recently issued token is accepted.
+func vaultTestServer(t *testing.T, logins *int32) *httptest.Server {
+	write := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("content-type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(v))
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/kubernetes/login" {
+			var req map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			if req["role"] != "stormdriver" || req["jwt"] != "service-account-jwt" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			n := atomic.AddInt32(logins, 1)
+			write(w, map[string]interface{}{"auth": map[string]interface{}{"client_token": fmt.Sprintf("token-%d", n)}})
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != fmt.Sprintf("token-%d", atomic.LoadInt32(logins)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/stormdriver":
+			write(w, map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"tls.crt": "CERTIFICATE", "tls.key": "KEY"},
+				"metadata": map[string]interface{}{"version": 3},
+			}})
+		case "/v1/kv/controller":
+			write(w, map[string]interface{}{"data": map[string]interface{}{"tls.crt": "CONTROLLER"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_vaultSync_sync(t *testing.T) {
+	var logins int32
+	server := vaultTestServer(t, &logins)
+	dir := t.TempDir()
+	jwtPath := filepath.Join(dir, "jwt")
+	require.NoError(t, os.WriteFile(jwtPath, []byte("service-account-jwt\n"), 0600))
+
+	c := vaultConfig{
+		Address: server.URL,
+		Auth:    vaultAuthConfig{Method: vaultAuthKubernetes, Role: "stormdriver", JWTPath: jwtPath},
+		Secrets: []vaultSecretConfig{
+			{Path: "secret/data/stormdriver", Field: "tls.crt", File: filepath.Join(dir, "clouddriver", "tls.crt")},
+			{Path: "secret/data/stormdriver", Field: "tls.key", File: filepath.Join(dir, "clouddriver", "tls.key")},
+			{Path: "kv/controller", Field: "tls.crt", File: filepath.Join(dir, "controller.crt")},
+		},
+	}
+	c.applyDefaults()
+	require.NoError(t, c.validate())
+	v, err := makeVaultSync(c)
+	require.NoError(t, err)
+
+	require.NoError(t, v.sync(context.Background()))
+	for file, want := range map[string]string{
+		"clouddriver/tls.crt": "CERTIFICATE",
+		"clouddriver/tls.key": "KEY",
+		"controller.crt":      "CONTROLLER",
+	} {
+		content, err := os.ReadFile(filepath.Join(dir, file))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(content), file)
+	}
+	info, err := os.Stat(filepath.Join(dir, "controller.crt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins))
+
+	// an expired token causes a new login
+	v.token = "expired"
+	require.NoError(t, v.sync(context.Background()))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+
+	// a missing secret is reported, but does not stop the others
+	v.conf.Secrets = append(v.conf.Secrets, vaultSecretConfig{Path: "secret/data/missing", Field: "x", File: filepath.Join(dir, "missing")})
+	v.conf.Secrets = append(v.conf.Secrets, vaultSecretConfig{Path: "kv/controller", Field: "tls.key", File: filepath.Join(dir, "controller.key")})
+	assert.ErrorContains(t, v.sync(context.Background()), "secret/data/missing")
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_vaultSync_tokenAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "agent-token" || r.Header.Get("X-Vault-Namespace") != "team" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{"token":"s3cret"}}`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("agent-token\n"), 0600))
+
+	c := vaultConfig{
+		Address:   server.URL,
+		Namespace: "team",
+		Auth:      vaultAuthConfig{TokenPath: tokenPath},
+		Secrets:   []vaultSecretConfig{{Path: "kv/clouddriver", Field: "token", File: filepath.Join(dir, "clouddriver-token")}},
+	}
+	c.applyDefaults()
+	v, err := makeVaultSync(c)
+	require.NoError(t, err)
+	require.NoError(t, v.sync(context.Background()))
+	content, err := os.ReadFile(filepath.Join(dir, "clouddriver-token"))
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", string(content))
+}
+
+func Test_writeFileIfChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	changed, err := writeFileIfChanged(path, []byte("one"))
+	require.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = writeFileIfChanged(path, []byte("one"))
+	require.NoError(t, err)
+	assert.False(t, changed)
+	changed, err = writeFileIfChanged(path, []byte("two"))
+	require.NoError(t, err)
+	assert.True(t, changed)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(content))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files are cleaned up")
+}
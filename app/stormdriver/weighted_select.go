@@ -0,0 +1,81 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// weightedSelector spreads requests across clouddrivers in proportion to
+// their weights, using smooth weighted round-robin so that a heavier
+// clouddriver's turns are interleaved with the others rather than bunched.
+type weightedSelector struct {
+	sync.Mutex
+	current map[string]int
+}
+
+var catchAllSelector = makeWeightedSelector()
+
+func makeWeightedSelector() *weightedSelector {
+	return &weightedSelector{current: map[string]int{}}
+}
+
+// pick returns one of candidates, which must not be empty.  State for
+// routes no longer among the candidates is dropped.
+func (s *weightedSelector) pick(candidates []URLAndPriority, weight func(URLAndPriority) int) URLAndPriority {
+	sorted := make([]URLAndPriority, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key() < sorted[j].key() })
+
+	s.Lock()
+	defer s.Unlock()
+	seen := make(map[string]bool, len(sorted))
+	total := 0
+	best := -1
+	for idx, route := range sorted {
+		key := route.key()
+		seen[key] = true
+		w := weight(route)
+		total += w
+		s.current[key] += w
+		if best < 0 || s.current[key] > s.current[sorted[best].key()] {
+			best = idx
+		}
+	}
+	for key := range s.current {
+		if !seen[key] {
+			delete(s.current, key)
+		}
+	}
+	s.current[sorted[best].key()] -= total
+	return sorted[best]
+}
+
+// weightForRoute returns the weight of the clouddriver a route points
+// to, or 1 if it is not known or has no weight set.
+func (m *ClouddriverManager) weightForRoute(route URLAndPriority) int {
+	m.Lock()
+	defer m.Unlock()
+	key := route.key()
+	for _, cd := range m.state {
+		if cd.routeKey() == key && cd.Weight > 0 {
+			return cd.Weight
+		}
+	}
+	return 1
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_weightedSelector_pick(t *testing.T) {
+	a := URLAndPriority{URL: "http://a"}
+	b := URLAndPriority{URL: "http://b"}
+	c := URLAndPriority{URL: "http://c"}
+	weights := map[string]int{a.key(): 3, b.key(): 1, c.key(): 1}
+	weight := func(u URLAndPriority) int { return weights[u.key()] }
+
+	s := makeWeightedSelector()
+	got := []string{}
+	for i := 0; i < 8; i++ {
+		got = append(got, s.pick([]URLAndPriority{b, a}, weight).URL)
+	}
+	assert.Equal(t, []string{
+		"http://a", "http://a", "http://b", "http://a",
+		"http://a", "http://a", "http://b", "http://a",
+	}, got, "3:1, interleaved, regardless of candidate order")
+
+	s.pick([]URLAndPriority{c}, weight)
+	assert.Len(t, s.current, 1, "routes which are gone are forgotten")
+	assert.Contains(t, s.current, c.key())
+}
+
+func Test_ClouddriverManager_weightForRoute(t *testing.T) {
+	m := &ClouddriverManager{state: map[string]*trackedClouddriver{
+		"config:heavy": {Name: "heavy", URL: "http://heavy", Weight: 4},
+		"config:plain": {Name: "plain", URL: "http://plain"},
+	}}
+	assert.Equal(t, 4, m.weightForRoute(URLAndPriority{URL: "http://heavy"}))
+	assert.Equal(t, 1, m.weightForRoute(URLAndPriority{URL: "http://plain"}))
+	assert.Equal(t, 1, m.weightForRoute(URLAndPriority{URL: "http://unknown"}))
+}